@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+)
+
+// -access-log values, each one logs more than the one before
+var accessLogLevels = []string{"off", "errors", "info", "debug"}
+
+type accessUserKey struct{}
+
+// Filled in by the auth middlewares, which run inside the access log
+type accessUser struct {
+	id string
+}
+
+// Records the user a request was authenticated as for the access log
+func setAccessUser(r *http.Request, userID string) {
+	if user, ok := r.Context().Value(accessUserKey{}).(*accessUser); ok {
+		user.id = userID
+	}
+}
+
+// Keeps the status and size of a response for the access log. Unwrap lets
+// http.ResponseController reach the connection (write deadlines), Flush and
+// Hijack are kept for event streams and websockets.
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+func (w *accessWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (w *accessWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Middleware: Logs every request once it is answered, at the verbosity of
+// -access-log. Only the path, the query with tokens masked and a few request
+// headers are logged, never tokens, other headers or bodies.
+func (s *server) accessLog(next http.Handler) http.Handler {
+	if *accessLogLevel == "off" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		user := &accessUser{}
+		aw := &accessWriter{ResponseWriter: w}
+		defer func() {
+			if aw.status == 0 {
+				// Handler panicked (or aborted) before answering
+				aw.status = http.StatusInternalServerError
+			}
+			if *accessLogLevel == "errors" && aw.status < 400 {
+				return
+			}
+			var event *zerolog.Event
+			switch {
+			case aw.status >= 500:
+				event = hlog.FromRequest(r).Error()
+			case aw.status >= 400:
+				event = hlog.FromRequest(r).Warn()
+			default:
+				event = hlog.FromRequest(r).Info()
+			}
+			event = event.
+				Str("method", r.Method).
+				Str("path", r.URL.Path).
+				Int("status", aw.status).
+				Dur("duration", time.Since(start)).
+				Str("userid", user.id)
+			if *accessLogLevel == "debug" {
+				event = event.
+					Str("url", logURL(r.URL)).
+					Int("size", aw.size).
+					Str("ip", r.RemoteAddr).
+					Str("user_agent", r.UserAgent()).
+					Str("referer", r.Referer())
+			}
+			event.Msg("Got API Request")
+		}()
+		ctx := context.WithValue(r.Context(), accessUserKey{}, user)
+		next.ServeHTTP(aw, r.WithContext(ctx))
+	})
+}
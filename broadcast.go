@@ -0,0 +1,372 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Limits of broadcast lists, WhatsApp's own lists take up to 256 contacts
+const (
+	maxBroadcastRecipients = 256
+	maxBroadcastNameLength = 64
+)
+
+type broadcastList struct {
+	Name       string
+	Recipients []string
+}
+
+func validateBroadcastName(name string) error {
+	if name == "" {
+		return errors.New("Missing Name in Payload")
+	}
+	if len(name) > maxBroadcastNameLength {
+		return errors.New(fmt.Sprintf("Invalid Name, longer than %d characters", maxBroadcastNameLength))
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) || c == '/' {
+			return errors.New("Invalid Name, control characters and / not allowed")
+		}
+	}
+	return nil
+}
+
+// Parses the recipients of a list into JIDs, dropping repeated ones. Lists
+// are sent as individual messages so only contacts are accepted. With a
+// client phone numbers are resolved as for single sends.
+func parseBroadcastRecipients(client *whatsmeow.Client, phones []string) ([]string, error) {
+	if len(phones) == 0 {
+		return nil, errors.New("Missing Recipients in Payload")
+	}
+	seen := make(map[string]bool)
+	var recipients []string
+	for _, phone := range phones {
+		if phone == "" {
+			return nil, errors.New("Invalid recipient: empty")
+		}
+		jid, err := parseRecipient(phone)
+		if err == nil && jid.Server != types.DefaultUserServer {
+			err = errors.New("must be a phone number")
+		}
+		if err == nil {
+			jid, err = resolvePhone(client, jid)
+		}
+		if err != nil {
+			return nil, recipientError("Recipients", fmt.Errorf("%s, %v", phone, err))
+		}
+		jid = jid.ToNonAD()
+		if !seen[jid.String()] {
+			seen[jid.String()] = true
+			recipients = append(recipients, jid.String())
+		}
+	}
+	if len(recipients) > maxBroadcastRecipients {
+		return nil, errors.New(fmt.Sprintf("Too many recipients, the limit is %d", maxBroadcastRecipients))
+	}
+	return recipients, nil
+}
+
+func (s *server) broadcastList(userID int, name string) (broadcastList, error) {
+	list := broadcastList{Name: name}
+	var stored string
+	err := s.db.QueryRow("SELECT recipients FROM broadcast_lists WHERE user_id=? AND name=?", userID, name).Scan(&stored)
+	if err != nil {
+		return list, err
+	}
+	err = json.Unmarshal([]byte(stored), &list.Recipients)
+	return list, err
+}
+
+// Creates a named list of recipients for /chat/send/broadcast
+func (s *server) CreateBroadcastList() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		var t broadcastList
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+		t.Name = strings.TrimSpace(t.Name)
+		if err := validateBroadcastName(t.Name); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		recipients, err := parseBroadcastRecipients(sessions.client(userid), t.Recipients)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		encoded, _ := json.Marshal(recipients)
+		result, err := execRetry(s.db, "INSERT OR IGNORE INTO broadcast_lists (user_id, name, recipients) VALUES (?, ?, ?)", userid, t.Name, string(encoded))
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			s.Respond(w, r, http.StatusConflict, errors.New("A broadcast list with this name already exists"))
+			return
+		}
+
+		responseJson, err := json.Marshal(broadcastList{Name: t.Name, Recipients: recipients})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets the user's broadcast lists
+func (s *server) ListBroadcastLists() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		rows, err := s.db.Query("SELECT name, recipients FROM broadcast_lists WHERE user_id=? ORDER BY name", userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
+		}
+		defer rows.Close()
+		lists := []broadcastList{}
+		for rows.Next() {
+			var list broadcastList
+			var stored string
+			if err := rows.Scan(&list.Name, &stored); err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+				return
+			}
+			json.Unmarshal([]byte(stored), &list.Recipients)
+			lists = append(lists, list)
+		}
+
+		responseJson, err := json.Marshal(map[string]interface{}{"Lists": lists})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets one broadcast list
+func (s *server) GetBroadcastList() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		list, err := s.broadcastList(userid, mux.Vars(r)["name"])
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Broadcast list not found"))
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
+		}
+
+		responseJson, err := json.Marshal(list)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Replaces the recipients of a broadcast list
+func (s *server) UpdateBroadcastList() http.HandlerFunc {
+	type updateStruct struct {
+		Recipients []string
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		name := mux.Vars(r)["name"]
+
+		var t updateStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+		recipients, err := parseBroadcastRecipients(sessions.client(userid), t.Recipients)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		encoded, _ := json.Marshal(recipients)
+		result, err := execRetry(s.db, "UPDATE broadcast_lists SET recipients=? WHERE user_id=? AND name=?", string(encoded), userid, name)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Broadcast list not found"))
+			return
+		}
+
+		responseJson, err := json.Marshal(broadcastList{Name: name, Recipients: recipients})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Deletes a broadcast list
+func (s *server) DeleteBroadcastList() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		result, err := execRetry(s.db, "DELETE FROM broadcast_lists WHERE user_id=? AND name=?", userid, mux.Vars(r)["name"])
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Broadcast list not found"))
+			return
+		}
+
+		responseJson, err := json.Marshal(map[string]interface{}{"Details": "Broadcast list deleted"})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Outcome of sending to one member of a broadcast list
+type broadcastResult struct {
+	Phone     string
+	Id        string     `json:",omitempty"`
+	Timestamp *time.Time `json:",omitempty"`
+	Error     string     `json:",omitempty"`
+}
+
+// Sends a text message to every member of a broadcast list, one at a time
+// and -broadcast-delay apart. Each message counts towards the daily quota,
+// the members left once it is reached are reported as not sent.
+func (s *server) SendBroadcast() http.HandlerFunc {
+	type broadcastStruct struct {
+		List string
+		Body string
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		var t broadcastStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+		if t.List == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing List in Payload"))
+			return
+		}
+		if t.Body == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Body in Payload"))
+			return
+		}
+		list, err := s.broadcastList(userid, t.List)
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Broadcast list not found"))
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
+		}
+
+		// Long lists take longer than the server's write timeout
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+		results := make([]broadcastResult, 0, len(list.Recipients))
+		sent := 0
+		for i, phone := range list.Recipients {
+			result := broadcastResult{Phone: phone}
+			if i > 0 && *broadcastDelay > 0 {
+				time.Sleep(*broadcastDelay)
+			}
+			if err := r.Context().Err(); err != nil {
+				result.Error = "Request cancelled"
+				results = append(results, result)
+				continue
+			}
+			if usage, err := s.messageUsage(userid); err == nil && usage.Limit > 0 && usage.Sent >= usage.Limit {
+				result.Error = "Daily message quota exceeded"
+				results = append(results, result)
+				continue
+			}
+			recipient, err := resolveRecipient(client, "Phone", phone)
+			if err != nil {
+				result.Error = err.Error()
+				results = append(results, result)
+				continue
+			}
+
+			msgid := whatsmeow.GenerateMessageID()
+			msg := &waProto.Message{
+				ExtendedTextMessage: &waProto.ExtendedTextMessage{
+					Text: &t.Body,
+				},
+			}
+			ctx, cancel := sendContext(r)
+			resp, err := tracedSend(ctx, client, recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+			if err != nil {
+				err = sendError(ctx, "Error sending message", err)
+			}
+			cancel()
+			if err != nil {
+				result.Error = err.Error()
+				results = append(results, result)
+				continue
+			}
+			s.recordSent(r, client, recipient, msgid, msg, resp.Timestamp)
+			result.Id = msgid
+			result.Timestamp = &resp.Timestamp
+			results = append(results, result)
+			sent++
+		}
+		hlog.FromRequest(r).Info().Str("list", list.Name).Int("sent", sent).Int("failed", len(results)-sent).Msg("Broadcast sent")
+
+		response := map[string]interface{}{"List": list.Name, "Sent": sent, "Failed": len(results) - sent, "Results": results}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Phone numbers WhatsApp was asked about already, answered from the cache
+// so nothing is looked up for real: a Brazilian mobile registered without
+// the 9th digit and a number not on WhatsApp
+func resolvedPhones(t *testing.T) {
+	t.Helper()
+	phoneJIDs.Set("5511987654321", &phoneJID{JID: types.NewJID("551187654321", types.DefaultUserServer)}, phoneJIDTTL)
+	phoneJIDs.Set("5511900000000", (*phoneJID)(nil), phoneJIDNotFoundTTL)
+	saved := *resolvePhones
+	*resolvePhones = true
+	t.Cleanup(func() {
+		*resolvePhones = saved
+		phoneJIDs.Delete("5511987654321")
+		phoneJIDs.Delete("5511900000000")
+	})
+}
+
+func TestBroadcastRecipientsResolved(t *testing.T) {
+	s := &server{db: testUsersDB(t)}
+	userID := testSession(t, s, "broadcast-lists")
+	resolvedPhones(t)
+
+	recipients, err := parseBroadcastRecipients(sessions.client(userID), []string{"+55 11 98765-4321", "551187654321", "14155550100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both forms are the same account once resolved
+	if want := []string{"551187654321@s.whatsapp.net", "14155550100@s.whatsapp.net"}; strings.Join(recipients, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v, want %v", recipients, want)
+	}
+
+	_, err = parseBroadcastRecipients(sessions.client(userID), []string{"14155550100", "5511900000000"})
+	if err == nil || !strings.Contains(err.Error(), "5511900000000, not on WhatsApp") {
+		t.Errorf("got %v, want the number not on WhatsApp named", err)
+	}
+
+	// Without a session the numbers are kept as given
+	recipients, err = parseBroadcastRecipients(nil, []string{"5511987654321", "5511900000000"})
+	if err != nil || len(recipients) != 2 || recipients[0] != "5511987654321@s.whatsapp.net" {
+		t.Errorf("got %v %v", recipients, err)
+	}
+}
+
+func TestSendBroadcastResolves(t *testing.T) {
+	s := &server{db: testUsersDB(t)}
+	userID := testSession(t, s, "broadcast-send")
+	resolvedPhones(t)
+	saved := *broadcastDelay
+	*broadcastDelay = 0
+	defer func() { *broadcastDelay = saved }()
+
+	// Saved before the numbers were resolved
+	if _, err := s.db.Exec("INSERT INTO broadcast_lists (user_id, name, recipients) VALUES (?, ?, ?)", userID, "clients", `["5511900000000@s.whatsapp.net","5511987654321@s.whatsapp.net"]`); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	s.SendBroadcast()(w, userRequest(t, "broadcast-send", "POST", "/chat/send/broadcast", `{"List":"clients","Body":"hello"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var body struct {
+		Data struct {
+			Sent    int
+			Failed  int
+			Results []broadcastResult
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	results := body.Data.Results
+	if len(results) != 2 || body.Data.Failed != 2 {
+		t.Fatalf("got %s", w.Body)
+	}
+	if results[0].Phone != "5511900000000@s.whatsapp.net" || results[0].Error != "Invalid Phone: not on WhatsApp" {
+		t.Errorf("number not on WhatsApp: got %+v", results[0])
+	}
+	// Resolved, then failing as the session never connects
+	if results[1].Error == "" || strings.HasPrefix(results[1].Error, "Invalid Phone") {
+		t.Errorf("resolved number: got %+v", results[1])
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"go.mau.fi/whatsmeow"
+	waBinary "go.mau.fi/whatsmeow/binary"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Business profiles change rarely, answers are reused for an hour
+const businessProfileTTL = time.Hour
+
+// Most numbers POST /user/businessprofile takes at once
+const businessProfileBatch = 50
+
+// What is known of a number, by status:
+//
+//	business         the account is a business and its profile is filled
+//	profile_hidden   the account is a business but shares no profile
+//	not_business     the account is a personal one
+//	not_on_whatsapp  no account has the number
+type businessProfile struct {
+	Query        string
+	Phone        string
+	Status       string
+	JID          string
+	VerifiedName string
+	Categories   []string
+	Description  string
+	Address      string
+	Email        string
+	Websites     []string
+}
+
+// Profiles by normalized phone number, shared by all users as everyone sees
+// the same profile
+var businessProfiles = cache.New(businessProfileTTL, 10*time.Minute)
+
+func nodeText(node waBinary.Node) string {
+	if content, ok := node.Content.([]byte); ok {
+		return string(content)
+	}
+	return ""
+}
+
+// Asks WhatsApp for the profile of a business account, false when it has
+// none to share. whatsmeow's GetBusinessProfile drops the description and
+// website, the query is the same.
+func fetchBusinessProfile(client *whatsmeow.Client, jid types.JID, profile *businessProfile) (bool, error) {
+	resp, err := client.DangerousInternals().SendIQ(whatsmeow.DangerousInfoQuery{
+		Type:      "get",
+		To:        types.ServerJID,
+		Namespace: "w:biz",
+		Content: []waBinary.Node{{
+			Tag:   "business_profile",
+			Attrs: waBinary.Attrs{"v": "244"},
+			Content: []waBinary.Node{{
+				Tag:   "profile",
+				Attrs: waBinary.Attrs{"jid": jid},
+			}},
+		}},
+	})
+	if err != nil {
+		return false, err
+	}
+	node, ok := resp.GetOptionalChildByTag("business_profile", "profile")
+	if !ok {
+		return false, nil
+	}
+	for _, child := range node.GetChildren() {
+		switch child.Tag {
+		case "address":
+			profile.Address = nodeText(child)
+		case "description":
+			profile.Description = nodeText(child)
+		case "email":
+			profile.Email = nodeText(child)
+		case "website":
+			if website := nodeText(child); website != "" {
+				profile.Websites = append(profile.Websites, website)
+			}
+		case "categories":
+			for _, category := range child.GetChildren() {
+				if name := nodeText(category); category.Tag == "category" && name != "" {
+					profile.Categories = append(profile.Categories, name)
+				}
+			}
+		}
+	}
+	filled := profile.Address != "" || profile.Description != "" || profile.Email != "" || len(profile.Websites) > 0 || len(profile.Categories) > 0
+	return filled, nil
+}
+
+// Business profile of a normalized phone number, from businessProfiles when
+// known. Failed queries aren't cached.
+func lookupBusinessProfile(client *whatsmeow.Client, digits string) (businessProfile, error) {
+	if cached, found := businessProfiles.Get(digits); found {
+		return cached.(businessProfile), nil
+	}
+	profile := businessProfile{Phone: digits, Categories: []string{}, Websites: []string{}}
+	match, err := lookupPhone(client, digits)
+	if err != nil {
+		return profile, err
+	}
+	switch {
+	case match == nil:
+		profile.Status = "not_on_whatsapp"
+	case match.VerifiedName == "":
+		// Only business accounts have a verified name
+		profile.Status = "not_business"
+		profile.JID = match.JID.String()
+	default:
+		profile.JID = match.JID.String()
+		profile.VerifiedName = match.VerifiedName
+		filled, err := fetchBusinessProfile(client, match.JID, &profile)
+		if err != nil {
+			return profile, err
+		}
+		profile.Status = "profile_hidden"
+		if filled {
+			profile.Status = "business"
+		}
+	}
+	businessProfiles.Set(digits, profile, cache.DefaultExpiration)
+	return profile, nil
+}
+
+// Business profile of the number in ?phone=
+func (s *server) GetBusinessProfile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		param := r.URL.Query().Get("phone")
+		if param == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing phone parameter"))
+			return
+		}
+		digits, err := normalizePhone(param)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, recipientError("phone", err))
+			return
+		}
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+		profile, err := lookupBusinessProfile(client, digits)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to get business profile: %s", err)))
+			return
+		}
+		profile.Query = param
+		responseJson, err := json.Marshal(profile)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Business profiles of up to businessProfileBatch numbers, in the order given
+func (s *server) GetBusinessProfiles() http.HandlerFunc {
+
+	type businessProfilesStruct struct {
+		Phone []string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		var t businessProfilesStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+		if len(t.Phone) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+		if len(t.Phone) > businessProfileBatch {
+			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("Too many numbers in Phone, at most %d", businessProfileBatch))
+			return
+		}
+		digits := make([]string, len(t.Phone))
+		for i, phone := range t.Phone {
+			var err error
+			digits[i], err = normalizePhone(phone)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, recipientError("Phone", fmt.Errorf("%s, %v", phone, err)))
+				return
+			}
+		}
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+		profiles := make([]businessProfile, len(digits))
+		for i := range digits {
+			profile, err := lookupBusinessProfile(client, digits[i])
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to get business profile of %s: %s", t.Phone[i], err)))
+				return
+			}
+			profile.Query = t.Phone[i]
+			profiles[i] = profile
+		}
+		responseJson, err := json.Marshal(map[string]interface{}{"Profiles": profiles})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waBinary "go.mau.fi/whatsmeow/binary"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// Incoming call still ringing, removed once accepted or terminated
+type pendingCall struct {
+	from     types.JID
+	accepted bool
+	offered  time.Time
+}
+
+// Calls never seen ending are forgotten after this long
+const callTrackTimeout = 10 * time.Minute
+
+// Calls ringing per user and call id, so /call/reject only needs the id
+type callTracker struct {
+	sync.Mutex
+	calls map[int]map[string]*pendingCall
+}
+
+var calls = &callTracker{calls: make(map[int]map[string]*pendingCall)}
+
+func (t *callTracker) offer(userID int, callID string, from types.JID) {
+	t.Lock()
+	defer t.Unlock()
+	if t.calls[userID] == nil {
+		t.calls[userID] = make(map[string]*pendingCall)
+	}
+	for id, call := range t.calls[userID] {
+		if time.Since(call.offered) > callTrackTimeout {
+			delete(t.calls[userID], id)
+		}
+	}
+	t.calls[userID][callID] = &pendingCall{from: from, offered: time.Now()}
+}
+
+func (t *callTracker) accept(userID int, callID string) {
+	t.Lock()
+	defer t.Unlock()
+	if call := t.calls[userID][callID]; call != nil {
+		call.accepted = true
+	}
+}
+
+func (t *callTracker) end(userID int, callID string) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.calls[userID], callID)
+	if len(t.calls[userID]) == 0 {
+		delete(t.calls, userID)
+	}
+}
+
+// Returns the caller of a call that is still ringing, false once it was
+// accepted, ended or never seen
+func (t *callTracker) ringing(userID int, callID string) (types.JID, bool) {
+	t.Lock()
+	defer t.Unlock()
+	call := t.calls[userID][callID]
+	if call == nil || call.accepted {
+		return types.EmptyJID, false
+	}
+	return call.from, true
+}
+
+// Declines an incoming call. This whatsmeow version has no helper for it,
+// the node is the one WhatsApp Web sends.
+func rejectCall(client *whatsmeow.Client, from types.JID, callID string) error {
+	if client.Store.ID == nil {
+		return whatsmeow.ErrNotLoggedIn
+	}
+	from = from.ToNonAD()
+	return client.DangerousInternals().SendNode(waBinary.Node{
+		Tag: "call",
+		Attrs: waBinary.Attrs{
+			"id":   client.GenerateMessageID(),
+			"from": client.Store.ID.ToNonAD(),
+			"to":   from,
+		},
+		Content: []waBinary.Node{{
+			Tag: "reject",
+			Attrs: waBinary.Attrs{
+				"call-id":      callID,
+				"call-creator": from,
+				"count":        "0",
+			},
+		}},
+	})
+}
+
+// Declines a call once the grace period passes, unless it was answered on
+// the phone or hung up meanwhile. The caller gets message, if set.
+func (mycli *MyClient) autoRejectCall(callID string, message string) {
+	time.Sleep(*callRejectGrace)
+	from, ok := calls.ringing(mycli.userID, callID)
+	if !ok {
+		return
+	}
+	if err := rejectCall(mycli.WAClient, from, callID); err != nil {
+		log.Error().Err(err).Str("userid", strconv.Itoa(mycli.userID)).Str("callid", callID).Msg("Could not reject call")
+		return
+	}
+	calls.end(mycli.userID, callID)
+	log.Info().Str("userid", strconv.Itoa(mycli.userID)).Str("callid", callID).Str("from", from.String()).Msg("Call rejected automatically")
+	if message == "" {
+		return
+	}
+	msg := &waProto.Message{Conversation: proto.String(message)}
+	if _, err := mycli.WAClient.SendMessage(context.Background(), from.ToNonAD(), msg); err != nil {
+		log.Error().Err(err).Str("to", from.String()).Msg("Could not send call rejection message")
+	}
+}
+
+// Starts the automatic rejection of an incoming call when the user turned
+// it on with /call/autoreject
+func (mycli *MyClient) checkAutoReject(callID string) {
+	var enabled bool
+	var message string
+	err := mycli.db.QueryRow("SELECT reject_calls, reject_calls_message FROM users WHERE id=?", mycli.userID).Scan(&enabled, &message)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not get call settings")
+		return
+	}
+	if enabled {
+		go mycli.autoRejectCall(callID, message)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Longest message preview kept for /chats, in characters
+const chatPreviewLength = 100
+
+// Last message of a chat. Preview is its text or caption, empty for media
+// without one, Type tells what it was.
+type chatLastMessage struct {
+	Id        string
+	Sender    string
+	FromMe    bool
+	Type      string
+	Preview   string
+	Timestamp time.Time
+}
+
+// A chat as /chats lists it. LastActivity is the unix time of its last
+// message, MutedUntil a unix time too, -1 when muted for good and 0 when not
+// muted.
+type chatSummary struct {
+	JID          string
+	Name         string
+	IsGroup      bool
+	LastMessage  *chatLastMessage
+	LastActivity int64
+	UnreadCount  int
+	Unread       bool
+	Archived     bool
+	Pinned       bool
+	Muted        bool
+	MutedUntil   int64
+}
+
+// Text shown for a message in a chat list, cut to chatPreviewLength
+func messagePreview(msg *waProto.Message) string {
+	if inner := msg.GetViewOnceMessage().GetMessage(); inner != nil {
+		return messagePreview(inner)
+	}
+	if inner := msg.GetEphemeralMessage().GetMessage(); inner != nil {
+		return messagePreview(inner)
+	}
+	var text string
+	switch {
+	case msg.GetConversation() != "":
+		text = msg.GetConversation()
+	case msg.GetExtendedTextMessage() != nil:
+		text = msg.GetExtendedTextMessage().GetText()
+	case msg.GetImageMessage() != nil:
+		text = msg.GetImageMessage().GetCaption()
+	case msg.GetVideoMessage() != nil:
+		text = msg.GetVideoMessage().GetCaption()
+	case msg.GetDocumentMessage() != nil:
+		text = msg.GetDocumentMessage().GetCaption()
+		if text == "" {
+			text = msg.GetDocumentMessage().GetFileName()
+		}
+	case msg.GetLocationMessage() != nil:
+		text = msg.GetLocationMessage().GetName()
+	case msg.GetContactMessage() != nil:
+		text = msg.GetContactMessage().GetDisplayName()
+	case msg.GetButtonsMessage() != nil:
+		text = msg.GetButtonsMessage().GetContentText()
+	case msg.GetButtonsResponseMessage() != nil:
+		text = msg.GetButtonsResponseMessage().GetSelectedDisplayText()
+	case msg.GetListMessage() != nil:
+		text = msg.GetListMessage().GetDescription()
+	case msg.GetListResponseMessage() != nil:
+		text = msg.GetListResponseMessage().GetTitle()
+	case msg.GetPollCreationMessage() != nil:
+		text = msg.GetPollCreationMessage().GetName()
+	}
+	if runes := []rune(text); len(runes) > chatPreviewLength {
+		text = string(runes[:chatPreviewLength])
+	}
+	return text
+}
+
+// Whether a message shows up in chat lists. Reactions, edits, deletions and
+// bare key distribution messages don't change a chat's last message.
+func listedInChats(chat types.JID, msg *waProto.Message) bool {
+	if chat.Server == types.NewsletterServer || chat == types.StatusBroadcastJID || msg == nil {
+		return false
+	}
+	switch messageKind(msg) {
+	case "protocol", "reaction":
+		return false
+	case "unknown":
+		return msg.GetSenderKeyDistributionMessage() == nil
+	}
+	return true
+}
+
+// Makes a message the last one of its chat, unless a newer one is known.
+// Incoming messages count as unread until the chat is read, ours mark it
+// read as on the phone.
+func recordChatMessage(db execer, userID int, chat types.JID, sender types.JID, msgid string, fromMe bool, msg *waProto.Message, timestamp time.Time) {
+	if !listedInChats(chat, msg) {
+		return
+	}
+	mine, unread := 0, 1
+	if fromMe {
+		mine, unread = 1, 0
+	}
+	_, err := execRetry(db, `INSERT INTO chats (user_id, jid, last_id, last_sender, last_from_me, last_type, last_preview, last_timestamp, unread_count)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, jid) DO UPDATE SET
+			last_id=CASE WHEN excluded.last_timestamp>=last_timestamp THEN excluded.last_id ELSE last_id END,
+			last_sender=CASE WHEN excluded.last_timestamp>=last_timestamp THEN excluded.last_sender ELSE last_sender END,
+			last_from_me=CASE WHEN excluded.last_timestamp>=last_timestamp THEN excluded.last_from_me ELSE last_from_me END,
+			last_type=CASE WHEN excluded.last_timestamp>=last_timestamp THEN excluded.last_type ELSE last_type END,
+			last_preview=CASE WHEN excluded.last_timestamp>=last_timestamp THEN excluded.last_preview ELSE last_preview END,
+			last_timestamp=MAX(last_timestamp, excluded.last_timestamp),
+			unread_count=CASE WHEN excluded.last_from_me=1 THEN 0 ELSE unread_count+1 END,
+			marked_unread=CASE WHEN excluded.last_from_me=1 THEN 0 ELSE marked_unread END`,
+		userID, chat.ToNonAD().String(), msgid, sender.ToNonAD().String(), mine, messageKind(msg), messagePreview(msg), timestamp.Unix(), unread)
+	if err != nil {
+		log.Error().Err(err).Str("chat", chat.String()).Msg("Could not record chat")
+	}
+}
+
+// Records the conversations of a history sync chunk with their newest
+// message, name and unread count. The newer of what is known wins, chunks
+// arrive in no particular order.
+func (mycli *MyClient) saveHistoryChats(evt *events.HistorySync) {
+	tx, err := mycli.db.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not record history sync chats")
+		return
+	}
+	for _, conv := range evt.Data.GetConversations() {
+		chatJID, err := types.ParseJID(conv.GetID())
+		if err != nil || chatJID.Server == types.NewsletterServer || chatJID == types.StatusBroadcastJID {
+			continue
+		}
+		var last *events.Message
+		for _, historyMsg := range conv.GetMessages() {
+			msg, err := mycli.WAClient.ParseWebMessage(chatJID, historyMsg.GetMessage())
+			if err != nil || !listedInChats(chatJID, msg.Message) {
+				continue
+			}
+			if last == nil || msg.Info.Timestamp.After(last.Info.Timestamp) {
+				last = msg
+			}
+		}
+		name := conv.GetName()
+		if name == "" {
+			name = conv.GetDisplayName()
+		}
+		markedUnread := 0
+		if conv.GetMarkedAsUnread() {
+			markedUnread = 1
+		}
+		var lastID, lastSender, lastType, lastPreview string
+		var lastFromMe int
+		lastTimestamp := int64(conv.GetConversationTimestamp())
+		if last != nil {
+			lastID, lastSender, lastType, lastPreview = last.Info.ID, last.Info.Sender.ToNonAD().String(), messageKind(last.Message), messagePreview(last.Message)
+			if last.Info.IsFromMe {
+				lastFromMe = 1
+			}
+			lastTimestamp = last.Info.Timestamp.Unix()
+		}
+		_, err = tx.Exec(`INSERT INTO chats (user_id, jid, name, last_id, last_sender, last_from_me, last_type, last_preview, last_timestamp, unread_count, marked_unread)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (user_id, jid) DO UPDATE SET
+				name=CASE WHEN excluded.name!='' THEN excluded.name ELSE name END,
+				last_id=CASE WHEN excluded.last_id!='' AND excluded.last_timestamp>=last_timestamp THEN excluded.last_id ELSE last_id END,
+				last_sender=CASE WHEN excluded.last_id!='' AND excluded.last_timestamp>=last_timestamp THEN excluded.last_sender ELSE last_sender END,
+				last_from_me=CASE WHEN excluded.last_id!='' AND excluded.last_timestamp>=last_timestamp THEN excluded.last_from_me ELSE last_from_me END,
+				last_type=CASE WHEN excluded.last_id!='' AND excluded.last_timestamp>=last_timestamp THEN excluded.last_type ELSE last_type END,
+				last_preview=CASE WHEN excluded.last_id!='' AND excluded.last_timestamp>=last_timestamp THEN excluded.last_preview ELSE last_preview END,
+				unread_count=CASE WHEN excluded.last_timestamp>=last_timestamp THEN excluded.unread_count ELSE unread_count END,
+				marked_unread=CASE WHEN excluded.last_timestamp>=last_timestamp THEN excluded.marked_unread ELSE marked_unread END,
+				last_timestamp=MAX(last_timestamp, excluded.last_timestamp)`,
+			mycli.userID, chatJID.ToNonAD().String(), name, lastID, lastSender, lastFromMe, lastType, lastPreview, lastTimestamp, conv.GetUnreadCount(), markedUnread)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not record history sync chats")
+			tx.Rollback()
+			return
+		}
+		if conv.EphemeralExpiration != nil {
+			recordChatTimer(tx, mycli.userID, chatJID, conv.GetEphemeralExpiration(), time.Unix(conv.GetEphemeralSettingTimestamp(), 0))
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error().Err(err).Msg("Could not record history sync chats")
+	}
+}
+
+// Keeps the unread state of a chat read or marked unread on another device
+func (mycli *MyClient) recordChatRead(evt *events.MarkChatAsRead) {
+	var err error
+	if evt.Action.GetRead() {
+		_, err = execRetry(mycli.db, "UPDATE chats SET unread_count=0, marked_unread=0 WHERE user_id=? AND jid=?", mycli.userID, evt.JID.ToNonAD().String())
+	} else {
+		_, err = execRetry(mycli.db, "UPDATE chats SET marked_unread=1 WHERE user_id=? AND jid=?", mycli.userID, evt.JID.ToNonAD().String())
+	}
+	if err != nil {
+		log.Error().Err(err).Str("chat", evt.JID.String()).Msg("Could not record chat read")
+	}
+}
+
+// Renamed groups keep their new name
+func (mycli *MyClient) recordChatName(chat types.JID, name string) {
+	if _, err := execRetry(mycli.db, "UPDATE chats SET name=? WHERE user_id=? AND jid=?", name, mycli.userID, chat.ToNonAD().String()); err != nil {
+		log.Error().Err(err).Str("chat", chat.String()).Msg("Could not record chat name")
+	}
+}
+
+// Chats deleted on another device are gone from the list too
+func (mycli *MyClient) forgetChat(chat types.JID) {
+	if _, err := execRetry(mycli.db, "DELETE FROM chats WHERE user_id=? AND jid=?", mycli.userID, chat.ToNonAD().String()); err != nil {
+		log.Error().Err(err).Str("chat", chat.String()).Msg("Could not delete chat")
+	}
+}
+
+// Chats of the account with the most recent activity first. Only chats
+// from history syncs and seen since pairing are known. ?before= pages with
+// the LastActivity of the previous page's last chat, ?limit= takes 1 to
+// 500, 50 by default.
+func (s *server) ListChats() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		limit := 50
+		var before int64
+		if param := r.URL.Query().Get("before"); param != "" {
+			value, err := strconv.ParseInt(param, 10, 64)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid before parameter, must be a unix timestamp"))
+				return
+			}
+			before = value
+		}
+		if param := r.URL.Query().Get("limit"); param != "" {
+			value, err := strconv.Atoi(param)
+			if err != nil || value < 1 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid limit parameter"))
+				return
+			}
+			limit = value
+		}
+		if limit > 500 {
+			limit = 500
+		}
+
+		query := "SELECT jid, name, last_id, last_sender, last_from_me, last_type, last_preview, last_timestamp, unread_count, marked_unread FROM chats WHERE user_id=?"
+		args := []interface{}{userid}
+		if before > 0 {
+			query += " AND last_timestamp<?"
+			args = append(args, before)
+		}
+		query += " ORDER BY last_timestamp DESC, jid LIMIT ?"
+		args = append(args, limit)
+		chats, err := queryChats(s.db, query, args...)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
+		}
+
+		// Names and app state settings come from the session's store
+		mycli := sessions.myClient(userid)
+		for i := range chats {
+			jid, err := types.ParseJID(chats[i].JID)
+			if err != nil || mycli == nil || mycli.WAClient == nil {
+				continue
+			}
+			if chats[i].Name == "" && !chats[i].IsGroup {
+				name := mycli.contactName(jid)
+				switch {
+				case name.FullName != "":
+					chats[i].Name = name.FullName
+				case name.PushName != "":
+					chats[i].Name = name.PushName
+				default:
+					chats[i].Name = name.BusinessName
+				}
+			}
+			state, err := getChatState(mycli.WAClient, jid)
+			if err != nil {
+				log.Warn().Err(err).Str("chat", chats[i].JID).Msg("Could not get chat settings")
+				continue
+			}
+			chats[i].Archived, chats[i].Pinned = state.Archived, state.Pinned
+			chats[i].Muted, chats[i].MutedUntil = state.Muted, state.MutedUntil
+		}
+
+		response := map[string]interface{}{"Chats": chats}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+func queryChats(db *sql.DB, query string, args ...interface{}) ([]chatSummary, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	chats := []chatSummary{}
+	for rows.Next() {
+		var chat chatSummary
+		var last chatLastMessage
+		var timestamp int64
+		var markedUnread bool
+		if err := rows.Scan(&chat.JID, &chat.Name, &last.Id, &last.Sender, &last.FromMe, &last.Type, &last.Preview, &timestamp, &chat.UnreadCount, &markedUnread); err != nil {
+			return nil, err
+		}
+		chat.LastActivity = timestamp
+		if last.Id != "" {
+			last.Timestamp = time.Unix(timestamp, 0)
+			chat.LastMessage = &last
+		}
+		chat.IsGroup = strings.HasSuffix(chat.JID, "@"+types.GroupServer)
+		chat.Unread = chat.UnreadCount > 0 || markedUnread
+		chats = append(chats, chat)
+	}
+	return chats, rows.Err()
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/appstate"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// Mute durations POST /chat/mute takes, those the phone offers. always is 0,
+// muted until unmuted.
+var muteDurations = map[string]time.Duration{
+	"8h":     8 * time.Hour,
+	"7d":     7 * 24 * time.Hour,
+	"always": 0,
+}
+
+// Whether a chat muted until the given time still is, and until when as a
+// unix time, -1 for good
+func chatMuted(until time.Time) (bool, int64) {
+	switch seconds := until.Unix(); {
+	case until.IsZero() || seconds == 0:
+		return false, 0
+	case seconds < 0:
+		return true, -1
+	case until.After(time.Now()):
+		return true, seconds
+	}
+	return false, 0
+}
+
+// Archived, pinned and muted state of a chat as the session's store has it
+type chatState struct {
+	Archived   bool
+	Pinned     bool
+	Muted      bool
+	MutedUntil int64
+}
+
+func getChatState(client *whatsmeow.Client, chat types.JID) (chatState, error) {
+	var state chatState
+	if client.Store.ChatSettings == nil {
+		return state, nil
+	}
+	settings, err := client.Store.ChatSettings.GetChatSettings(chat)
+	if err != nil {
+		return state, err
+	}
+	state.Archived, state.Pinned = settings.Archived, settings.Pinned
+	state.Muted, state.MutedUntil = chatMuted(settings.MutedUntil)
+	return state, nil
+}
+
+// Sends a ChatArchiveChanged, ChatPinChanged, ChatMuteChanged,
+// MessageStarChanged or ContactChanged event for app state changes made on
+// another device or through the API, so chat lists can be mirrored
+func (mycli *MyClient) dispatchAppStateChange(rawEvt interface{}) {
+	var postmap map[string]interface{}
+	var at time.Time
+	switch evt := rawEvt.(type) {
+	case *events.Archive:
+		postmap = map[string]interface{}{"type": "ChatArchiveChanged", "chat": evt.JID.String(), "archived": evt.Action.GetArchived()}
+		at = evt.Timestamp
+	case *events.Pin:
+		postmap = map[string]interface{}{"type": "ChatPinChanged", "chat": evt.JID.String(), "pinned": evt.Action.GetPinned()}
+		at = evt.Timestamp
+	case *events.Mute:
+		muted, until := false, int64(0)
+		if evt.Action.GetMuted() {
+			// No end is muted for good, as with always
+			muted, until = true, -1
+			if end := evt.Action.GetMuteEndTimestamp(); end != 0 {
+				muted, until = chatMuted(time.UnixMilli(end))
+			}
+		}
+		postmap = map[string]interface{}{"type": "ChatMuteChanged", "chat": evt.JID.String(), "muted": muted, "mutedUntil": until}
+		at = evt.Timestamp
+	case *events.Star:
+		postmap = map[string]interface{}{"type": "MessageStarChanged", "chat": evt.ChatJID.String(), "id": evt.MessageID, "fromMe": evt.IsFromMe, "starred": evt.Action.GetStarred()}
+		if !evt.SenderJID.IsEmpty() {
+			postmap["sender"] = evt.SenderJID.String()
+		}
+		at = evt.Timestamp
+	case *events.Contact:
+		postmap = map[string]interface{}{"type": "ContactChanged", "jid": evt.JID.String(), "fullName": evt.Action.GetFullName(), "firstName": evt.Action.GetFirstName()}
+		at = evt.Timestamp
+	default:
+		return
+	}
+	postmap["event"] = rawEvt
+	postmap["timestamp"] = at.Unix()
+	log.Info().Str("userid", strconv.Itoa(mycli.userID)).Str("type", postmap["type"].(string)).Msg("App state changed")
+	mycli.dispatchEvent(postmap, "")
+}
+
+// Key of the last message known in a chat, WhatsApp archives the chat up to
+// it. Zero and nil when the chat was never seen.
+func lastChatMessage(db *sql.DB, userID int, chat types.JID) (time.Time, *waProto.MessageKey) {
+	var id, sender string
+	var fromMe bool
+	var timestamp int64
+	err := db.QueryRow("SELECT last_id, last_sender, last_from_me, last_timestamp FROM chats WHERE user_id=? AND jid=?", userID, chat.ToNonAD().String()).Scan(&id, &sender, &fromMe, &timestamp)
+	if err != nil || id == "" {
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Warn().Err(err).Str("chat", chat.String()).Msg("Could not get last message of chat")
+		}
+		return time.Time{}, nil
+	}
+	key := &waProto.MessageKey{RemoteJID: proto.String(chat.String()), FromMe: proto.Bool(fromMe), ID: proto.String(id)}
+	if chat.Server == types.GroupServer && !fromMe && sender != "" {
+		key.Participant = proto.String(sender)
+	}
+	return time.Unix(timestamp, 0), key
+}
+
+// Payload of POST /chat/archive, /chat/pin and /chat/mute, each reads its
+// own flag
+type chatSettingStruct struct {
+	Phone    string
+	Archive  *bool
+	Pin      *bool
+	Mute     *bool
+	Duration string
+}
+
+// What the archive, pin and mute endpoints share: the session, the chat in
+// Phone and sending the app state patch they build. The answer is the chat's
+// state once WhatsApp applied it, a ChatArchiveChanged, ChatPinChanged or
+// ChatMuteChanged event is sent too.
+func (s *server) chatSettingHandler(setting string, build func(userID int, chat types.JID, t chatSettingStruct) (appstate.PatchInfo, string, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		var t chatSettingStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+		chat, err := resolveRecipient(client, "Phone", t.Phone)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		chat = chat.ToNonAD()
+		if chat.Server != types.DefaultUserServer && chat.Server != types.GroupServer {
+			s.Respond(w, r, http.StatusBadRequest, recipientError("Phone", errors.New("must be a contact or a group")))
+			return
+		}
+
+		patch, details, err := build(userid, chat, t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if err := client.SendAppState(patch); err != nil {
+			hlog.FromRequest(r).Error().Err(err).Str("chat", chat.String()).Msg("Failed to " + setting + " chat")
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Failed to %s chat: %v", setting, err))
+			return
+		}
+
+		state, err := getChatState(client, chat)
+		if err != nil {
+			hlog.FromRequest(r).Warn().Err(err).Str("chat", chat.String()).Msg("Could not get chat settings")
+		}
+		response := map[string]interface{}{"Details": details, "JID": chat.String(), "Archived": state.Archived, "Pinned": state.Pinned, "Muted": state.Muted, "MutedUntil": state.MutedUntil}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Archives the chat in Phone, or unarchives it with Archive false. Archiving
+// unpins the chat, as on the phone.
+func (s *server) ArchiveChat() http.HandlerFunc {
+	return s.chatSettingHandler("archive", func(userID int, chat types.JID, t chatSettingStruct) (appstate.PatchInfo, string, error) {
+		if t.Archive == nil {
+			return appstate.PatchInfo{}, "", errors.New("Missing Archive in Payload")
+		}
+		lastTimestamp, lastKey := lastChatMessage(s.db, userID, chat)
+		details := "Chat archived"
+		if !*t.Archive {
+			details = "Chat unarchived"
+		}
+		return appstate.BuildArchive(chat, *t.Archive, lastTimestamp, lastKey), details, nil
+	})
+}
+
+// Pins the chat in Phone, or unpins it with Pin false. The phone shows 3
+// pinned chats at most.
+func (s *server) PinChat() http.HandlerFunc {
+	return s.chatSettingHandler("pin", func(userID int, chat types.JID, t chatSettingStruct) (appstate.PatchInfo, string, error) {
+		if t.Pin == nil {
+			return appstate.PatchInfo{}, "", errors.New("Missing Pin in Payload")
+		}
+		details := "Chat pinned"
+		if !*t.Pin {
+			details = "Chat unpinned"
+		}
+		return appstate.BuildPin(chat, *t.Pin), details, nil
+	})
+}
+
+// Mutes the chat in Phone for Duration, 8h, 7d or always (the default), or
+// unmutes it with Mute false
+func (s *server) MuteChat() http.HandlerFunc {
+	return s.chatSettingHandler("mute", func(userID int, chat types.JID, t chatSettingStruct) (appstate.PatchInfo, string, error) {
+		if t.Mute == nil {
+			return appstate.PatchInfo{}, "", errors.New("Missing Mute in Payload")
+		}
+		if !*t.Mute {
+			return appstate.BuildMute(chat, false, 0), "Chat unmuted", nil
+		}
+		name := strings.ToLower(strings.TrimSpace(t.Duration))
+		if name == "" {
+			name = "always"
+		}
+		duration, ok := muteDurations[name]
+		if !ok {
+			return appstate.PatchInfo{}, "", errors.New("Invalid Duration, must be 8h, 7d or always")
+		}
+		patch := appstate.BuildMute(chat, true, duration)
+		if duration == 0 {
+			// The phone mutes for good with an end of -1, without one the
+			// store would take the chat as not muted
+			patch.Mutations[0].Value.MuteAction.MuteEndTimestamp = proto.Int64(-1)
+		}
+		return patch, "Chat muted", nil
+	})
+}
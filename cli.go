@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+const userUsage = `Usage: wuzapi [flags] user <command> [options]
+
+Manages users in the users database of -datadir, without the server.
+
+Commands:
+  add --name NAME [--token TOKEN] [--webhook URL] [--events All]
+  list [--json]
+  delete --id ID
+  rotate-token --id ID
+`
+
+// Runs wuzapi user ..., returns the exit code: 1 when the command failed, 2
+// when it was used wrong. Results go to stdout as JSON (list prints a table
+// unless --json), logs to stderr.
+func userCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, userUsage)
+		return 2
+	}
+	command, args := args[0], args[1:]
+	fs := flag.NewFlagSet("user "+command, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	var run func(db *sql.DB) (interface{}, error)
+
+	switch command {
+	case "add":
+		var user newUser
+		fs.StringVar(&user.Name, "name", "", "Name of the user")
+		fs.StringVar(&user.Token, "token", "", "Token of the user, a random one is generated when not given")
+		fs.StringVar(&user.Webhook, "webhook", "", "Webhook URL")
+		fs.StringVar(&user.Events, "events", "All", "Comma separated event types sent to the webhook")
+		run = func(db *sql.DB) (interface{}, error) {
+			if user.Name == "" {
+				return nil, errors.New("Missing --name")
+			}
+			if user.Token == "" {
+				token, err := generateToken()
+				if err != nil {
+					return nil, err
+				}
+				user.Token = token
+			}
+			if err := user.validate(); err != nil {
+				return nil, err
+			}
+			var id int64
+			err := userWrite(db, func(tx *sql.Tx) error {
+				var err error
+				id, err = insertUser(tx, user)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"id": id, "name": user.Name, "token": user.Token}, nil
+		}
+	case "list":
+		asJSON := fs.Bool("json", false, "Print the users as JSON, tokens included, instead of a table")
+		run = func(db *sql.DB) (interface{}, error) {
+			users, err := cliUsers(db)
+			if err != nil || *asJSON {
+				return users, err
+			}
+			printUserTable(os.Stdout, users)
+			return nil, nil
+		}
+	case "delete", "rotate-token":
+		id := fs.Int("id", 0, "Id of the user")
+		run = func(db *sql.DB) (interface{}, error) {
+			if *id <= 0 {
+				return nil, errors.New("Missing --id")
+			}
+			if command == "delete" {
+				return cliDeleteUser(db, *id)
+			}
+			return cliRotateToken(db, *id)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown user command %q\n\n%s", command, userUsage)
+		return 2
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments %v\n", fs.Args())
+		return 2
+	}
+
+	db, err := openUsersCLI()
+	if err != nil {
+		log.Error().Err(err).Str("datadir", *dataDir).Msg("Could not open users.db")
+		return 1
+	}
+	defer db.Close()
+	result, err := run(db)
+	if err != nil {
+		log.Error().Err(err).Str("command", command).Msg("User command failed")
+		return 1
+	}
+	if result != nil {
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		out.Encode(result)
+	}
+	return 0
+}
+
+// Opens users.db of -datadir, migrated like the server does. Unlike the
+// server it never falls back to a temporary directory, the user would be
+// written where the server doesn't look. Writes take the lock when their
+// transaction begins so a server writing at the same time is noticed there.
+func openUsersCLI() (*sql.DB, error) {
+	if err := checkWritable(*dataDir); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(sqlDriver(), sqliteDSN(filepath.Join(*dataDir, "users.db"))+"&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Runs write in a transaction, waiting a little for a server holding the
+// write lock and refusing to go on when it keeps it
+func userWrite(db *sql.DB, write func(tx *sql.Tx) error) error {
+	delay := dbRetryDelay
+	var tx *sql.Tx
+	var err error
+	for attempt := 1; ; attempt++ {
+		tx, err = db.Begin()
+		if err == nil {
+			break
+		}
+		if !sqliteBusy(err) {
+			return err
+		}
+		if attempt >= dbWriteAttempts {
+			return errors.New("users.db is locked by another process, likely the running server: try again or use the admin API")
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	if err := write(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type cliUser struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	Token      string `json:"token"`
+	Jid        string `json:"jid"`
+	Webhook    string `json:"webhook"`
+	Connected  bool   `json:"connected"`
+	Expiration int64  `json:"expiration"`
+}
+
+func cliUsers(db *sql.DB) ([]cliUser, error) {
+	rows, err := db.Query("SELECT id, name, token, jid, webhook, connected, expiration FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := []cliUser{}
+	for rows.Next() {
+		var user cliUser
+		var connected sql.NullInt64
+		var expiration sql.NullInt64
+		if err := rows.Scan(&user.ID, &user.Name, &user.Token, &user.Jid, &user.Webhook, &connected, &expiration); err != nil {
+			return nil, err
+		}
+		user.Connected = connected.Int64 == 1
+		user.Expiration = expiration.Int64
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// Tokens are left out of the table, it ends up in terminals and logs
+func printUserTable(w io.Writer, users []cliUser) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tJID\tCONNECTED\tEXPIRATION\tWEBHOOK")
+	for _, user := range users {
+		expiration := "never"
+		if user.Expiration > 0 {
+			expiration = time.Unix(user.Expiration, 0).UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%t\t%s\t%s\n", user.ID, user.Name, user.Jid, user.Connected, expiration, user.Webhook)
+	}
+	tw.Flush()
+}
+
+// Deletes the user, and its store file with -store-per-user. A running server
+// keeps the user's token in its cache until restarted.
+func cliDeleteUser(db *sql.DB, id int) (interface{}, error) {
+	err := userWrite(db, func(tx *sql.Tx) error {
+		result, err := execRetry(tx, "DELETE FROM users WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+		if deleted, _ := result.RowsAffected(); deleted == 0 {
+			return errors.New("User not found")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if *storePerUser {
+		stores.dir = filepath.Join(*dataDir, "stores")
+		stores.remove(id)
+	}
+	return map[string]interface{}{"id": id, "details": "User deleted successfully"}, nil
+}
+
+// Gives the user a new token. A running server keeps accepting the old one
+// from its cache until restarted, use the admin API while it runs.
+func cliRotateToken(db *sql.DB, id int) (interface{}, error) {
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	err = userWrite(db, func(tx *sql.Tx) error {
+		result, err := execRetry(tx, "UPDATE users SET token=? WHERE id=?", token, id)
+		if err != nil {
+			return err
+		}
+		if updated, _ := result.RowsAffected(); updated == 0 {
+			return errors.New("User not found")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"id": id, "token": token}, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// Responses smaller than this go out as they are, gzip would barely save
+// anything on them
+const gzipMinSize = 1024
+
+// Content types worth compressing. Media is already compressed and event
+// streams must reach the client as they are written.
+func compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.TrimSpace(strings.ToLower(mediaType))
+	switch {
+	case mediaType == "text/event-stream":
+		return false
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case mediaType == "application/json", mediaType == "application/javascript", mediaType == "application/xml",
+		mediaType == "application/x-yaml", mediaType == "application/yaml", mediaType == "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&buf, *gzipLevel)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Sets the form of a webhook post, gzipped with Content-Encoding: gzip for
+// users that turned it on
+func setWebhookForm(req *resty.Request, data map[string]string, compress bool) error {
+	if !compress {
+		req.SetFormData(data)
+		return nil
+	}
+	form := url.Values{}
+	for key, value := range data {
+		form.Set(key, value)
+	}
+	body, err := gzipBytes([]byte(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetHeader("Content-Type", "application/x-www-form-urlencoded").
+		SetHeader("Content-Encoding", "gzip").
+		SetBody(body)
+	return nil
+}
+
+// Holds the start of a response until it is known whether it is worth
+// compressing: gzipMinSize bytes of a compressible type the handler didn't
+// encode itself. Flushing before that sends it as it is. Unwrap lets
+// http.ResponseController reach the connection.
+type gzipWriter struct {
+	http.ResponseWriter
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < gzipMinSize {
+			return len(b), nil
+		}
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Sends the headers, compressing from here on when big enough, and what was
+// held back
+func (w *gzipWriter) decide(big bool) error {
+	w.decided = true
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	if big && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		// The level was checked at startup
+		w.gz, _ = gzip.NewWriterLevel(w.ResponseWriter, *gzipLevel)
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(w.buf)
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf)
+	}
+	w.buf = nil
+	return err
+}
+
+func (w *gzipWriter) Flush() {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Ends the response, small ones go out uncompressed
+func (w *gzipWriter) close() {
+	if !w.decided {
+		if w.status == 0 && len(w.buf) == 0 {
+			// Nothing written, the handler may have hijacked the connection
+			return
+		}
+		w.decide(false)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Middleware: Gzips responses for clients sending Accept-Encoding: gzip, at
+// -gzip-level. Small responses, media and event streams are left alone, and
+// so are websocket upgrades.
+func (s *server) compress(next http.Handler) http.Handler {
+	if !*gzipResponses {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if strings.TrimSpace(strings.ToLower(coding)) != "gzip" {
+			continue
+		}
+		// gzip;q=0 refuses it
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+// Package config resolves the values of a flag set from the command line,
+// environment variables and a YAML file, in that order of precedence, with
+// the flag defaults last.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Where the value of a setting came from
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag"
+)
+
+// Value of a flag once resolved, Value is "********" for secrets
+type Setting struct {
+	Name   string
+	Value  string
+	Source Source
+}
+
+type Config struct {
+	// Prepended to the environment variable of each flag: with WUZAPI_ the
+	// flag webhook-timeout is read from WUZAPI_WEBHOOK_TIMEOUT
+	EnvPrefix string
+	// Extra environment variable names by flag, checked after the default one
+	EnvAliases map[string]string
+	// Flag holding the path of the config file, it can come from the command
+	// line or the environment but not from the file itself
+	FileFlag string
+	// Flags whose values are redacted by Settings
+	Secrets []string
+
+	sources map[string]Source
+}
+
+// Environment variable a flag is read from
+func (c *Config) EnvName(name string) string {
+	return c.EnvPrefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+}
+
+// Parses args into fs, then sets the flags not given there from the
+// environment or else from the config file. Unknown keys in the file and
+// values a flag doesn't accept are errors.
+func (c *Config) Load(fs *flag.FlagSet, args []string) error {
+	c.sources = make(map[string]Source)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		c.sources[f.Name] = SourceFlag
+	})
+
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if envErr != nil || c.sources[f.Name] != "" {
+			return
+		}
+		value, ok := c.lookupEnv(f.Name)
+		if !ok {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			envErr = fmt.Errorf("invalid value %q for %s: %w", value, c.EnvName(f.Name), err)
+			return
+		}
+		c.sources[f.Name] = SourceEnv
+	})
+	if envErr != nil {
+		return envErr
+	}
+
+	if c.FileFlag == "" {
+		return nil
+	}
+	fileFlag := fs.Lookup(c.FileFlag)
+	if fileFlag == nil || fileFlag.Value.String() == "" {
+		return nil
+	}
+	values, err := readFile(fileFlag.Value.String())
+	if err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(values) {
+		name := strings.ReplaceAll(key, "_", "-")
+		f := fs.Lookup(name)
+		if f == nil || name == c.FileFlag {
+			return fmt.Errorf("%s: unknown setting %s", fileFlag.Value.String(), key)
+		}
+		if c.sources[name] != "" {
+			continue
+		}
+		value, err := scalar(values[key])
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", fileFlag.Value.String(), key, err)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s: invalid value %q for %s: %w", fileFlag.Value.String(), value, key, err)
+		}
+		c.sources[name] = SourceFile
+	}
+	return nil
+}
+
+// Where the value of a flag came from, after Load
+func (c *Config) Source(name string) Source {
+	if source := c.sources[name]; source != "" {
+		return source
+	}
+	return SourceDefault
+}
+
+// All flags of fs with their effective values, sorted by name
+func (c *Config) Settings(fs *flag.FlagSet) []Setting {
+	var settings []Setting
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if value != "" && c.secret(f.Name) {
+			value = "********"
+		}
+		settings = append(settings, Setting{Name: f.Name, Value: value, Source: c.Source(f.Name)})
+	})
+	return settings
+}
+
+func (c *Config) lookupEnv(name string) (string, bool) {
+	if value, ok := os.LookupEnv(c.EnvName(name)); ok {
+		return value, true
+	}
+	if alias := c.EnvAliases[name]; alias != "" {
+		return os.LookupEnv(alias)
+	}
+	return "", false
+}
+
+func (c *Config) secret(name string) bool {
+	for _, secret := range c.Secrets {
+		if secret == name {
+			return true
+		}
+	}
+	return false
+}
+
+func readFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+// Flag value of a YAML scalar, lists and maps have no flag equivalent
+func scalar(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case map[string]interface{}, []interface{}:
+		return "", fmt.Errorf("must be a single value")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+func sortedKeys(values map[string]interface{}) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,149 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(new(strings.Builder))
+	fs.String("config", "", "")
+	fs.String("from-flag", "default", "")
+	fs.String("from-env", "default", "")
+	fs.String("from-file", "default", "")
+	fs.String("untouched", "default", "")
+	fs.Int("number", 1, "")
+	fs.String("token", "", "")
+	return fs
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// A flag wins over the environment, which wins over the file, which wins
+// over the default
+func TestLoadPrecedence(t *testing.T) {
+	file := writeFile(t, "from_flag: file\nfrom_env: file\nfrom_file: file\n")
+	t.Setenv("TEST_FROM_FLAG", "env")
+	t.Setenv("TEST_FROM_ENV", "env")
+
+	fs := testFlags()
+	c := Config{EnvPrefix: "TEST_", FileFlag: "config"}
+	if err := c.Load(fs, []string{"-config", file, "-from-flag", "flag"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		value  string
+		source Source
+	}{
+		{"from-flag", "flag", SourceFlag},
+		{"from-env", "env", SourceEnv},
+		{"from-file", "file", SourceFile},
+		{"untouched", "default", SourceDefault},
+	}
+	for _, tt := range tests {
+		if got := fs.Lookup(tt.name).Value.String(); got != tt.value {
+			t.Errorf("%s = %q, want %q", tt.name, got, tt.value)
+		}
+		if got := c.Source(tt.name); got != tt.source {
+			t.Errorf("%s from %s, want %s", tt.name, got, tt.source)
+		}
+	}
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	t.Setenv("TEST_CONFIG", writeFile(t, "number: 7\n"))
+	fs := testFlags()
+	c := Config{EnvPrefix: "TEST_", FileFlag: "config"}
+	if err := c.Load(fs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.Lookup("number").Value.String(); got != "7" || c.Source("number") != SourceFile {
+		t.Errorf("number = %s from %s, want 7 from file", got, c.Source("number"))
+	}
+}
+
+func TestLoadEnvAlias(t *testing.T) {
+	t.Setenv("OLD_TOKEN", "alias")
+	fs := testFlags()
+	c := Config{EnvPrefix: "TEST_", EnvAliases: map[string]string{"token": "OLD_TOKEN"}}
+	if err := c.Load(fs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.Lookup("token").Value.String(); got != "alias" {
+		t.Errorf("token = %q, want the alias value", got)
+	}
+
+	// The flag's own variable comes first
+	t.Setenv("TEST_TOKEN", "own")
+	fs = testFlags()
+	if err := c.Load(fs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.Lookup("token").Value.String(); got != "own" {
+		t.Errorf("token = %q, want the own variable's value", got)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		file string
+	}{
+		{"invalid env value", "x", ""},
+		{"unknown file key", "", "nope: 1\n"},
+		{"invalid file value", "", "number: many\n"},
+		{"list in file", "", "from_file: [a, b]\n"},
+		{"config file in itself", "", "config: other.yaml\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("TEST_NUMBER", tt.env)
+			}
+			args := []string{}
+			if tt.file != "" {
+				args = append(args, "-config", writeFile(t, tt.file))
+			}
+			c := Config{EnvPrefix: "TEST_", FileFlag: "config"}
+			if err := c.Load(testFlags(), args); err == nil {
+				t.Error("Load succeeded")
+			}
+		})
+	}
+}
+
+func TestSettingsRedactSecrets(t *testing.T) {
+	fs := testFlags()
+	c := Config{EnvPrefix: "TEST_", Secrets: []string{"token"}}
+	if err := c.Load(fs, []string{"-token", "s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, setting := range c.Settings(fs) {
+		if strings.Contains(setting.Value, "s3cret") {
+			t.Errorf("%s shows the secret", setting.Name)
+		}
+		if setting.Name == "token" {
+			found = true
+			if setting.Value != "********" || setting.Source != SourceFlag {
+				t.Errorf("token = %q from %s, want ******** from flag", setting.Value, setting.Source)
+			}
+		}
+	}
+	if !found {
+		t.Error("token missing from the settings")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// How long names read from the contact store are reused, contact updates
+// drop them sooner
+const contactNamesTTL = 30 * time.Minute
+
+// Names of contacts by user and JID, reading the contact store hits sqlite
+var contactNames = cache.New(contactNamesTTL, 10*time.Minute)
+
+// Names of a sender added to Message and Receipt webhooks, empty when not
+// known
+type contactName struct {
+	PushName     string
+	FullName     string
+	BusinessName string
+}
+
+func contactNamesEnabled(token string) bool {
+	myuserinfo, found := userinfocache.Get(token)
+	if !found {
+		return false
+	}
+	return myuserinfo.(Values).Get("ContactNames") == "1"
+}
+
+// Contacts are stored by phone number, LIDs are looked up by the one they
+// belong to when known
+func contactNameKey(userID int, jid types.JID) (types.JID, string) {
+	jid = jid.ToNonAD()
+	if jid.Server == types.HiddenUserServer {
+		if pn, ok := lids.pn(jid); ok {
+			jid = pn
+		}
+	}
+	return jid, strconv.Itoa(userID) + "/" + jid.String()
+}
+
+// Names of jid in the user's contact store, cached
+func (mycli *MyClient) contactName(jid types.JID) contactName {
+	jid, key := contactNameKey(mycli.userID, jid)
+	if cached, found := contactNames.Get(key); found {
+		return cached.(contactName)
+	}
+	var name contactName
+	if mycli.WAClient == nil || mycli.WAClient.Store.Contacts == nil {
+		return name
+	}
+	info, err := mycli.WAClient.Store.Contacts.GetContact(jid)
+	if err != nil {
+		log.Warn().Err(err).Str("jid", jid.String()).Msg("Could not get contact names")
+		return name
+	}
+	if info.Found {
+		name = contactName{PushName: info.PushName, FullName: info.FullName, BusinessName: info.BusinessName}
+	}
+	contactNames.Set(key, name, cache.DefaultExpiration)
+	return name
+}
+
+// Drops the cached names of a contact that changed
+func (mycli *MyClient) forgetContactName(jid types.JID) {
+	_, key := contactNameKey(mycli.userID, jid)
+	contactNames.Delete(key)
+}
+
+// Sets contact in a webhook with the names of sender, unless the user turned
+// contact_names off. The push name of a message is newer than the stored one.
+func (mycli *MyClient) addContact(postmap map[string]interface{}, sender types.JID, pushName string) {
+	if !contactNamesEnabled(mycli.getToken()) {
+		return
+	}
+	name := mycli.contactName(sender)
+	if pushName != "" {
+		name.PushName = pushName
+	}
+	postmap["contact"] = name
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Defaults of -cors-methods and -cors-headers, what the API uses
+const (
+	corsAllowMethods  = "GET,POST,PUT,DELETE,OPTIONS"
+	corsAllowHeaders  = "Content-Type,Token,Authorization,Passphrase,X-Request-ID"
+	corsExposeHeaders = "X-Total-Count, Retry-After, X-Request-ID, Deprecation, Link"
+	corsMaxAge        = "600"
+)
+
+// Non empty items of a comma separated flag
+func corsList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Origins allowed by -cors-origins, nil when CORS is off
+func corsOrigins() []string {
+	var origins []string
+	for _, origin := range corsList(*corsOriginList) {
+		origins = append(origins, strings.TrimRight(origin, "/"))
+	}
+	return origins
+}
+
+// Checks -cors-methods and -cors-headers, both are lists of header tokens
+func validateCORS() error {
+	if len(corsList(*corsMethods)) == 0 {
+		return fmt.Errorf("-cors-methods can't be empty")
+	}
+	for _, method := range corsList(*corsMethods) {
+		if !validHeaderName(method) {
+			return fmt.Errorf("invalid method %q in -cors-methods", method)
+		}
+	}
+	for _, header := range corsList(*corsHeaders) {
+		if !validHeaderName(header) {
+			return fmt.Errorf("invalid header %q in -cors-headers", header)
+		}
+	}
+	return nil
+}
+
+// Wraps the router with CORS headers for the configured origins. It sits in
+// front of mux because preflights match no route. Requests from other
+// origins are served without CORS headers, so browsers block them.
+func (s *server) cors(next http.Handler) http.Handler {
+	origins := corsOrigins()
+	if len(origins) == 0 {
+		return next
+	}
+	anyOrigin := Find(origins, "*")
+	allowMethods := strings.ToUpper(strings.Join(corsList(*corsMethods), ", "))
+	allowHeaders := strings.Join(corsList(*corsHeaders), ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || (*corsNoAdmin && isAdminPath(r.URL.Path)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		w.Header().Add("Vary", "Origin")
+		if !anyOrigin && !Find(origins, origin) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if anyOrigin {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if *corsCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", allowMethods)
+			if allowHeaders != "" {
+				w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+			}
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
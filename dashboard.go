@@ -0,0 +1,42 @@
+package main
+
+import (
+	_ "embed"
+	"html/template"
+	"net/http"
+)
+
+// Single page to pair and manage a session, and list users with the admin
+// token. Plain HTML and JS, everything it shows comes from the JSON API.
+//
+//go:embed dashboard/index.html
+var dashboardHTML string
+
+var dashboardPage = template.Must(template.New("dashboard").Parse(dashboardHTML))
+
+// What the page can reach on the listener serving it: with -admin-port the
+// user API and the admin API are on different ones
+type dashboardConfig struct {
+	API   string `json:"api"`
+	Admin string `json:"admin"`
+	User  bool   `json:"user"`
+}
+
+// Serves the dashboard, user tells whether the user API is on this listener
+// and admin whether the admin one is
+func (s *server) Dashboard(user bool, admin bool) http.HandlerFunc {
+	config := dashboardConfig{API: "/" + apiVersion, User: user}
+	if admin {
+		config.Admin = "/" + apiVersion + *adminPrefix
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		// Tokens are typed in it, it must not be framed by other sites
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; img-src 'self' data:; style-src 'unsafe-inline'; script-src 'unsafe-inline'; frame-ancestors 'none'")
+		w.Header().Set("X-Frame-Options", "DENY")
+		if err := dashboardPage.Execute(w, config); err != nil {
+			log.Error().Err(err).Msg("Could not render dashboard")
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Attempts of a write failing with "database is locked" before giving up.
+// busy_timeout already waits for the lock, but SQLite answers busy right
+// away when waiting could deadlock (a reader upgrading to writer, a WAL
+// snapshot gone stale), those succeed when the statement is run again.
+const dbWriteAttempts = 5
+
+// Wait before the first retry, doubled on each one after
+const dbRetryDelay = 50 * time.Millisecond
+
+// Tells whether err is SQLite's busy or locked, extended codes included
+func sqliteBusy(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	code := sqliteErr.Code() & 0xff
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
+
+// Runs a write statement, retrying it while the database is busy. Statements
+// of a transaction are run once, a busy error there needs the whole
+// transaction to be retried.
+func execRetry(db execer, query string, args ...interface{}) (sql.Result, error) {
+	attempts := dbWriteAttempts
+	if _, ok := db.(*sql.Tx); ok {
+		attempts = 1
+	}
+	delay := dbRetryDelay
+	for attempt := 1; ; attempt++ {
+		result, err := db.Exec(query, args...)
+		if err == nil || attempt >= attempts || !sqliteBusy(err) {
+			return result, err
+		}
+		log.Warn().Err(err).Int("attempt", attempt).Msg("Database busy, retrying write")
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
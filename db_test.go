@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// Webhook changes of many users at once, as with a fleet reconfigured by a
+// script, must all get through without busy or locked errors. Run with the
+// default single connection and with a pool, where SQLite's locks come in.
+func TestConcurrentWebhookUpdates(t *testing.T) {
+	for _, conns := range []int{1, 8} {
+		t.Run(fmt.Sprintf("%d connections", conns), func(t *testing.T) {
+			db, err := sql.Open(sqlDriver(), sqliteDSN(filepath.Join(t.TempDir(), "users.db")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			db.SetMaxOpenConns(conns)
+			if err := migrate(db); err != nil {
+				t.Fatal(err)
+			}
+			var mode string
+			if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil || mode != "wal" {
+				t.Fatalf("journal mode %q (%v), want wal", mode, err)
+			}
+
+			const writers = 50
+			ids := make([]int64, writers)
+			for i := range ids {
+				if ids[i], err = insertUser(db, newUser{Name: fmt.Sprintf("u%d", i), Token: fmt.Sprintf("stress%d", i), PayloadFormat: "raw"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, writers*5)
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					id := ids[i]
+					webhook := fmt.Sprintf("https://example.com/hook/%d", i)
+					for _, update := range []struct {
+						query string
+						value interface{}
+					}{
+						{"UPDATE users SET webhook=? WHERE id=?", webhook},
+						{"UPDATE users SET webhook_headers=? WHERE id=?", `{"X-Key":"k"}`},
+						{"UPDATE users SET webhook_timeout=? WHERE id=?", i % 30},
+						{"UPDATE users SET webhook_gzip=? WHERE id=?", i%2 == 0},
+					} {
+						if _, err := execRetry(db, update.query, update.value, id); err != nil {
+							errs <- err
+						}
+					}
+					var stored string
+					if err := db.QueryRow("SELECT webhook FROM users WHERE id=?", id).Scan(&stored); err != nil {
+						errs <- err
+					} else if stored != webhook {
+						errs <- fmt.Errorf("user %d has webhook %q, want %q", id, stored, webhook)
+					}
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+		})
+	}
+}
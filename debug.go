@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/hlog"
+)
+
+// Creators listed in the goroutine summary, the most frequent first
+const goroutineTopCreators = 15
+
+// Serves /debug/pprof/{profile} like net/http/pprof does under
+// /debug/pprof/, which it can't here as it expects that exact prefix
+func (s *server) PprofProfile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch name := mux.Vars(r)["profile"]; name {
+		case "cmdline":
+			pprof.Cmdline(w, r)
+		case "profile":
+			pprof.Profile(w, r)
+		case "symbol":
+			pprof.Symbol(w, r)
+		case "trace":
+			pprof.Trace(w, r)
+		default:
+			pprof.Handler(name).ServeHTTP(w, r)
+		}
+	}
+}
+
+// Index of the pprof profiles, its links are relative to /debug/pprof/
+func (s *server) PprofIndex() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = "/debug/pprof/"
+		pprof.Index(w, r)
+	}
+}
+
+type goroutineCreator struct {
+	Function string `json:"function"`
+	Count    int    `json:"count"`
+}
+
+// Counts of the goroutines running, in all and in whatsmeow code, with the
+// functions that started most of them. A count growing as sessions connect
+// and disconnect points at a leak in the session lifecycle. ?full=true
+// returns the stack of every goroutine instead, as text.
+func (s *server) DebugGoroutines() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		buf := make([]byte, 1<<20)
+		for {
+			n := runtime.Stack(buf, true)
+			if n < len(buf) {
+				buf = buf[:n]
+				break
+			}
+			buf = make([]byte, 2*len(buf))
+		}
+		if r.URL.Query().Get("full") == "true" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write(buf)
+			return
+		}
+
+		total, whatsmeowCount := 0, 0
+		creators := map[string]int{}
+		for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+			if len(bytes.TrimSpace(stack)) == 0 {
+				continue
+			}
+			total++
+			if bytes.Contains(stack, []byte("go.mau.fi/whatsmeow")) {
+				whatsmeowCount++
+			}
+			creator := "main goroutine"
+			if i := bytes.LastIndex(stack, []byte("created by ")); i >= 0 {
+				line, _, _ := strings.Cut(string(stack[i+len("created by "):]), "\n")
+				// Drops " in goroutine N"
+				creator, _, _ = strings.Cut(line, " in goroutine")
+			}
+			creators[creator]++
+		}
+		top := make([]goroutineCreator, 0, len(creators))
+		for function, count := range creators {
+			top = append(top, goroutineCreator{Function: function, Count: count})
+		}
+		sort.Slice(top, func(i, j int) bool {
+			if top[i].Count != top[j].Count {
+				return top[i].Count > top[j].Count
+			}
+			return top[i].Function < top[j].Function
+		})
+		if len(top) > goroutineTopCreators {
+			top = top[:goroutineTopCreators]
+		}
+
+		response := map[string]interface{}{
+			"goroutines": total,
+			"whatsmeow":  whatsmeowCount,
+			"sessions":   len(sessions.clients()),
+			"created_by": top,
+		}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+type memorySnapshot struct {
+	HeapAlloc   uint64 `json:"heap_alloc"`
+	HeapInuse   uint64 `json:"heap_inuse"`
+	HeapObjects uint64 `json:"heap_objects"`
+	HeapSys     uint64 `json:"heap_sys"`
+	Sys         uint64 `json:"sys"`
+	NumGC       uint32 `json:"num_gc"`
+}
+
+func readMemory() memorySnapshot {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return memorySnapshot{HeapAlloc: m.HeapAlloc, HeapInuse: m.HeapInuse, HeapObjects: m.HeapObjects, HeapSys: m.HeapSys, Sys: m.Sys, NumGC: m.NumGC}
+}
+
+// Runs a garbage collection and returns memory to the OS, with the memory
+// figures before and after
+func (s *server) DebugGC() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		before := readMemory()
+		start := time.Now()
+		debug.FreeOSMemory()
+		elapsed := time.Since(start)
+		after := readMemory()
+		hlog.FromRequest(r).Info().Uint64("heap_before", before.HeapAlloc).Uint64("heap_after", after.HeapAlloc).Dur("duration", elapsed).Msg("Forced garbage collection")
+
+		response := map[string]interface{}{"before": before, "after": after, "duration_ms": elapsed.Milliseconds()}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Messages received lately, by user, chat and id, to drop the copies
+// WhatsApp delivers again after a retry or a reconnect. Entries expire after
+// -dedup-window.
+var seenMessages = cache.New(cache.NoExpiration, time.Minute)
+
+// Edits and revokes are messages of their own, the edit attribute and the
+// protocol message type keep them apart from the message they change even
+// if they were to come with its id
+func messageDedupKey(userID int, evt *events.Message) string {
+	kind := ""
+	if protocol := evt.Message.GetProtocolMessage(); protocol != nil {
+		kind = protocol.GetType().String()
+	}
+	return strconv.Itoa(userID) + "|" + evt.Info.Chat.ToNonAD().String() + "|" + evt.Info.ID + "|" + string(evt.Info.Edit) + "|" + kind
+}
+
+// Tells whether the message was already received within -dedup-window,
+// remembering it otherwise
+func duplicateMessage(userID int, evt *events.Message) bool {
+	if *dedupWindow <= 0 || evt.Info.ID == "" {
+		return false
+	}
+	// Add fails when the key is there and not expired
+	return seenMessages.Add(messageDedupKey(userID, evt), struct{}{}, *dedupWindow) != nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// Sets -dedup-window for the test, with nothing remembered from others
+func setDedupWindow(t *testing.T, window time.Duration) {
+	t.Helper()
+	saved := *dedupWindow
+	*dedupWindow = window
+	seenMessages.Flush()
+	t.Cleanup(func() {
+		*dedupWindow = saved
+		seenMessages.Flush()
+	})
+}
+
+func TestDuplicateMessage(t *testing.T) {
+	setDedupWindow(t, time.Minute)
+	text := func() *events.Message { return testMessage(&waProto.Message{Conversation: proto.String("hello")}) }
+
+	if duplicateMessage(1, text()) {
+		t.Fatal("first delivery taken as duplicate")
+	}
+	if !duplicateMessage(1, text()) {
+		t.Error("second delivery not taken as duplicate")
+	}
+	// Device of the chat doesn't matter, the same message comes through
+	// another device of the sender
+	again := text()
+	again.Info.Chat.Device = 7
+	if !duplicateMessage(1, again) {
+		t.Error("delivery with a device chat JID not taken as duplicate")
+	}
+
+	tests := []struct {
+		name   string
+		userID int
+		change func(evt *events.Message)
+	}{
+		{"other user", 2, func(evt *events.Message) {}},
+		{"other chat", 1, func(evt *events.Message) {
+			evt.Info.Chat = types.NewJID("120363025246125486", types.GroupServer)
+		}},
+		{"other id", 1, func(evt *events.Message) { evt.Info.ID = "3EB0OTHER" }},
+		{"edit", 1, func(evt *events.Message) {
+			evt.Info.Edit = types.EditAttributeMessageEdit
+			evt.Message = &waProto.Message{ProtocolMessage: &waProto.ProtocolMessage{Type: waProto.ProtocolMessage_MESSAGE_EDIT.Enum(), EditedMessage: &waProto.Message{Conversation: proto.String("hello!")}}}
+		}},
+		{"revoke", 1, func(evt *events.Message) {
+			evt.Info.Edit = types.EditAttributeSenderRevoke
+			evt.Message = &waProto.Message{ProtocolMessage: &waProto.ProtocolMessage{Type: waProto.ProtocolMessage_REVOKE.Enum()}}
+		}},
+		{"revoke by an admin", 1, func(evt *events.Message) {
+			evt.Info.Edit = types.EditAttributeAdminRevoke
+			evt.Message = &waProto.Message{ProtocolMessage: &waProto.ProtocolMessage{Type: waProto.ProtocolMessage_REVOKE.Enum()}}
+		}},
+	}
+	for _, tt := range tests {
+		evt := text()
+		tt.change(evt)
+		if duplicateMessage(tt.userID, evt) {
+			t.Errorf("%s: taken as duplicate of the original", tt.name)
+		}
+		// Its own copies are dropped all the same
+		if !duplicateMessage(tt.userID, evt) {
+			t.Errorf("%s: second delivery not taken as duplicate", tt.name)
+		}
+	}
+
+	// Messages without id can't be told apart
+	noID := text()
+	noID.Info.ID = ""
+	if duplicateMessage(1, noID) || duplicateMessage(1, noID) {
+		t.Error("message without id taken as duplicate")
+	}
+}
+
+func TestDuplicateMessageWindow(t *testing.T) {
+	setDedupWindow(t, 50*time.Millisecond)
+	evt := testMessage(&waProto.Message{Conversation: proto.String("hello")})
+	if duplicateMessage(1, evt) || !duplicateMessage(1, evt) {
+		t.Fatal("second delivery within the window not taken as duplicate")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if duplicateMessage(1, evt) {
+		t.Error("delivery after the window taken as duplicate")
+	}
+}
+
+func TestDuplicateMessageDisabled(t *testing.T) {
+	setDedupWindow(t, 0)
+	evt := testMessage(&waProto.Message{Conversation: proto.String("hello")})
+	for i := 0; i < 3; i++ {
+		if duplicateMessage(1, evt) {
+			t.Fatalf("delivery %d taken as duplicate with -dedup-window 0", i+1)
+		}
+	}
+}
+
+// The same message delivered twice makes one webhook, its edit another
+func TestDuplicateDeliveryWebhooks(t *testing.T) {
+	setDedupWindow(t, time.Minute)
+	var posts atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { posts.Add(1) }))
+	defer receiver.Close()
+	s := &server{db: testUsersDB(t)}
+	id, err := insertUser(s.db, newUser{Name: "dedup", Token: "dedup-token", Webhook: receiver.URL, Events: "Message", PayloadFormat: "raw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := int(id)
+	s.refreshUserInfo(strconv.Itoa(userID), "")
+	mycli := &MyClient{userID: userID, db: s.db, webhooks: newWebhookQueue(userID, newWebhookClient()), token: "dedup-token", subscriptions: []string{"Message"}}
+	defer mycli.webhooks.stop()
+
+	original := testMessage(&waProto.Message{Conversation: proto.String("hello")})
+	edit := testMessage(&waProto.Message{ProtocolMessage: &waProto.ProtocolMessage{Type: waProto.ProtocolMessage_MESSAGE_EDIT.Enum(), EditedMessage: &waProto.Message{Conversation: proto.String("hello!")}}})
+	edit.Info.Edit = types.EditAttributeMessageEdit
+	for _, evt := range []*events.Message{original, original, edit, edit} {
+		mycli.myEventHandler(evt)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for posts.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Room for a late duplicate to show up
+	time.Sleep(200 * time.Millisecond)
+	if got := posts.Load(); got != 2 {
+		t.Errorf("%d webhooks for a message and its edit delivered twice each, want 2", got)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// What /session/deviceinfo tells of the account and this session. Updated is
+// when it was last read from a connected session, Stale when the session
+// isn't connected and the values may have changed since.
+type deviceInfo struct {
+	JID          string
+	PushName     string
+	BusinessName string
+	Platform     string
+	DeviceName   string
+	WAVersion    string
+	PairedAt     int64
+	Companions   []string
+	Connected    bool
+	Stale        bool
+	Updated      int64
+}
+
+// Last device info read from each user's connected session, by user id,
+// refreshed on every connection. Forgotten on logout, the device is gone
+// then.
+var deviceInfos = cache.New(cache.NoExpiration, 0)
+
+// Reads the device info of a connected and logged in session, the companions
+// come from WhatsApp
+func readDeviceInfo(db *sql.DB, userID int, client *whatsmeow.Client) (deviceInfo, error) {
+	own := *client.Store.ID
+	devices, err := client.GetUserDevices([]types.JID{own.ToNonAD()})
+	if err != nil {
+		return deviceInfo{}, fmt.Errorf("Failed to get devices: %v", err)
+	}
+	info := deviceInfo{
+		JID:          own.ToNonAD().String(),
+		PushName:     client.Store.PushName,
+		BusinessName: client.Store.BusinessName,
+		Platform:     client.Store.Platform,
+		WAVersion:    store.GetWAVersion().String(),
+		Companions:   []string{},
+		Connected:    true,
+		Updated:      time.Now().Unix(),
+	}
+	if err := db.QueryRow("SELECT device_name, paired_at FROM users WHERE id=?", userID).Scan(&info.DeviceName, &info.PairedAt); err != nil {
+		log.Error().Err(err).Int("userid", userID).Msg("Could not get device name and pairing time")
+	}
+	if info.DeviceName == "" {
+		info.DeviceName = *deviceName
+	}
+	for _, jid := range devices {
+		// The phone is the account itself, not a companion
+		if jid.Device != 0 && jid.Device != own.Device {
+			info.Companions = append(info.Companions, jid.String())
+		}
+	}
+	return info, nil
+}
+
+// Caches the device info on connecting, so it is known once disconnected
+func (mycli *MyClient) refreshDeviceInfo() {
+	if !mycli.WAClient.IsLoggedIn() || mycli.WAClient.Store.ID == nil {
+		return
+	}
+	info, err := readDeviceInfo(mycli.db, mycli.userID, mycli.WAClient)
+	if err != nil {
+		log.Warn().Err(err).Int("userid", mycli.userID).Msg("Could not read device info")
+		return
+	}
+	deviceInfos.Set(strconv.Itoa(mycli.userID), info, cache.NoExpiration)
+}
+
+// Device info of a session that isn't connected, from the store as far as
+// nothing was cached from a connection
+func (s *server) storedDeviceInfo(userID int) (deviceInfo, error) {
+	var jid string
+	var pairedAt int64
+	if err := s.db.QueryRow("SELECT jid, paired_at FROM users WHERE id=?", userID).Scan(&jid, &pairedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return deviceInfo{}, newAPIError(ErrNotFound, "User not found", nil)
+		}
+		return deviceInfo{}, err
+	}
+	if jid == "" {
+		return deviceInfo{}, newAPIError(ErrSessionNotPaired, "No paired device", nil)
+	}
+	info := deviceInfo{DeviceName: s.deviceName(userID), WAVersion: store.GetWAVersion().String(), PairedAt: pairedAt, Companions: []string{}, Stale: true}
+	deviceJid, ok := parseJID(jid)
+	if !ok {
+		return deviceInfo{}, newAPIError(ErrSessionNotPaired, "No paired device", nil)
+	}
+	info.JID = deviceJid.ToNonAD().String()
+	userContainer, err := deviceContainer(userID)
+	if err != nil {
+		return deviceInfo{}, err
+	}
+	device, err := userContainer.GetDevice(deviceJid)
+	if err != nil {
+		return deviceInfo{}, err
+	}
+	if device != nil {
+		info.PushName = device.PushName
+		info.BusinessName = device.BusinessName
+		info.Platform = device.Platform
+	}
+	return info, nil
+}
+
+// Own JID, phone platform, push name, pairing time and the other companion
+// devices of the account. While disconnected the last values read from a
+// connection are returned, marked stale.
+func (s *server) GetDeviceInfo() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		var info deviceInfo
+		client := sessions.client(userid)
+		if client != nil && client.IsConnected() && client.IsLoggedIn() && client.Store.ID != nil {
+			live, err := readDeviceInfo(s.db, userid, client)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			info = live
+			deviceInfos.Set(txtid, info, cache.NoExpiration)
+		} else if cached, found := deviceInfos.Get(txtid); found {
+			info = cached.(deviceInfo)
+			info.Connected = client != nil && client.IsConnected()
+			info.Stale = true
+		} else {
+			stored, err := s.storedDeviceInfo(userid)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			info = stored
+			info.Connected = client != nil && client.IsConnected()
+		}
+
+		responseJson, err := json.Marshal(info)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"unicode"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/store"
+	"google.golang.org/protobuf/proto"
+)
+
+// Longest device name accepted for -device-name and device_name
+const maxDeviceNameLength = 50
+
+func validateDeviceName(name string) error {
+	if len(name) > maxDeviceNameLength {
+		return errors.New("too long")
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) {
+			return errors.New("control characters not allowed")
+		}
+	}
+	return nil
+}
+
+// Name the session is listed with in the phone's linked devices, the user's
+// device_name or -device-name
+func (s *server) deviceName(userID int) string {
+	var name string
+	if err := s.db.QueryRow("SELECT device_name FROM users WHERE id=?", userID).Scan(&name); err != nil {
+		log.Error().Err(err).Int("userid", userID).Msg("Could not get device name for user")
+	}
+	if name == "" {
+		return *deviceName
+	}
+	return name
+}
+
+// Presents name to WhatsApp when client pairs. It only goes in the device
+// properties of the registration payload, sessions already paired keep the
+// name they were linked with and the rest of the handshake is untouched.
+func setDeviceName(client *whatsmeow.Client, name string) {
+	client.GetClientPayload = func() *waProto.ClientPayload {
+		payload := client.Store.GetClientPayload()
+		if payload.DevicePairingData == nil {
+			return payload
+		}
+		props := proto.Clone(store.DeviceProps).(*waProto.DeviceProps)
+		props.Os = proto.String(name)
+		if data, err := proto.Marshal(props); err == nil {
+			payload.DevicePairingData.DeviceProps = data
+		}
+		return payload
+	}
+}
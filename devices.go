@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// Drops a user's link to its WhatsApp device once it was logged out: clears
+// jid and connected, and deletes the device from the store in case whatsmeow
+// couldn't. The next connect pairs a new device.
+func forgetDevice(db *sql.DB, userID int, token string) {
+	var jid string
+	if err := db.QueryRow("SELECT jid FROM users WHERE id=?", userID).Scan(&jid); err != nil {
+		log.Error().Err(err).Int("userid", userID).Msg("Could not get jid of logged out user")
+	}
+	sqlStmt := `UPDATE users SET connected=0, jid='', paired_at=0 WHERE id=?`
+	if _, err := execRetry(db, sqlStmt, userID); err != nil {
+		log.Error().Err(err).Msg(sqlStmt)
+	}
+	if v, found := userinfocache.Get(token); found {
+		userinfocache.Set(token, updateUserInfo(v, "Jid", ""), cache.NoExpiration)
+	}
+	deviceInfos.Delete(strconv.Itoa(userID))
+	// Chats belong to the unlinked account
+	if _, err := execRetry(db, "DELETE FROM chats WHERE user_id=?", userID); err != nil {
+		log.Error().Err(err).Int("userid", userID).Msg("Could not delete chats of logged out user")
+	}
+	if _, err := execRetry(db, "DELETE FROM chat_timers WHERE user_id=?", userID); err != nil {
+		log.Error().Err(err).Int("userid", userID).Msg("Could not delete disappearing timers of logged out user")
+	}
+	if jid == "" {
+		return
+	}
+	deviceJid, ok := parseJID(jid)
+	if !ok {
+		return
+	}
+	userContainer, err := deviceContainer(userID)
+	if err != nil {
+		log.Error().Err(err).Str("jid", jid).Msg("Could not open store of logged out user")
+		return
+	}
+	device, err := userContainer.GetDevice(deviceJid)
+	if err != nil {
+		log.Error().Err(err).Str("jid", jid).Msg("Could not get device of logged out user")
+		return
+	}
+	if device == nil {
+		return
+	}
+	if err := userContainer.DeleteDevice(device); err != nil {
+		log.Error().Err(err).Str("jid", jid).Msg("Could not delete device of logged out user")
+		return
+	}
+	log.Info().Str("jid", jid).Int("userid", userID).Msg("Deleted device of logged out user")
+}
+
+// Brings the users table and the whatsmeow store back in line: devices no
+// user points to are deleted, users whose device is gone get their jid
+// cleared. Running sessions are left alone, a device that just paired is
+// saved before users.jid is set.
+func (s *server) sweepDevices() (removed []string, cleared []int, err error) {
+	devices, err := container.GetAllDevices()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	users := make(map[string]sweptUser)
+	rows, err := s.db.Query("SELECT id, token, jid FROM users WHERE jid!=''")
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var u sweptUser
+		var jid string
+		if err := rows.Scan(&u.id, &u.token, &jid); err == nil {
+			users[jid] = u
+		}
+	}
+	rows.Close()
+
+	running := make(map[string]bool)
+	runningUsers := make(map[int]bool)
+	for userID, client := range sessions.clients() {
+		runningUsers[userID] = true
+		if client.Store.ID != nil {
+			running[client.Store.ID.String()] = true
+		}
+	}
+
+	stored := make(map[string]bool)
+	for _, device := range devices {
+		jid := device.ID.String()
+		stored[jid] = true
+		// Devices in main.db are only left over from before
+		// -store-per-user, waiting to be moved on their user's next connect
+		if _, ok := users[jid]; ok || running[jid] || *storePerUser {
+			continue
+		}
+		if err := container.DeleteDevice(device); err != nil {
+			log.Error().Err(err).Str("jid", jid).Msg("Could not delete orphaned device")
+			continue
+		}
+		log.Info().Str("jid", jid).Msg("Deleted device with no user")
+		removed = append(removed, jid)
+	}
+	if *storePerUser {
+		removed, err = s.sweepUserStores(users, runningUsers, stored)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for jid, u := range users {
+		if stored[jid] || runningUsers[u.id] {
+			continue
+		}
+		if _, err := execRetry(s.db, "UPDATE users SET connected=0, jid='', paired_at=0 WHERE id=?", u.id); err != nil {
+			log.Error().Err(err).Int("userid", u.id).Msg("Could not clear jid of user without device")
+			continue
+		}
+		if v, found := userinfocache.Get(u.token); found {
+			userinfocache.Set(u.token, updateUserInfo(v, "Jid", ""), cache.NoExpiration)
+		}
+		log.Info().Str("jid", jid).Int("userid", u.id).Msg("Cleared jid of user without device")
+		cleared = append(cleared, u.id)
+	}
+	return removed, cleared, nil
+}
+
+type sweptUser struct {
+	id    int
+	token string
+}
+
+// sweepDevices for -store-per-user: store files of users that no longer
+// exist are deleted, and the devices found in the users' own stores are
+// added to stored
+func (s *server) sweepUserStores(users map[string]sweptUser, runningUsers map[int]bool, stored map[string]bool) (removed []string, err error) {
+	ids, err := stores.files()
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[int]bool)
+	rows, err := s.db.Query("SELECT id FROM users")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			existing[id] = true
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if existing[id] || runningUsers[id] {
+			continue
+		}
+		stores.remove(id)
+		log.Info().Int("userid", id).Msg("Deleted store of missing user")
+		removed = append(removed, filepath.Base(stores.path(id)))
+	}
+
+	for jid, u := range users {
+		if stored[jid] || runningUsers[u.id] {
+			continue
+		}
+		deviceJid, ok := parseJID(jid)
+		if !ok {
+			continue
+		}
+		userContainer, err := deviceContainer(u.id)
+		if err != nil {
+			log.Error().Err(err).Int("userid", u.id).Msg("Could not open user store")
+			// Not knowing is no reason to clear the jid
+			stored[jid] = true
+			continue
+		}
+		device, err := userContainer.GetDevice(deviceJid)
+		if err != nil {
+			log.Error().Err(err).Int("userid", u.id).Msg("Could not get device from user store")
+			stored[jid] = true
+			continue
+		}
+		if device != nil {
+			stored[jid] = true
+		}
+		// Opened just for the check
+		if !sessions.running(u.id) {
+			stores.close(u.id)
+		}
+	}
+	return removed, nil
+}
+
+// Runs sweepDevices every -device-sweep
+func (s *server) deviceSweeper() {
+	if *deviceSweep <= 0 {
+		return
+	}
+	for {
+		time.Sleep(*deviceSweep)
+		if _, _, err := s.sweepDevices(); err != nil {
+			log.Error().Err(err).Msg("Could not sweep devices")
+		}
+	}
+}
+
+// Runs the device sweep now
+func (s *server) SweepDevices() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		removed, cleared, err := s.sweepDevices()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if removed == nil {
+			removed = []string{}
+		}
+		if cleared == nil {
+			cleared = []int{}
+		}
+		response := map[string]interface{}{"removed_devices": removed, "cleared_users": cleared}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
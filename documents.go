@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nfnt/resize"
+)
+
+// Largest side of the preview image of a document or video
+const thumbnailSize = 320
+
+// First pages of a big PDF take a while to render, don't hold the send
+const pdfRenderTimeout = 10 * time.Second
+
+// Longest document file name, what most filesystems take
+const documentMaxFileName = 255
+
+// File names are shown to the recipient and used to save the file, paths and
+// control characters are refused
+func validateDocumentFileName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("Missing FileName in Payload")
+	}
+	if len(name) > documentMaxFileName {
+		return fmt.Errorf("FileName is longer than %d bytes", documentMaxFileName)
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return errors.New("FileName can't be a path")
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f {
+			return errors.New("FileName can't contain control characters")
+		}
+	}
+	return nil
+}
+
+// Office formats by extension, Go only knows them from the system's
+// mime.types, which slim images don't have
+var documentMimetypes = map[string]string{
+	".doc":  "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xls":  "application/vnd.ms-excel",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".odp":  "application/vnd.oasis.opendocument.presentation",
+	".csv":  "text/csv",
+	".txt":  "text/plain",
+}
+
+// Mimetype of a document: the Mimetype field when given, else the sniffed
+// type. Office files sniff as zip and many formats as octet-stream, the file
+// name extension is more precise for those.
+func documentMimetype(data []byte, fileName string, override string) (string, error) {
+	if override != "" {
+		if _, _, err := mime.ParseMediaType(override); err != nil {
+			return "", fmt.Errorf("invalid Mimetype: %w", err)
+		}
+		return override, nil
+	}
+	sniffed := http.DetectContentType(data)
+	if sniffed == "application/octet-stream" || sniffed == "application/zip" || strings.HasPrefix(sniffed, "text/plain") {
+		ext := strings.ToLower(filepath.Ext(fileName))
+		if byName, ok := documentMimetypes[ext]; ok {
+			return byName, nil
+		}
+		if byName := mime.TypeByExtension(ext); byName != "" {
+			return byName, nil
+		}
+	}
+	return sniffed, nil
+}
+
+var pdfPagesCount = regexp.MustCompile(`/Type\s*/Pages\b[^>]*?/Count\s+(\d+)|/Count\s+(\d+)[^>]*?/Type\s*/Pages\b`)
+
+// Pages of a PDF from its page tree, the root has the highest count. 0 when
+// it can't be told, in PDFs keeping their objects in compressed streams.
+func pdfPageCount(data []byte) uint32 {
+	var pages uint64
+	for _, match := range pdfPagesCount.FindAllSubmatch(data, -1) {
+		count := match[1]
+		if count == nil {
+			count = match[2]
+		}
+		if n, err := strconv.ParseUint(string(count), 10, 32); err == nil && n > pages {
+			pages = n
+		}
+	}
+	return uint32(pages)
+}
+
+// JPEG preview of a document or video from an image, scaled to fit
+// thumbnailSize
+func mediaThumbnail(data []byte) ([]byte, uint32, uint32, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("could not decode thumbnail: %w", err)
+	}
+	scaled := resize.Thumbnail(thumbnailSize, thumbnailSize, img, resize.Lanczos3)
+	var thumbnail bytes.Buffer
+	if err := jpeg.Encode(&thumbnail, scaled, &jpeg.Options{Quality: 75}); err != nil {
+		return nil, 0, 0, err
+	}
+	return thumbnail.Bytes(), uint32(scaled.Bounds().Dx()), uint32(scaled.Bounds().Dy()), nil
+}
+
+// Thumbnail given with a document or video, a data URL or bare base64 of a
+// JPEG or PNG image
+func decodeThumbnail(encoded string) ([]byte, uint32, uint32, error) {
+	if strings.HasPrefix(encoded, "data:") {
+		_, data, found := strings.Cut(encoded, ",")
+		if !found {
+			return nil, 0, 0, errors.New("invalid ThumbnailBase64 data URL")
+		}
+		encoded = data
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, 0, 0, errors.New("could not decode ThumbnailBase64")
+	}
+	return mediaThumbnail(data)
+}
+
+// Renders the first page of a PDF as its preview card. Go can't render
+// PDFs, this needs pdftoppm from poppler installed, without it documents are
+// sent without preview.
+func pdfThumbnail(data []byte) ([]byte, uint32, uint32, error) {
+	pdftoppm, err := exec.LookPath("pdftoppm")
+	if err != nil {
+		return nil, 0, 0, errors.New("rendering PDF previews needs pdftoppm installed")
+	}
+	dir, err := os.MkdirTemp("", "wuzapi-pdf")
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "in.pdf")
+	if err := os.WriteFile(input, data, 0600); err != nil {
+		return nil, 0, 0, err
+	}
+	output := filepath.Join(dir, "page")
+	ctx, cancel := context.WithTimeout(context.Background(), pdfRenderTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, pdftoppm, "-q", "-png", "-f", "1", "-l", "1", "-singlefile",
+		"-scale-to", strconv.Itoa(thumbnailSize*2), input, output).CombinedOutput()
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("pdftoppm failed: %v %s", err, out)
+	}
+	page, err := os.ReadFile(output + ".png")
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return mediaThumbnail(page)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Names of the disappearing timers, as PUT /chat/ephemeral takes them
+var disappearingTimerNames = map[string]uint32{
+	"off": 0,
+	"24h": 24 * 60 * 60,
+	"7d":  7 * 24 * 60 * 60,
+	"90d": 90 * 24 * 60 * 60,
+}
+
+// Timer named by value, one of disappearingTimerNames or its seconds
+func parseDisappearingTimer(value string) (uint32, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if timer, ok := disappearingTimerNames[value]; ok {
+		return timer, nil
+	}
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		for _, timer := range disappearingTimers {
+			if uint32(seconds) == timer {
+				return timer, nil
+			}
+		}
+	}
+	return 0, errors.New("Invalid Duration, must be off, 24h, 7d or 90d")
+}
+
+// Name of a timer, its seconds when WhatsApp used one not offered here
+func disappearingTimerName(timer uint32) string {
+	for name, value := range disappearingTimerNames {
+		if value == timer {
+			return name
+		}
+	}
+	return strconv.FormatUint(uint64(timer), 10)
+}
+
+// Where the context info of a message goes, nil for kinds that have none
+func messageContextInfo(msg *waProto.Message) **waProto.ContextInfo {
+	if inner := msg.GetDocumentWithCaptionMessage().GetMessage(); inner != nil {
+		return messageContextInfo(inner)
+	}
+	switch {
+	case msg.ExtendedTextMessage != nil:
+		return &msg.ExtendedTextMessage.ContextInfo
+	case msg.ImageMessage != nil:
+		return &msg.ImageMessage.ContextInfo
+	case msg.VideoMessage != nil:
+		return &msg.VideoMessage.ContextInfo
+	case msg.AudioMessage != nil:
+		return &msg.AudioMessage.ContextInfo
+	case msg.DocumentMessage != nil:
+		return &msg.DocumentMessage.ContextInfo
+	case msg.StickerMessage != nil:
+		return &msg.StickerMessage.ContextInfo
+	case msg.LocationMessage != nil:
+		return &msg.LocationMessage.ContextInfo
+	case msg.ContactMessage != nil:
+		return &msg.ContactMessage.ContextInfo
+	}
+	return nil
+}
+
+// Timer of a chat as last seen, 0 when off or never seen. Groups aren't
+// kept, WhatsApp is asked for their timer.
+func storedChatTimer(db *sql.DB, userID int, chat types.JID) (uint32, error) {
+	var timer uint32
+	err := db.QueryRow("SELECT timer FROM chat_timers WHERE user_id=? AND jid=?", userID, chat.ToNonAD().String()).Scan(&timer)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return timer, err
+}
+
+// Keeps the timer of a contact's chat as of at, unless a newer one is known
+func recordChatTimer(db execer, userID int, chat types.JID, timer uint32, at time.Time) {
+	if chat.Server != types.DefaultUserServer {
+		return
+	}
+	_, err := execRetry(db, `INSERT INTO chat_timers (user_id, jid, timer, updated) VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id, jid) DO UPDATE SET timer=excluded.timer, updated=excluded.updated WHERE excluded.updated>=updated`,
+		userID, chat.ToNonAD().String(), timer, at.Unix())
+	if err != nil {
+		log.Error().Err(err).Str("chat", chat.String()).Msg("Could not record disappearing timer")
+	}
+}
+
+// Timer a message tells its chat has: the one a disappearing messages
+// setting changes to, or the one the message disappears after. False when
+// it tells nothing, messages of chats with it off carry no timer.
+func messageChatTimer(msg *waProto.Message) (uint32, bool) {
+	if protocol := msg.GetProtocolMessage(); protocol != nil {
+		if protocol.GetType() != waProto.ProtocolMessage_EPHEMERAL_SETTING {
+			return 0, false
+		}
+		return protocol.GetEphemeralExpiration(), true
+	}
+	if slot := messageContextInfo(msg); slot != nil && *slot != nil && (*slot).Expiration != nil {
+		return (*slot).GetExpiration(), true
+	}
+	return 0, false
+}
+
+// Learns the timer of a contact's chat from a message in it
+func (mycli *MyClient) learnChatTimer(evt *events.Message) {
+	if evt.Info.Chat.Server != types.DefaultUserServer {
+		return
+	}
+	if timer, ok := messageChatTimer(evt.Message); ok {
+		recordChatTimer(mycli.db, mycli.userID, evt.Info.Chat, timer, evt.Info.Timestamp)
+	}
+}
+
+// Disappearing timer of a chat: a group's as WhatsApp has it, a contact's
+// as last set through the API, from the phone or by the contact
+func chatTimer(db *sql.DB, client *whatsmeow.Client, userID int, chat types.JID) (uint32, error) {
+	if chat.Server != types.GroupServer {
+		return storedChatTimer(db, userID, chat)
+	}
+	info, err := client.GetGroupInfo(chat)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get group info: %v", err)
+	}
+	if !info.IsEphemeral {
+		return 0, nil
+	}
+	return info.DisappearingTimer, nil
+}
+
+// Timer a message sent with Ephemeral disappears after, the chat's. Refused
+// when the chat's messages don't disappear.
+func (s *server) ephemeralTimer(client *whatsmeow.Client, userID int, chat types.JID) (uint32, error) {
+	timer, err := chatTimer(s.db, client, userID, chat)
+	if err != nil {
+		return 0, err
+	}
+	if timer == 0 {
+		return 0, newAPIError(ErrInvalidParameter, "Disappearing messages are off in this chat, turn them on with PUT /chat/ephemeral first", map[string]interface{}{"JID": chat.String()})
+	}
+	return timer, nil
+}
+
+// Makes msg disappear after timer, nothing when it is 0
+func setMessageExpiration(msg *waProto.Message, timer uint32) {
+	slot := messageContextInfo(msg)
+	if timer == 0 || slot == nil {
+		return
+	}
+	if *slot == nil {
+		*slot = &waProto.ContextInfo{}
+	}
+	(*slot).Expiration = &timer
+}
+
+// Whether the account is an admin of the group, true when it isn't found
+// among the participants so WhatsApp gets to decide
+func groupAdmin(client *whatsmeow.Client, info *types.GroupInfo) bool {
+	if client.Store.ID == nil {
+		return true
+	}
+	for _, participant := range info.Participants {
+		if participant.JID.User == client.Store.ID.User {
+			return participant.IsAdmin || participant.IsSuperAdmin
+		}
+	}
+	return true
+}
+
+// Turns disappearing messages of a chat on or off. Duration is off, 24h, 7d
+// or 90d. In groups whose info only admins can edit (Locked) only they can
+// change it. Returns the timer applied, messages sent with Ephemeral then
+// disappear after it.
+func (s *server) SetChatEphemeral() http.HandlerFunc {
+
+	type ephemeralStruct struct {
+		Phone    string
+		Duration string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		var t ephemeralStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+		if t.Duration == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Duration in Payload"))
+			return
+		}
+		timer, err := parseDisappearingTimer(t.Duration)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		chat, err := resolveRecipient(client, "Phone", t.Phone)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		chat = chat.ToNonAD()
+		if chat.Server != types.DefaultUserServer && chat.Server != types.GroupServer {
+			s.Respond(w, r, http.StatusBadRequest, recipientError("Phone", errors.New("must be a contact or a group")))
+			return
+		}
+
+		if chat.Server == types.GroupServer {
+			info, err := client.GetGroupInfo(chat)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to get group info: %v", err)))
+				return
+			}
+			if info.IsLocked && !groupAdmin(client, info) {
+				s.Respond(w, r, http.StatusForbidden, newAPIError(ErrForbidden, "Only group admins can change the disappearing timer of this group", map[string]interface{}{"GroupJID": chat.String()}))
+				return
+			}
+		}
+		if err := client.SetDisappearingTimer(chat, time.Duration(timer)*time.Second); err != nil {
+			hlog.FromRequest(r).Error().Err(err).Str("chat", chat.String()).Msg("Failed to set disappearing timer")
+			if errors.Is(err, whatsmeow.ErrInvalidDisappearingTimer) {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid Duration, WhatsApp refused it"))
+				return
+			}
+			s.Respond(w, r, http.StatusInternalServerError, groupSettingsError(err, chat, "set disappearing timer"))
+			return
+		}
+		recordChatTimer(s.db, userid, chat, timer, time.Now())
+
+		response := map[string]interface{}{"Details": "Disappearing timer set", "JID": chat.String(), "Duration": disappearingTimerName(timer), "Timer": timer}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// Events waiting to be sent to Sentry, more are dropped
+	sentryQueueSize = 100
+	// Recent warnings and errors sent along with each event
+	sentryBreadcrumbs = 30
+	sentryTimeout     = 5 * time.Second
+)
+
+// Message panics are logged with. The log hook skips it, the panic is
+// reported on its own with the stack and tags.
+const panicLogMessage = "Panic recovered"
+
+// Sends events to Sentry's envelope endpoint, with -sentry-dsn. Events are
+// queued and posted by a single goroutine so reporting never blocks.
+type sentryReporter struct {
+	endpoint string
+	dsn      string
+	auth     string
+	server   string
+	client   *http.Client
+	events   chan map[string]interface{}
+	pending  sync.WaitGroup
+
+	mu          sync.Mutex
+	breadcrumbs []map[string]interface{}
+}
+
+// Set when -sentry-dsn is, nil otherwise
+var errorReports *sentryReporter
+
+// Endpoint and auth header of a DSN, https://key@host/path/project
+func parseSentryDSN(dsn string) (string, string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return "", "", errors.New("scheme must be https or http")
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return "", "", errors.New("missing public key")
+	}
+	path, project := "", strings.Trim(u.Path, "/")
+	if i := strings.LastIndex(project, "/"); i >= 0 {
+		path, project = "/"+project[:i], project[i+1:]
+	}
+	if project == "" {
+		return "", "", errors.New("missing project id")
+	}
+	endpoint := u.Scheme + "://" + u.Host + path + "/api/" + project + "/envelope/"
+	auth := "Sentry sentry_version=7, sentry_client=wuzapi/" + version + ", sentry_key=" + u.User.Username()
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+	return endpoint, auth, nil
+}
+
+// Starts reporting to -sentry-dsn and forwards error logs there
+func setupErrorReports() error {
+	if *sentryDSN == "" {
+		return nil
+	}
+	endpoint, auth, err := parseSentryDSN(*sentryDSN)
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	errorReports = &sentryReporter{
+		endpoint: endpoint,
+		dsn:      *sentryDSN,
+		auth:     auth,
+		server:   hostname,
+		client:   &http.Client{Timeout: sentryTimeout},
+		events:   make(chan map[string]interface{}, sentryQueueSize),
+	}
+	go errorReports.sender()
+	log = log.Hook(errorReports)
+	return nil
+}
+
+// zerolog hook: errors become events, warnings breadcrumbs of the next ones.
+// Only the message is seen, zerolog doesn't hand hooks the fields.
+func (rep *sentryReporter) Run(e *zerolog.Event, level zerolog.Level, msg string) {
+	if level < zerolog.WarnLevel || level == zerolog.NoLevel || msg == panicLogMessage {
+		return
+	}
+	if level == zerolog.WarnLevel {
+		rep.breadcrumb(msg, "warning")
+		return
+	}
+	rep.capture(sentryLevel(level), map[string]interface{}{"message": map[string]interface{}{"formatted": msg}}, nil)
+	rep.breadcrumb(msg, "error")
+	if level == zerolog.FatalLevel {
+		// The process exits right after
+		ctx, cancel := context.WithTimeout(context.Background(), sentryTimeout)
+		defer cancel()
+		rep.flush(ctx)
+	}
+}
+
+func sentryLevel(level zerolog.Level) string {
+	switch level {
+	case zerolog.FatalLevel, zerolog.PanicLevel:
+		return "fatal"
+	case zerolog.WarnLevel:
+		return "warning"
+	}
+	return "error"
+}
+
+func (rep *sentryReporter) breadcrumb(msg string, level string) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	rep.breadcrumbs = append(rep.breadcrumbs, map[string]interface{}{
+		"timestamp": float64(time.Now().UnixMilli()) / 1000,
+		"category":  "log",
+		"level":     level,
+		"message":   msg,
+	})
+	if len(rep.breadcrumbs) > sentryBreadcrumbs {
+		rep.breadcrumbs = rep.breadcrumbs[len(rep.breadcrumbs)-sentryBreadcrumbs:]
+	}
+}
+
+// Queues an event, dropped when the queue is full
+func (rep *sentryReporter) capture(level string, fields map[string]interface{}, tags map[string]string) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	event := map[string]interface{}{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   float64(time.Now().UnixMilli()) / 1000,
+		"level":       level,
+		"platform":    "go",
+		"logger":      "wuzapi",
+		"release":     "wuzapi@" + version,
+		"server_name": rep.server,
+	}
+	if len(tags) > 0 {
+		event["tags"] = tags
+	}
+	for key, value := range fields {
+		event[key] = value
+	}
+	rep.mu.Lock()
+	if len(rep.breadcrumbs) > 0 {
+		event["breadcrumbs"] = map[string]interface{}{"values": append([]map[string]interface{}(nil), rep.breadcrumbs...)}
+	}
+	rep.mu.Unlock()
+
+	rep.pending.Add(1)
+	select {
+	case rep.events <- event:
+	default:
+		rep.pending.Done()
+	}
+}
+
+func (rep *sentryReporter) sender() {
+	for event := range rep.events {
+		rep.send(event)
+		rep.pending.Done()
+	}
+}
+
+func (rep *sentryReporter) send(event map[string]interface{}) {
+	header, _ := json.Marshal(map[string]interface{}{"event_id": event["event_id"], "dsn": rep.dsn})
+	item, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	var body bytes.Buffer
+	body.Write(header)
+	body.WriteString("\n{\"type\":\"event\"}\n")
+	body.Write(item)
+	body.WriteString("\n")
+	req, err := http.NewRequest(http.MethodPost, rep.endpoint, &body)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", rep.auth)
+	resp, err := rep.client.Do(req)
+	if err != nil {
+		// Not through log, it would report itself
+		fmt.Fprintf(os.Stderr, "Could not send event to Sentry: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		fmt.Fprintf(os.Stderr, "Sentry refused event: %s\n", resp.Status)
+	}
+}
+
+// Waits for the queued events to be sent, up to ctx
+func (rep *sentryReporter) flush(ctx context.Context) bool {
+	if rep == nil {
+		return true
+	}
+	return waitGroupContext(ctx, &rep.pending)
+}
+
+// Sentry stack frames of the code that panicked, oldest call first
+func panicFrames() []map[string]interface{} {
+	pcs := make([]uintptr, 64)
+	// Skips runtime.Callers, panicFrames, reportPanic and the deferred func
+	n := runtime.Callers(4, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var stack []map[string]interface{}
+	for {
+		frame, more := frames.Next()
+		stack = append(stack, map[string]interface{}{
+			"function": frame.Function,
+			"abs_path": frame.File,
+			"lineno":   frame.Line,
+			"in_app":   strings.HasPrefix(frame.Function, "main."),
+		})
+		if !more {
+			break
+		}
+	}
+	for i, j := 0, len(stack)-1; i < j; i, j = i+1, j-1 {
+		stack[i], stack[j] = stack[j], stack[i]
+	}
+	return stack
+}
+
+// Logs a recovered panic with its stack and reports it to Sentry with tags.
+// Called from the deferred function that recovered it.
+func reportPanic(recovered interface{}, tags map[string]string) {
+	event := log.Error().Str("panic", fmt.Sprint(recovered)).Bytes("stack", debug.Stack())
+	for name, value := range tags {
+		event = event.Str(name, value)
+	}
+	event.Msg(panicLogMessage)
+	if errorReports == nil {
+		return
+	}
+	errorReports.capture("fatal", map[string]interface{}{
+		"exception": map[string]interface{}{"values": []interface{}{map[string]interface{}{
+			"type":       "panic",
+			"value":      fmt.Sprint(recovered),
+			"stacktrace": map[string]interface{}{"frames": panicFrames()},
+		}}},
+	}, tags)
+}
+
+// Path template of the route r matches in router, the path itself when none
+// does, so reports group requests by endpoint
+func routeTemplate(router *mux.Router, r *http.Request) string {
+	var match mux.RouteMatch
+	if router.Match(r, &match) && match.Route != nil {
+		if template, err := match.Route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return r.URL.Path
+}
+
+// Middleware: Answers 500 instead of dropping the connection when a handler
+// panics, and reports the panic with the route, user and request id. The
+// route is looked up in router, the one the handler was served from.
+func (s *server) recoverPanic(router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(accessUserKey{}).(*accessUser)
+		if !ok {
+			user = &accessUser{}
+			r = r.WithContext(context.WithValue(r.Context(), accessUserKey{}, user))
+		}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			reportPanic(recovered, map[string]string{"route": r.Method + " " + routeTemplate(router, r), "user_id": user.id, "request_id": requestIDFrom(r)})
+			s.Respond(w, r, http.StatusInternalServerError, newAPIError(ErrInternal, "Internal server error", nil))
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Keeps a panic in the handling of one event from taking down the client's
+// event loop: whatsmeow only logs it at the client's log level, often OFF
+func (mycli *MyClient) recoverEvent(rawEvt interface{}) {
+	if recovered := recover(); recovered != nil {
+		reportPanic(recovered, map[string]string{"user_id": strconv.Itoa(mycli.userID), "event": fmt.Sprintf("%T", rawEvt)})
+		globalHooks.send("UserError", mycli.userID, fmt.Sprintf("panic handling %T", rawEvt))
+	}
+}
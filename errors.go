@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Machine readable error codes returned in the "code" field of failed
+// responses. They are part of the API, don't rename them.
+const (
+	ErrInvalidToken        = "INVALID_TOKEN"
+	ErrExpired             = "EXPIRED"
+	ErrForbidden           = "FORBIDDEN"
+	ErrNotFound            = "NOT_FOUND"
+	ErrInvalidPayload      = "INVALID_PAYLOAD"
+	ErrMissingField        = "MISSING_FIELD"
+	ErrInvalidParameter    = "INVALID_PARAMETER"
+	ErrInvalidJID          = "INVALID_JID"
+	ErrInvalidMedia        = "INVALID_MEDIA"
+	ErrMediaExpired        = "MEDIA_EXPIRED"
+	ErrMediaDecryption     = "MEDIA_DECRYPTION_FAILED"
+	ErrSessionNotConnected = "SESSION_NOT_CONNECTED"
+	ErrSessionNotPaired    = "SESSION_NOT_PAIRED"
+	ErrAlreadyConnected    = "ALREADY_CONNECTED"
+	ErrAlreadyPaired       = "ALREADY_PAIRED"
+	ErrConflict            = "CONFLICT"
+	ErrPayloadTooLarge     = "PAYLOAD_TOO_LARGE"
+	ErrRateLimited         = "RATE_LIMITED"
+	ErrUpstreamFailed      = "UPSTREAM_SEND_FAILED"
+	ErrSendTimeout         = "SEND_TIMEOUT"
+	ErrRequestCanceled     = "REQUEST_CANCELED"
+	ErrDatabase            = "DATABASE_ERROR"
+	ErrInternal            = "INTERNAL_ERROR"
+)
+
+// HTTP status matching each code
+var errorStatus = map[string]int{
+	ErrInvalidToken:        http.StatusUnauthorized,
+	ErrExpired:             http.StatusForbidden,
+	ErrForbidden:           http.StatusForbidden,
+	ErrNotFound:            http.StatusNotFound,
+	ErrInvalidPayload:      http.StatusBadRequest,
+	ErrMissingField:        http.StatusBadRequest,
+	ErrInvalidParameter:    http.StatusBadRequest,
+	ErrInvalidJID:          http.StatusBadRequest,
+	ErrInvalidMedia:        http.StatusUnprocessableEntity,
+	ErrMediaExpired:        http.StatusGone,
+	ErrMediaDecryption:     http.StatusUnprocessableEntity,
+	ErrSessionNotConnected: http.StatusConflict,
+	ErrSessionNotPaired:    http.StatusConflict,
+	ErrAlreadyConnected:    http.StatusConflict,
+	ErrAlreadyPaired:       http.StatusConflict,
+	ErrConflict:            http.StatusConflict,
+	ErrPayloadTooLarge:     http.StatusRequestEntityTooLarge,
+	ErrRateLimited:         http.StatusTooManyRequests,
+	ErrUpstreamFailed:      http.StatusBadGateway,
+	ErrSendTimeout:         http.StatusGatewayTimeout,
+	ErrRequestCanceled:     statusClientClosedRequest,
+	ErrDatabase:            http.StatusInternalServerError,
+	ErrInternal:            http.StatusInternalServerError,
+}
+
+// Error carrying its code, status and optional details. Respond answers with
+// them whatever status the handler passed.
+type apiError struct {
+	Code    string
+	Status  int
+	Message string
+	Details map[string]interface{}
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// The status is the one of the code
+func newAPIError(code string, message string, details map[string]interface{}) *apiError {
+	return &apiError{Code: code, Status: errorStatus[code], Message: message, Details: details}
+}
+
+// Session errors most handlers share
+var (
+	errExpired      = newAPIError(ErrExpired, "Session expired", nil)
+	errNoSession    = newAPIError(ErrSessionNotConnected, "No session", nil)
+	errNotConnected = newAPIError(ErrSessionNotConnected, "Not connected", nil)
+	errNotLoggedIn  = newAPIError(ErrSessionNotPaired, "Not logged in", nil)
+)
+
+// Message patterns of plain errors, checked in order against the lowercased
+// message. They only pick the code among those of the status the handler
+// passed, never the status.
+var errorPatterns = []struct {
+	match string
+	code  string
+}{
+	{"unauthorized", ErrInvalidToken},
+	{"disabled", ErrForbidden},
+	// Upstream errors embed whatsmeow's message, match them before the rest
+	{"error sending", ErrUpstreamFailed},
+	{"rejected", ErrUpstreamFailed},
+	{"failed to upload", ErrUpstreamFailed},
+	{"failure", ErrUpstreamFailed},
+	{"not found", ErrNotFound},
+	{"no session", ErrSessionNotConnected},
+	{"not connected", ErrSessionNotConnected},
+	{"failed to connect", ErrSessionNotConnected},
+	{"not logged in", ErrSessionNotPaired},
+	{"no paired device", ErrSessionNotPaired},
+	{"already connected", ErrAlreadyConnected},
+	{"already paired", ErrAlreadyPaired},
+	{"already loggedin", ErrAlreadyPaired},
+	{"already exists", ErrConflict},
+	{"could not decode payload", ErrInvalidPayload},
+	{"incomplete data", ErrMissingField},
+	{"missing", ErrMissingField},
+	{"cannot be empty", ErrMissingField},
+	{"parse phone", ErrInvalidJID},
+	{"parse group jid", ErrInvalidJID},
+	{"invalid jid", ErrInvalidJID},
+	{"data should start with", ErrInvalidMedia},
+	{"could not decode base64", ErrInvalidMedia},
+	{"sticker", ErrInvalidMedia},
+	{"too large", ErrPayloadTooLarge},
+	{"rate limit", ErrRateLimited},
+	{"quota", ErrRateLimited},
+	{"accessing db", ErrDatabase},
+	{"accessing store db", ErrDatabase},
+	{"invalid", ErrInvalidParameter},
+}
+
+// Works out the code and status for an error. Typed errors carry both, as do
+// whatsmeow's session errors. Plain errors keep the status the handler asked
+// for, with the code going with it.
+func classifyError(err error, status int) (string, int, map[string]interface{}) {
+	var e *apiError
+	if errors.As(err, &e) {
+		if e.Status == 0 {
+			return e.Code, errorStatus[e.Code], e.Details
+		}
+		return e.Code, e.Status, e.Details
+	}
+	switch {
+	case errors.Is(err, whatsmeow.ErrNotConnected):
+		return ErrSessionNotConnected, errorStatus[ErrSessionNotConnected], nil
+	case errors.Is(err, whatsmeow.ErrNotLoggedIn):
+		return ErrSessionNotPaired, errorStatus[ErrSessionNotPaired], nil
+	}
+	// Errors never answer with a success status
+	if status < http.StatusBadRequest {
+		status = http.StatusInternalServerError
+	}
+	message := strings.ToLower(err.Error())
+	for _, pattern := range errorPatterns {
+		if errorStatus[pattern.code] == status && strings.Contains(message, pattern.match) {
+			return pattern.code, status, nil
+		}
+	}
+	switch {
+	case status == http.StatusUnauthorized:
+		return ErrInvalidToken, status, nil
+	case status == http.StatusForbidden:
+		return ErrForbidden, status, nil
+	case status == http.StatusNotFound:
+		return ErrNotFound, status, nil
+	case status == http.StatusConflict:
+		return ErrConflict, status, nil
+	case status == http.StatusRequestEntityTooLarge:
+		return ErrPayloadTooLarge, status, nil
+	case status == http.StatusTooManyRequests:
+		return ErrRateLimited, status, nil
+	case status == http.StatusBadGateway:
+		return ErrUpstreamFailed, status, nil
+	case status == http.StatusGatewayTimeout:
+		return ErrSendTimeout, status, nil
+	case status < http.StatusInternalServerError:
+		return ErrInvalidParameter, status, nil
+	}
+	return ErrInternal, status, nil
+}
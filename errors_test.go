@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.mau.fi/whatsmeow"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+		want   int
+	}{
+		{"typed error wins over the handler's status", errNoSession, http.StatusInternalServerError, ErrSessionNotConnected, http.StatusConflict},
+		{"typed error with its code's status", newAPIError(ErrInvalidMedia, "bad image", nil), http.StatusBadRequest, ErrInvalidMedia, http.StatusUnprocessableEntity},
+		{"typed error with its own status", &apiError{Code: ErrInternal, Status: http.StatusServiceUnavailable, Message: "later"}, http.StatusInternalServerError, ErrInternal, http.StatusServiceUnavailable},
+		{"wrapped typed error", fmt.Errorf("sending: %w", errNotLoggedIn), http.StatusInternalServerError, ErrSessionNotPaired, http.StatusConflict},
+		{"upstream send", sendError(context.Background(), "Error sending message", errors.New("server returned error 479")), http.StatusInternalServerError, ErrUpstreamFailed, http.StatusBadGateway},
+		{"whatsmeow not connected", fmt.Errorf("failed: %w", whatsmeow.ErrNotConnected), http.StatusInternalServerError, ErrSessionNotConnected, http.StatusConflict},
+		{"whatsmeow not logged in", whatsmeow.ErrNotLoggedIn, http.StatusInternalServerError, ErrSessionNotPaired, http.StatusConflict},
+		{"finer code of the same status", errors.New("Problem accessing DB"), http.StatusInternalServerError, ErrDatabase, http.StatusInternalServerError},
+		{"missing field", errors.New("Missing Phone in Payload"), http.StatusBadRequest, ErrMissingField, http.StatusBadRequest},
+		{"bad json", errors.New("Could not decode Payload"), http.StatusBadRequest, ErrInvalidPayload, http.StatusBadRequest},
+		{"bad phone", errors.New("Could not parse Phone"), http.StatusBadRequest, ErrInvalidJID, http.StatusBadRequest},
+		{"message never changes the status", errors.New("Group not found"), http.StatusInternalServerError, ErrInternal, http.StatusInternalServerError},
+		{"message of another status is ignored", errors.New("Already connected"), http.StatusBadRequest, ErrInvalidParameter, http.StatusBadRequest},
+		{"401", errors.New("nope"), http.StatusUnauthorized, ErrInvalidToken, http.StatusUnauthorized},
+		{"403", errors.New("nope"), http.StatusForbidden, ErrForbidden, http.StatusForbidden},
+		{"404", errors.New("nope"), http.StatusNotFound, ErrNotFound, http.StatusNotFound},
+		{"409", errors.New("nope"), http.StatusConflict, ErrConflict, http.StatusConflict},
+		{"413", errors.New("nope"), http.StatusRequestEntityTooLarge, ErrPayloadTooLarge, http.StatusRequestEntityTooLarge},
+		{"422", errors.New("nope"), http.StatusUnprocessableEntity, ErrInvalidParameter, http.StatusUnprocessableEntity},
+		{"429", errors.New("nope"), http.StatusTooManyRequests, ErrRateLimited, http.StatusTooManyRequests},
+		{"502", errors.New("nope"), http.StatusBadGateway, ErrUpstreamFailed, http.StatusBadGateway},
+		{"504", errors.New("nope"), http.StatusGatewayTimeout, ErrSendTimeout, http.StatusGatewayTimeout},
+		{"500", errors.New("nope"), http.StatusInternalServerError, ErrInternal, http.StatusInternalServerError},
+		{"success status for an error", errors.New("nope"), http.StatusOK, ErrInternal, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		code, status, _ := classifyError(tt.err, tt.status)
+		if code != tt.code || status != tt.want {
+			t.Errorf("%s: got %s %d, want %s %d", tt.name, code, status, tt.code, tt.want)
+		}
+	}
+}
+
+func TestErrorCodesHaveStatus(t *testing.T) {
+	for _, code := range []string{ErrInvalidToken, ErrExpired, ErrForbidden, ErrNotFound, ErrInvalidPayload, ErrMissingField, ErrInvalidParameter, ErrInvalidJID, ErrInvalidMedia, ErrMediaExpired, ErrMediaDecryption, ErrSessionNotConnected, ErrSessionNotPaired, ErrAlreadyConnected, ErrAlreadyPaired, ErrConflict, ErrPayloadTooLarge, ErrRateLimited, ErrUpstreamFailed, ErrSendTimeout, ErrRequestCanceled, ErrDatabase, ErrInternal} {
+		if errorStatus[code] < 400 {
+			t.Errorf("%s has no error status", code)
+		}
+	}
+}
+
+func TestRespondErrorEnvelope(t *testing.T) {
+	s := &server{}
+	w := httptest.NewRecorder()
+	s.Respond(w, httptest.NewRequest("GET", "/session/status", nil), http.StatusInternalServerError, newAPIError(ErrInvalidJID, "Invalid Phone: bad", map[string]interface{}{"field": "Phone"}))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", w.Code)
+	}
+	var body struct {
+		Success bool
+		Code    string
+		Status  int
+		Error   string
+		Details map[string]interface{}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Success || body.Code != ErrInvalidJID || body.Status != http.StatusBadRequest || body.Error != "Invalid Phone: bad" || body.Details["field"] != "Phone" {
+		t.Errorf("unexpected envelope %s", w.Body)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Failed posts in a row after which a user's webhook is reported failing
+const webhookFailingAfter = 5
+
+// Operator's webhook for instance events of all users, -globalwebhook or as
+// set through the admin API. Only lifecycle and operational events go there,
+// never anything from a message or chat.
+type globalWebhook struct {
+	url   atomic.Value // string
+	db    *sql.DB
+	queue *webhookQueue
+}
+
+// Set up by startGlobalWebhook, events before that are dropped
+var globalHooks *globalWebhook
+
+// Starts the global webhook's queue, its posts go the way users' webhooks do
+func startGlobalWebhook(db *sql.DB) *globalWebhook {
+	g := &globalWebhook{db: db, queue: newWebhookQueue(0, newWebhookClient())}
+	g.url.Store(*globalWebhookURL)
+	globalHooks = g
+	return g
+}
+
+func (g *globalWebhook) target() string {
+	if g == nil {
+		return ""
+	}
+	return g.url.Load().(string)
+}
+
+// Queues an event about a user for the global webhook, nothing when none is
+// set. reason is left out when empty.
+func (g *globalWebhook) send(event string, userID int, reason string) {
+	target := g.target()
+	if target == "" {
+		return
+	}
+	var name, jid string
+	if err := g.db.QueryRow("SELECT name, jid FROM users WHERE id=?", userID).Scan(&name, &jid); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Warn().Err(err).Str("userid", strconv.Itoa(userID)).Msg("Could not get user for global webhook")
+	}
+	payload := map[string]interface{}{"event": event, "userId": userID, "name": name, "jid": jid, "timestamp": time.Now().Unix()}
+	if reason != "" {
+		payload["reason"] = reason
+	}
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		log.Error().Err(err).Str("event", event).Msg("Could not encode global webhook event")
+		return
+	}
+	g.queue.enqueue(webhookJob{url: target, data: map[string]string{"jsonData": string(jsonData)}, event: event})
+}
+
+// Tells the global webhook when a user's webhook starts failing, after
+// webhookFailingAfter posts in a row, and when it works again
+func (q *webhookQueue) trackFailures(err error) {
+	if err == nil {
+		if q.failures.Swap(0) >= webhookFailingAfter {
+			globalHooks.send("WebhookRecovered", q.userID, "")
+		}
+		return
+	}
+	if q.failures.Add(1) == webhookFailingAfter {
+		globalHooks.send("WebhookFailing", q.userID, fmt.Sprintf("%d posts failed in a row, last: %v", webhookFailingAfter, err))
+	}
+}
+
+// Shows the global webhook URL, empty when there is none
+func (s *server) GetGlobalWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := map[string]interface{}{"URL": globalHooks.target()}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Changes the global webhook URL, empty turns it off. Kept in memory only, a
+// restart goes back to -globalwebhook.
+func (s *server) SetGlobalWebhook() http.HandlerFunc {
+
+	type globalWebhookStruct struct {
+		URL *string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		var t globalWebhookStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+		if t.URL == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing URL in Payload"))
+			return
+		}
+		if err := validateWebhookURL(*t.URL); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("Invalid URL: %v", err))
+			return
+		}
+		globalHooks.url.Store(*t.URL)
+		log.Info().Str("url", redactURL(*t.URL)).Msg("Global webhook changed")
+
+		response := map[string]interface{}{"Details": "Global webhook updated", "URL": *t.URL}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
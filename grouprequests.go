@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/whatsmeow"
+	waBinary "go.mau.fi/whatsmeow/binary"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Most requests POST /group/requests answers at once
+const groupRequestsBatch = 50
+
+// A pending request to join a group that approves new members. Method is how
+// the requester came, invite_link usually.
+type groupJoinRequest struct {
+	JID         string
+	RequestedAt int64
+	Method      string
+}
+
+// Outcome of approving or rejecting one request: approved, rejected, stale
+// when it wasn't pending anymore, answered elsewhere or withdrawn, or failed
+// with the error code WhatsApp gave
+type groupRequestResult struct {
+	JID    string
+	Status string
+	Error  int `json:",omitempty"`
+}
+
+// Error for a join request query WhatsApp refused, 403 when the user isn't
+// an admin of the group
+func groupRequestsError(err error, group types.JID, action string) error {
+	if errors.Is(err, whatsmeow.ErrIQForbidden) || errors.Is(err, whatsmeow.ErrIQNotAuthorized) {
+		return newAPIError(ErrForbidden, "Only group admins can see and answer join requests", map[string]interface{}{"GroupJID": group.String()})
+	}
+	return fmt.Errorf("Failed to %s: %v", action, err)
+}
+
+// Pending join requests of a group. whatsmeow's GetGroupRequestParticipants
+// drops the request time, the query is the same.
+func fetchGroupJoinRequests(client *whatsmeow.Client, group types.JID) ([]groupJoinRequest, error) {
+	resp, err := client.DangerousInternals().SendIQ(whatsmeow.DangerousInfoQuery{
+		Type:      "get",
+		To:        group,
+		Namespace: "w:g2",
+		Content:   []waBinary.Node{{Tag: "membership_approval_requests"}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	node, ok := resp.GetOptionalChildByTag("membership_approval_requests")
+	if !ok {
+		return nil, errors.New("no membership_approval_requests in the response")
+	}
+	requests := []groupJoinRequest{}
+	for _, child := range node.GetChildrenByTag("membership_approval_request") {
+		ag := child.AttrGetter()
+		jid, ok := ag.GetJID("jid", true)
+		if !ok {
+			continue
+		}
+		requests = append(requests, groupJoinRequest{
+			JID:         jid.String(),
+			RequestedAt: ag.OptionalUnixTime("request_time").Unix(),
+			Method:      ag.OptionalString("request_method"),
+		})
+	}
+	return requests, nil
+}
+
+// Pending requests to join the group in ?groupJID=, oldest first as WhatsApp
+// lists them
+func (s *server) GetGroupRequests() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		groupJID := r.URL.Query().Get("groupJID")
+		if groupJID == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing groupJID parameter"))
+			return
+		}
+		group, err := parseGroupJID("GroupJID", groupJID)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		requests, err := fetchGroupJoinRequests(client, group)
+		if err != nil {
+			hlog.FromRequest(r).Error().Err(err).Msg("Failed to get group join requests")
+			s.Respond(w, r, http.StatusInternalServerError, groupRequestsError(err, group, "get join requests"))
+			return
+		}
+		response := map[string]interface{}{"GroupJID": group.String(), "Requests": requests}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Approves or rejects requests to join a group, with one result per JID in
+// the order given. Requests not pending anymore are stale and don't fail the
+// others.
+func (s *server) UpdateGroupRequests() http.HandlerFunc {
+
+	type updateGroupRequestsStruct struct {
+		GroupJID string
+		Action   string
+		JIDs     []string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		var t updateGroupRequestsStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+		group, err := parseGroupJID("GroupJID", t.GroupJID)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		var action whatsmeow.ParticipantRequestChange
+		var done string
+		switch t.Action {
+		case "approve":
+			action, done = whatsmeow.ParticipantChangeApprove, "approved"
+		case "reject":
+			action, done = whatsmeow.ParticipantChangeReject, "rejected"
+		case "":
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Action in Payload"))
+			return
+		default:
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid Action, must be approve or reject"))
+			return
+		}
+		if len(t.JIDs) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing JIDs in Payload"))
+			return
+		}
+		if len(t.JIDs) > groupRequestsBatch {
+			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("Too many JIDs, at most %d", groupRequestsBatch))
+			return
+		}
+		keys := make([]string, len(t.JIDs))
+		for i, value := range t.JIDs {
+			jid, err := parseRecipient(value)
+			if err != nil && strings.HasSuffix(value, "@"+types.HiddenUserServer) {
+				// Requesters may be known by their LID only
+				jid, err = types.ParseJID(strings.TrimSpace(value))
+			}
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, recipientError("JIDs", fmt.Errorf("%s, %v", value, err)))
+				return
+			}
+			keys[i] = recipientKey(jid)
+		}
+
+		// Only pending requests are sent, the others were answered elsewhere
+		// or withdrawn
+		requests, err := fetchGroupJoinRequests(client, group)
+		if err != nil {
+			hlog.FromRequest(r).Error().Err(err).Msg("Failed to get group join requests")
+			s.Respond(w, r, http.StatusInternalServerError, groupRequestsError(err, group, "get join requests"))
+			return
+		}
+		pending := make(map[string]types.JID)
+		for _, request := range requests {
+			if jid, err := types.ParseJID(request.JID); err == nil {
+				pending[recipientKey(jid)] = jid
+			}
+		}
+		var answer []types.JID
+		for _, key := range keys {
+			if jid, ok := pending[key]; ok {
+				answer = append(answer, jid)
+				delete(pending, key)
+			}
+		}
+
+		outcomes := make(map[string]types.GroupParticipant)
+		if len(answer) > 0 {
+			participants, err := client.UpdateGroupRequestParticipants(group, answer, action)
+			if err != nil {
+				hlog.FromRequest(r).Error().Err(err).Msg("Failed to update group join requests")
+				s.Respond(w, r, http.StatusInternalServerError, groupRequestsError(err, group, t.Action+" join requests"))
+				return
+			}
+			for _, participant := range participants {
+				outcomes[recipientKey(participant.JID)] = participant
+			}
+		}
+
+		results := make([]groupRequestResult, len(t.JIDs))
+		for i, key := range keys {
+			results[i] = groupRequestResult{JID: t.JIDs[i], Status: "stale"}
+			participant, ok := outcomes[key]
+			switch {
+			case !ok:
+			case participant.Error == 0:
+				results[i].Status = done
+			case participant.Error == 404:
+				// Answered in between
+			default:
+				results[i].Status = "failed"
+				results[i].Error = participant.Error
+			}
+		}
+		response := map[string]interface{}{"GroupJID": group.String(), "Action": t.Action, "Results": results}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Sends a GroupJoinRequest event for requests to join a group the user
+// admins: created when someone asks, revoked when they withdraw and rejected
+// when an admin turns them down, sender then. Approved requesters show up as
+// joining.
+func (mycli *MyClient) dispatchJoinRequests(evt *events.GroupInfo) {
+	requested := func(action string, requester types.JID, method string) {
+		pn, _ := lids.forms(requester)
+		postmap := map[string]interface{}{"type": "GroupJoinRequest", "event": evt, "group": evt.JID.String(), "action": action, "requester": requester.ToNonAD().String(), "requesterPn": pn, "method": method}
+		if evt.Sender != nil && action == "rejected" {
+			addSender(postmap, *evt.Sender)
+		}
+		log.Info().Str("group", evt.JID.String()).Str("requester", requester.String()).Str("action", action).Msg("Group join request")
+		mycli.dispatchEvent(postmap, "")
+	}
+	for _, change := range evt.UnknownChanges {
+		ag := change.AttrGetter()
+		switch change.Tag {
+		case "created_membership_requests":
+			// The requester is who sent the notification
+			if evt.Sender != nil {
+				requested("created", *evt.Sender, ag.OptionalString("request_method"))
+			}
+		case "revoked_membership_requests":
+			for _, participant := range change.GetChildrenByTag("participant") {
+				requester, ok := participant.Attrs["jid"].(types.JID)
+				if !ok {
+					continue
+				}
+				action := "rejected"
+				if evt.Sender != nil && evt.Sender.ToNonAD() == requester.ToNonAD() {
+					action = "revoked"
+				}
+				requested(action, requester, "")
+			}
+		}
+	}
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"path/filepath"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -18,11 +20,15 @@ import (
 
 	"github.com/nfnt/resize"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/hlog"
 	"github.com/patrickmn/go-cache"
 	"github.com/vincent-petithory/dataurl"
 	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/appstate"
 	waProto "go.mau.fi/whatsmeow/binary/proto"
 	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -34,12 +40,36 @@ func (v Values) Get(key string) string {
 	return v.m[key]
 }
 
-var messageTypes = []string{"Message", "ReadReceipt", "Presence", "HistorySync", "ChatPresence", "All"}
+// Copy of v with key set, v itself is left alone
+func (v Values) with(key string, value string) Values {
+	m := make(map[string]string, len(v.m)+1)
+	for k, val := range v.m {
+		m[k] = val
+	}
+	m[key] = value
+	return Values{m}
+}
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = 30 * time.Second
+)
+
+var messageTypes = []string{"Message", "Receipt", "ReadReceipt", "Presence", "HistorySync", "ChatPresence", "QR", "PairSuccess", "LoggedOut", "SessionReplaced", "Connected", "Disconnected", "Reconnecting", "Reconnected", "CallOffer", "CallAccept", "CallTerminate", "NewsletterMessage", "GroupAnnounceChanged", "GroupLockedChanged", "GroupEphemeralChanged", "GroupJoinRequest", "ChatArchiveChanged", "ChatPinChanged", "ChatMuteChanged", "MessageStarChanged", "ContactChanged", "All"}
+
+// Event types sent by the /session/events stream
+var sessionEventTypes = []string{"QR", "PairSuccess", "LoggedOut", "SessionReplaced", "Connected", "Disconnected", "Reconnecting", "Reconnected"}
 
 func (s *server) authadmin(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        token := r.Header.Get("Authorization")
-        if token != *adminToken {
+        // As user routes take it, or the bare token in Authorization as
+        // older clients send it
+        token := requestToken(r)
+        if token == "" {
+            token = r.Header.Get("Authorization")
+        }
+        if *adminToken == "" || !tokensEqual(token, *adminToken) {
 			s.Respond(w, r, http.StatusUnauthorized, errors.New("Unauthorized"))
             return
         }
@@ -50,56 +80,21 @@ func (s *server) authadmin(next http.Handler) http.Handler {
 func (s *server) authalice(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		var ctx context.Context
-		userid := 0
-		txtid := ""
-		webhook := ""
-		jid := ""
-		events := ""
-
-		// Get token from headers or uri parameters
-		token := r.Header.Get("token")
-		if token == "" {
-			token = strings.Join(r.URL.Query()["token"], "")
+		myuserinfo, found, err := s.lookupUser(r.Context(), requestToken(r))
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
 		}
-
-		myuserinfo, found := userinfocache.Get(token)
 		if !found {
-			log.Info().Msg("Looking for user information in DB")
-			// Checks DB from matching user and store user values in context
-			rows, err := s.db.Query("SELECT id,webhook,jid,events FROM users WHERE token=? LIMIT 1", token)
-			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, err)
-				return
-			}
-			defer rows.Close()
-			for rows.Next() {
-				err = rows.Scan(&txtid, &webhook, &jid, &events)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, err)
-					return
-				}
-				userid, _ = strconv.Atoi(txtid)
-				v := Values{map[string]string{
-					"Id":      txtid,
-					"Jid":     jid,
-					"Webhook": webhook,
-					"Token":   token,
-					"Events":  events,
-				}}
-
-				userinfocache.Set(token, v, cache.NoExpiration)
-				ctx = context.WithValue(r.Context(), "userinfo", v)
-			}
-		} else {
-			ctx = context.WithValue(r.Context(), "userinfo", myuserinfo)
-			userid, _ = strconv.Atoi(myuserinfo.(Values).Get("Id"))
-		}
-
-		if userid == 0 {
 			s.Respond(w, r, http.StatusUnauthorized, errors.New("Unauthorized"))
 			return
 		}
+		if s.checkExpired(myuserinfo) {
+			s.Respond(w, r, http.StatusForbidden, errExpired)
+			return
+		}
+		setAccessUser(r, myuserinfo.Get("Id"))
+		ctx := context.WithValue(r.Context(), "userinfo", myuserinfo)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -108,60 +103,102 @@ func (s *server) authalice(next http.Handler) http.Handler {
 func (s *server) auth(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		var ctx context.Context
-		userid := 0
-		txtid := ""
-		webhook := ""
-		jid := ""
-		events := ""
-
-		// Get token from headers or uri parameters
-		token := r.Header.Get("token")
-		if token == "" {
-			token = strings.Join(r.URL.Query()["token"], "")
+		myuserinfo, found, err := s.lookupUser(r.Context(), requestToken(r))
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
 		}
-
-		myuserinfo, found := userinfocache.Get(token)
 		if !found {
-			log.Info().Msg("Looking for user information in DB")
-			// Checks DB from matching user and store user values in context
-			rows, err := s.db.Query("SELECT id,webhook,jid,events FROM users WHERE token=? LIMIT 1", token)
-			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, err)
-				return
-			}
-			defer rows.Close()
-			for rows.Next() {
-				err = rows.Scan(&txtid, &webhook, &jid, &events)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, err)
-					return
-				}
-				userid, _ = strconv.Atoi(txtid)
-				v := Values{map[string]string{
-					"Id":      txtid,
-					"Jid":     jid,
-					"Webhook": webhook,
-					"Token":   token,
-					"Events":  events,
-				}}
-
-				userinfocache.Set(token, v, cache.NoExpiration)
-				ctx = context.WithValue(r.Context(), "userinfo", v)
-			}
-		} else {
-			ctx = context.WithValue(r.Context(), "userinfo", myuserinfo)
-			userid, _ = strconv.Atoi(myuserinfo.(Values).Get("Id"))
-		}
-
-		if userid == 0 {
 			s.Respond(w, r, http.StatusUnauthorized, errors.New("Unauthorized"))
 			return
 		}
+		if s.checkExpired(myuserinfo) {
+			s.Respond(w, r, http.StatusForbidden, errExpired)
+			return
+		}
+		setAccessUser(r, myuserinfo.Get("Id"))
+		ctx := context.WithValue(r.Context(), "userinfo", myuserinfo)
 		handler(w, r.WithContext(ctx))
 	}
 }
 
+// Tells whether the user's expiration (unix timestamp, 0 means never) has
+// passed, in which case its session is stopped
+func (s *server) checkExpired(v Values) bool {
+	expiration, _ := strconv.ParseInt(v.Get("Expiration"), 10, 64)
+	if expiration <= 0 || time.Now().Unix() < expiration {
+		return false
+	}
+	userid, _ := strconv.Atoi(v.Get("Id"))
+	s.killExpired(userid)
+	return true
+}
+
+// Finds the user for a token, in cache or else in the DB. Runs under the
+// token read lock so it cannot interleave with a token change
+func (s *server) lookupUser(ctx context.Context, token string) (Values, bool, error) {
+	tokenLock.RLock()
+	defer tokenLock.RUnlock()
+
+	if token == "" {
+		return Values{}, false, nil
+	}
+
+	ctx, sp := startSpan(ctx, "auth.lookup_user", spanInternal)
+	defer sp.finish(nil)
+
+	// The cache and the DB index find the candidate, the final check is in
+	// constant time. The token itself is never logged.
+	myuserinfo, found := userinfocache.Get(token)
+	if found {
+		sp.setString("wuzapi.token_cache", "hit")
+		v := myuserinfo.(Values)
+		return v, tokensEqual(v.Get("Token"), token), nil
+	}
+
+	sp.setString("wuzapi.token_cache", "miss")
+	log.Info().Msg("Looking for user information in DB")
+	// Checks DB from matching user and store user values in context
+	txtid := ""
+	webhook := ""
+	jid := ""
+	events := ""
+	var expiration sql.NullInt64
+	storeMessages := 0
+	payloadFormat := ""
+	contactNames := 0
+	webhookHeaders := ""
+	webhookTimeout := 0
+	webhookGzip := 0
+	var dbToken string
+	err := s.db.QueryRowContext(ctx, "SELECT id,token,webhook,jid,events,expiration,store_messages,payload_format,contact_names,webhook_headers,webhook_timeout,webhook_gzip FROM users WHERE token=? LIMIT 1", token).Scan(&txtid, &dbToken, &webhook, &jid, &events, &expiration, &storeMessages, &payloadFormat, &contactNames, &webhookHeaders, &webhookTimeout, &webhookGzip)
+	if err == sql.ErrNoRows {
+		return Values{}, false, nil
+	}
+	if err != nil {
+		return Values{}, false, err
+	}
+	if !tokensEqual(dbToken, token) {
+		return Values{}, false, nil
+	}
+	v := Values{map[string]string{
+		"Id":            txtid,
+		"Jid":           jid,
+		"Webhook":       webhook,
+		"Token":         token,
+		"Events":        events,
+		"Expiration":    strconv.FormatInt(expiration.Int64, 10),
+		"StoreMessages": strconv.Itoa(storeMessages),
+		"PayloadFormat": payloadFormat,
+		"ContactNames":  strconv.Itoa(contactNames),
+		"WebhookHeaders": webhookHeaders,
+		"WebhookTimeout": strconv.Itoa(webhookTimeout),
+		"WebhookGzip":    strconv.Itoa(webhookGzip),
+	}}
+	userinfocache.Set(token, v, cache.NoExpiration)
+	return v, true, nil
+}
+
 // Connects to Whatsapp Servers
 func (s *server) Connect() http.HandlerFunc {
 
@@ -178,6 +215,7 @@ func (s *server) Connect() http.HandlerFunc {
 		token := r.Context().Value("userinfo").(Values).Get("Token")
 		userid, _ := strconv.Atoi(txtid)
 		eventstring := ""
+		state, code := "connecting", ""
 
 		// Decodes request BODY looking for events to subscribe
 		decoder := json.NewDecoder(r.Body)
@@ -188,8 +226,12 @@ func (s *server) Connect() http.HandlerFunc {
 			return
 		}
 
-		if clientPointer[userid] != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Already Connected"))
+		if sessions.closing() {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Server is shutting down"))
+			return
+		}
+		if sessions.running(userid) {
+			s.Respond(w, r, http.StatusConflict, newAPIError(ErrAlreadyConnected, "Already Connected", nil))
 			return
 		} else {
 
@@ -201,7 +243,7 @@ func (s *server) Connect() http.HandlerFunc {
 			} else {
 				for _, arg := range t.Subscribe {
 					if !Find(messageTypes, arg) {
-						log.Warn().Str("Type", arg).Msg("Message type discarded")
+						hlog.FromRequest(r).Warn().Str("Type", arg).Msg("Message type discarded")
 						continue
 					}
 					if !Find(subscribedEvents, arg) {
@@ -210,35 +252,42 @@ func (s *server) Connect() http.HandlerFunc {
 				}
 			}
 			eventstring = strings.Join(subscribedEvents, ",")
-			_, err = s.db.Exec("UPDATE users SET events=? WHERE id=?", eventstring, userid)
+			_, err = execRetry(s.db, "UPDATE users SET events=? WHERE id=?", eventstring, userid)
 			if err != nil {
-				log.Warn().Msg("Could not set events in users table")
+				hlog.FromRequest(r).Warn().Msg("Could not set events in users table")
 			}
-			log.Info().Str("events", eventstring).Msg("Setting subscribed events")
+			hlog.FromRequest(r).Info().Str("events", eventstring).Msg("Setting subscribed events")
 			v := updateUserInfo(r.Context().Value("userinfo"), "Events", eventstring)
 			userinfocache.Set(token, v, cache.NoExpiration)
 
-			log.Info().Str("jid", jid).Msg("Attempt to connect")
-			killchannel[userid] = make(chan bool)
-			go s.startClient(userid, jid, token, subscribedEvents)
+			hlog.FromRequest(r).Info().Str("jid", jid).Msg("Attempt to connect")
+			sess := s.startSession(userid, jid, token, subscribedEvents)
+			if sess == nil {
+				s.Respond(w, r, http.StatusConflict, newAPIError(ErrAlreadyConnected, "Already Connected", nil))
+				return
+			}
 
 			if t.Immediate == false {
-				log.Warn().Msg("Waiting 10 seconds")
-				time.Sleep(10000 * time.Millisecond)
-
-				if clientPointer[userid] != nil {
-					if !clientPointer[userid].IsConnected() {
-						s.Respond(w, r, http.StatusInternalServerError, errors.New("Failed to Connect"))
-						return
-					}
-				} else {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New("Failed to Connect"))
+				hlog.FromRequest(r).Info().Dur("timeout", connectWait).Msg("Waiting for login or QR code")
+				state, code, err = awaitConnect(sess, userid, connectWait)
+				if err != nil {
+					s.Respond(w, r, http.StatusInternalServerError, err)
 					return
 				}
 			}
 		}
 
-		response := map[string]interface{}{"webhook": webhook, "jid": jid, "events": eventstring, "details": "Connected!"}
+		// Later QR codes come as QR events, on the webhook and /session/events
+		response := map[string]interface{}{"webhook": webhook, "jid": jid, "events": eventstring, "state": state}
+		switch state {
+		case "connected":
+			response["details"] = "Connected!"
+		case "qr":
+			response["details"] = "Scan the QR code to pair"
+			response["qr"] = map[string]string{"code": code, "image": qrDataURL(code)}
+		default:
+			response["details"] = "Connecting"
+		}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -259,17 +308,19 @@ func (s *server) Disconnect() http.HandlerFunc {
 		token := r.Context().Value("userinfo").(Values).Get("Token")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
 			return
 		}
-		if clientPointer[userid].IsConnected() == true {
-			if clientPointer[userid].IsLoggedIn() == true {
-				log.Info().Str("jid", jid).Msg("Disconnection successfull")
-				killchannel[userid] <- true
-				_, err := s.db.Exec("UPDATE users SET events=? WHERE id=?", "", userid)
+		if client.IsConnected() == true {
+			if client.IsLoggedIn() == true {
+				hlog.FromRequest(r).Info().Str("jid", jid).Msg("Disconnection successfull")
+				sessions.disconnect(userid)
+				globalHooks.send("UserDisconnected", userid, "disconnected through the API")
+				_, err := execRetry(s.db, "UPDATE users SET events=? WHERE id=?", "", userid)
 				if err != nil {
-					log.Warn().Str("userid", txtid).Msg("Could not set events in users table")
+					hlog.FromRequest(r).Warn().Str("userid", txtid).Msg("Could not set events in users table")
 				}
 				v := updateUserInfo(r.Context().Value("userinfo"), "Events", "")
 				userinfocache.Set(token, v, cache.NoExpiration)
@@ -283,13 +334,13 @@ func (s *server) Disconnect() http.HandlerFunc {
 				}
 				return
 			} else {
-				log.Warn().Str("jid", jid).Msg("Ignoring disconnect as it was not connected")
-				s.Respond(w, r, http.StatusInternalServerError, errors.New("Cannot disconnect because it is not logged in"))
+				hlog.FromRequest(r).Warn().Str("jid", jid).Msg("Ignoring disconnect as it was not connected")
+				s.Respond(w, r, http.StatusConflict, newAPIError(ErrSessionNotPaired, "Cannot disconnect because it is not logged in", nil))
 				return
 			}
 		} else {
-			log.Warn().Str("jid", jid).Msg("Ignoring disconnect as it was not connected")
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Cannot disconnect because it is not logged in"))
+			hlog.FromRequest(r).Warn().Str("jid", jid).Msg("Ignoring disconnect as it was not connected")
+			s.Respond(w, r, http.StatusConflict, newAPIError(ErrSessionNotPaired, "Cannot disconnect because it is not logged in", nil))
 			return
 		}
 	}
@@ -301,16 +352,19 @@ func (s *server) GetWebhook() http.HandlerFunc {
 
 		webhook := ""
 		events := ""
+		headers := ""
+		timeout := 0
+		compress := false
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 
-		rows, err := s.db.Query("SELECT webhook,events FROM users WHERE id=? LIMIT 1", txtid)
+		rows, err := s.db.Query("SELECT webhook,events,webhook_headers,webhook_timeout,webhook_gzip FROM users WHERE id=? LIMIT 1", txtid)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get webhook: %v", err)))
 			return
 		}
 		defer rows.Close()
 		for rows.Next() {
-			err = rows.Scan(&webhook, &events)
+			err = rows.Scan(&webhook, &events, &headers, &timeout, &compress)
 			if err != nil {
 				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get webhook: %s", fmt.Sprintf("%s", err))))
 				return
@@ -324,7 +378,8 @@ func (s *server) GetWebhook() http.HandlerFunc {
 
 		eventarray := strings.Split(events, ",")
 
-		response := map[string]interface{}{"webhook": webhook, "subscribe": eventarray}
+		// Header values are credentials, only their names are shown
+		response := map[string]interface{}{"webhook": webhook, "subscribe": eventarray, "headers": webhookHeaderNames(parseWebhookHeaders(headers)), "timeout": timeout, "gzip": compress}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -338,7 +393,11 @@ func (s *server) GetWebhook() http.HandlerFunc {
 // Sets WebHook
 func (s *server) SetWebhook() http.HandlerFunc {
 	type webhookStruct struct {
-		WebhookURL string
+		WebhookURL *string
+		Headers    *map[string]string
+		Timeout    *int
+		Gzip       *bool
+		Test       bool
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 
@@ -353,18 +412,80 @@ func (s *server) SetWebhook() http.HandlerFunc {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not set webhook: %v", err)))
 			return
 		}
-		var webhook = t.WebhookURL
-
-		_, err = s.db.Exec("UPDATE users SET webhook=? WHERE id=?", webhook, userid)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("%s", err)))
+		if t.WebhookURL == nil && t.Headers == nil && t.Timeout == nil && t.Gzip == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing WebhookURL, Headers, Timeout or Gzip in Payload"))
 			return
 		}
 
-		v := updateUserInfo(r.Context().Value("userinfo"), "Webhook", webhook)
+		v := r.Context().Value("userinfo")
+		webhook := v.(Values).Get("Webhook")
+		if t.WebhookURL != nil {
+			if err := validateWebhookURL(*t.WebhookURL); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid WebhookURL: %v", err)))
+				return
+			}
+			webhook = *t.WebhookURL
+			_, err = execRetry(s.db, "UPDATE users SET webhook=? WHERE id=?", webhook, userid)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("%s", err)))
+				return
+			}
+			v = updateUserInfo(v, "Webhook", webhook)
+		}
+		if t.Headers != nil {
+			if err := validateWebhookHeaders(*t.Headers); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid Headers: %v", err)))
+				return
+			}
+			stored := ""
+			if len(*t.Headers) > 0 {
+				encoded, _ := json.Marshal(*t.Headers)
+				stored = string(encoded)
+			}
+			_, err = execRetry(s.db, "UPDATE users SET webhook_headers=? WHERE id=?", stored, userid)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("%s", err)))
+				return
+			}
+			v = updateUserInfo(v, "WebhookHeaders", stored)
+		}
+		if t.Timeout != nil {
+			if *t.Timeout < 0 || *t.Timeout > maxWebhookTimeout {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid Timeout, must be between 0 and %d seconds", maxWebhookTimeout)))
+				return
+			}
+			_, err = execRetry(s.db, "UPDATE users SET webhook_timeout=? WHERE id=?", *t.Timeout, userid)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("%s", err)))
+				return
+			}
+			v = updateUserInfo(v, "WebhookTimeout", strconv.Itoa(*t.Timeout))
+		}
+		if t.Gzip != nil {
+			_, err = execRetry(s.db, "UPDATE users SET webhook_gzip=? WHERE id=?", *t.Gzip, userid)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("%s", err)))
+				return
+			}
+			compress := "0"
+			if *t.Gzip {
+				compress = "1"
+			}
+			v = updateUserInfo(v, "WebhookGzip", compress)
+		}
 		userinfocache.Set(token, v, cache.NoExpiration)
 
-		response := map[string]interface{}{"webhook": webhook}
+		timeout, _ := strconv.Atoi(v.(Values).Get("WebhookTimeout"))
+		compress := v.(Values).Get("WebhookGzip") == "1"
+		response := map[string]interface{}{"webhook": webhook, "headers": webhookHeaderNames(parseWebhookHeaders(v.(Values).Get("WebhookHeaders"))), "timeout": timeout, "gzip": compress}
+		// A failing test doesn't undo the save, the receiver may not be up yet
+		if t.Test && webhook != "" {
+			result := testWebhook(r.Context(), webhook, token, parseWebhookHeaders(v.(Values).Get("WebhookHeaders")), webhookTimeoutFor(v.(Values).Get("WebhookTimeout")), compress)
+			response["test"] = result
+			if result.Error != "" {
+				response["warning"] = "Webhook saved but the test failed: " + result.Error
+			}
+		}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -375,6 +496,50 @@ func (s *server) SetWebhook() http.HandlerFunc {
 	}
 }
 
+// Posts a test event to the saved webhook, or to WebhookURL to try one before
+// saving it, and reports how the receiver answered
+func (s *server) TestWebhook() http.HandlerFunc {
+	type testStruct struct {
+		WebhookURL string
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		v := r.Context().Value("userinfo").(Values)
+
+		var t testStruct
+		// The body is optional
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+				return
+			}
+		}
+		webhook := t.WebhookURL
+		if webhook == "" {
+			webhook = v.Get("Webhook")
+		}
+		if webhook == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("No webhook set, pass WebhookURL"))
+			return
+		}
+		if err := validateWebhookURL(webhook); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid WebhookURL: %v", err)))
+			return
+		}
+
+		result := testWebhook(r.Context(), webhook, v.Get("Token"), parseWebhookHeaders(v.Get("WebhookHeaders")), webhookTimeoutFor(v.Get("WebhookTimeout")), v.Get("WebhookGzip") == "1")
+		log.Info().Str("userid", v.Get("Id")).Str("url", redactURL(webhook)).Int("status", result.Status).Str("error", result.Error).Msg("Webhook test")
+
+		responseJson, err := json.Marshal(result)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
 // Gets QR code encoded in Base64
 func (s *server) GetQR() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -383,12 +548,13 @@ func (s *server) GetQR() http.HandlerFunc {
 		userid, _ := strconv.Atoi(txtid)
 		code := ""
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
 			return
 		} else {
-			if clientPointer[userid].IsConnected() == false {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New("Not connected"))
+			if client.IsConnected() == false {
+				s.Respond(w, r, http.StatusConflict, errNotConnected)
 				return
 			}
 			rows, err := s.db.Query("SELECT qrcode AS code FROM users WHERE id=? LIMIT 1", userid)
@@ -409,13 +575,13 @@ func (s *server) GetQR() http.HandlerFunc {
 				s.Respond(w, r, http.StatusInternalServerError, err)
 				return
 			}
-			if clientPointer[userid].IsLoggedIn() == true {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New("Already Loggedin"))
+			if client.IsLoggedIn() == true {
+				s.Respond(w, r, http.StatusConflict, newAPIError(ErrAlreadyPaired, "Already Loggedin", nil))
 				return
 			}
 		}
 
-		log.Info().Str("userid", txtid).Str("qrcode", code).Msg("Get QR successful")
+		hlog.FromRequest(r).Info().Str("userid", txtid).Str("qrcode", code).Msg("Get QR successful")
 		response := map[string]interface{}{"QRCode": fmt.Sprintf("%s", code)}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
@@ -435,28 +601,31 @@ func (s *server) Logout() http.HandlerFunc {
 		jid := r.Context().Value("userinfo").(Values).Get("Jid")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
 			return
 		} else {
-			if clientPointer[userid].IsLoggedIn() == true && clientPointer[userid].IsConnected() == true {
-				err := clientPointer[userid].Logout()
+			if client.IsLoggedIn() == true && client.IsConnected() == true {
+				err := client.Logout()
 				if err != nil {
-					log.Error().Str("jid", jid).Msg("Could not perform logout")
+					hlog.FromRequest(r).Error().Str("jid", jid).Msg("Could not perform logout")
 					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not perform logout"))
 					return
 				} else {
-					log.Info().Str("jid", jid).Msg("Logged out")
-					killchannel[userid] <- true
+					hlog.FromRequest(r).Info().Str("jid", jid).Msg("Logged out")
+					globalHooks.send("UserLoggedOut", userid, "logged out through the API")
+					sessions.disconnect(userid)
+					forgetDevice(s.db, userid, r.Context().Value("userinfo").(Values).Get("Token"))
 				}
 			} else {
-				if clientPointer[userid].IsConnected() == true {
-					log.Warn().Str("jid", jid).Msg("Ignoring logout as it was not logged in")
-					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not disconnect as it was not logged in"))
+				if client.IsConnected() == true {
+					hlog.FromRequest(r).Warn().Str("jid", jid).Msg("Ignoring logout as it was not logged in")
+					s.Respond(w, r, http.StatusConflict, newAPIError(ErrSessionNotPaired, "Could not disconnect as it was not logged in", nil))
 					return
 				} else {
-					log.Warn().Str("jid", jid).Msg("Ignoring logout as it was not connected")
-					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not disconnect as it was not connected"))
+					hlog.FromRequest(r).Warn().Str("jid", jid).Msg("Ignoring logout as it was not connected")
+					s.Respond(w, r, http.StatusConflict, newAPIError(ErrSessionNotConnected, "Could not disconnect as it was not connected", nil))
 					return
 				}
 			}
@@ -485,8 +654,9 @@ func (s *server) PairPhone() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
 			return
 		}
 
@@ -503,16 +673,16 @@ func (s *server) PairPhone() http.HandlerFunc {
 			return
 		}
 
-		isLoggedIn := clientPointer[userid].IsLoggedIn()
+		isLoggedIn := client.IsLoggedIn()
 		if(isLoggedIn) {
-			log.Error().Msg(fmt.Sprintf("%s", "Already paired"))
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Already paired"))
+			hlog.FromRequest(r).Error().Msg(fmt.Sprintf("%s", "Already paired"))
+			s.Respond(w, r, http.StatusConflict, newAPIError(ErrAlreadyPaired, "Already paired", nil))
 			return
 		}
 
-		linkingCode, err := clientPointer[userid].PairPhone(t.Phone, true, whatsmeow.PairClientChrome, "Chrome (Linux)")
+		linkingCode, err := client.PairPhone(t.Phone, true, whatsmeow.PairClientChrome, "Chrome (Linux)")
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
+			hlog.FromRequest(r).Error().Msg(fmt.Sprintf("%s", err))
 			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
@@ -529,148 +699,90 @@ func (s *server) PairPhone() http.HandlerFunc {
 }
 
 
-// Gets Connected and LoggedIn Status
-func (s *server) GetStatus() http.HandlerFunc {
-
-	return func(w http.ResponseWriter, r *http.Request) {
-
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
-
-		isConnected := clientPointer[userid].IsConnected()
-		isLoggedIn := clientPointer[userid].IsLoggedIn()
-
-		response := map[string]interface{}{"Connected": isConnected, "LoggedIn": isLoggedIn}
-		responseJson, err := json.Marshal(response)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
-		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
-		}
-		return
-	}
-}
-
-// Sends a document/attachment message
-func (s *server) SendDocument() http.HandlerFunc {
+// Sets the proxy (http, https or socks5 URL) used for the websocket and media
+// transfers. Empty ProxyURL removes it. Takes effect on the next connect
+func (s *server) SetProxy() http.HandlerFunc {
 
-	type documentStruct struct {
-		Caption     string
-		Phone       string
-		Document    string
-		FileName    string
-		Id          string
-		ContextInfo waProto.ContextInfo
+	type proxyStruct struct {
+		ProxyURL string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
 
 		decoder := json.NewDecoder(r.Body)
-		var t documentStruct
+		var t proxyStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
-			return
+		if t.ProxyURL != "" {
+			if err := validateProxyURL(t.ProxyURL); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid ProxyURL: %v", err)))
+				return
+			}
 		}
 
-		if t.Document == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Document in Payload"))
+		_, err = execRetry(s.db, "UPDATE users SET proxy_url=? WHERE id=?", t.ProxyURL, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not set proxy: %v", err)))
 			return
 		}
 
-		if t.FileName == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing FileName in Payload"))
-			return
+		reconnect, _ := sessions.status(userid)
+		details := "Proxy set"
+		if t.ProxyURL == "" {
+			details = "Proxy removed"
 		}
-
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
-		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
-			return
+		if reconnect {
+			details += ", disconnect and connect again for it to take effect"
 		}
+		hlog.FromRequest(r).Info().Str("userid", txtid).Str("proxy", redactURL(t.ProxyURL)).Msg("Proxy updated")
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
+		response := map[string]interface{}{"Details": details, "ProxyURL": redactURL(t.ProxyURL), "ReconnectRequired": reconnect}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
-			msgid = t.Id
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+		return
+	}
+}
 
-		var uploaded whatsmeow.UploadResponse
-		var filedata []byte
+// Gets Connected and LoggedIn Status
+func (s *server) GetStatus() http.HandlerFunc {
 
-		if t.Document[0:29] == "data:application/octet-stream" {
-			dataURL, err := dataurl.DecodeString(t.Document)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			if msg, ok := getConnectError(userid); ok {
+				s.Respond(w, r, http.StatusConflict, newAPIError(ErrSessionNotConnected, "No session: "+msg, nil))
 				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaDocument)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
-					return
-				}
 			}
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Document data should start with \"data:application/octet-stream;base64,\""))
+			s.Respond(w, r, http.StatusConflict, errNoSession)
 			return
 		}
 
-		msg := &waProto.Message{DocumentMessage: &waProto.DocumentMessage{
-			URL:           proto.String(uploaded.URL),
-			FileName:      &t.FileName,
-			DirectPath:    proto.String(uploaded.DirectPath),
-			MediaKey:      uploaded.MediaKey,
-			Mimetype:      proto.String(http.DetectContentType(filedata)),
-			FileEncSHA256: uploaded.FileEncSHA256,
-			FileSHA256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
-			Caption:       proto.String(t.Caption),
-		}}
+		isConnected := client.IsConnected()
+		isLoggedIn := client.IsLoggedIn()
 
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
-		}
-		if(t.ContextInfo.MentionedJID != nil) {
-			if(msg.ExtendedTextMessage.ContextInfo == nil) {
-				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
-			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		response := map[string]interface{}{"Connected": isConnected, "LoggedIn": isLoggedIn}
+		if isLoggedIn && client.Store.ID != nil {
+			response["PushName"] = client.Store.PushName
+			response["PictureID"] = ownPictureID(userid, client)
 		}
-
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
-			return
+		if msg, ok := getConnectError(userid); ok {
+			response["Error"] = msg
 		}
-
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -681,602 +793,538 @@ func (s *server) SendDocument() http.HandlerFunc {
 	}
 }
 
-// Sends an audio message
-func (s *server) SendAudio() http.HandlerFunc {
+// Changes the display (push) name of the logged in account
+func (s *server) SetProfileName() http.HandlerFunc {
 
-	type audioStruct struct {
-		Phone       string
-		Audio       string
-		Caption     string
-		Id          string
-		ContextInfo waProto.ContextInfo
+	type nameStruct struct {
+		Name string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
-		msgid := ""
-		var resp whatsmeow.SendResponse
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+		if !client.IsLoggedIn() {
+			s.Respond(w, r, http.StatusConflict, errNotLoggedIn)
 			return
 		}
 
 		decoder := json.NewDecoder(r.Body)
-		var t audioStruct
+		var t nameStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
-
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		t.Name = strings.TrimSpace(t.Name)
+		if t.Name == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Name in Payload"))
 			return
 		}
-
-		if t.Audio == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Audio in Payload"))
+		if len([]rune(t.Name)) > 25 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid Name, at most 25 characters"))
 			return
 		}
 
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		err = client.SendAppState(appstate.BuildSettingPushName(t.Name))
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to set profile name: %v", err)))
 			return
 		}
-
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
-		} else {
-			msgid = t.Id
-		}
-
-		var uploaded whatsmeow.UploadResponse
-		var filedata []byte
-
-		if t.Audio[0:14] == "data:audio/ogg" {
-			dataURL, err := dataurl.DecodeString(t.Audio)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
-				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaAudio)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
-					return
-				}
-			}
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Audio data should start with \"data:audio/ogg;base64,\""))
-			return
-		}
-
-        ptt := true
-        mime := "audio/ogg; codecs=opus"
-
-		msg := &waProto.Message{AudioMessage: &waProto.AudioMessage{
-			URL:           proto.String(uploaded.URL),
-			DirectPath:    proto.String(uploaded.DirectPath),
-			MediaKey:      uploaded.MediaKey,
-            //Mimetype:      proto.String(http.DetectContentType(filedata)),
-			Mimetype:      &mime,
-			FileEncSHA256: uploaded.FileEncSHA256,
-			FileSHA256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
-            PTT:           &ptt,
-		}}
-
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
-		}
-		if(t.ContextInfo.MentionedJID != nil) {
-			if(msg.ExtendedTextMessage.ContextInfo == nil) {
-				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
-			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		client.Store.PushName = t.Name
+		if err := client.Store.Save(); err != nil {
+			hlog.FromRequest(r).Warn().Err(err).Msg("Could not save push name")
 		}
-
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
-			return
+		// Contacts see the new name on the next presence update
+		if err := client.SendPresence(types.PresenceAvailable); err != nil {
+			hlog.FromRequest(r).Warn().Err(err).Msg("Failed to send available presence")
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		hlog.FromRequest(r).Info().Str("userid", txtid).Str("name", t.Name).Msg("Profile name set")
+		response := map[string]interface{}{"Details": "Profile name set successfully", "PushName": t.Name}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// Sends an Image message
-func (s *server) SendImage() http.HandlerFunc {
+// Changes the profile picture of the logged in account, from a base64 JPEG
+// data URL in Image or a remote JPEG in URL
+func (s *server) SetProfilePicture() http.HandlerFunc {
 
-	type imageStruct struct {
-		Phone       string
-		Image       string
-		Caption     string
-		Id          string
-		ContextInfo waProto.ContextInfo
+	type pictureStruct struct {
+		Image string
+		URL   string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
 
-		decoder := json.NewDecoder(r.Body)
-		var t imageStruct
-		err := decoder.Decode(&t)
-		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
-			return
-		}
-
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
 			return
 		}
-
-		if t.Image == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Image in Payload"))
+		if !client.IsLoggedIn() {
+			s.Respond(w, r, http.StatusConflict, errNotLoggedIn)
 			return
 		}
 
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		decoder := json.NewDecoder(r.Body)
+		var t pictureStruct
+		err := decoder.Decode(&t)
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
+			s.decodeFailed(w, r, err, "picture")
 			return
 		}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
-		} else {
-			msgid = t.Id
-		}
-
-		var uploaded whatsmeow.UploadResponse
 		var filedata []byte
-		var thumbnailBytes []byte
-
-		if t.Image[0:10] == "data:image" {
-			dataURL, err := dataurl.DecodeString(t.Image)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
-				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaImage)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
-					return
-				}
-			}
-
-			// decode jpeg into image.Image
-			reader := bytes.NewReader(filedata)
-			img, _, err := image.Decode(reader)
-			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not decode image for thumbnail preparation: %v", err)))
-				return
-			}
-
-			// resize to width 72 using Lanczos resampling and preserve aspect ratio
-			m := resize.Thumbnail(72, 72, img, resize.Lanczos3)
-
-			tmpFile, err := os.CreateTemp("", "resized-*.jpg")
+		if t.URL != "" {
+			filedata, err = fetchRemote(t.URL, "picture", profilePictureMaxDownload)
 			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create temp file for thumbnail: %v", err)))
-				return
-			}
-			defer tmpFile.Close()
-
-			// write new image to file
-			if err := jpeg.Encode(tmpFile, m, nil); err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to encode jpeg: %v", err)))
+				s.Respond(w, r, http.StatusBadRequest, err)
 				return
 			}
-
-			thumbnailBytes, err = os.ReadFile(tmpFile.Name())
+		} else if t.Image == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Image or URL in Payload"))
+			return
+		} else if strings.HasPrefix(t.Image, "data:image/jp") {
+			dataURL, err := dataurl.DecodeString(t.Image)
 			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to read %s: %v", tmpFile.Name(), err)))
+				s.Respond(w, r, http.StatusUnprocessableEntity, newAPIError(ErrInvalidMedia, "Could not decode base64 encoded data from payload", nil))
 				return
 			}
-
-
+			filedata = dataURL.Data
 		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Image data should start with \"data:image/png;base64,\""))
+			s.Respond(w, r, http.StatusUnprocessableEntity, newAPIError(ErrInvalidMedia, "Image data should start with \"data:image/jpeg;base64,\"", nil))
 			return
 		}
 
-		msg := &waProto.Message{ImageMessage: &waProto.ImageMessage{
-			Caption:       proto.String(t.Caption),
-			URL:           proto.String(uploaded.URL),
-			DirectPath:    proto.String(uploaded.DirectPath),
-			MediaKey:      uploaded.MediaKey,
-			Mimetype:      proto.String(http.DetectContentType(filedata)),
-			FileEncSHA256: uploaded.FileEncSHA256,
-			FileSHA256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
-			JPEGThumbnail: thumbnailBytes,
-		}}
-
-		if t.ContextInfo.StanzaID != nil {
-			if(msg.ImageMessage.ContextInfo == nil) {
-				msg.ImageMessage.ContextInfo = &waProto.ContextInfo {
-					StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-					Participant:   proto.String(*t.ContextInfo.Participant),
-					QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-				}
-			}
-		}
-
-		if(t.ContextInfo.MentionedJID != nil) {
-			msg.ImageMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		filedata, err = profilePicture(filedata)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid picture: %v", err)))
+			return
 		}
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		pictureID, err := client.SetGroupPhoto(client.Store.ID.ToNonAD(), filedata)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to set profile picture: %v", err)))
 			return
 		}
+		profilePictures.Store(userid, pictureID)
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		hlog.FromRequest(r).Info().Str("userid", txtid).Str("id", pictureID).Msg("Profile picture set")
+		response := map[string]interface{}{"Details": "Profile picture set successfully", "PictureID": pictureID}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// Sends Sticker message
-func (s *server) SendSticker() http.HandlerFunc {
-
-	type stickerStruct struct {
-		Phone        string
-		Sticker      string
-		Id           string
-		PngThumbnail []byte
-		ContextInfo  waProto.ContextInfo
-	}
+// Removes the profile picture of the logged in account
+func (s *server) DeleteProfilePicture() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
-		msgid := ""
-		var resp whatsmeow.SendResponse
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+		if !client.IsLoggedIn() {
+			s.Respond(w, r, http.StatusConflict, errNotLoggedIn)
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
-		var t stickerStruct
-		err := decoder.Decode(&t)
+		_, err := client.SetGroupPhoto(client.Store.ID.ToNonAD(), nil)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to remove profile picture: %v", err)))
 			return
 		}
+		profilePictures.Store(userid, "")
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
-			return
+		hlog.FromRequest(r).Info().Str("userid", txtid).Msg("Profile picture removed")
+		response := map[string]interface{}{"Details": "Profile picture removed successfully"}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+	}
+}
 
-		if t.Sticker == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Sticker in Payload"))
+// Gets the privacy settings of the logged in account
+func (s *server) GetPrivacy() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+		if !client.IsLoggedIn() {
+			s.Respond(w, r, http.StatusConflict, errNotLoggedIn)
 			return
 		}
 
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		settings, err := client.TryFetchPrivacySettings(true)
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to get privacy settings: %v", err)))
 			return
 		}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
+		responseJson, err := json.Marshal(privacyMap(*settings))
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
-			msgid = t.Id
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+	}
+}
 
-		var uploaded whatsmeow.UploadResponse
-		var filedata []byte
+// Lists the devices linked to the account. Device 0 is the phone, whose
+// platform WhatsApp sent when pairing. The platform of other companions isn't
+// known, only the one this session announces.
+func (s *server) GetDevices() http.HandlerFunc {
+
+	type deviceStruct struct {
+		Jid      string
+		Device   uint16
+		Primary  bool
+		Self     bool
+		Platform string
+	}
 
-		if t.Sticker[0:4] == "data" {
-			dataURL, err := dataurl.DecodeString(t.Sticker)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
-				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaImage)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
-					return
-				}
-			}
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Data should start with \"data:mime/type;base64,\""))
-			return
-		}
+	return func(w http.ResponseWriter, r *http.Request) {
 
-		msg := &waProto.Message{StickerMessage: &waProto.StickerMessage{
-			URL:           proto.String(uploaded.URL),
-			DirectPath:    proto.String(uploaded.DirectPath),
-			MediaKey:      uploaded.MediaKey,
-			Mimetype:      proto.String(http.DetectContentType(filedata)),
-			FileEncSHA256: uploaded.FileEncSHA256,
-			FileSHA256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
-			PngThumbnail:  t.PngThumbnail,
-		}}
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
 
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
 		}
-		if(t.ContextInfo.MentionedJID != nil) {
-			if(msg.ExtendedTextMessage.ContextInfo == nil) {
-				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
-			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		if !client.IsConnected() {
+			s.Respond(w, r, http.StatusConflict, errNotConnected)
+			return
+		}
+		if !client.IsLoggedIn() {
+			s.Respond(w, r, http.StatusConflict, errNotLoggedIn)
+			return
 		}
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		own := *client.Store.ID
+		jids, err := client.GetUserDevices([]types.JID{own.ToNonAD()})
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to get devices: %v", err)))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		devices := make([]deviceStruct, 0, len(jids))
+		for _, jid := range jids {
+			device := deviceStruct{
+				Jid:     jid.String(),
+				Device:  jid.Device,
+				Primary: jid.Device == 0,
+				Self:    jid.Device == own.Device,
+			}
+			if device.Primary {
+				device.Platform = client.Store.Platform
+			} else if device.Self {
+				// Name presented when pairing, a later change only applies
+				// to new pairings
+				device.Platform = s.deviceName(userid)
+			}
+			devices = append(devices, device)
+		}
+
+		response := map[string]interface{}{"Count": len(devices), "Devices": devices}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// Sends Video message
-func (s *server) SendVideo() http.HandlerFunc {
-
-	type imageStruct struct {
-		Phone         string
-		Video         string
-		Caption       string
-		Id            string
-		JPEGThumbnail []byte
-		ContextInfo   waProto.ContextInfo
-	}
+// Changes the given privacy settings, the others are left as they are.
+// Returns all the settings after the change.
+func (s *server) SetPrivacy() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
-		msgid := ""
-		var resp whatsmeow.SendResponse
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+		if !client.IsLoggedIn() {
+			s.Respond(w, r, http.StatusConflict, errNotLoggedIn)
 			return
 		}
 
 		decoder := json.NewDecoder(r.Body)
-		var t imageStruct
+		var t map[string]string
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
-
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		if len(t) == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Nothing to update. Accepted settings are LastSeen,Online,Profile,About,ReadReceipts,GroupAdd,CallAdd"))
 			return
 		}
 
-		if t.Video == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Video in Payload"))
-			return
-		}
-
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
-		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
-			return
-		}
-
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
-		} else {
-			msgid = t.Id
+		// Check everything before changing anything
+		type change struct {
+			setting types.PrivacySettingType
+			value   types.PrivacySetting
 		}
-
-		var uploaded whatsmeow.UploadResponse
-		var filedata []byte
-
-		if t.Video[0:4] == "data" {
-			dataURL, err := dataurl.DecodeString(t.Video)
+		changes := []change{}
+		for _, option := range privacyOptions {
+			value, ok := t[option.name]
+			if !ok {
+				continue
+			}
+			delete(t, option.name)
+			setting, err := privacyValue(option.name, option.allowed, value)
 			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
+				s.Respond(w, r, http.StatusBadRequest, err)
 				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaVideo)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
-					return
-				}
 			}
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Data should start with \"data:mime/type;base64,\""))
+			changes = append(changes, change{option.setting, setting})
+		}
+		for name := range t {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid privacy setting "+name))
 			return
 		}
 
-		msg := &waProto.Message{VideoMessage: &waProto.VideoMessage{
-			Caption:       proto.String(t.Caption),
-			URL:           proto.String(uploaded.URL),
-			DirectPath:    proto.String(uploaded.DirectPath),
-			MediaKey:      uploaded.MediaKey,
-			Mimetype:      proto.String(http.DetectContentType(filedata)),
-			FileEncSHA256: uploaded.FileEncSHA256,
-			FileSHA256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
-			JPEGThumbnail: t.JPEGThumbnail,
-		}}
-
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
-		}
-		if(t.ContextInfo.MentionedJID != nil) {
-			if(msg.ExtendedTextMessage.ContextInfo == nil) {
-				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
+		var settings types.PrivacySettings
+		for _, c := range changes {
+			settings, err = client.SetPrivacySetting(c.setting, c.value)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to set privacy setting %s: %v", c.setting, err)))
+				return
 			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
-		}
-
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
-			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
-		responseJson, err := json.Marshal(response)
+		hlog.FromRequest(r).Info().Str("userid", txtid).Int("changed", len(changes)).Msg("Privacy settings updated")
+		responseJson, err := json.Marshal(privacyMap(settings))
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// Sends Contact
-func (s *server) SendContact() http.HandlerFunc {
+// Sends a document/attachment message
+func (s *server) SendDocument() http.HandlerFunc {
 
-	type contactStruct struct {
-		Phone       string
-		Id          string
-		Name        string
-		Vcard       string
-		ContextInfo waProto.ContextInfo
+	type documentStruct struct {
+		Caption         string
+		Phone           string
+		Document        string
+		FileName        string
+		Title           string
+		Mimetype        string
+		ThumbnailBase64 string
+		Id              string
+		ContextInfo     waProto.ContextInfo
+		Ephemeral       bool
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
+		msgid := ""
+		var resp whatsmeow.SendResponse
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
 			return
 		}
 
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
 		decoder := json.NewDecoder(r.Body)
-		var t contactStruct
+		var t documentStruct
 		err := decoder.Decode(&t)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.decodeFailed(w, r, err, "document")
 			return
 		}
+
 		if t.Phone == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
 			return
 		}
-		if t.Name == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Name in Payload"))
+
+		if t.Document == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Document in Payload"))
 			return
 		}
-		if t.Vcard == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Vcard in Payload"))
+
+		if err := validateDocumentFileName(t.FileName); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
+		if t.Title == "" {
+			t.Title = t.FileName
+		}
 
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		recipient, err := validateMessageFields(client, t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
+			hlog.FromRequest(r).Error().Msg(fmt.Sprintf("%s", err))
 			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
+		var quoted *waProto.ContextInfo
+		if t.ContextInfo.StanzaID != nil {
+			quoted, err = s.quotedContext(r, recipient, &t.ContextInfo)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		var expiration uint32
+		if t.Ephemeral {
+			expiration, err = s.ephemeralTimer(client, userid, recipient)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+		}
+
 		if t.Id == "" {
 			msgid = whatsmeow.GenerateMessageID()
 		} else {
 			msgid = t.Id
 		}
 
-		msg := &waProto.Message{ContactMessage: &waProto.ContactMessage{
-			DisplayName: &t.Name,
-			Vcard:       &t.Vcard,
-		}}
+		var uploaded whatsmeow.UploadResponse
+		var filedata []byte
 
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
+		// Any data URL type is taken, the mimetype sent comes from the content
+		if !strings.HasPrefix(t.Document, "data:") {
+			s.Respond(w, r, http.StatusUnprocessableEntity, newAPIError(ErrInvalidMedia, "Document data should start with \"data:application/octet-stream;base64,\"", nil))
+			return
+		}
+		dataURL, err := dataurl.DecodeString(t.Document)
+		if err != nil {
+			s.Respond(w, r, http.StatusUnprocessableEntity, newAPIError(ErrInvalidMedia, "Could not decode base64 encoded data from payload", nil))
+			return
+		}
+		filedata = dataURL.Data
+
+		mimetype, err := documentMimetype(filedata, t.FileName, t.Mimetype)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		var thumbnail []byte
+		var thumbnailWidth, thumbnailHeight, pages uint32
+		if t.ThumbnailBase64 != "" {
+			thumbnail, thumbnailWidth, thumbnailHeight, err = decodeThumbnail(t.ThumbnailBase64)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if mimetype == "application/pdf" {
+			pages = pdfPageCount(filedata)
+			if thumbnail == nil {
+				thumbnail, thumbnailWidth, thumbnailHeight, err = pdfThumbnail(filedata)
+				if err != nil {
+					hlog.FromRequest(r).Warn().Err(err).Msg("Sending PDF without preview")
+				}
 			}
 		}
+
+		ctx, cancel := sendContext(r)
+		defer cancel()
+
+		uploaded, err = tracedUpload(ctx, client, filedata, whatsmeow.MediaDocument)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "Failed to upload file", err))
+			return
+		}
+
+		msg := &waProto.Message{DocumentMessage: &waProto.DocumentMessage{
+			URL:           proto.String(uploaded.URL),
+			FileName:      &t.FileName,
+			Title:         &t.Title,
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(mimetype),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(filedata))),
+			Caption:       proto.String(t.Caption),
+		}}
+		if thumbnail != nil {
+			msg.DocumentMessage.JPEGThumbnail = thumbnail
+			msg.DocumentMessage.ThumbnailWidth = proto.Uint32(thumbnailWidth)
+			msg.DocumentMessage.ThumbnailHeight = proto.Uint32(thumbnailHeight)
+		}
+		if pages > 0 {
+			msg.DocumentMessage.PageCount = proto.Uint32(pages)
+		}
+
+		if quoted != nil {
+			msg.DocumentMessage.ContextInfo = quoted
+		}
 		if(t.ContextInfo.MentionedJID != nil) {
-			if(msg.ExtendedTextMessage.ContextInfo == nil) {
-				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
+			if(msg.DocumentMessage.ContextInfo == nil) {
+				msg.DocumentMessage.ContextInfo = &waProto.ContextInfo{}
 			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+			msg.DocumentMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
 		}
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		setMessageExpiration(msg, expiration)
+		resp, err = tracedSend(ctx, client, recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "Error sending message", err))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		s.recordSent(r, client, recipient, msgid, msg, resp.Timestamp)
+		hlog.FromRequest(r).Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid, "JID": recipient.String()}
+		if expiration > 0 {
+			response["Expiration"] = expiration
+		}
+		s.waitReceipt(r, msgid, response)
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -1287,92 +1335,149 @@ func (s *server) SendContact() http.HandlerFunc {
 	}
 }
 
-// Sends location
-func (s *server) SendLocation() http.HandlerFunc {
+// Sends an audio message
+func (s *server) SendAudio() http.HandlerFunc {
 
-	type locationStruct struct {
+	type audioStruct struct {
 		Phone       string
+		Audio       string
+		Caption     string
 		Id          string
-		Name        string
-		Latitude    float64
-		Longitude   float64
+		ViewOnce    bool
 		ContextInfo waProto.ContextInfo
+		Ephemeral   bool
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
+		msgid := ""
+		var resp whatsmeow.SendResponse
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
 			return
 		}
 
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
 		decoder := json.NewDecoder(r.Body)
-		var t locationStruct
+		var t audioStruct
 		err := decoder.Decode(&t)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.decodeFailed(w, r, err, "audio")
 			return
 		}
+
 		if t.Phone == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
 			return
 		}
-		if t.Latitude == 0 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Latitude in Payload"))
-			return
-		}
-		if t.Longitude == 0 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Longitude in Payload"))
+
+		if t.Audio == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Audio in Payload"))
 			return
 		}
 
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		recipient, err := validateMessageFields(client, t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
+			hlog.FromRequest(r).Error().Msg(fmt.Sprintf("%s", err))
 			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
+		var quoted *waProto.ContextInfo
+		if t.ContextInfo.StanzaID != nil {
+			quoted, err = s.quotedContext(r, recipient, &t.ContextInfo)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		var expiration uint32
+		if t.Ephemeral {
+			expiration, err = s.ephemeralTimer(client, userid, recipient)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+		}
+
 		if t.Id == "" {
 			msgid = whatsmeow.GenerateMessageID()
 		} else {
 			msgid = t.Id
 		}
 
-		msg := &waProto.Message{LocationMessage: &waProto.LocationMessage{
-			DegreesLatitude:  &t.Latitude,
-			DegreesLongitude: &t.Longitude,
-			Name:             &t.Name,
-		}}
+		var uploaded whatsmeow.UploadResponse
+		var filedata []byte
 
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
+		ctx, cancel := sendContext(r)
+		defer cancel()
+
+		if t.Audio[0:14] == "data:audio/ogg" {
+			dataURL, err := dataurl.DecodeString(t.Audio)
+			if err != nil {
+				s.Respond(w, r, http.StatusUnprocessableEntity, newAPIError(ErrInvalidMedia, "Could not decode base64 encoded data from payload", nil))
+				return
+			} else {
+				filedata = dataURL.Data
+				uploaded, err = tracedUpload(ctx, client, filedata, whatsmeow.MediaAudio)
+				if err != nil {
+					s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "Failed to upload file", err))
+					return
+				}
 			}
+		} else {
+			s.Respond(w, r, http.StatusUnprocessableEntity, newAPIError(ErrInvalidMedia, "Audio data should start with \"data:audio/ogg;base64,\"", nil))
+			return
+		}
+
+        ptt := true
+        mime := "audio/ogg; codecs=opus"
+
+		msg := &waProto.Message{AudioMessage: &waProto.AudioMessage{
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+            //Mimetype:      proto.String(http.DetectContentType(filedata)),
+			Mimetype:      &mime,
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(filedata))),
+            PTT:           &ptt,
+		}}
+
+		if quoted != nil {
+			msg.AudioMessage.ContextInfo = quoted
 		}
 		if(t.ContextInfo.MentionedJID != nil) {
-			if(msg.ExtendedTextMessage.ContextInfo == nil) {
-				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
+			if(msg.AudioMessage.ContextInfo == nil) {
+				msg.AudioMessage.ContextInfo = &waProto.ContextInfo{}
 			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+			msg.AudioMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		}
+
+		if t.ViewOnce {
+			msg.AudioMessage.ViewOnce = proto.Bool(true)
+			msg = viewOnceMessage(msg)
 		}
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		setMessageExpiration(msg, expiration)
+		resp, err = tracedSend(ctx, client, recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "Error sending message", err))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		s.recordSent(r, client, recipient, msgid, msg, resp.Timestamp)
+		hlog.FromRequest(r).Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid, "JID": recipient.String()}
+		if expiration > 0 {
+			response["Expiration"] = expiration
+		}
+		s.waitReceipt(r, msgid, response)
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -1383,39 +1488,37 @@ func (s *server) SendLocation() http.HandlerFunc {
 	}
 }
 
-// Sends Buttons (not implemented, does not work)
-
-func (s *server) SendButtons() http.HandlerFunc {
+// Sends an Image message
+func (s *server) SendImage() http.HandlerFunc {
 
-    type buttonStruct struct {
-        ButtonId   string
-        ButtonText string
-    }
-	type textStruct struct {
-        Phone   string
-        Title   string
-        Buttons []buttonStruct
-        Id      string
+	type imageStruct struct {
+		Phone       string
+		Image       string
+		Caption     string
+		Id          string
+		ViewOnce    bool
+		ContextInfo waProto.ContextInfo
+		Ephemeral   bool
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
+		msgid := ""
+		var resp whatsmeow.SendResponse
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
 			return
 		}
 
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
 		decoder := json.NewDecoder(r.Body)
-		var t textStruct
+		var t imageStruct
 		err := decoder.Decode(&t)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.decodeFailed(w, r, err, "image")
 			return
 		}
 
@@ -1424,8 +1527,805 @@ func (s *server) SendButtons() http.HandlerFunc {
 			return
 		}
 
-		if t.Title == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Title in Payload"))
+		if t.Image == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Image in Payload"))
+			return
+		}
+
+		recipient, err := validateMessageFields(client, t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		if err != nil {
+			hlog.FromRequest(r).Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		var quoted *waProto.ContextInfo
+		if t.ContextInfo.StanzaID != nil {
+			quoted, err = s.quotedContext(r, recipient, &t.ContextInfo)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		var expiration uint32
+		if t.Ephemeral {
+			expiration, err = s.ephemeralTimer(client, userid, recipient)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+		}
+
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		} else {
+			msgid = t.Id
+		}
+
+		var uploaded whatsmeow.UploadResponse
+		var filedata []byte
+		var thumbnailBytes []byte
+
+		ctx, cancel := sendContext(r)
+		defer cancel()
+
+		if t.Image[0:10] == "data:image" {
+			dataURL, err := dataurl.DecodeString(t.Image)
+			if err != nil {
+				s.Respond(w, r, http.StatusUnprocessableEntity, newAPIError(ErrInvalidMedia, "Could not decode base64 encoded data from payload", nil))
+				return
+			} else {
+				filedata = dataURL.Data
+				uploaded, err = tracedUpload(ctx, client, filedata, whatsmeow.MediaImage)
+				if err != nil {
+					s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "Failed to upload file", err))
+					return
+				}
+			}
+
+			// decode jpeg into image.Image
+			reader := bytes.NewReader(filedata)
+			img, _, err := image.Decode(reader)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not decode image for thumbnail preparation: %v", err)))
+				return
+			}
+
+			// resize to width 72 using Lanczos resampling and preserve aspect ratio
+			m := resize.Thumbnail(72, 72, img, resize.Lanczos3)
+
+			tmpFile, err := os.CreateTemp("", "resized-*.jpg")
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create temp file for thumbnail: %v", err)))
+				return
+			}
+			defer tmpFile.Close()
+
+			// write new image to file
+			if err := jpeg.Encode(tmpFile, m, nil); err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to encode jpeg: %v", err)))
+				return
+			}
+
+			thumbnailBytes, err = os.ReadFile(tmpFile.Name())
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to read %s: %v", tmpFile.Name(), err)))
+				return
+			}
+
+
+		} else {
+			s.Respond(w, r, http.StatusUnprocessableEntity, newAPIError(ErrInvalidMedia, "Image data should start with \"data:image/png;base64,\"", nil))
+			return
+		}
+
+		msg := &waProto.Message{ImageMessage: &waProto.ImageMessage{
+			Caption:       proto.String(t.Caption),
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(http.DetectContentType(filedata)),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(filedata))),
+			JPEGThumbnail: thumbnailBytes,
+		}}
+
+		if quoted != nil {
+			if(msg.ImageMessage.ContextInfo == nil) {
+				msg.ImageMessage.ContextInfo = quoted
+			}
+		}
+
+		if(t.ContextInfo.MentionedJID != nil) {
+			msg.ImageMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		}
+
+		if t.ViewOnce {
+			msg.ImageMessage.ViewOnce = proto.Bool(true)
+			msg = viewOnceMessage(msg)
+		}
+
+		setMessageExpiration(msg, expiration)
+		resp, err = tracedSend(ctx, client, recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "Error sending message", err))
+			return
+		}
+
+		s.recordSent(r, client, recipient, msgid, msg, resp.Timestamp)
+		hlog.FromRequest(r).Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid, "JID": recipient.String()}
+		if expiration > 0 {
+			response["Expiration"] = expiration
+		}
+		s.waitReceipt(r, msgid, response)
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Sends Sticker message
+func (s *server) SendSticker() http.HandlerFunc {
+
+	type stickerStruct struct {
+		Phone        string
+		Sticker      string
+		URL          string
+		Id           string
+		PngThumbnail []byte
+		ContextInfo  waProto.ContextInfo
+		Ephemeral    bool
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t stickerStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.decodeFailed(w, r, err, "sticker")
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if t.Sticker == "" && t.URL == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Sticker or URL in Payload"))
+			return
+		}
+
+		recipient, err := validateMessageFields(client, t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		if err != nil {
+			hlog.FromRequest(r).Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		var quoted *waProto.ContextInfo
+		if t.ContextInfo.StanzaID != nil {
+			quoted, err = s.quotedContext(r, recipient, &t.ContextInfo)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		var expiration uint32
+		if t.Ephemeral {
+			expiration, err = s.ephemeralTimer(client, userid, recipient)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+		}
+
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		} else {
+			msgid = t.Id
+		}
+
+		var uploaded whatsmeow.UploadResponse
+		var filedata []byte
+
+		if t.Sticker == "" {
+			filedata, err = fetchSticker(t.URL)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		} else if len(t.Sticker) > 4 && t.Sticker[0:4] == "data" {
+			dataURL, err := dataurl.DecodeString(t.Sticker)
+			if err != nil {
+				s.Respond(w, r, http.StatusUnprocessableEntity, newAPIError(ErrInvalidMedia, "Could not decode base64 encoded data from payload", nil))
+				return
+			}
+			filedata = dataURL.Data
+		} else {
+			s.Respond(w, r, http.StatusUnprocessableEntity, newAPIError(ErrInvalidMedia, "Data should start with \"data:mime/type;base64,\"", nil))
+			return
+		}
+
+		// Stickers are WebP, PNG and JPEG are converted
+		switch http.DetectContentType(filedata) {
+		case "image/webp":
+		case "image/png", "image/jpeg":
+			filedata, err = convertToSticker(filedata)
+			if err != nil {
+				s.Respond(w, r, http.StatusUnprocessableEntity, newAPIError(ErrInvalidMedia, fmt.Sprintf("Could not convert sticker: %v", err), nil))
+				return
+			}
+		default:
+			s.Respond(w, r, http.StatusUnprocessableEntity, newAPIError(ErrInvalidMedia, "Sticker must be a WebP, PNG or JPEG image", nil))
+			return
+		}
+		width, height, animated, err := validateSticker(filedata)
+		if err != nil {
+			s.Respond(w, r, http.StatusUnprocessableEntity, newAPIError(ErrInvalidMedia, fmt.Sprintf("Invalid sticker: %v", err), nil))
+			return
+		}
+
+		ctx, cancel := sendContext(r)
+		defer cancel()
+
+		uploaded, err = tracedUpload(ctx, client, filedata, whatsmeow.MediaImage)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "Failed to upload file", err))
+			return
+		}
+
+		msg := &waProto.Message{StickerMessage: &waProto.StickerMessage{
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String("image/webp"),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(filedata))),
+			Width:         proto.Uint32(uint32(width)),
+			Height:        proto.Uint32(uint32(height)),
+			IsAnimated:    proto.Bool(animated),
+			PngThumbnail:  t.PngThumbnail,
+		}}
+
+		if quoted != nil {
+			msg.StickerMessage.ContextInfo = quoted
+		}
+		if(t.ContextInfo.MentionedJID != nil) {
+			if(msg.StickerMessage.ContextInfo == nil) {
+				msg.StickerMessage.ContextInfo = &waProto.ContextInfo{}
+			}
+			msg.StickerMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		}
+
+		setMessageExpiration(msg, expiration)
+		resp, err = tracedSend(ctx, client, recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "Error sending message", err))
+			return
+		}
+
+		s.recordSent(r, client, recipient, msgid, msg, resp.Timestamp)
+		hlog.FromRequest(r).Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid, "JID": recipient.String()}
+		if expiration > 0 {
+			response["Expiration"] = expiration
+		}
+		s.waitReceipt(r, msgid, response)
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Sends Video message
+func (s *server) SendVideo() http.HandlerFunc {
+
+	type imageStruct struct {
+		Phone           string
+		Video           string
+		Caption         string
+		Id              string
+		JPEGThumbnail   []byte
+		ThumbnailBase64 string
+		Seconds         uint32
+		GifPlayback     bool
+		ViewOnce        bool
+		ContextInfo     waProto.ContextInfo
+		Ephemeral       bool
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t imageStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.decodeFailed(w, r, err, "video")
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if t.Video == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Video in Payload"))
+			return
+		}
+
+		recipient, err := validateMessageFields(client, t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		if err != nil {
+			hlog.FromRequest(r).Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		var quoted *waProto.ContextInfo
+		if t.ContextInfo.StanzaID != nil {
+			quoted, err = s.quotedContext(r, recipient, &t.ContextInfo)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		var expiration uint32
+		if t.Ephemeral {
+			expiration, err = s.ephemeralTimer(client, userid, recipient)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+		}
+
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		} else {
+			msgid = t.Id
+		}
+
+		var uploaded whatsmeow.UploadResponse
+		var filedata []byte
+
+		if !strings.HasPrefix(t.Video, "data") {
+			s.Respond(w, r, http.StatusUnprocessableEntity, newAPIError(ErrInvalidMedia, "Data should start with \"data:mime/type;base64,\"", nil))
+			return
+		}
+		dataURL, err := dataurl.DecodeString(t.Video)
+		if err != nil {
+			s.Respond(w, r, http.StatusUnprocessableEntity, newAPIError(ErrInvalidMedia, "Could not decode base64 encoded data from payload", nil))
+			return
+		}
+		filedata = dataURL.Data
+
+		// Caller given thumbnail and duration win over the probed ones
+		thumbnail := t.JPEGThumbnail
+		var thumbnailWidth, thumbnailHeight uint32
+		if t.ThumbnailBase64 != "" {
+			thumbnail, thumbnailWidth, thumbnailHeight, err = decodeThumbnail(t.ThumbnailBase64)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+		info, frame, frameWidth, frameHeight, err := inspectVideo(filedata)
+		if err != nil {
+			hlog.FromRequest(r).Warn().Err(err).Msg("Could not inspect video")
+		}
+		if thumbnail == nil && frame != nil {
+			thumbnail, thumbnailWidth, thumbnailHeight = frame, frameWidth, frameHeight
+		}
+		if t.Seconds == 0 {
+			t.Seconds = info.Seconds
+		}
+		warning := ""
+		if info.Codec != "" && !Find(playableVideoCodecs, info.Codec) {
+			warning = fmt.Sprintf("Video is %s, iOS recipients can only play H.264", info.Codec)
+			hlog.FromRequest(r).Warn().Str("codec", info.Codec).Msg("Sending video iOS can't play")
+		}
+
+		ctx, cancel := sendContext(r)
+		defer cancel()
+
+		uploaded, err = tracedUpload(ctx, client, filedata, whatsmeow.MediaVideo)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "Failed to upload file", err))
+			return
+		}
+
+		msg := &waProto.Message{VideoMessage: &waProto.VideoMessage{
+			Caption:       proto.String(t.Caption),
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(http.DetectContentType(filedata)),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(filedata))),
+			JPEGThumbnail: thumbnail,
+		}}
+		if t.Seconds > 0 {
+			msg.VideoMessage.Seconds = proto.Uint32(t.Seconds)
+		}
+		// The video size, or the thumbnail's which has its aspect ratio
+		if info.Width > 0 && info.Height > 0 {
+			msg.VideoMessage.Width, msg.VideoMessage.Height = proto.Uint32(info.Width), proto.Uint32(info.Height)
+		} else if thumbnailWidth > 0 && thumbnailHeight > 0 {
+			msg.VideoMessage.Width, msg.VideoMessage.Height = proto.Uint32(thumbnailWidth), proto.Uint32(thumbnailHeight)
+		}
+		if t.GifPlayback {
+			msg.VideoMessage.GifPlayback = proto.Bool(true)
+		}
+
+		if quoted != nil {
+			msg.VideoMessage.ContextInfo = quoted
+		}
+		if(t.ContextInfo.MentionedJID != nil) {
+			if(msg.VideoMessage.ContextInfo == nil) {
+				msg.VideoMessage.ContextInfo = &waProto.ContextInfo{}
+			}
+			msg.VideoMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		}
+
+		if t.ViewOnce {
+			msg.VideoMessage.ViewOnce = proto.Bool(true)
+			msg = viewOnceMessage(msg)
+		}
+
+		setMessageExpiration(msg, expiration)
+		resp, err = tracedSend(ctx, client, recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "Error sending message", err))
+			return
+		}
+
+		s.recordSent(r, client, recipient, msgid, msg, resp.Timestamp)
+		hlog.FromRequest(r).Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid, "JID": recipient.String()}
+		if expiration > 0 {
+			response["Expiration"] = expiration
+		}
+		s.waitReceipt(r, msgid, response)
+		if warning != "" {
+			response["Warning"] = warning
+		}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Sends Contact
+func (s *server) SendContact() http.HandlerFunc {
+
+	type contactStruct struct {
+		Phone       string
+		Id          string
+		Name        string
+		Vcard       string
+		ContextInfo waProto.ContextInfo
+		Ephemeral   bool
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		decoder := json.NewDecoder(r.Body)
+		var t contactStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+		if t.Name == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Name in Payload"))
+			return
+		}
+		if t.Vcard == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Vcard in Payload"))
+			return
+		}
+
+		recipient, err := validateMessageFields(client, t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		if err != nil {
+			hlog.FromRequest(r).Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		var quoted *waProto.ContextInfo
+		if t.ContextInfo.StanzaID != nil {
+			quoted, err = s.quotedContext(r, recipient, &t.ContextInfo)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		var expiration uint32
+		if t.Ephemeral {
+			expiration, err = s.ephemeralTimer(client, userid, recipient)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+		}
+
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		} else {
+			msgid = t.Id
+		}
+
+		msg := &waProto.Message{ContactMessage: &waProto.ContactMessage{
+			DisplayName: &t.Name,
+			Vcard:       &t.Vcard,
+		}}
+
+		if quoted != nil {
+			msg.ExtendedTextMessage.ContextInfo = quoted
+		}
+		if(t.ContextInfo.MentionedJID != nil) {
+			if(msg.ExtendedTextMessage.ContextInfo == nil) {
+				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
+			}
+			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		}
+
+		ctx, cancel := sendContext(r)
+		defer cancel()
+
+		setMessageExpiration(msg, expiration)
+		resp, err = tracedSend(ctx, client, recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "Error sending message", err))
+			return
+		}
+
+		s.recordSent(r, client, recipient, msgid, msg, resp.Timestamp)
+		hlog.FromRequest(r).Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid, "JID": recipient.String()}
+		if expiration > 0 {
+			response["Expiration"] = expiration
+		}
+		s.waitReceipt(r, msgid, response)
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Sends location
+func (s *server) SendLocation() http.HandlerFunc {
+
+	type locationStruct struct {
+		Phone       string
+		Id          string
+		Name        string
+		Latitude    float64
+		Longitude   float64
+		ContextInfo waProto.ContextInfo
+		Ephemeral   bool
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		decoder := json.NewDecoder(r.Body)
+		var t locationStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+		if t.Latitude == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Latitude in Payload"))
+			return
+		}
+		if t.Longitude == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Longitude in Payload"))
+			return
+		}
+
+		recipient, err := validateMessageFields(client, t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		if err != nil {
+			hlog.FromRequest(r).Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		var quoted *waProto.ContextInfo
+		if t.ContextInfo.StanzaID != nil {
+			quoted, err = s.quotedContext(r, recipient, &t.ContextInfo)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		var expiration uint32
+		if t.Ephemeral {
+			expiration, err = s.ephemeralTimer(client, userid, recipient)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+		}
+
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		} else {
+			msgid = t.Id
+		}
+
+		msg := &waProto.Message{LocationMessage: &waProto.LocationMessage{
+			DegreesLatitude:  &t.Latitude,
+			DegreesLongitude: &t.Longitude,
+			Name:             &t.Name,
+		}}
+
+		if quoted != nil {
+			msg.ExtendedTextMessage.ContextInfo = quoted
+		}
+		if(t.ContextInfo.MentionedJID != nil) {
+			if(msg.ExtendedTextMessage.ContextInfo == nil) {
+				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
+			}
+			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		}
+
+		ctx, cancel := sendContext(r)
+		defer cancel()
+
+		setMessageExpiration(msg, expiration)
+		resp, err = tracedSend(ctx, client, recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "Error sending message", err))
+			return
+		}
+
+		s.recordSent(r, client, recipient, msgid, msg, resp.Timestamp)
+		hlog.FromRequest(r).Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid, "JID": recipient.String()}
+		if expiration > 0 {
+			response["Expiration"] = expiration
+		}
+		s.waitReceipt(r, msgid, response)
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Sends a buttons message with up to three quick replies. WhatsApp only
+// shows them on some clients, so it has to be enabled with -buttons
+func (s *server) SendButtons() http.HandlerFunc {
+
+    type buttonStruct struct {
+        ButtonId   string
+        ButtonText string
+    }
+	type textStruct struct {
+        Phone   string
+        Title   string
+        Buttons []buttonStruct
+        Id      string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if !*buttons {
+			s.Respond(w, r, http.StatusForbidden, errors.New("Buttons messages are disabled, start the server with -buttons to enable them"))
+			return
+		}
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		decoder := json.NewDecoder(r.Body)
+		var t textStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if t.Title == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Title in Payload"))
 			return
 		}
 
@@ -1433,316 +2333,1836 @@ func (s *server) SendButtons() http.HandlerFunc {
             s.Respond(w, r, http.StatusBadRequest, errors.New("missing Buttons in Payload"))
             return
         }
-        if len(t.Buttons) > 3 {
-            s.Respond(w, r, http.StatusBadRequest, errors.New("buttons cant more than 3"))
+        if len(t.Buttons) > 3 {
+            s.Respond(w, r, http.StatusBadRequest, errors.New("buttons cant more than 3"))
+            return
+        }
+        var buttonIds []string
+        for _, item := range t.Buttons {
+            if item.ButtonId == "" || item.ButtonText == "" {
+                s.Respond(w, r, http.StatusBadRequest, errors.New("missing ButtonId or ButtonText in Buttons"))
+                return
+            }
+            if Find(buttonIds, item.ButtonId) {
+                s.Respond(w, r, http.StatusBadRequest, errors.New("duplicated ButtonId "+item.ButtonId))
+                return
+            }
+            buttonIds = append(buttonIds, item.ButtonId)
+        }
+
+		recipient, err := resolveRecipient(client, "Phone", t.Phone)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		} else {
+			msgid = t.Id
+		}
+
+        var buttons []*waProto.ButtonsMessage_Button
+
+        for _, item := range t.Buttons {
+            buttons = append(buttons, &waProto.ButtonsMessage_Button{
+                ButtonID:       proto.String(item.ButtonId),
+                ButtonText:     &waProto.ButtonsMessage_Button_ButtonText{DisplayText: proto.String(item.ButtonText)},
+                Type:           waProto.ButtonsMessage_Button_RESPONSE.Enum(),
+                NativeFlowInfo: &waProto.ButtonsMessage_Button_NativeFlowInfo{},
+            })
+        }
+
+        msg2 := &waProto.ButtonsMessage{
+            ContentText: proto.String(t.Title),
+            HeaderType:  waProto.ButtonsMessage_EMPTY.Enum(),
+            Buttons:     buttons,
+        }
+
+		msg := &waProto.Message{ViewOnceMessage: &waProto.FutureProofMessage{
+            Message: &waProto.Message{
+                ButtonsMessage: msg2,
+            },
+        }}
+
+		ctx, cancel := sendContext(r)
+		defer cancel()
+
+		resp, err = tracedSend(ctx, client, recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+        if err != nil {
+            hlog.FromRequest(r).Warn().Err(err).Str("id", msgid).Msg("Buttons message rejected")
+            s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "WhatsApp rejected the buttons message", err))
+            return
+        }
+
+		s.recordSent(r, client, recipient, msgid, msg, resp.Timestamp)
+		hlog.FromRequest(r).Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid, "JID": recipient.String()}
+		s.waitReceipt(r, msgid, response)
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// SendList
+// https://github.com/tulir/whatsmeow/issues/305
+func (s *server) SendList() http.HandlerFunc {
+
+    type rowsStruct struct {
+        RowId       string
+        Title       string
+        Description string
+    }
+
+    type sectionsStruct struct {
+        Title string
+        Rows  []rowsStruct
+    }
+
+    type listStruct struct {
+        Phone       string
+        Title       string
+        Description string
+        ButtonText  string
+        FooterText  string
+        Sections    []sectionsStruct
+        Id          string
+    }
+
+    return func(w http.ResponseWriter, r *http.Request) {
+
+        txtid := r.Context().Value("userinfo").(Values).Get("Id")
+        userid, _ := strconv.Atoi(txtid)
+
+        client := sessions.client(userid)
+        if client == nil {
+            s.Respond(w, r, http.StatusConflict, errNoSession)
+            return
+        }
+
+        msgid := ""
+        var resp whatsmeow.SendResponse
+
+        decoder := json.NewDecoder(r.Body)
+        var t listStruct
+        err := decoder.Decode(&t)
+        if err != nil {
+            s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+            return
+        }
+
+        if t.Phone == "" {
+            s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
+            return
+        }
+
+        if t.Title == "" {
+            s.Respond(w, r, http.StatusBadRequest, errors.New("missing Title in Payload"))
+            return
+        }
+
+        if t.Description == "" {
+            s.Respond(w, r, http.StatusBadRequest, errors.New("missing Description in Payload"))
+            return
+        }
+
+        if t.ButtonText == "" {
+            s.Respond(w, r, http.StatusBadRequest, errors.New("missing ButtonText in Payload"))
+            return
+        }
+
+        if len(t.Sections) < 1 {
+            s.Respond(w, r, http.StatusBadRequest, errors.New("missing Sections in Payload"))
+            return
+        }
+        for _, section := range t.Sections {
+            if len(section.Rows) < 1 {
+                s.Respond(w, r, http.StatusBadRequest, errors.New("missing Rows in Section"))
+                return
+            }
+            for _, row := range section.Rows {
+                if row.Title == "" {
+                    s.Respond(w, r, http.StatusBadRequest, errors.New("missing Title in Row"))
+                    return
+                }
+            }
+        }
+        recipient, err := resolveRecipient(client, "Phone", t.Phone)
+        if err != nil {
+            s.Respond(w, r, http.StatusBadRequest, err)
+            return
+        }
+
+        if t.Id == "" {
+            msgid = whatsmeow.GenerateMessageID()
+        } else {
+            msgid = t.Id
+        }
+
+        var sections []*waProto.ListMessage_Section
+
+        // Rows without an id are numbered across the whole list, so the
+        // selected one can be told apart in the reply
+        id := 0
+        for _, item := range t.Sections {
+            var rows []*waProto.ListMessage_Row
+            for _, row := range item.Rows {
+                id++
+                var idtext string
+                if row.RowId == "" {
+                    idtext = strconv.Itoa(id)
+                } else {
+                    idtext = row.RowId
+                }
+                rows = append(rows, &waProto.ListMessage_Row{
+                    RowID:       proto.String(idtext),
+                    Title:       proto.String(row.Title),
+                    Description: proto.String(row.Description),
+                })
+            }
+
+            sections = append(sections, &waProto.ListMessage_Section{
+                Title: proto.String(item.Title),
+                Rows:  rows,
+            })
+        }
+        msg1 := &waProto.ListMessage{
+            Title:       proto.String(t.Title),
+            Description: proto.String(t.Description),
+            ButtonText:  proto.String(t.ButtonText),
+            ListType:    waProto.ListMessage_SINGLE_SELECT.Enum(),
+            Sections:    sections,
+            FooterText:  proto.String(t.FooterText),
+        }
+
+		msg := &waProto.Message{
+            ViewOnceMessage: &waProto.FutureProofMessage{
+                Message: &waProto.Message{
+                    ListMessage: msg1,
+                },
+            }}
+
+		ctx, cancel := sendContext(r)
+		defer cancel()
+
+		resp, err = tracedSend(ctx, client, recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+        if err != nil {
+            hlog.FromRequest(r).Warn().Err(err).Str("id", msgid).Msg("List message rejected")
+            s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "WhatsApp rejected the list message (needs a business account, not shown on all clients)", err))
             return
         }
 
-		recipient, ok := parseJID(t.Phone)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+        s.recordSent(r, client, recipient, msgid, msg, resp.Timestamp)
+        hlog.FromRequest(r).Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid, "JID": recipient.String()}
+		s.waitReceipt(r, msgid, response)
+		responseJson, err := json.Marshal(response)
+        if err != nil {
+            s.Respond(w, r, http.StatusInternalServerError, err)
+        } else {
+            s.Respond(w, r, http.StatusOK, string(responseJson))
+        }
+        return
+    }
+}
+
+// Sends a message given as the JSON (protojson) of a waE2E.Message, as is,
+// for message types without an endpoint of their own. WhatsApp may silently
+// drop messages it doesn't accept, nothing beyond parsing is checked.
+func (s *server) SendProto() http.HandlerFunc {
+
+	type protoStruct struct {
+		Phone   string
+		Message json.RawMessage
+		Id      string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if !*rawProto {
+			s.Respond(w, r, http.StatusForbidden, errors.New("Raw proto messages are disabled, start the server with -raw-proto to enable them"))
+			return
+		}
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		var t protoStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+		if len(t.Message) == 0 || string(t.Message) == "null" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Message in Payload"))
+			return
+		}
+
+		msg := &waProto.Message{}
+		if err := protojson.Unmarshal(t.Message, msg); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid Message: %v", err)))
+			return
+		}
+		if proto.Size(msg) == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid Message, it has no content"))
+			return
+		}
+
+		recipient, err := validateMessageFields(client, t.Phone, nil, nil)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		msgid := t.Id
+		if msgid == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		}
+
+		ctx, cancel := sendContext(r)
+		defer cancel()
+
+		resp, err := tracedSend(ctx, client, recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "Error sending message", err))
+			return
+		}
+
+		s.recordSent(r, client, recipient, msgid, msg, resp.Timestamp)
+		hlog.FromRequest(r).Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid, "JID": recipient.String()}
+		s.waitReceipt(r, msgid, response)
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Sends a regular text message
+func (s *server) SendMessage() http.HandlerFunc {
+
+	type textStruct struct {
+		Phone       string
+		Body        string
+		Id          string
+		ContextInfo waProto.ContextInfo
+		Ephemeral   bool
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		decoder := json.NewDecoder(r.Body)
+		var t textStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if t.Body == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Body in Payload"))
+			return
+		}
+
+		recipient, err := validateMessageFields(client, t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		if err != nil {
+			hlog.FromRequest(r).Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		var quoted *waProto.ContextInfo
+		if t.ContextInfo.StanzaID != nil {
+			quoted, err = s.quotedContext(r, recipient, &t.ContextInfo)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		var expiration uint32
+		if t.Ephemeral {
+			expiration, err = s.ephemeralTimer(client, userid, recipient)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+		}
+
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		} else {
+			msgid = t.Id
+		}
+
+		//	msg := &waProto.Message{Conversation: &t.Body}
+
+		msg := &waProto.Message{
+			ExtendedTextMessage: &waProto.ExtendedTextMessage{
+				Text: &t.Body,
+			},
+		}
+
+		if quoted != nil {
+			msg.ExtendedTextMessage.ContextInfo = quoted
+		}
+		if(t.ContextInfo.MentionedJID != nil) {
+			if(msg.ExtendedTextMessage.ContextInfo == nil) {
+				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
+			}
+			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		}
+
+		ctx, cancel := sendContext(r)
+		defer cancel()
+
+		setMessageExpiration(msg, expiration)
+		resp, err = tracedSend(ctx, client, recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "Error sending message", err))
+			return
+		}
+
+		s.recordSent(r, client, recipient, msgid, msg, resp.Timestamp)
+		hlog.FromRequest(r).Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid, "JID": recipient.String()}
+		if expiration > 0 {
+			response["Expiration"] = expiration
+		}
+		s.waitReceipt(r, msgid, response)
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+/*
+// Sends a Template message
+func (s *server) SendTemplate() http.HandlerFunc {
+
+	type buttonStruct struct {
+		DisplayText string
+		Id          string
+		Url         string
+		PhoneNumber string
+		Type        string
+	}
+
+	type templateStruct struct {
+		Phone   string
+		Content string
+		Footer  string
+		Id      string
+		Buttons []buttonStruct
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		msgid := ""
+		var resp whatsmeow.SendResponse
+//var ts time.Time
+
+		decoder := json.NewDecoder(r.Body)
+		var t templateStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if t.Content == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Content in Payload"))
+			return
+		}
+
+		if t.Footer == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Footer in Payload"))
+			return
+		}
+
+		if len(t.Buttons) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Buttons in Payload"))
+			return
+		}
+
+		recipient, err := resolveRecipient(client, "Phone", t.Phone)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		} else {
+			msgid = t.Id
+		}
+
+		var buttons []*waProto.HydratedTemplateButton
+
+		id := 1
+		for _, item := range t.Buttons {
+			switch item.Type {
+			case "quickreply":
+				var idtext string
+				text := item.DisplayText
+				if item.Id == "" {
+					idtext = strconv.Itoa(id)
+				} else {
+					idtext = item.Id
+				}
+				buttons = append(buttons, &waProto.HydratedTemplateButton{
+					HydratedButton: &waProto.HydratedTemplateButton_QuickReplyButton{
+						QuickReplyButton: &waProto.HydratedQuickReplyButton{
+							DisplayText: &text,
+							Id:          proto.String(idtext),
+						},
+					},
+				})
+			case "url":
+				text := item.DisplayText
+				url := item.Url
+				buttons = append(buttons, &waProto.HydratedTemplateButton{
+					HydratedButton: &waProto.HydratedTemplateButton_UrlButton{
+						UrlButton: &waProto.HydratedURLButton{
+							DisplayText: &text,
+							Url:         &url,
+						},
+					},
+				})
+			case "call":
+				text := item.DisplayText
+				phonenumber := item.PhoneNumber
+				buttons = append(buttons, &waProto.HydratedTemplateButton{
+					HydratedButton: &waProto.HydratedTemplateButton_CallButton{
+						CallButton: &waProto.HydratedCallButton{
+							DisplayText: &text,
+							PhoneNumber: &phonenumber,
+						},
+					},
+				})
+			default:
+				text := item.DisplayText
+				buttons = append(buttons, &waProto.HydratedTemplateButton{
+					HydratedButton: &waProto.HydratedTemplateButton_QuickReplyButton{
+						QuickReplyButton: &waProto.HydratedQuickReplyButton{
+							DisplayText: &text,
+							Id:          proto.String(string(id)),
+						},
+					},
+				})
+			}
+			id++
+		}
+
+		msg := &waProto.Message{TemplateMessage: &waProto.TemplateMessage{
+			HydratedTemplate: &waProto.HydratedFourRowTemplate{
+				HydratedContentText: proto.String(t.Content),
+				HydratedFooterText:  proto.String(t.Footer),
+				HydratedButtons:     buttons,
+				TemplateId:          proto.String("1"),
+			},
+		},
+		}
+
+		ctx, cancel := sendContext(r)
+		defer cancel()
+
+		resp, err = tracedSend(ctx, client, recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "Error sending message", err))
+			return
+		}
+
+		hlog.FromRequest(r).Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid, "JID": recipient.String()}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+*/
+// checks if users/phones are on Whatsapp
+func (s *server) CheckUser() http.HandlerFunc {
+
+	type checkUserStruct struct {
+		Phone []string
+	}
+
+	type User struct {
+		Query        string
+		IsInWhatsapp bool
+		JID          string
+		VerifiedName string
+	}
+
+	type UserCollection struct {
+		Users []User
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t checkUserStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if len(t.Phone) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		// Numbers are asked for normalized, Query answers with them as given
+		queries := make([]string, len(t.Phone))
+		given := make(map[string]string, len(t.Phone))
+		for i, phone := range t.Phone {
+			digits, err := normalizePhone(phone)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, recipientError("Phone", fmt.Errorf("%s, %v", phone, err)))
+				return
+			}
+			queries[i] = "+" + digits
+			given[queries[i]] = phone
+		}
+
+		resp, err := client.IsOnWhatsApp(queries)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to check if users are on WhatsApp: %s", err)))
+			return
+		}
+
+		uc := new(UserCollection)
+		for _, item := range resp {
+			if query, ok := given[item.Query]; ok {
+				item.Query = query
+			}
+			if item.VerifiedName != nil {
+				var msg = User{Query: item.Query, IsInWhatsapp: item.IsIn, JID: fmt.Sprintf("%s", item.JID), VerifiedName: item.VerifiedName.Details.GetVerifiedName()}
+				uc.Users = append(uc.Users, msg)
+			} else {
+				var msg = User{Query: item.Query, IsInWhatsapp: item.IsIn, JID: fmt.Sprintf("%s", item.JID), VerifiedName: ""}
+				uc.Users = append(uc.Users, msg)
+			}
+		}
+		responseJson, err := json.Marshal(uc)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Subscribes to the online/last seen presence of contacts, updates come as
+// Presence events
+func (s *server) SubscribePresence() http.HandlerFunc {
+
+	type subscribeStruct struct {
+		Phone []string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t subscribeStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if len(t.Phone) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		subscribed := []string{}
+		failed := map[string]string{}
+		for _, phone := range t.Phone {
+			if phone == "" {
+				continue
+			}
+			jid, err := parseRecipient(phone)
+			if err != nil {
+				failed[phone] = "invalid phone: " + err.Error()
+				continue
+			}
+			jid = jid.ToNonAD()
+			if err := client.SubscribePresence(jid); err != nil {
+				failed[phone] = err.Error()
+				continue
+			}
+			presenceSubscriptions.add(userid, jid)
+			subscribed = append(subscribed, jid.String())
+		}
+
+		response := map[string]interface{}{"Subscribed": subscribed, "Failed": failed}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets user information
+func (s *server) GetUser() http.HandlerFunc {
+
+	type checkUserStruct struct {
+		Phone []string
+	}
+
+	type UserCollection struct {
+		Users map[types.JID]types.UserInfo
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t checkUserStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if len(t.Phone) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		var jids []types.JID
+		for _, arg := range t.Phone {
+			jid, err := types.ParseJID(arg)
+			if err != nil {
+				return
+			}
+			jids = append(jids, jid)
+		}
+		resp, err := client.GetUserInfo(jids)
+
+		if err != nil {
+			msg := fmt.Sprintf("Failed to get user info: %v", err)
+			hlog.FromRequest(r).Error().Msg(msg)
+			s.Respond(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+
+		uc := new(UserCollection)
+		uc.Users = make(map[types.JID]types.UserInfo)
+
+		for jid, info := range resp {
+			uc.Users[jid] = info
+		}
+
+		responseJson, err := json.Marshal(uc)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Gets avatar info for user
+func (s *server) GetAvatar() http.HandlerFunc {
+
+	type getAvatarStruct struct {
+		Phone   string
+		Preview bool
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t getAvatarStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if len(t.Phone) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		jid, err := parseRecipient(t.Phone)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, recipientError("Phone", err))
+			return
+		}
+
+		var pic *types.ProfilePictureInfo
+
+		existingID := ""
+		pic, err = client.GetProfilePictureInfo(jid, &whatsmeow.GetProfilePictureParams{
+			Preview:    t.Preview,
+			ExistingID: existingID,
+		})
+		if err != nil {
+			msg := fmt.Sprintf("Failed to get avatar: %v", err)
+			hlog.FromRequest(r).Error().Msg(msg)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+			return
+		}
+
+		if pic == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No avatar found"))
+			return
+		}
+
+		hlog.FromRequest(r).Info().Str("id", pic.ID).Str("url", pic.URL).Msg("Got avatar")
+
+		responseJson, err := json.Marshal(pic)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Gets all contacts
+func (s *server) GetContacts() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		result := map[types.JID]types.ContactInfo{}
+		result, err := client.Store.Contacts.GetAllContacts()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		responseJson, err := json.Marshal(result)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+// Sets Chat Presence (typing/paused/recording audio)
+func (s *server) ChatPresence() http.HandlerFunc {
+
+	type chatPresenceStruct struct {
+		Phone string
+		State string
+		Media types.ChatPresenceMedia
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t chatPresenceStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if len(t.Phone) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if len(t.State) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing State in Payload"))
+			return
+		}
+
+		jid, err := parseRecipient(t.Phone)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, recipientError("Phone", err))
+			return
+		}
+
+		err = client.SendChatPresence(jid, types.ChatPresence(t.State), types.ChatPresenceMedia(t.Media))
+		if err != nil {
+			s.Respond(w, r, http.StatusBadGateway, newAPIError(ErrUpstreamFailed, "Failure sending chat presence to Whatsapp servers", nil))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Chat presence set successfuly"}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Shows the session online and typing in a chat for Duration seconds, or
+// until a message is sent to it, then sets the Revert presence
+func (s *server) ReplyBotOnline() http.HandlerFunc {
+
+	type replyBotStruct struct {
+		Phone    string
+		Duration int
+		Revert   string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t replyBotStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if len(t.Phone) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+		jid, err := parseRecipient(t.Phone)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, recipientError("Phone", err))
+			return
+		}
+
+		if t.Duration == 0 {
+			t.Duration = replyBotDefaultDuration
+		}
+		if t.Duration < 0 || t.Duration > replyBotMaxDuration {
+			s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid Duration, must be between 1 and %d seconds", replyBotMaxDuration)))
+			return
+		}
+		if t.Revert == "" {
+			t.Revert = "unavailable"
+		}
+		revert, ok := replyBotReverts[t.Revert]
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid Revert, must be unavailable, available or none"))
+			return
+		}
+
+		duration := time.Duration(t.Duration) * time.Second
+		if err := replyBots.start(userid, client, jid, duration, revert); err != nil {
+			s.Respond(w, r, http.StatusBadGateway, newAPIError(ErrUpstreamFailed, fmt.Sprintf("Failure sending presence to Whatsapp servers: %v", err), nil))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Typing started", "Chat": jid.String(), "Until": time.Now().Add(duration).Unix(), "Revert": t.Revert}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Downloads Image and returns base64 representation
+func (s *server) DownloadImage() http.HandlerFunc {
+
+	type downloadImageStruct struct {
+		Url           string
+		DirectPath    string
+		MediaKey      []byte
+		Mimetype      string
+		FileEncSHA256 []byte
+		FileSHA256    []byte
+		FileLength    uint64
+		Stream        bool
+		Id            string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		mimetype := ""
+		var imgdata []byte
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		// check/creates user directory for files
+		userDirectory := filepath.Join(s.exPath, "files", "user_"+txtid)
+		_, err := os.Stat(userDirectory)
+		if os.IsNotExist(err) {
+			errDir := os.MkdirAll(userDirectory, 0751)
+			if errDir != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
+				return
+			}
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t downloadImageStruct
+		err = decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		msg := &waProto.Message{ImageMessage: &waProto.ImageMessage{
+			URL:           proto.String(t.Url),
+			DirectPath:    proto.String(t.DirectPath),
+			MediaKey:      t.MediaKey,
+			Mimetype:      proto.String(t.Mimetype),
+			FileEncSHA256: t.FileEncSHA256,
+			FileSHA256:    t.FileSHA256,
+			FileLength:    &t.FileLength,
+		}}
+
+		img := msg.GetImageMessage()
+
+		// Media saved when the message was received is served from that copy,
+		// view once media is gone from the CDN once opened on the phone
+		if saved, ok := savedMedia(userDirectory, t.Id); ok {
+			s.respondSaved(w, r, saved, t.Mimetype, t.Stream)
+			return
+		}
+
+		// Raw bytes straight to the response instead of a data URL in JSON
+		if t.Stream {
+			s.streamMedia(w, r, client, userid, img, img.GetMimetype(), t.FileLength)
+			return
+		}
+
+		if img != nil {
+			imgdata, err = tracedDownload(r.Context(), client, img)
+			if err != nil {
+				hlog.FromRequest(r).Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download image")
+				s.Respond(w, r, http.StatusInternalServerError, downloadFailed(err, "image"))
+				return
+			}
+			mimetype = img.GetMimetype()
+		}
+
+		dataURL := dataurl.New(imgdata, mimetype)
+		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Downloads Document and returns base64 representation
+func (s *server) DownloadDocument() http.HandlerFunc {
+
+	type downloadDocumentStruct struct {
+		Url           string
+		DirectPath    string
+		MediaKey      []byte
+		Mimetype      string
+		FileEncSHA256 []byte
+		FileSHA256    []byte
+		FileLength    uint64
+		Stream        bool
+		Id            string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		mimetype := ""
+		var docdata []byte
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		// check/creates user directory for files
+		userDirectory := filepath.Join(s.exPath, "files", "user_"+txtid)
+		_, err := os.Stat(userDirectory)
+		if os.IsNotExist(err) {
+			errDir := os.MkdirAll(userDirectory, 0751)
+			if errDir != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
+				return
+			}
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t downloadDocumentStruct
+		err = decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		msg := &waProto.Message{DocumentMessage: &waProto.DocumentMessage{
+			URL:           proto.String(t.Url),
+			DirectPath:    proto.String(t.DirectPath),
+			MediaKey:      t.MediaKey,
+			Mimetype:      proto.String(t.Mimetype),
+			FileEncSHA256: t.FileEncSHA256,
+			FileSHA256:    t.FileSHA256,
+			FileLength:    &t.FileLength,
+		}}
+
+		doc := msg.GetDocumentMessage()
+
+		// Media saved when the message was received is served from that copy,
+		// view once media is gone from the CDN once opened on the phone
+		if saved, ok := savedMedia(userDirectory, t.Id); ok {
+			s.respondSaved(w, r, saved, t.Mimetype, t.Stream)
+			return
+		}
+
+		// Raw bytes straight to the response instead of a data URL in JSON
+		if t.Stream {
+			s.streamMedia(w, r, client, userid, doc, doc.GetMimetype(), t.FileLength)
+			return
+		}
+
+		if doc != nil {
+			docdata, err = tracedDownload(r.Context(), client, doc)
+			if err != nil {
+				hlog.FromRequest(r).Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download document")
+				s.Respond(w, r, http.StatusInternalServerError, downloadFailed(err, "document"))
+				return
+			}
+			mimetype = doc.GetMimetype()
+		}
+
+		dataURL := dataurl.New(docdata, mimetype)
+		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Downloads Video and returns base64 representation
+func (s *server) DownloadVideo() http.HandlerFunc {
+
+	type downloadVideoStruct struct {
+		Url           string
+		DirectPath    string
+		MediaKey      []byte
+		Mimetype      string
+		FileEncSHA256 []byte
+		FileSHA256    []byte
+		FileLength    uint64
+		Stream        bool
+		Id            string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		mimetype := ""
+		var docdata []byte
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		// check/creates user directory for files
+		userDirectory := filepath.Join(s.exPath, "files", "user_"+txtid)
+		_, err := os.Stat(userDirectory)
+		if os.IsNotExist(err) {
+			errDir := os.MkdirAll(userDirectory, 0751)
+			if errDir != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
+				return
+			}
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t downloadVideoStruct
+		err = decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		msg := &waProto.Message{VideoMessage: &waProto.VideoMessage{
+			URL:           proto.String(t.Url),
+			DirectPath:    proto.String(t.DirectPath),
+			MediaKey:      t.MediaKey,
+			Mimetype:      proto.String(t.Mimetype),
+			FileEncSHA256: t.FileEncSHA256,
+			FileSHA256:    t.FileSHA256,
+			FileLength:    &t.FileLength,
+		}}
+
+		doc := msg.GetVideoMessage()
+
+		// Media saved when the message was received is served from that copy,
+		// view once media is gone from the CDN once opened on the phone
+		if saved, ok := savedMedia(userDirectory, t.Id); ok {
+			s.respondSaved(w, r, saved, t.Mimetype, t.Stream)
+			return
+		}
+
+		// Raw bytes straight to the response instead of a data URL in JSON
+		if t.Stream {
+			s.streamMedia(w, r, client, userid, doc, doc.GetMimetype(), t.FileLength)
+			return
+		}
+
+		if doc != nil {
+			docdata, err = tracedDownload(r.Context(), client, doc)
+			if err != nil {
+				hlog.FromRequest(r).Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download video")
+				s.Respond(w, r, http.StatusInternalServerError, downloadFailed(err, "video"))
+				return
+			}
+			mimetype = doc.GetMimetype()
+		}
+
+		dataURL := dataurl.New(docdata, mimetype)
+		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Downloads Audio and returns base64 representation
+func (s *server) DownloadAudio() http.HandlerFunc {
+
+	type downloadAudioStruct struct {
+		Url           string
+		DirectPath    string
+		MediaKey      []byte
+		Mimetype      string
+		FileEncSHA256 []byte
+		FileSHA256    []byte
+		FileLength    uint64
+		Stream        bool
+		Id            string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		mimetype := ""
+		var docdata []byte
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		// check/creates user directory for files
+		userDirectory := filepath.Join(s.exPath, "files", "user_"+txtid)
+		_, err := os.Stat(userDirectory)
+		if os.IsNotExist(err) {
+			errDir := os.MkdirAll(userDirectory, 0751)
+			if errDir != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
+				return
+			}
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t downloadAudioStruct
+		err = decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		msg := &waProto.Message{AudioMessage: &waProto.AudioMessage{
+			URL:           proto.String(t.Url),
+			DirectPath:    proto.String(t.DirectPath),
+			MediaKey:      t.MediaKey,
+			Mimetype:      proto.String(t.Mimetype),
+			FileEncSHA256: t.FileEncSHA256,
+			FileSHA256:    t.FileSHA256,
+			FileLength:    &t.FileLength,
+		}}
+
+		doc := msg.GetAudioMessage()
+
+		// Media saved when the message was received is served from that copy,
+		// view once media is gone from the CDN once opened on the phone
+		if saved, ok := savedMedia(userDirectory, t.Id); ok {
+			s.respondSaved(w, r, saved, t.Mimetype, t.Stream)
+			return
+		}
+
+		// Raw bytes straight to the response instead of a data URL in JSON
+		if t.Stream {
+			s.streamMedia(w, r, client, userid, doc, doc.GetMimetype(), t.FileLength)
+			return
+		}
+
+		if doc != nil {
+			docdata, err = tracedDownload(r.Context(), client, doc)
+			if err != nil {
+				hlog.FromRequest(r).Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download audio")
+				s.Respond(w, r, http.StatusInternalServerError, downloadFailed(err, "audio"))
+				return
+			}
+			mimetype = doc.GetMimetype()
+		}
+
+		dataURL := dataurl.New(docdata, mimetype)
+		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// React
+func (s *server) React() http.HandlerFunc {
+
+	type textStruct struct {
+		Phone string
+		Body  string
+		Id    string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		decoder := json.NewDecoder(r.Body)
+		var t textStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if t.Body == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Body in Payload"))
+			return
+		}
+
+		recipient, err := resolveRecipient(client, "Phone", t.Phone)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
 		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
+			return
 		} else {
 			msgid = t.Id
 		}
 
-        var buttons []*waProto.ButtonsMessage_Button
+		fromMe := false
+		if strings.HasPrefix(msgid, "me:") {
+			fromMe = true
+			msgid = msgid[len("me:"):]
+		}
+		reaction := t.Body
+		if reaction == "remove" {
+			reaction = ""
+		}
 
-        for _, item := range t.Buttons {
-            buttons = append(buttons, &waProto.ButtonsMessage_Button{
-                ButtonID:       proto.String(item.ButtonId),
-                ButtonText:     &waProto.ButtonsMessage_Button_ButtonText{DisplayText: proto.String(item.ButtonText)},
-                Type:           waProto.ButtonsMessage_Button_RESPONSE.Enum(),
-                NativeFlowInfo: &waProto.ButtonsMessage_Button_NativeFlowInfo{},
-            })
-        }
+		msg := &waProto.Message{
+			ReactionMessage: &waProto.ReactionMessage{
+				Key: &waProto.MessageKey{
+					RemoteJID: proto.String(recipient.String()),
+					FromMe:    proto.Bool(fromMe),
+					ID:        proto.String(msgid),
+				},
+				Text:              proto.String(reaction),
+				GroupingKey:       proto.String(reaction),
+				SenderTimestampMS: proto.Int64(time.Now().UnixMilli()),
+			},
+		}
 
-        msg2 := &waProto.ButtonsMessage{
-            ContentText: proto.String(t.Title),
-            HeaderType:  waProto.ButtonsMessage_EMPTY.Enum(),
-            Buttons:     buttons,
-        }
+		ctx, cancel := sendContext(r)
+		defer cancel()
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, &waProto.Message{ViewOnceMessage: &waProto.FutureProofMessage{
-            Message: &waProto.Message{
-                ButtonsMessage: msg2,
-            },
-        }}, whatsmeow.SendRequestExtra{ID: msgid})
-        if err != nil {
-            s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
-            return
-        }
+		resp, err = tracedSend(ctx, client, recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "Error sending message", err))
+			return
+		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		s.recordSent(r, client, recipient, msgid, msg, resp.Timestamp)
+		hlog.FromRequest(r).Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid, "JID": recipient.String()}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+
 		return
 	}
 }
 
-// SendList
-// https://github.com/tulir/whatsmeow/issues/305
-func (s *server) SendList() http.HandlerFunc {
+// Mark messages as read
+func (s *server) MarkRead() http.HandlerFunc {
 
-    type rowsStruct struct {
-        RowId       string
-        Title       string
-        Description string
-    }
+	type markReadStruct struct {
+		Id     []string
+		Chat   types.JID
+		Sender types.JID
+	}
 
-    type sectionsStruct struct {
-        Title string
-        Rows  []rowsStruct
-    }
+	return func(w http.ResponseWriter, r *http.Request) {
 
-    type listStruct struct {
-        Phone       string
-        Title       string
-        Description string
-        ButtonText  string
-        FooterText  string
-        Sections    []sectionsStruct
-        Id          string
-    }
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
 
-    return func(w http.ResponseWriter, r *http.Request) {
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
 
-        txtid := r.Context().Value("userinfo").(Values).Get("Id")
-        userid, _ := strconv.Atoi(txtid)
+		decoder := json.NewDecoder(r.Body)
+		var t markReadStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
 
-        if clientPointer[userid] == nil {
-            s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
-            return
-        }
+		if t.Chat.String() == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Chat in Payload"))
+			return
+		}
 
-        msgid := ""
-        var resp whatsmeow.SendResponse
+		if len(t.Id) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
+			return
+		}
 
-        decoder := json.NewDecoder(r.Body)
-        var t listStruct
-        err := decoder.Decode(&t)
-        marshal, _ := json.Marshal(t)
-        fmt.Println(string(marshal))
-        if err != nil {
-            fmt.Println(err)
-            s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
-            return
-        }
+		err = client.MarkRead(t.Id, time.Now(), t.Chat, t.Sender)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadGateway, newAPIError(ErrUpstreamFailed, "Failure marking messages as read", nil))
+			return
+		}
 
-        if t.Phone == "" {
-            s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
-            return
-        }
+		response := map[string]interface{}{"Details": "Message(s) marked as read"}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
 
-        if t.Title == "" {
-            s.Respond(w, r, http.StatusBadRequest, errors.New("missing Title in Payload"))
-            return
-        }
+// Lists stored messages newest first, optionally only one chat and only
+// those older than the before unix timestamp, for paging back
+func (s *server) ListMessages() http.HandlerFunc {
 
-        if t.Description == "" {
-            s.Respond(w, r, http.StatusBadRequest, errors.New("missing Description in Payload"))
-            return
-        }
+	return func(w http.ResponseWriter, r *http.Request) {
 
-        if t.ButtonText == "" {
-            s.Respond(w, r, http.StatusBadRequest, errors.New("missing ButtonText in Payload"))
-            return
-        }
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
 
-        if len(t.Sections) < 1 {
-            s.Respond(w, r, http.StatusBadRequest, errors.New("missing Sections in Payload"))
-            return
-        }
-        recipient, ok := parseJID(t.Phone)
-        if !ok {
-            s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse Phone"))
-            return
-        }
+		q, err := parseMessageQuery(r)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
 
-        if t.Id == "" {
-            msgid = whatsmeow.GenerateMessageID()
-        } else {
-            msgid = t.Id
-        }
+		messages, err := queryMessages(s.db, userid, q)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
+		}
 
-        var sections []*waProto.ListMessage_Section
+		response := map[string]interface{}{"Messages": messages}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
 
-        for _, item := range t.Sections {
-            var rows []*waProto.ListMessage_Row
-            id := 1
-            for _, row := range item.Rows {
-                var idtext string
-                if row.RowId == "" {
-                    idtext = strconv.Itoa(id)
-                } else {
-                    idtext = row.RowId
-                }
-                rows = append(rows, &waProto.ListMessage_Row{
-                    RowID:       proto.String(idtext),
-                    Title:       proto.String(row.Title),
-                    Description: proto.String(row.Description),
-                })
-            }
+// Delivery state of a message sent through the API, with the highest state
+// reached by each recipient (each participant in groups)
+func (s *server) GetMessageStatus() http.HandlerFunc {
 
-            sections = append(sections, &waProto.ListMessage_Section{
-                Title: proto.String(item.Title),
-                Rows:  rows,
-            })
-        }
-        msg1 := &waProto.ListMessage{
-            Title:       proto.String(t.Title),
-            Description: proto.String(t.Description),
-            ButtonText:  proto.String(t.ButtonText),
-            ListType:    waProto.ListMessage_SINGLE_SELECT.Enum(),
-            Sections:    sections,
-            FooterText:  proto.String(t.FooterText),
-        }
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		msgid := mux.Vars(r)["id"]
+
+		var chat string
+		var sent int64
+		err := s.db.QueryRow("SELECT chat_jid, timestamp FROM sent_messages WHERE user_id=? AND id=?", userid, msgid).Scan(&chat, &sent)
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Message not found, only messages sent through the API are tracked"))
+			return
+		}
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
+		}
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, &waProto.Message{
-            ViewOnceMessage: &waProto.FutureProofMessage{
-                Message: &waProto.Message{
-                    ListMessage: msg1,
-                },
-            }}, whatsmeow.SendRequestExtra{ID: msgid})
-        if err != nil {
-            s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
-            return
-        }
+		rows, err := s.db.Query("SELECT recipient_jid, state, rank, timestamp FROM message_receipts WHERE user_id=? AND message_id=? ORDER BY recipient_jid", userid, msgid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
+		}
+		defer rows.Close()
+
+		state := "sent"
+		highest := 0
+		recipients := []receiptState{}
+		for rows.Next() {
+			var receipt receiptState
+			var rank int
+			var timestamp int64
+			if err := rows.Scan(&receipt.Jid, &receipt.State, &rank, &timestamp); err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+				return
+			}
+			receipt.Timestamp = time.Unix(timestamp, 0)
+			recipients = append(recipients, receipt)
+			if rank > highest {
+				highest = rank
+				state = receipt.State
+			}
+		}
+		if err := rows.Err(); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
+		}
 
-        log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := map[string]interface{}{"Id": msgid, "Chat": chat, "Sent": time.Unix(sent, 0), "State": state, "Recipients": recipients}
 		responseJson, err := json.Marshal(response)
-        if err != nil {
-            s.Respond(w, r, http.StatusInternalServerError, err)
-        } else {
-            s.Respond(w, r, http.StatusOK, string(responseJson))
-        }
-        return
-    }
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
 }
 
-// Sends a regular text message
-func (s *server) SendMessage() http.HandlerFunc {
-
-	type textStruct struct {
-		Phone       string
-		Body        string
-		Id          string
-		ContextInfo waProto.ContextInfo
-	}
+// Delivery and read state of a message sent through the API for each
+// recipient, with the time of each receipt. In groups the participants who
+// sent no receipt yet are listed too.
+func (s *server) GetMessageInfo() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
 			return
 		}
 
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
-		decoder := json.NewDecoder(r.Body)
-		var t textStruct
-		err := decoder.Decode(&t)
+		msgid := r.URL.Query().Get("id")
+		if msgid == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing id parameter"))
+			return
+		}
+		chat, err := parseRecipient(r.URL.Query().Get("phone"))
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusBadRequest, recipientError("phone", err))
 			return
 		}
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		var trackedChat string
+		var sent int64
+		err = s.db.QueryRow("SELECT chat_jid, timestamp FROM sent_messages WHERE user_id=? AND id=?", userid, msgid).Scan(&trackedChat, &sent)
+		if err == sql.ErrNoRows || (err == nil && trackedChat != chat.ToNonAD().String()) {
+			s.Respond(w, r, http.StatusNotFound, errors.New("No info for this message, only messages sent through the API in the last -receiptretention are tracked"))
 			return
 		}
-
-		if t.Body == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Body in Payload"))
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
 			return
 		}
 
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		rows, err := s.db.Query("SELECT recipient_jid, state, delivered_at, read_at, played_at FROM message_receipts WHERE user_id=? AND message_id=? ORDER BY recipient_jid", userid, msgid)
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
 			return
 		}
+		defer rows.Close()
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
-		} else {
-			msgid = t.Id
+		recipients := []recipientInfo{}
+		seen := make(map[string]bool)
+		for rows.Next() {
+			var recipient recipientInfo
+			var delivered, read, played int64
+			if err := rows.Scan(&recipient.Jid, &recipient.State, &delivered, &read, &played); err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+				return
+			}
+			recipient.Delivered, recipient.Read, recipient.Played = receiptTime(delivered), receiptTime(read), receiptTime(played)
+			recipients = append(recipients, recipient)
+			if jid, err := types.ParseJID(recipient.Jid); err == nil {
+				seen[recipientKey(jid)] = true
+			}
+		}
+		if err := rows.Err(); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
 		}
 
-		//	msg := &waProto.Message{Conversation: &t.Body}
+		isGroup := chat.Server == types.GroupServer
+		if isGroup {
+			group, err := client.GetGroupInfo(chat)
+			if err != nil {
+				// Receipts are still worth returning without the pending ones
+				hlog.FromRequest(r).Warn().Err(err).Str("group", chat.String()).Msg("Could not get group participants for message info")
+			} else {
+				lids.learnGroup(group)
+				var own string
+				if client.Store.ID != nil {
+					own = recipientKey(*client.Store.ID)
+				}
+				for _, participant := range group.Participants {
+					key := recipientKey(participant.JID)
+					if key == own || seen[key] || seen[recipientKey(participant.LID)] {
+						continue
+					}
+					recipients = append(recipients, recipientInfo{Jid: participant.JID.String(), State: "sent"})
+				}
+			}
+		} else if len(recipients) == 0 {
+			recipients = append(recipients, recipientInfo{Jid: chat.ToNonAD().String(), State: "sent"})
+		}
 
-		msg := &waProto.Message{
-			ExtendedTextMessage: &waProto.ExtendedTextMessage{
-				Text: &t.Body,
-			},
+		counts := map[string]int{"sent": 0, "delivered": 0, "read": 0, "played": 0}
+		for _, recipient := range recipients {
+			counts[recipient.State]++
 		}
 
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
+		response := map[string]interface{}{"Id": msgid, "Chat": trackedChat, "IsGroup": isGroup, "Sent": time.Unix(sent, 0), "Counts": counts, "Recipients": recipients}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		if(t.ContextInfo.MentionedJID != nil) {
-			if(msg.ExtendedTextMessage.ContextInfo == nil) {
-				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
-			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+	}
+}
+
+// Gets the stored history of one chat, including messages imported from
+// history syncs, newest first
+func (s *server) GetHistory() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		if r.URL.Query().Get("phone") == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing phone parameter"))
+			return
+		}
+		q, err := parseMessageQuery(r)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
 		}
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		messages, err := queryMessages(s.db, userid, q)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := map[string]interface{}{"Chat": q.chat, "Messages": messages}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
-		return
 	}
 }
 
-/*
-// Sends a Template message
-func (s *server) SendTemplate() http.HandlerFunc {
-
-	type buttonStruct struct {
-		DisplayText string
-		Id          string
-		Url         string
-		PhoneNumber string
-		Type        string
-	}
+// Asks the phone for messages older than Before or the oldest one stored for
+// a chat, they arrive later as an on demand history sync tagged with the
+// request id
+func (s *server) RequestHistory() http.HandlerFunc {
 
-	type templateStruct struct {
-		Phone   string
-		Content string
-		Footer  string
-		Id      string
-		Buttons []buttonStruct
+	type historyStruct struct {
+		Phone  string
+		Count  int
+		Before string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1750,17 +4170,14 @@ func (s *server) SendTemplate() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
 			return
 		}
 
-		msgid := ""
-		var resp whatsmeow.SendResponse
-//var ts time.Time
-
 		decoder := json.NewDecoder(r.Body)
-		var t templateStruct
+		var t historyStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
@@ -1771,195 +4188,100 @@ func (s *server) SendTemplate() http.HandlerFunc {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
 			return
 		}
-
-		if t.Content == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Content in Payload"))
+		if t.Count == 0 {
+			t.Count = 50
+		}
+		if t.Count < 1 || t.Count > 500 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid Count, must be between 1 and 500"))
 			return
 		}
 
-		if t.Footer == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Footer in Payload"))
+		chat, err := parseRecipient(t.Phone)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, recipientError("Phone", err))
 			return
 		}
+		chat = chat.ToNonAD()
 
-		if len(t.Buttons) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Buttons in Payload"))
+		if client.Store.ID == nil {
+			s.Respond(w, r, http.StatusConflict, errNotLoggedIn)
 			return
 		}
 
-		recipient, ok := parseJID(t.Phone)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+		// WhatsApp sends what came before a known message
+		oldest, found, err := historyAnchor(s.db, userid, chat, t.Before)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
 			return
 		}
-
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
-		} else {
-			msgid = t.Id
+		if !found && t.Before != "" {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Before message not found in this chat"))
+			return
 		}
-
-		var buttons []*waProto.HydratedTemplateButton
-
-		id := 1
-		for _, item := range t.Buttons {
-			switch item.Type {
-			case "quickreply":
-				var idtext string
-				text := item.DisplayText
-				if item.Id == "" {
-					idtext = strconv.Itoa(id)
-				} else {
-					idtext = item.Id
-				}
-				buttons = append(buttons, &waProto.HydratedTemplateButton{
-					HydratedButton: &waProto.HydratedTemplateButton_QuickReplyButton{
-						QuickReplyButton: &waProto.HydratedQuickReplyButton{
-							DisplayText: &text,
-							Id:          proto.String(idtext),
-						},
-					},
-				})
-			case "url":
-				text := item.DisplayText
-				url := item.Url
-				buttons = append(buttons, &waProto.HydratedTemplateButton{
-					HydratedButton: &waProto.HydratedTemplateButton_UrlButton{
-						UrlButton: &waProto.HydratedURLButton{
-							DisplayText: &text,
-							Url:         &url,
-						},
-					},
-				})
-			case "call":
-				text := item.DisplayText
-				phonenumber := item.PhoneNumber
-				buttons = append(buttons, &waProto.HydratedTemplateButton{
-					HydratedButton: &waProto.HydratedTemplateButton_CallButton{
-						CallButton: &waProto.HydratedCallButton{
-							DisplayText: &text,
-							PhoneNumber: &phonenumber,
-						},
-					},
-				})
-			default:
-				text := item.DisplayText
-				buttons = append(buttons, &waProto.HydratedTemplateButton{
-					HydratedButton: &waProto.HydratedTemplateButton_QuickReplyButton{
-						QuickReplyButton: &waProto.HydratedQuickReplyButton{
-							DisplayText: &text,
-							Id:          proto.String(string(id)),
-						},
-					},
-				})
-			}
-			id++
+		if !found {
+			s.Respond(w, r, http.StatusNotFound, errors.New("No messages known for this chat to request history from"))
+			return
 		}
 
-		msg := &waProto.Message{TemplateMessage: &waProto.TemplateMessage{
-			HydratedTemplate: &waProto.HydratedFourRowTemplate{
-				HydratedContentText: proto.String(t.Content),
-				HydratedFooterText:  proto.String(t.Footer),
-				HydratedButtons:     buttons,
-				TemplateId:          proto.String("1"),
-			},
-		},
-		}
+		msg := client.BuildHistorySyncRequest(&oldest, t.Count)
+		ctx, cancel := sendContext(r)
+		defer cancel()
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(),recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		// Known before sending, the answer can be quick
+		requestID := requestIDFrom(r)
+		historyRequests.Set(historyRequestKey(userid, chat), requestID, cache.DefaultExpiration)
+		_, err = tracedSend(ctx, client, client.Store.ID.ToNonAD(), msg, whatsmeow.SendRequestExtra{Peer: true})
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			historyRequests.Delete(historyRequestKey(userid, chat))
+			s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "Error sending history sync request", err))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		hlog.FromRequest(r).Info().Str("chat", chat.String()).Str("before", oldest.ID).Int("count", t.Count).Msg("Requested history sync")
+		response := map[string]interface{}{"Details": "History sync requested", "Chat": chat.String(), "Before": oldest.ID, "RequestId": requestID}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
-*/
-// checks if users/phones are on Whatsapp
-func (s *server) CheckUser() http.HandlerFunc {
-
-	type checkUserStruct struct {
-		Phone []string
-	}
-
-	type User struct {
-		Query        string
-		IsInWhatsapp bool
-		JID          string
-		VerifiedName string
-	}
 
-	type UserCollection struct {
-		Users []User
-	}
+// Gets a stored message by id
+func (s *server) GetMessage() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
+		msgid := mux.Vars(r)["id"]
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		m, err := scanMessage(s.db.QueryRow("SELECT "+storedMessageColumns+" FROM messages WHERE user_id=? AND id=?", userid, msgid))
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Message not found"))
 			return
 		}
-
-		decoder := json.NewDecoder(r.Body)
-		var t checkUserStruct
-		err := decoder.Decode(&t)
-		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
-			return
-		}
-
-		if len(t.Phone) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
-			return
-		}
-
-		resp, err := clientPointer[userid].IsOnWhatsApp(t.Phone)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to check if users are on WhatsApp: %s", err)))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
 			return
 		}
 
-		uc := new(UserCollection)
-		for _, item := range resp {
-			if item.VerifiedName != nil {
-				var msg = User{Query: item.Query, IsInWhatsapp: item.IsIn, JID: fmt.Sprintf("%s", item.JID), VerifiedName: item.VerifiedName.Details.GetVerifiedName()}
-				uc.Users = append(uc.Users, msg)
-			} else {
-				var msg = User{Query: item.Query, IsInWhatsapp: item.IsIn, JID: fmt.Sprintf("%s", item.JID), VerifiedName: ""}
-				uc.Users = append(uc.Users, msg)
-			}
-		}
-		responseJson, err := json.Marshal(uc)
+		responseJson, err := json.Marshal(m)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// Gets user information
-func (s *server) GetUser() http.HandlerFunc {
-
-	type checkUserStruct struct {
-		Phone []string
-	}
+// Declines an incoming call that is still ringing
+func (s *server) RejectCall() http.HandlerFunc {
 
-	type UserCollection struct {
-		Users map[types.JID]types.UserInfo
+	type rejectStruct struct {
+		CallID string
+		Phone  string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1967,64 +4289,64 @@ func (s *server) GetUser() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
 			return
 		}
 
 		decoder := json.NewDecoder(r.Body)
-		var t checkUserStruct
+		var t rejectStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
-
-		if len(t.Phone) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		if t.CallID == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing CallID in Payload"))
 			return
 		}
 
-		var jids []types.JID
-		for _, arg := range t.Phone {
-			jid, err := types.ParseJID(arg)
+		// The caller is known from the offer, Phone is only needed for calls
+		// offered before the session started
+		from, ok := calls.ringing(userid, t.CallID)
+		if t.Phone != "" {
+			from, err = parseRecipient(t.Phone)
 			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, recipientError("Phone", err))
 				return
 			}
-			jids = append(jids, jid)
 		}
-		resp, err := clientPointer[userid].GetUserInfo(jids)
-
-		if err != nil {
-			msg := fmt.Sprintf("Failed to get user info: %v", err)
-			log.Error().Msg(msg)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+		if !ok {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Call not found or no longer ringing"))
 			return
 		}
 
-		uc := new(UserCollection)
-		uc.Users = make(map[types.JID]types.UserInfo)
-
-		for jid, info := range resp {
-			uc.Users[jid] = info
+		err = rejectCall(client, from, t.CallID)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to reject call: %v", err)))
+			return
 		}
+		calls.end(userid, t.CallID)
 
-		responseJson, err := json.Marshal(uc)
+		hlog.FromRequest(r).Info().Str("userid", txtid).Str("callid", t.CallID).Str("from", from.String()).Msg("Call rejected")
+		response := map[string]interface{}{"Details": "Call rejected", "CallID": t.CallID}
+		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// Gets avatar info for user
-func (s *server) GetAvatar() http.HandlerFunc {
+// Turns automatic rejection of incoming calls on or off, Message is sent to
+// the caller after each rejection when set
+func (s *server) SetCallAutoReject() http.HandlerFunc {
 
-	type getAvatarStruct struct {
-		Phone   string
-		Preview bool
+	type autoRejectStruct struct {
+		Enabled bool
+		Message string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -2032,82 +4354,124 @@ func (s *server) GetAvatar() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
-
 		decoder := json.NewDecoder(r.Body)
-		var t getAvatarStruct
+		var t autoRejectStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		if len(t.Phone) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		_, err = execRetry(s.db, "UPDATE users SET reject_calls=?, reject_calls_message=? WHERE id=?", t.Enabled, t.Message, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
 			return
 		}
 
-		jid, ok := parseJID(t.Phone)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
-			return
+		details := "Calls are no longer rejected"
+		if t.Enabled {
+			details = "Incoming calls are rejected automatically"
+		}
+		hlog.FromRequest(r).Info().Str("userid", txtid).Bool("enabled", t.Enabled).Msg("Call auto reject updated")
+		response := map[string]interface{}{"Details": details, "Enabled": t.Enabled, "Message": t.Message}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+	}
+}
 
-		var pic *types.ProfilePictureInfo
+// List groups
+func (s *server) ListGroups() http.HandlerFunc {
 
-		existingID := ""
-		pic, err = clientPointer[userid].GetProfilePictureInfo(jid, &whatsmeow.GetProfilePictureParams{
-			Preview:    t.Preview,
-			ExistingID: existingID,
-		})
-		if err != nil {
-			msg := fmt.Sprintf("Failed to get avatar: %v", err)
-			log.Error().Msg(msg)
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+	type GroupCollection struct {
+		Groups []types.GroupInfo
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
 			return
 		}
 
-		if pic == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No avatar found"))
+		resp, err := client.GetJoinedGroups()
+
+		if err != nil {
+			msg := fmt.Sprintf("Failed to get group list: %v", err)
+			hlog.FromRequest(r).Error().Msg(msg)
+			s.Respond(w, r, http.StatusInternalServerError, msg)
 			return
 		}
 
-		log.Info().Str("id", pic.ID).Str("url", pic.URL).Msg("Got avatar")
+		gc := new(GroupCollection)
+		for _, info := range resp {
+			lids.learnGroup(info)
+			lids.fillGroup(info)
+			gc.Groups = append(gc.Groups, *info)
+		}
 
-		responseJson, err := json.Marshal(pic)
+		responseJson, err := json.Marshal(gc)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+
 		return
 	}
 }
 
-// Gets all contacts
-func (s *server) GetContacts() http.HandlerFunc {
+// Get group info
+func (s *server) GetGroupInfo() http.HandlerFunc {
+
+	type getGroupInfoStruct struct {
+		GroupJID string
+	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
 			return
 		}
 
-		result := map[types.JID]types.ContactInfo{}
-		result, err := clientPointer[userid].Store.Contacts.GetAllContacts()
+		// Get GroupJID from query parameter
+		groupJID := r.URL.Query().Get("groupJID")
+		if groupJID == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing groupJID parameter"))
+			return
+		}
+
+		group, err := parseGroupJID("GroupJID", groupJID)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		responseJson, err := json.Marshal(result)
+		resp, err := client.GetGroupInfo(group)
+
+		if err != nil {
+			msg := fmt.Sprintf("Failed to get group info: %v", err)
+			hlog.FromRequest(r).Error().Msg(msg)
+			s.Respond(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		lids.learnGroup(resp)
+		lids.fillGroup(resp)
+
+		responseJson, err := json.Marshal(resp)
+
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
@@ -2118,13 +4482,12 @@ func (s *server) GetContacts() http.HandlerFunc {
 	}
 }
 
-// Sets Chat Presence (typing/paused/recording audio)
-func (s *server) ChatPresence() http.HandlerFunc {
+// Get group invite link
+func (s *server) GetGroupInviteLink() http.HandlerFunc {
 
-	type chatPresenceStruct struct {
-		Phone string
-		State string
-		Media types.ChatPresenceMedia
+	type getGroupInfoStruct struct {
+		GroupJID string
+		Reset    bool
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -2132,63 +4495,65 @@ func (s *server) ChatPresence() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
-		var t chatPresenceStruct
-		err := decoder.Decode(&t)
-		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+		// Get GroupJID from query parameter
+		groupJID := r.URL.Query().Get("groupJID")
+		if groupJID == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing groupJID parameter"))
 			return
 		}
 
-		if len(t.Phone) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
-			return
+		// Get reset parameter
+		resetParam := r.URL.Query().Get("reset")
+		reset := false
+		if resetParam != "" {
+			var err error
+			reset, err = strconv.ParseBool(resetParam)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid reset parameter, must be true or false"))
+				return
+			}
 		}
 
-		if len(t.State) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing State in Payload"))
+		group, err := parseGroupJID("GroupJID", groupJID)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		jid, ok := parseJID(t.Phone)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
-			return
-		}
+		resp, err := client.GetGroupInviteLink(group, reset)
 
-		err = clientPointer[userid].SendChatPresence(jid, types.ChatPresence(t.State), types.ChatPresenceMedia(t.Media))
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Failure sending chat presence to Whatsapp servers"))
+			hlog.FromRequest(r).Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to get group invite link")
+			msg := fmt.Sprintf("Failed to get group invite link: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, msg)
 			return
 		}
 
-		response := map[string]interface{}{"Details": "Chat presence set successfuly"}
+		response := map[string]interface{}{"InviteLink": resp}
 		responseJson, err := json.Marshal(response)
+
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+
 		return
 	}
 }
 
-// Downloads Image and returns base64 representation
-func (s *server) DownloadImage() http.HandlerFunc {
+// Set group photo
+func (s *server) SetGroupPhoto() http.HandlerFunc {
 
-	type downloadImageStruct struct {
-		Url           string
-		DirectPath    string
-		MediaKey      []byte
-		Mimetype      string
-		FileEncSHA256 []byte
-		FileSHA256    []byte
-		FileLength    uint64
+	type setGroupPhotoStruct struct {
+		GroupJID string
+		Image    string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -2196,79 +4561,74 @@ func (s *server) DownloadImage() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		mimetype := ""
-		var imgdata []byte
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
 			return
 		}
 
-		// check/creates user directory for files
-		userDirectory := filepath.Join(s.exPath, "files", "user_"+txtid)
-		_, err := os.Stat(userDirectory)
-		if os.IsNotExist(err) {
-			errDir := os.MkdirAll(userDirectory, 0751)
-			if errDir != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
-				return
-			}
+		decoder := json.NewDecoder(r.Body)
+		var t setGroupPhotoStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.decodeFailed(w, r, err, "picture")
+			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
-		var t downloadImageStruct
-		err = decoder.Decode(&t)
+		group, err := parseGroupJID("GroupJID", t.GroupJID)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		msg := &waProto.Message{ImageMessage: &waProto.ImageMessage{
-			URL:           proto.String(t.Url),
-			DirectPath:    proto.String(t.DirectPath),
-			MediaKey:      t.MediaKey,
-			Mimetype:      proto.String(t.Mimetype),
-			FileEncSHA256: t.FileEncSHA256,
-			FileSHA256:    t.FileSHA256,
-			FileLength:    &t.FileLength,
-		}}
+		if t.Image == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Image in Payload"))
+			return
+		}
 
-		img := msg.GetImageMessage()
+		var filedata []byte
 
-		if img != nil {
-			imgdata, err = clientPointer[userid].Download(img)
+		if t.Image[0:13] == "data:image/jp" {
+			dataURL, err := dataurl.DecodeString(t.Image)
 			if err != nil {
-				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download image")
-				msg := fmt.Sprintf("Failed to download image %v", err)
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+				s.Respond(w, r, http.StatusUnprocessableEntity, newAPIError(ErrInvalidMedia, "Could not decode base64 encoded data from payload", nil))
 				return
+			} else {
+				filedata = dataURL.Data
 			}
-			mimetype = img.GetMimetype()
+		} else {
+			s.Respond(w, r, http.StatusUnprocessableEntity, newAPIError(ErrInvalidMedia, "Image data should start with \"data:image/jpeg;base64,\"", nil))
+			return
 		}
 
-		dataURL := dataurl.New(imgdata, mimetype)
-		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+		picture_id, err := client.SetGroupPhoto(group, filedata)
+
+		if err != nil {
+			hlog.FromRequest(r).Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set group photo")
+			msg := fmt.Sprintf("Failed to set group photo: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Group Photo set successfully", "PictureID": picture_id}
 		responseJson, err := json.Marshal(response)
+
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+
 		return
 	}
 }
 
-// Downloads Document and returns base64 representation
-func (s *server) DownloadDocument() http.HandlerFunc {
-
-	type downloadDocumentStruct struct {
-		Url           string
-		DirectPath    string
-		MediaKey      []byte
-		Mimetype      string
-		FileEncSHA256 []byte
-		FileSHA256    []byte
-		FileLength    uint64
+// Set group name
+func (s *server) SetGroupName() http.HandlerFunc {
+
+	type setGroupNameStruct struct {
+		GroupJID string
+		Name     string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -2276,79 +4636,75 @@ func (s *server) DownloadDocument() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		mimetype := ""
-		var docdata []byte
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
 			return
 		}
 
-		// check/creates user directory for files
-		userDirectory := filepath.Join(s.exPath, "files", "user_"+txtid)
-		_, err := os.Stat(userDirectory)
-		if os.IsNotExist(err) {
-			errDir := os.MkdirAll(userDirectory, 0751)
-			if errDir != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
-				return
-			}
-		}
-
 		decoder := json.NewDecoder(r.Body)
-		var t downloadDocumentStruct
-		err = decoder.Decode(&t)
+		var t setGroupNameStruct
+		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		msg := &waProto.Message{DocumentMessage: &waProto.DocumentMessage{
-			URL:           proto.String(t.Url),
-			DirectPath:    proto.String(t.DirectPath),
-			MediaKey:      t.MediaKey,
-			Mimetype:      proto.String(t.Mimetype),
-			FileEncSHA256: t.FileEncSHA256,
-			FileSHA256:    t.FileSHA256,
-			FileLength:    &t.FileLength,
-		}}
+		group, err := parseGroupJID("GroupJID", t.GroupJID)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
 
-		doc := msg.GetDocumentMessage()
+		if t.Name == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Name in Payload"))
+			return
+		}
 
-		if doc != nil {
-			docdata, err = clientPointer[userid].Download(doc)
-			if err != nil {
-				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download document")
-				msg := fmt.Sprintf("Failed to download document %v", err)
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
-				return
-			}
-			mimetype = doc.GetMimetype()
+		err = client.SetGroupName(group, t.Name)
+
+		if err != nil {
+			hlog.FromRequest(r).Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set group name")
+			msg := fmt.Sprintf("Failed to set group name: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, msg)
+			return
 		}
 
-		dataURL := dataurl.New(docdata, mimetype)
-		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+		response := map[string]interface{}{"Details": "Group Name set successfully"}
 		responseJson, err := json.Marshal(response)
+
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+
 		return
 	}
 }
 
-// Downloads Video and returns base64 representation
-func (s *server) DownloadVideo() http.HandlerFunc {
+// Disappearing message timers WhatsApp offers, in seconds
+var disappearingTimers = []uint32{0, 24 * 60 * 60, 7 * 24 * 60 * 60, 90 * 24 * 60 * 60}
 
-	type downloadVideoStruct struct {
-		Url           string
-		DirectPath    string
-		MediaKey      []byte
-		Mimetype      string
-		FileEncSHA256 []byte
-		FileSHA256    []byte
-		FileLength    uint64
+// Error for a group change WhatsApp refused, 403 with the group when the
+// user isn't an admin
+func groupSettingsError(err error, group types.JID, action string) error {
+	if errors.Is(err, whatsmeow.ErrIQForbidden) || errors.Is(err, whatsmeow.ErrIQNotAuthorized) {
+		return newAPIError(ErrForbidden, "Only group admins can change its settings", map[string]interface{}{"GroupJID": group.String()})
+	}
+	return fmt.Errorf("Failed to %s: %v", action, err)
+}
+
+// Sets announce (only admins send), locked (only admins edit the group info)
+// and the disappearing messages timer of a group, the fields left out are
+// unchanged. Returns the settings after the change.
+func (s *server) SetGroupSettings() http.HandlerFunc {
+
+	type setGroupSettingsStruct struct {
+		GroupJID          string
+		Announce          *bool
+		Locked            *bool
+		DisappearingTimer *uint32
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -2356,791 +4712,1256 @@ func (s *server) DownloadVideo() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		mimetype := ""
-		var docdata []byte
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
 			return
 		}
 
-		// check/creates user directory for files
-		userDirectory := filepath.Join(s.exPath, "files", "user_"+txtid)
-		_, err := os.Stat(userDirectory)
-		if os.IsNotExist(err) {
-			errDir := os.MkdirAll(userDirectory, 0751)
-			if errDir != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
-				return
-			}
+		var t setGroupSettingsStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
-		var t downloadVideoStruct
-		err = decoder.Decode(&t)
+		group, err := parseGroupJID("GroupJID", t.GroupJID)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if t.Announce == nil && t.Locked == nil && t.DisappearingTimer == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing settings in Payload, set Announce, Locked or DisappearingTimer"))
+			return
+		}
+		if t.DisappearingTimer != nil && !slices.Contains(disappearingTimers, *t.DisappearingTimer) {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid DisappearingTimer, must be 0 (off), 86400 (24 hours), 604800 (7 days) or 7776000 (90 days)"))
 			return
 		}
 
-		msg := &waProto.Message{VideoMessage: &waProto.VideoMessage{
-			URL:           proto.String(t.Url),
-			DirectPath:    proto.String(t.DirectPath),
-			MediaKey:      t.MediaKey,
-			Mimetype:      proto.String(t.Mimetype),
-			FileEncSHA256: t.FileEncSHA256,
-			FileSHA256:    t.FileSHA256,
-			FileLength:    &t.FileLength,
-		}}
-
-		doc := msg.GetVideoMessage()
-
-		if doc != nil {
-			docdata, err = clientPointer[userid].Download(doc)
-			if err != nil {
-				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download video")
-				msg := fmt.Sprintf("Failed to download video %v", err)
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+		if t.Announce != nil {
+			if err := client.SetGroupAnnounce(group, *t.Announce); err != nil {
+				hlog.FromRequest(r).Error().Err(err).Msg("Failed to set group announce")
+				s.Respond(w, r, http.StatusInternalServerError, groupSettingsError(err, group, "set group announce"))
+				return
+			}
+		}
+		if t.Locked != nil {
+			if err := client.SetGroupLocked(group, *t.Locked); err != nil {
+				hlog.FromRequest(r).Error().Err(err).Msg("Failed to set group locked")
+				s.Respond(w, r, http.StatusInternalServerError, groupSettingsError(err, group, "set group locked"))
+				return
+			}
+		}
+		if t.DisappearingTimer != nil {
+			if err := client.SetDisappearingTimer(group, time.Duration(*t.DisappearingTimer)*time.Second); err != nil {
+				hlog.FromRequest(r).Error().Err(err).Msg("Failed to set group disappearing timer")
+				s.Respond(w, r, http.StatusInternalServerError, groupSettingsError(err, group, "set disappearing timer"))
 				return
 			}
-			mimetype = doc.GetMimetype()
 		}
 
-		dataURL := dataurl.New(docdata, mimetype)
-		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+		info, err := client.GetGroupInfo(group)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to get group info: %v", err)))
+			return
+		}
+		response := map[string]interface{}{"GroupJID": group.String(), "Announce": info.IsAnnounce, "Locked": info.IsLocked, "DisappearingTimer": info.DisappearingTimer}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// Downloads Audio and returns base64 representation
-func (s *server) DownloadAudio() http.HandlerFunc {
-
-	type downloadAudioStruct struct {
-		Url           string
-		DirectPath    string
-		MediaKey      []byte
-		Mimetype      string
-		FileEncSHA256 []byte
-		FileSHA256    []byte
-		FileLength    uint64
-	}
+// Admin List users. Supports ?connected=true|false to filter by live
+// connection state and ?limit=&offset= for pagination, the total count of
+// matching users is returned in the X-Total-Count header
+func (s *server) ListUsers() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
+		var filterConnected *bool
+		if param := r.URL.Query().Get("connected"); param != "" {
+			value, err := strconv.ParseBool(param)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid connected parameter, must be true or false"))
+				return
+			}
+			filterConnected = &value
+		}
 
-		mimetype := ""
-		var docdata []byte
+		limit := 0
+		offset := 0
+		if param := r.URL.Query().Get("limit"); param != "" {
+			value, err := strconv.Atoi(param)
+			if err != nil || value < 0 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid limit parameter"))
+				return
+			}
+			limit = value
+		}
+		if param := r.URL.Query().Get("offset"); param != "" {
+			value, err := strconv.Atoi(param)
+			if err != nil || value < 0 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid offset parameter"))
+				return
+			}
+			offset = value
+		}
+
+		// The live state isn't in the table, the filter goes by the ids of
+		// the connected clients so the page is still cut by the query
+		where := ""
+		var args []interface{}
+		if filterConnected != nil {
+			ids := sessions.connectedIDs()
+			switch {
+			case len(ids) == 0 && *filterConnected:
+				where = " WHERE 0"
+			case len(ids) > 0:
+				where = " WHERE id NOT IN (" + strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",") + ")"
+				if *filterConnected {
+					where = " WHERE id IN (" + strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",") + ")"
+				}
+				for _, id := range ids {
+					args = append(args, id)
+				}
+			}
+		}
+		var total int
+		if err := s.db.QueryRow("SELECT COUNT(*) FROM users"+where, args...).Scan(&total); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
+		}
+		// -1 is no limit to SQLite
+		pageLimit := limit
+		if pageLimit == 0 {
+			pageLimit = -1
+		}
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		// Query the database to get the list of users
+		rows, err := s.db.Query("SELECT id, name, token, webhook, jid, connected, expiration, events, proxy_url, store_messages, max_messages_per_day, messages_sent, messages_day, device_name, payload_format, contact_names FROM users"+where+" ORDER BY id LIMIT ? OFFSET ?", append(args, pageLimit, offset)...)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
 			return
 		}
+		defer rows.Close()
 
-		// check/creates user directory for files
-		userDirectory := filepath.Join(s.exPath, "files", "user_"+txtid)
-		_, err := os.Stat(userDirectory)
-		if os.IsNotExist(err) {
-			errDir := os.MkdirAll(userDirectory, 0751)
-			if errDir != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
+		// Create a slice to store the user data
+		users := []map[string]interface{}{}
+
+		// Iterate over the rows and populate the user data
+		for rows.Next() {
+			var id int
+			var name, token, webhook, jid string
+			var connectedNull sql.NullInt64
+			var expiration sql.NullInt64
+			var events, proxyURL string
+			var storeMessages, contactNames bool
+			var maxMessages, messagesSent int
+			var messagesDay, deviceName, payloadFormat string
+
+			err := rows.Scan(&id, &name, &token, &webhook, &jid, &connectedNull, &expiration, &events, &proxyURL, &storeMessages, &maxMessages, &messagesSent, &messagesDay, &deviceName, &payloadFormat, &contactNames)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
 				return
 			}
+
+			connected := int(0)
+			if connectedNull.Valid {
+				connected = int(connectedNull.Int64)
+			}
+
+			// Live state of the whatsmeow client, the connected column only
+			// tells whether it should be connected on startup
+			state := sessions.state(id)
+			loggedIn := state == "connected"
+
+
+			if messagesDay != quotaDay(time.Now()) {
+				messagesSent = 0
+			}
+
+			user := map[string]interface{}{
+				"id":                   id,
+				"name":                 name,
+				"token":                maskToken(token),
+				"webhook":              webhook,
+				"jid":                  jid,
+				"connected":            connected == 1,
+				"state":                state,
+				"loggedIn":             loggedIn,
+				"expiration":           expiration.Int64,
+				"events":               events,
+				"proxy_url":            "",
+				"store_messages":       storeMessages,
+				"max_messages_per_day": maxMessages,
+				"messages_today":       messagesSent,
+				"device_name":          deviceName,
+				"payload_format":       payloadFormat,
+				"contact_names":        contactNames,
+			}
+			if proxyURL != "" {
+				user["proxy_url"] = redactURL(proxyURL)
+			}
+
+			users = append(users, user)
+		}
+		// Check for any error that occurred during iteration
+		if err := rows.Err(); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
-		var t downloadAudioStruct
-		err = decoder.Decode(&t)
+		// Set the response content type to JSON
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+		// Encode the user data as JSON and write the response
+		err = json.NewEncoder(w).Encode(users)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem encodingJSON"))
 			return
 		}
+	}
+}
 
-		msg := &waProto.Message{AudioMessage: &waProto.AudioMessage{
-			URL:           proto.String(t.Url),
-			DirectPath:    proto.String(t.DirectPath),
-			MediaKey:      t.MediaKey,
-			Mimetype:      proto.String(t.Mimetype),
-			FileEncSHA256: t.FileEncSHA256,
-			FileSHA256:    t.FileSHA256,
-			FileLength:    &t.FileLength,
-		}}
+func (s *server) AddUser() http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
 
-		doc := msg.GetAudioMessage()
+        // Parse the request body
+        var user newUser
+        err := json.NewDecoder(r.Body).Decode(&user)
+        if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Incomplete data in Payload. Required name,token,webhook,expiration,events"))
+            return
+        }
 
-		if doc != nil {
-			docdata, err = clientPointer[userid].Download(doc)
-			if err != nil {
-				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download audio")
-				msg := fmt.Sprintf("Failed to download audio %v", err)
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
-				return
-			}
-			mimetype = doc.GetMimetype()
+		if err := user.validate(); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
 		}
 
-		dataURL := dataurl.New(docdata, mimetype)
-		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+        // Insert the user into the database
+        id, err := insertUser(s.db, user)
+        if err == errTokenTaken {
+			s.Respond(w, r, http.StatusConflict, err)
+            return
+        }
+        if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			hlog.FromRequest(r).Error().Str("error", fmt.Sprintf("%v", err)).Msg("Admin DB Error")
+            return
+        }
+
+        // Return the inserted user ID
+		response := map[string]interface{}{
+            "id": id,
+        }
+        json.NewEncoder(w).Encode(response)
+    }
+}
+
+func (s *server) DeleteUser() http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+
+        // Get the user ID from the request URL
+        vars := mux.Vars(r)
+        userID := vars["id"]
+
+        // Delete the user from the database
+        result, err := execRetry(s.db, "DELETE FROM users WHERE id = ?", userID)
+        if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+            return
+        }
+
+        // Check if the user was deleted
+        rowsAffected, _ := result.RowsAffected()
+        if rowsAffected == 0 {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
+            return
+        }
+        if id, err := strconv.Atoi(userID); err == nil {
+            streams.closeUser(id)
+            stats.forget(id)
+            replay.forget(id)
+            if *storePerUser {
+                sessions.disconnect(id)
+                stores.remove(id)
+            }
+        }
+
+        // Return a success response
+		response := map[string]interface{}{"Details": "User deleted successfully"}
 		responseJson, err := json.Marshal(response)
+
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
-	}
+    }
 }
 
-// React
-func (s *server) React() http.HandlerFunc {
-
-	type textStruct struct {
-		Phone string
-		Body  string
-		Id    string
+// Admin partial update of a user (name, token, webhook, events, expiration, proxy, message storage, quota, device name, payload format, contact names)
+func (s *server) UpdateUser() http.HandlerFunc {
+
+	type updateStruct struct {
+		Name              *string `json:"name"`
+		Token             *string `json:"token"`
+		Webhook           *string `json:"webhook"`
+		Events            *string `json:"events"`
+		Expiration        *int64  `json:"expiration"`
+		ProxyURL          *string `json:"proxy_url"`
+		StoreMessages     *bool   `json:"store_messages"`
+		MaxMessagesPerDay *int    `json:"max_messages_per_day"`
+		DeviceName        *string `json:"device_name"`
+		PayloadFormat     *string `json:"payload_format"`
+		ContactNames      *bool   `json:"contact_names"`
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
+		vars := mux.Vars(r)
+		userID := vars["id"]
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		var t updateStruct
+		err := json.NewDecoder(r.Body).Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
-		decoder := json.NewDecoder(r.Body)
-		var t textStruct
-		err := decoder.Decode(&t)
+		var oldToken string
+		err = s.db.QueryRow("SELECT token FROM users WHERE id=?", userID).Scan(&oldToken)
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
+			return
+		}
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
 			return
 		}
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
-			return
+		sets := []string{}
+		args := []interface{}{}
+		updated := []string{}
+
+		if t.Name != nil {
+			if *t.Name == "" {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Name cannot be empty"))
+				return
+			}
+			sets = append(sets, "name=?")
+			args = append(args, *t.Name)
+			updated = append(updated, "name")
+		}
+		if t.Token != nil {
+			if *t.Token == "" {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Token cannot be empty"))
+				return
+			}
+			var count int
+			err = s.db.QueryRow("SELECT COUNT(*) FROM users WHERE token=? AND id!=?", *t.Token, userID).Scan(&count)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+				return
+			}
+			if count > 0 {
+				s.Respond(w, r, http.StatusConflict, errors.New("User with the same token already exists"))
+				return
+			}
+			sets = append(sets, "token=?")
+			args = append(args, *t.Token)
+			updated = append(updated, "token")
+		}
+		if t.Webhook != nil {
+			if err := validateWebhookURL(*t.Webhook); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid webhook: %v", err)))
+				return
+			}
+			sets = append(sets, "webhook=?")
+			args = append(args, *t.Webhook)
+			updated = append(updated, "webhook")
+		}
+		if t.Events != nil {
+			// Empty goes back to All, the default
+			events, err := parseEvents(*t.Events)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+			sets = append(sets, "events=?")
+			args = append(args, events)
+			updated = append(updated, "events")
+		}
+		if t.Expiration != nil {
+			sets = append(sets, "expiration=?")
+			args = append(args, *t.Expiration)
+			updated = append(updated, "expiration")
+		}
+		if t.ProxyURL != nil {
+			if *t.ProxyURL != "" {
+				if err := validateProxyURL(*t.ProxyURL); err != nil {
+					s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid proxy_url: %v", err)))
+					return
+				}
+			}
+			sets = append(sets, "proxy_url=?")
+			args = append(args, *t.ProxyURL)
+			updated = append(updated, "proxy_url")
+		}
+		if t.StoreMessages != nil {
+			sets = append(sets, "store_messages=?")
+			args = append(args, *t.StoreMessages)
+			updated = append(updated, "store_messages")
+		}
+		if t.MaxMessagesPerDay != nil {
+			if *t.MaxMessagesPerDay < 0 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid max_messages_per_day"))
+				return
+			}
+			sets = append(sets, "max_messages_per_day=?")
+			args = append(args, *t.MaxMessagesPerDay)
+			updated = append(updated, "max_messages_per_day")
+		}
+		if t.DeviceName != nil {
+			if err := validateDeviceName(*t.DeviceName); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid device_name: %v", err)))
+				return
+			}
+			sets = append(sets, "device_name=?")
+			args = append(args, *t.DeviceName)
+			updated = append(updated, "device_name")
+		}
+		if t.PayloadFormat != nil {
+			if !Find(payloadFormats, *t.PayloadFormat) {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid payload_format, must be raw or simplified"))
+				return
+			}
+			sets = append(sets, "payload_format=?")
+			args = append(args, *t.PayloadFormat)
+			updated = append(updated, "payload_format")
+		}
+		if t.ContactNames != nil {
+			sets = append(sets, "contact_names=?")
+			args = append(args, *t.ContactNames)
+			updated = append(updated, "contact_names")
 		}
 
-		if t.Body == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Body in Payload"))
+		if len(sets) == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Nothing to update. Accepted fields are name,token,webhook,events,expiration,proxy_url,store_messages,max_messages_per_day,device_name,payload_format,contact_names"))
 			return
 		}
 
-		recipient, ok := parseJID(t.Phone)
-		if !ok {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+		args = append(args, userID)
+		tokenLock.Lock()
+		_, err = execRetry(s.db, "UPDATE users SET "+strings.Join(sets, ",")+" WHERE id=?", args...)
+		if err == nil {
+			s.refreshUserInfo(userID, oldToken)
+		}
+		tokenLock.Unlock()
+		if err != nil {
+			hlog.FromRequest(r).Error().Str("error", fmt.Sprintf("%v", err)).Msg("Admin DB Error")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
 			return
 		}
 
-		if t.Id == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
-			return
+		hlog.FromRequest(r).Info().Str("userid", userID).Strs("fields", updated).Msg("User updated")
+
+		response := map[string]interface{}{"Details": "User updated successfully", "Updated": updated}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
-			msgid = t.Id
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+	}
+}
 
-		fromMe := false
-		if strings.HasPrefix(msgid, "me:") {
-			fromMe = true
-			msgid = msgid[len("me:"):]
+// Admin token rotation. The new token is only returned in this response
+func (s *server) RotateToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		vars := mux.Vars(r)
+		userID := vars["id"]
+
+		var oldToken string
+		err := s.db.QueryRow("SELECT token FROM users WHERE id=?", userID).Scan(&oldToken)
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
+			return
 		}
-		reaction := t.Body
-		if reaction == "remove" {
-			reaction = ""
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
 		}
 
-		msg := &waProto.Message{
-			ReactionMessage: &waProto.ReactionMessage{
-				Key: &waProto.MessageKey{
-					RemoteJID: proto.String(recipient.String()),
-					FromMe:    proto.Bool(fromMe),
-					ID:        proto.String(msgid),
-				},
-				Text:              proto.String(reaction),
-				GroupingKey:       proto.String(reaction),
-				SenderTimestampMS: proto.Int64(time.Now().UnixMilli()),
-			},
+		token, err := generateToken()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not generate token"))
+			return
 		}
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		// Swap the token in DB and cache without letting requests in between,
+		// so there is no window where both tokens are accepted
+		tokenLock.Lock()
+		_, err = execRetry(s.db, "UPDATE users SET token=? WHERE id=?", token, userID)
+		if err == nil {
+			s.refreshUserInfo(userID, oldToken)
+		}
+		tokenLock.Unlock()
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			hlog.FromRequest(r).Error().Str("error", fmt.Sprintf("%v", err)).Msg("Admin DB Error")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		hlog.FromRequest(r).Warn().Str("userid", userID).Msg("User token rotated")
+
+		response := map[string]interface{}{"Id": userID, "Token": token}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
-		return
 	}
 }
 
-// Mark messages as read
-func (s *server) MarkRead() http.HandlerFunc {
+// Admin update of a user's expiration, either as an absolute unix timestamp
+// (0 removes it) or extending the current one by a number of seconds
+func (s *server) SetExpiration() http.HandlerFunc {
 
-	type markReadStruct struct {
-		Id     []string
-		Chat   types.JID
-		Sender types.JID
+	type expirationStruct struct {
+		Expiration *int64 `json:"expiration"`
+		Extend     *int64 `json:"extend"`
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
+		vars := mux.Vars(r)
+		userID := vars["id"]
 
+		var t expirationStruct
 		decoder := json.NewDecoder(r.Body)
-		var t markReadStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
-
-		if t.Chat.String() == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Chat in Payload"))
+		if (t.Expiration == nil) == (t.Extend == nil) {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Provide either expiration or extend"))
 			return
 		}
 
-		if len(t.Id) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
+		var token string
+		var current sql.NullInt64
+		err = s.db.QueryRow("SELECT token,expiration FROM users WHERE id=?", userID).Scan(&token, &current)
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
+			return
+		}
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
 			return
 		}
 
-		err = clientPointer[userid].MarkRead(t.Id, time.Now(), t.Chat, t.Sender)
+		var expiration int64
+		if t.Expiration != nil {
+			expiration = *t.Expiration
+			if expiration < 0 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid expiration"))
+				return
+			}
+		} else {
+			if *t.Extend <= 0 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid extend"))
+				return
+			}
+			// Extending an expired (or unset) expiration counts from now
+			expiration = time.Now().Unix()
+			if current.Int64 > expiration {
+				expiration = current.Int64
+			}
+			expiration += *t.Extend
+		}
+
+		tokenLock.Lock()
+		_, err = execRetry(s.db, "UPDATE users SET expiration=? WHERE id=?", expiration, userID)
+		if err == nil {
+			s.refreshUserInfo(userID, token)
+		}
+		tokenLock.Unlock()
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Failure marking messages as read"))
+			hlog.FromRequest(r).Error().Str("error", fmt.Sprintf("%v", err)).Msg("Admin DB Error")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
 			return
 		}
 
-		response := map[string]interface{}{"Details": "Message(s) marked as read"}
+		if expiration > 0 && time.Now().Unix() >= expiration {
+			id, _ := strconv.Atoi(userID)
+			s.killExpired(id)
+		}
+
+		response := map[string]interface{}{"Id": userID, "Expiration": expiration}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// List groups
-func (s *server) ListGroups() http.HandlerFunc {
-
-	type GroupCollection struct {
-		Groups []types.GroupInfo
-	}
-
+// Admin view of a user's messages sent today against its daily quota
+func (s *server) GetUsage() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		vars := mux.Vars(r)
+		userID, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
 			return
 		}
 
-		resp, err := clientPointer[userid].GetJoinedGroups()
-
+		usage, err := s.messageUsage(userID)
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
+			return
+		}
 		if err != nil {
-			msg := fmt.Sprintf("Failed to get group list: %v", err)
-			log.Error().Msg(msg)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
 			return
 		}
 
-		gc := new(GroupCollection)
-		for _, info := range resp {
-			gc.Groups = append(gc.Groups, *info)
+		remaining := -1
+		if usage.Limit > 0 {
+			remaining = usage.Limit - usage.Sent
+			if remaining < 0 {
+				remaining = 0
+			}
 		}
-
-		responseJson, err := json.Marshal(gc)
+		response := map[string]interface{}{
+			"Id":        userID,
+			"Day":       quotaDay(time.Now()),
+			"Limit":     usage.Limit,
+			"Sent":      usage.Sent,
+			"Remaining": remaining,
+			"Reset":     usage.Reset.Unix(),
+		}
+		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
-		return
 	}
 }
 
-// Get group info
-func (s *server) GetGroupInfo() http.HandlerFunc {
-
-	type getGroupInfoStruct struct {
-		GroupJID string
-	}
-
+// Admin remedy for a session that looks connected but whose socket is dead:
+// drops the websocket and connects again, then sets the connected column to
+// what the client reports. Sessions not running or not logged in are refused.
+func (s *server) ReconnectUser() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		userID, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
 			return
 		}
-
-		// Get GroupJID from query parameter
-		groupJID := r.URL.Query().Get("groupJID")
-		if groupJID == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing groupJID parameter"))
+		var connected int
+		err = s.db.QueryRow("SELECT connected FROM users WHERE id=?", userID).Scan(&connected)
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
 			return
 		}
-
-		group, ok := parseJID(groupJID)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
 			return
 		}
 
-		resp, err := clientPointer[userid].GetGroupInfo(group)
-
-		if err != nil {
-			msg := fmt.Sprintf("Failed to get group info: %v", err)
-			log.Error().Msg(msg)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+		client := sessions.client(userID)
+		if client == nil {
+			if connected == 1 {
+				if _, err := execRetry(s.db, "UPDATE users SET connected=0 WHERE id=?", userID); err != nil {
+					hlog.FromRequest(r).Error().Err(err).Msg("Could not reset connected")
+				}
+			}
+			s.Respond(w, r, http.StatusConflict, newAPIError(ErrSessionNotConnected, "No session running for the user, connect it with /session/connect", map[string]interface{}{"id": userID}))
+			return
+		}
+		if client.Store.ID == nil {
+			s.Respond(w, r, http.StatusConflict, newAPIError(ErrSessionNotPaired, "Session is not logged in, pair it before reconnecting", map[string]interface{}{"id": userID}))
 			return
 		}
 
-		responseJson, err := json.Marshal(resp)
+		hlog.FromRequest(r).Info().Int("userid", userID).Msg("Forcing reconnection")
+		client.Disconnect()
+		connectErr := client.Connect()
+		if connectErr != nil {
+			hlog.FromRequest(r).Warn().Err(connectErr).Int("userid", userID).Msg("Forced reconnection failed")
+			// Keep trying in the background as after any drop
+			if mycli := sessions.myClient(userID); mycli != nil {
+				if sess := sessions.sessionOf(mycli); sess != nil {
+					go mycli.reconnect(sess)
+				}
+			}
+		} else {
+			client.WaitForConnection(10 * time.Second)
+		}
 
+		isConnected, loggedIn := sessions.status(userID)
+		live := 0
+		if isConnected && loggedIn {
+			live = 1
+		}
+		if _, err := execRetry(s.db, "UPDATE users SET connected=? WHERE id=?", live, userID); err != nil {
+			hlog.FromRequest(r).Error().Err(err).Msg("Could not set connected")
+		}
+		response := map[string]interface{}{
+			"Id":        userID,
+			"State":     sessions.state(userID),
+			"Connected": isConnected,
+			"LoggedIn":  loggedIn,
+		}
+		if connectErr != nil {
+			response["Error"] = connectErr.Error()
+		}
+		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
-		return
 	}
 }
 
-// Get group invite link
-func (s *server) GetGroupInviteLink() http.HandlerFunc {
-
-	type getGroupInfoStruct struct {
-		GroupJID string
-		Reset    bool
-	}
-
+// Admin export of a paired session (users row plus whatsmeow store records),
+// encrypted with the passphrase passed in the Passphrase header
+func (s *server) ExportUser() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
+		vars := mux.Vars(r)
+		userID := vars["id"]
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		passphrase := r.Header.Get("Passphrase")
+		if passphrase == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Passphrase header"))
 			return
 		}
 
-		// Get GroupJID from query parameter
-		groupJID := r.URL.Query().Get("groupJID")
-		if groupJID == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing groupJID parameter"))
+		var export sessionExport
+		var expiration sql.NullInt64
+		var contactNames bool
+		err := s.db.QueryRow("SELECT name, token, webhook, jid, expiration, events, proxy_url, store_messages, reject_calls, reject_calls_message, max_messages_per_day, device_name, payload_format, webhook_headers, webhook_timeout, webhook_gzip, contact_names, paired_at FROM users WHERE id=?", userID).Scan(
+			&export.User.Name, &export.User.Token, &export.User.Webhook, &export.User.Jid, &expiration, &export.User.Events,
+			&export.User.ProxyURL, &export.User.StoreMessages, &export.User.RejectCalls, &export.User.RejectCallsMessage, &export.User.MaxMessagesPerDay, &export.User.DeviceName, &export.User.PayloadFormat, &export.User.WebhookHeaders, &export.User.WebhookTimeout, &export.User.WebhookGzip, &contactNames, &export.User.PairedAt)
+		export.User.ContactNames = &contactNames
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
 			return
 		}
-
-		// Get reset parameter
-		resetParam := r.URL.Query().Get("reset")
-		reset := false
-		if resetParam != "" {
-			var err error
-			reset, err = strconv.ParseBool(resetParam)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid reset parameter, must be true or false"))
-				return
-			}
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
 		}
+		export.User.Expiration = expiration.Int64
 
-		group, ok := parseJID(groupJID)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+		if export.User.Jid == "" {
+			s.Respond(w, r, http.StatusConflict, newAPIError(ErrSessionNotPaired, "User has no paired device to export", nil))
 			return
 		}
 
-		resp, err := clientPointer[userid].GetGroupInviteLink(group, reset)
+		id, _ := strconv.Atoi(userID)
+		_, userDb, err := s.userContainer(id)
+		if err == nil {
+			export.Tables, err = exportStoreRows(userDb, export.User.Jid)
+		}
+		if err != nil {
+			hlog.FromRequest(r).Error().Err(err).Str("userid", userID).Msg("Could not read device store")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not read device store: %v", err)))
+			return
+		}
+		export.Version = sessionExportVersion
+		export.Exported = time.Now().Unix()
 
+		blob, err := sealExport(&export, passphrase)
 		if err != nil {
-			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to get group invite link")
-			msg := fmt.Sprintf("Failed to get group invite link: %v", err)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not encrypt export: %v", err)))
 			return
 		}
 
-		response := map[string]interface{}{"InviteLink": resp}
-		responseJson, err := json.Marshal(response)
+		hlog.FromRequest(r).Warn().Str("userid", userID).Str("jid", export.User.Jid).Str("remote", r.RemoteAddr).Msg("Session exported")
 
+		response := map[string]interface{}{"Id": userID, "Jid": export.User.Jid, "Export": base64.StdEncoding.EncodeToString(blob)}
+		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
-		return
 	}
 }
 
-// Set group photo
-func (s *server) SetGroupPhoto() http.HandlerFunc {
+// Admin import of a session produced by ExportUser. Fails with 409 when the
+// JID already exists unless force=true is passed, in which case the existing
+// users and device for that JID are replaced
+func (s *server) ImportUser() http.HandlerFunc {
 
-	type setGroupPhotoStruct struct {
-		GroupJID string
-		Image    string
+	type importStruct struct {
+		Passphrase string
+		Export     string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
-
-		decoder := json.NewDecoder(r.Body)
-		var t setGroupPhotoStruct
-		err := decoder.Decode(&t)
+		var t importStruct
+		err := json.NewDecoder(r.Body).Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
-
-		group, ok := parseJID(t.GroupJID)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+		if t.Passphrase == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Passphrase in Payload"))
 			return
 		}
-
-		if t.Image == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Image in Payload"))
+		if t.Export == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Export in Payload"))
 			return
 		}
 
-		var filedata []byte
-
-		if t.Image[0:13] == "data:image/jp" {
-			dataURL, err := dataurl.DecodeString(t.Image)
+		force := false
+		if forceParam := r.URL.Query().Get("force"); forceParam != "" {
+			force, err = strconv.ParseBool(forceParam)
 			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid force parameter, must be true or false"))
 				return
-			} else {
-				filedata = dataURL.Data
 			}
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Image data should start with \"data:image/jpeg;base64,\""))
-			return
 		}
 
-		picture_id, err := clientPointer[userid].SetGroupPhoto(group, filedata)
-
+		blob, err := base64.StdEncoding.DecodeString(t.Export)
 		if err != nil {
-			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set group photo")
-			msg := fmt.Sprintf("Failed to set group photo: %v", err)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+			s.Respond(w, r, http.StatusBadRequest, newAPIError(ErrInvalidPayload, "Could not decode base64 encoded export", nil))
 			return
 		}
-
-		response := map[string]interface{}{"Details": "Group Photo set successfully", "PictureID": picture_id}
-		responseJson, err := json.Marshal(response)
-
+		export, err := openExport(blob, t.Passphrase)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
-		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
 		}
+		jid := export.User.Jid
+		if jid == "" || len(export.Tables["whatsmeow_device"]) == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Export contains no device"))
+			return
+		}
+		// Checked before anything is replaced
+		if err := checkStoreColumns(s.storeDb, export.Tables); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid export: %v", err)))
+			return
+		}
+		// Exports made before payload_format existed
+		if !Find(payloadFormats, export.User.PayloadFormat) {
+			export.User.PayloadFormat = "raw"
+		}
+		contactNames := export.User.ContactNames == nil || *export.User.ContactNames
 
-		return
-	}
-}
-
-// Set group name
-func (s *server) SetGroupName() http.HandlerFunc {
-
-	type setGroupNameStruct struct {
-		GroupJID string
-		Name     string
-	}
-
-	return func(w http.ResponseWriter, r *http.Request) {
-
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		// Look for users or devices already using this JID
+		var existing []int
+		rows, err := s.db.Query("SELECT id, token FROM users WHERE jid=?", jid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
 			return
 		}
+		var existingTokens []string
+		for rows.Next() {
+			var id int
+			var token string
+			if err := rows.Scan(&id, &token); err != nil {
+				rows.Close()
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+				return
+			}
+			existing = append(existing, id)
+			existingTokens = append(existingTokens, token)
+		}
+		rows.Close()
 
-		decoder := json.NewDecoder(r.Body)
-		var t setGroupNameStruct
-		err := decoder.Decode(&t)
+		// User stores only hold the device of their user, found above
+		var deviceCount int
+		if !*storePerUser {
+			err = s.storeDb.QueryRow("SELECT COUNT(*) FROM whatsmeow_device WHERE jid=?", jid).Scan(&deviceCount)
+		}
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing store DB"))
 			return
 		}
 
-		group, ok := parseJID(t.GroupJID)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+		if (len(existing) > 0 || deviceCount > 0) && !force {
+			s.Respond(w, r, http.StatusConflict, errors.New("A session for this JID already exists, use force=true to replace it"))
 			return
 		}
 
-		if t.Name == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Name in Payload"))
+		var count int
+		err = s.db.QueryRow("SELECT COUNT(*) FROM users WHERE token=? AND jid!=?", export.User.Token, jid).Scan(&count)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
+		}
+		if count > 0 {
+			s.Respond(w, r, http.StatusConflict, errors.New("User with the same token already exists"))
 			return
 		}
 
-		err = clientPointer[userid].SetGroupName(group, t.Name)
+		// Stop and remove whatever is being replaced
+		for i, id := range existing {
+			sessions.disconnect(id)
+			streams.closeUser(id)
+			userinfocache.Delete(existingTokens[i])
+		}
+
+		// A user's own store only exists once the user does, it is
+		// restored after the insert below
+		if !*storePerUser {
+			if err = restoreStoreRows(s.storeDb, jid, export.Tables); err != nil {
+				hlog.FromRequest(r).Error().Err(err).Str("jid", jid).Msg("Could not restore device store")
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not restore device store: %v", err)))
+				return
+			}
+		}
 
+		if _, err = execRetry(s.db, "DELETE FROM users WHERE jid=?", jid); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
+		}
+		if *storePerUser {
+			for _, id := range existing {
+				stores.remove(id)
+			}
+		}
+		result, err := execRetry(s.db, "INSERT INTO users (name, token, webhook, jid, qrcode, connected, expiration, events, proxy_url, store_messages, reject_calls, reject_calls_message, max_messages_per_day, device_name, payload_format, webhook_headers, webhook_timeout, webhook_gzip, contact_names, paired_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			export.User.Name, export.User.Token, export.User.Webhook, jid, "", 1, export.User.Expiration, export.User.Events,
+			export.User.ProxyURL, export.User.StoreMessages, export.User.RejectCalls, export.User.RejectCallsMessage, export.User.MaxMessagesPerDay, export.User.DeviceName, export.User.PayloadFormat, export.User.WebhookHeaders, export.User.WebhookTimeout, export.User.WebhookGzip, contactNames, export.User.PairedAt)
 		if err != nil {
-			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set group name")
-			msg := fmt.Sprintf("Failed to set group name: %v", err)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+			hlog.FromRequest(r).Error().Str("error", fmt.Sprintf("%v", err)).Msg("Admin DB Error")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
 			return
 		}
+		id, _ := result.LastInsertId()
+		userid := int(id)
 
-		response := map[string]interface{}{"Details": "Group Name set successfully"}
-		responseJson, err := json.Marshal(response)
+		if *storePerUser {
+			_, userDb, err := stores.open(userid)
+			if err == nil {
+				err = restoreStoreRows(userDb, jid, export.Tables)
+			}
+			if err != nil {
+				stores.remove(userid)
+				execRetry(s.db, "DELETE FROM users WHERE id=?", userid)
+				hlog.FromRequest(r).Error().Err(err).Str("jid", jid).Msg("Could not restore device store")
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not restore device store: %v", err)))
+				return
+			}
+		}
 
+		var subscribedEvents []string
+		for _, arg := range strings.Split(export.User.Events, ",") {
+			if Find(messageTypes, arg) && !Find(subscribedEvents, arg) {
+				subscribedEvents = append(subscribedEvents, arg)
+			}
+		}
+		if len(subscribedEvents) < 1 {
+			subscribedEvents = append(subscribedEvents, "All")
+		}
+
+		hlog.FromRequest(r).Warn().Int("userid", userid).Str("jid", jid).Bool("force", force).Str("remote", r.RemoteAddr).Msg("Session imported")
+		s.startSession(userid, jid, export.User.Token, subscribedEvents)
+
+		response := map[string]interface{}{"Id": userid, "Jid": jid, "Replaced": len(existing) > 0 || deviceCount > 0, "Details": "Session imported"}
+		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
-		return
 	}
 }
 
-// Admin List users
-func (s *server) ListUsers() http.HandlerFunc {
-
-	type usersStruct struct {
-		Id int
-        Name string
-        Connected bool
-        Events string
-	}
+// Writes JSON response to API clients
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// Token auth is required, so connections from any origin are accepted
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
 
+// Streams the user's events over a websocket, filtered with ?events= (comma
+// separated) or by the user's subscriptions otherwise
+func (s *server) EventStream() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-        // Query the database to get the list of users
-        rows, err := s.db.Query("SELECT id, name, token, webhook, jid, connected, expiration, events FROM users")
-        if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
-            return
-        }
-        defer rows.Close()
-
-        // Create a slice to store the user data
-        users := []map[string]interface{}{}
-
-        // Iterate over the rows and populate the user data
-        for rows.Next() {
-            var id int
-            var name, token, webhook, jid string
-            var connectedNull sql.NullInt64
-            var expiration int
-            var events string
-
-            err := rows.Scan(&id, &name, &token, &webhook, &jid, &connectedNull, &expiration, &events)
-            if err != nil {
-			    s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
-                return
-            }
-
-            connected := int(0)
-            if connectedNull.Valid {
-                connected = int(connectedNull.Int64)
-            }
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		token := r.Context().Value("userinfo").(Values).Get("Token")
+		userid, _ := strconv.Atoi(txtid)
 
-            user := map[string]interface{}{
-                "id":         id,
-                "name":       name,
-                "token":      token,
-                "webhook":    webhook,
-                "jid":        jid,
-                "connected":  connected == 1,
-                "expiration": expiration,
-                "events":     events,
-            }
+		filter := r.URL.Query().Get("events")
+		if filter == "" {
+			filter = r.Context().Value("userinfo").(Values).Get("Events")
+		}
+		var events []string
+		for _, event := range strings.Split(filter, ",") {
+			event = strings.TrimSpace(event)
+			if event == "" {
+				continue
+			}
+			if !Find(messageTypes, event) {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid event: "+event))
+				return
+			}
+			events = append(events, event)
+		}
+		if len(events) == 0 {
+			events = append(events, "All")
+		}
 
-            users = append(users, user)
-        }
-        // Check for any error that occurred during iteration
-        if err := rows.Err(); err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
-            return
-        }
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade already replied with an error
+			hlog.FromRequest(r).Warn().Err(err).Str("userid", txtid).Msg("Websocket upgrade failed")
+			return
+		}
+		defer conn.Close()
 
-        // Set the response content type to JSON
-        w.Header().Set("Content-Type", "application/json")
+		sub := streams.subscribe(userid, events)
+		defer streams.unsubscribe(userid, sub)
+		hlog.FromRequest(r).Info().Str("userid", txtid).Str("events", strings.Join(events, ",")).Msg("Websocket stream opened")
 
-        // Encode the user data as JSON and write the response
-        err = json.NewEncoder(w).Encode(users)
-        if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem encodingJSON"))
-            return
-        }
-    }
+		// Reader loop, only needed to process pongs and notice the client leaving
+		conn.SetReadLimit(512)
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					sub.close()
+					return
+				}
+			}
+		}()
+
+		ticker := time.NewTicker(wsPingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case payload := <-sub.send:
+				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				if err := conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+					return
+				}
+			case <-ticker.C:
+				// Drop the stream if the token was revoked or expired meanwhile
+				v, found, err := s.lookupUser(r.Context(), token)
+				if err == nil && (!found || v.Get("Id") != txtid || s.checkExpired(v)) {
+					hlog.FromRequest(r).Info().Str("userid", txtid).Msg("Token no longer valid, closing websocket stream")
+					sub.close()
+					continue
+				}
+				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+					return
+				}
+			case <-sub.done:
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "stream closed"), time.Now().Add(wsWriteWait))
+				hlog.FromRequest(r).Info().Str("userid", txtid).Msg("Websocket stream closed")
+				return
+			}
+		}
+	}
 }
 
-func (s *server) AddUser() http.HandlerFunc {
-    return func(w http.ResponseWriter, r *http.Request) {
+// Server-Sent Events stream of QR codes, pairing and connection state for
+// onboarding pages, ends once pairing succeeds
+func (s *server) SessionEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
-        // Parse the request body
-        var user struct {
-            Name       string `json:"name"`
-            Token      string `json:"token"`
-            Webhook    string `json:"webhook"`
-            Expiration int    `json:"expiration"`
-            Events     string `json:"events"`
-        }
-        err := json.NewDecoder(r.Body).Decode(&user)
-        if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Incomplete data in Payload. Required name,token,webhook,expiration,events"))
-            return
-        }
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
 
-		// Check if a user with the same token already exists
-		var count int
-		err = s.db.QueryRow("SELECT COUNT(*) FROM users WHERE token = ?", user.Token).Scan(&count)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+		rc := http.NewResponseController(w)
+		// The stream lives longer than the server write timeout
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Streaming not supported"))
 			return
 		}
-		if count > 0 {
-			s.Respond(w, r, http.StatusConflict, errors.New("User with the same token already exists"))
-			return
+
+		sub := streams.subscribe(userid, sessionEventTypes)
+		defer streams.unsubscribe(userid, sub)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		// Start with the current state so the page does not wait for a change
+		connected, loggedIn := sessions.status(userid)
+		state, _ := json.Marshal(map[string]interface{}{"type": "Status", "event": map[string]bool{"Connected": connected, "LoggedIn": loggedIn}})
+		fmt.Fprintf(w, "event: Status\ndata: %s\n\n", state)
+		var code string
+		if err := s.db.QueryRow("SELECT qrcode FROM users WHERE id=?", userid).Scan(&code); err == nil && code != "" {
+			qr, _ := json.Marshal(map[string]interface{}{"type": "QR", "event": map[string]string{"QRCode": code}})
+			fmt.Fprintf(w, "event: QR\ndata: %s\n\n", qr)
 		}
+		rc.Flush()
 
-		// Validate the events input
-		validEvents := []string{"Message", "ReadReceipt", "Presence", "HistorySync", "ChatPresence", "All"}
-		eventList := strings.Split(user.Events, ",")
-		for _, event := range eventList {
-			event = strings.TrimSpace(event)
-			if !contains(validEvents, event) {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid event: "+event))
+		heartbeat := time.NewTicker(15 * time.Second)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case payload := <-sub.send:
+				var evt struct {
+					Type string `json:"type"`
+				}
+				json.Unmarshal(payload, &evt)
+				if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", evt.Type, payload); err != nil {
+					return
+				}
+				rc.Flush()
+				if evt.Type == "PairSuccess" {
+					return
+				}
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+				rc.Flush()
+			case <-sub.done:
+				return
+			case <-r.Context().Done():
 				return
 			}
 		}
-
-        // Insert the user into the database
-        result, err := s.db.Exec("INSERT INTO users (name, token, webhook, expiration, events, jid, qrcode) VALUES (?, ?, ?, ?, ?, ?, ?)",
-            user.Name, user.Token, user.Webhook, user.Expiration, user.Events, "", "")
-        if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
-			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Admin DB Error")
-            return
-        }
-
-        // Get the ID of the inserted user
-        id, _ := result.LastInsertId()
-
-        // Return the inserted user ID
-		response := map[string]interface{}{
-            "id": id,
-        }
-        json.NewEncoder(w).Encode(response)
-    }
+	}
 }
 
-func (s *server) DeleteUser() http.HandlerFunc {
-    return func(w http.ResponseWriter, r *http.Request) {
+// Health check for orchestrators: DB reachability, session counts, pending
+// webhooks and uptime, 503 when degraded
+func (s *server) Health() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
-        // Get the user ID from the request URL
-        vars := mux.Vars(r)
-        userID := vars["id"]
+		status := "ok"
+		httpStatus := http.StatusOK
 
-        // Delete the user from the database
-        result, err := s.db.Exec("DELETE FROM users WHERE id = ?", userID)
-        if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
-            return
-        }
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		dbStatus := "ok"
+		if err := s.db.PingContext(ctx); err != nil {
+			dbStatus = err.Error()
+		} else if err := s.storeDb.PingContext(ctx); err != nil {
+			dbStatus = err.Error()
+		}
 
-        // Check if the user was deleted
-        rowsAffected, _ := result.RowsAffected()
-        if rowsAffected == 0 {
-			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
-            return
-        }
+		configured := 0
+		if dbStatus == "ok" {
+			if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users").Scan(&configured); err != nil {
+				dbStatus = err.Error()
+			}
+		}
+		if dbStatus != "ok" {
+			hlog.FromRequest(r).Error().Str("error", dbStatus).Msg("Health check DB failure")
+			status = "degraded"
+			httpStatus = http.StatusServiceUnavailable
+		}
 
-        // Return a success response
-		response := map[string]interface{}{"Details": "User deleted successfully"}
-		responseJson, err := json.Marshal(response)
+		connected := 0
+		for _, client := range sessions.clients() {
+			if client.IsConnected() && client.IsLoggedIn() {
+				connected++
+			}
+		}
 
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
-		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
+		response := map[string]interface{}{
+			"status":             status,
+			"db":                 dbStatus,
+			"sessions":           configured,
+			"sessions_connected": connected,
+			"webhooks_pending":   webhooksPending.Load(),
+			"webhooks_queued":    webhooksQueued.Load(),
+			"webhooks_dropped":   webhooksDropped.Load(),
+			"uptime":             int64(time.Since(startTime).Seconds()),
+			"ready":              startupReady.Load(),
+			"datadir":            s.exPath,
+			"datadir_temporary":  s.exPathTemp,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(httpStatus)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// Readiness probe, succeeds once sessions connected on startup were started
+func (s *server) Ready() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !startupReady.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{"status": "starting"})
+			return
 		}
-    }
+		json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
+	}
 }
 
-// Writes JSON response to API clients
 func (s *server) Respond(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
+
+	// Bodies limitBody cut off fail to decode, tell why instead
+	if limit, exceeded := bodyLimitExceeded(r); exceeded && status >= http.StatusBadRequest {
+		status, data = http.StatusRequestEntityTooLarge, bodyTooLarge(limit)
+	}
 
 	dataenvelope := map[string]interface{}{"code": status}
 	if err, ok := data.(error); ok {
+		// Errors carry a stable code, the HTTP status follows from it
+		code, errStatus, details := classifyError(err, status)
+		status = errStatus
+		dataenvelope["code"] = code
+		dataenvelope["status"] = status
 		dataenvelope["error"] = err.Error()
 		dataenvelope["success"] = false
+		if details != nil {
+			dataenvelope["details"] = details
+		}
+		if id := requestIDFrom(r); id != "" {
+			dataenvelope["request_id"] = id
+		}
 	} else {
 		mydata := make(map[string]interface{})
 		err = json.Unmarshal([]byte(data.(string)), &mydata)
 		if err != nil {
-			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Error unmarshalling JSON")
+			hlog.FromRequest(r).Error().Str("error", fmt.Sprintf("%v", err)).Msg("Error unmarshalling JSON")
 		}
 		dataenvelope["data"] = mydata
 		dataenvelope["success"] = true
 	}
 	data = dataenvelope
+	w.WriteHeader(status)
 
 	if err := json.NewEncoder(w).Encode(data); err != nil {
 		panic("respond: " + err.Error())
 	}
 }
 
-func validateMessageFields(phone string, stanzaid *string, participant *string) (types.JID, error) {
-
-	recipient, ok := parseJID(phone)
-	if !ok {
-		return types.NewJID("", types.DefaultUserServer), errors.New("Could not parse Phone")
-	}
+func validateMessageFields(client *whatsmeow.Client, phone string, stanzaid *string, participant *string) (types.JID, error) {
 
-	if stanzaid != nil {
-		if participant == nil {
-			return types.NewJID("", types.DefaultUserServer), errors.New("Missing Participant in ContextInfo")
-		}
+	recipient, err := resolveRecipient(client, "Phone", phone)
+	if err != nil {
+		return types.NewJID("", types.DefaultUserServer), err
 	}
 
 	if participant != nil {
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Code of an error response
+func responseCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Code string
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	return body.Code
+}
+
+func TestExpiredUserIsRefused(t *testing.T) {
+	s := &server{db: testUsersDB(t)}
+	id, err := insertUser(s.db, newUser{Name: "expired", Token: "expired-token", Expiration: int(time.Now().Add(-time.Minute).Unix()), PayloadFormat: "raw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := int(id)
+	sess, ok := sessions.reserve(userID)
+	if !ok {
+		t.Fatal("could not reserve session")
+	}
+	defer sessions.finished()
+	defer sessions.remove(userID, sess)
+
+	called := false
+	handler := s.auth(func(w http.ResponseWriter, r *http.Request) { called = true })
+	r := httptest.NewRequest("GET", "/session/status", nil)
+	r.Header.Set("Token", "expired-token")
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	if called {
+		t.Error("handler ran for an expired user")
+	}
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status %d, want 403", w.Code)
+	}
+	if code := responseCode(t, w); code != "EXPIRED" {
+		t.Errorf("code %s, want EXPIRED", code)
+	}
+	select {
+	case <-sess.kill:
+	default:
+		t.Error("session of user " + strconv.Itoa(userID) + " not disconnected")
+	}
+}
+
+// User and admin routes take the token the same way: Authorization: Bearer
+// first, then the Token header
+func TestAuthTokenPrecedence(t *testing.T) {
+	s := &server{db: testUsersDB(t)}
+	if _, err := insertUser(s.db, newUser{Name: "auth", Token: "user-token", PayloadFormat: "raw"}); err != nil {
+		t.Fatal(err)
+	}
+	savedAdmin := *adminToken
+	*adminToken = "admin-token"
+	defer func() { *adminToken = savedAdmin }()
+
+	tests := []struct {
+		name   string
+		bearer string
+		token  string
+		ok     bool
+	}{
+		{"bearer only", "%s", "", true},
+		{"token only", "", "%s", true},
+		{"both", "%s", "wrong", true},
+		{"bearer wins over token", "wrong", "%s", false},
+		{"neither", "", "", false},
+	}
+	for _, route := range []struct {
+		name  string
+		token string
+		auth  func(http.Handler) http.Handler
+	}{
+		{"user", "user-token", s.authalice},
+		{"admin", "admin-token", s.authadmin},
+	} {
+		for _, tt := range tests {
+			called := false
+			handler := route.auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+			r := httptest.NewRequest("GET", "/session/status", nil)
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+strings.Replace(tt.bearer, "%s", route.token, 1))
+			}
+			if tt.token != "" {
+				r.Header.Set("Token", strings.Replace(tt.token, "%s", route.token, 1))
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if called != tt.ok {
+				t.Errorf("%s %s: let through %v, want %v", route.name, tt.name, called, tt.ok)
+			}
+			if !tt.ok && w.Code != http.StatusUnauthorized {
+				t.Errorf("%s %s: status %d, want 401", route.name, tt.name, w.Code)
+			}
+		}
+	}
+
+	// Older admin clients send the bare token
+	called := false
+	r := httptest.NewRequest("GET", "/admin/users", nil)
+	r.Header.Set("Authorization", "admin-token")
+	s.authadmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true })).ServeHTTP(httptest.NewRecorder(), r)
+	if !called {
+		t.Error("bare admin token in Authorization refused")
+	}
+}
@@ -1,8 +1,22 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/patrickmn/go-cache"
 )
 
 func Find(slice []string, val string) bool {
@@ -14,34 +28,44 @@ func Find(slice []string, val string) bool {
     return false
 }
 
-// Update entry in User map
+// Update entry in User map. The cached map is shared with concurrent
+// requests and the event goroutine, a changed copy is returned for the caller
+// to Set in the cache.
 func updateUserInfo(values interface{}, field string, value string) interface{} {
-    log.Debug().Str("field",field).Str("value",value).Msg("User info updated")
-    values.(Values).m[field] = value
-    return values
+    log.Debug().Str("field",field).Msg("User info updated")
+    return values.(Values).with(field, value)
 }
 
-// webhook for regular messages
-func callHook(myurl string, payload map[string]string, id int) {
-    log.Info().Str("url",myurl).Msg("Sending POST to client "+strconv.Itoa(id))
+// Webhook posts currently in flight, reported by the health check
+var webhooksPending atomic.Int64
 
-    // Log the payload map
-    log.Debug().Msg("Payload:")
-    for key, value := range payload {
-        log.Debug().Str(key, value).Msg("")
-    }
+// webhook for regular messages, fails on errors and non 2xx answers
+func callHook(req *resty.Request, myurl string, payload map[string]string, id int, compress bool) error {
+    webhooksPending.Add(1)
+    defer webhooksPending.Add(-1)
+    log.Info().Str("url",redactURL(myurl)).Msg("Sending POST to client "+strconv.Itoa(id))
 
-    _, err := clientHttp[id].R().SetFormData(payload).Post(myurl)
+    if err := setWebhookForm(req, payload, compress); err != nil {
+        return err
+    }
+    resp, err := req.Post(myurl)
     if err != nil {
-        log.Debug().Str("error",err.Error())
+        log.Debug().Err(err).Str("url",redactURL(myurl)).Msg("Webhook POST failed")
+        return err
+    }
+    if resp.IsError() {
+        return fmt.Errorf("webhook answered %s", resp.Status())
     }
+    return nil
 }
 
 // webhook for messages with file attachments
-func callHookFile(myurl string, payload map[string]string, id int, file string) error {
-    log.Info().Str("file", file).Str("url", myurl).Msg("Sending POST")
+func callHookFile(req *resty.Request, myurl string, payload map[string]string, id int, file string) error {
+    webhooksPending.Add(1)
+    defer webhooksPending.Add(-1)
+    log.Info().Str("file", file).Str("url", redactURL(myurl)).Msg("Sending POST")
 
-    resp, err := clientHttp[id].R().
+    resp, err := req.
         SetFiles(map[string]string{
             "file": file,
         }).
@@ -49,12 +73,202 @@ func callHookFile(myurl string, payload map[string]string, id int, file string)
         Post(myurl)
 
     if err != nil {
-        log.Error().Err(err).Str("url", myurl).Msg("Failed to send POST request")
+        log.Error().Err(err).Str("url", redactURL(myurl)).Msg("Failed to send POST request")
         return fmt.Errorf("failed to send POST request: %w", err)
     }
 
     // Optionally, you can log the response status
     log.Info().Int("status", resp.StatusCode()).Msg("POST request completed")
+    if resp.IsError() {
+        return fmt.Errorf("webhook answered %s", resp.Status())
+    }
+
+    return nil
+}
+
+// Generates a random hex token suitable for API authentication
+func generateToken() (string, error) {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(b), nil
+}
+
+// Token from an "Authorization: Bearer" header, "" without one
+func bearerToken(r *http.Request) string {
+    auth := r.Header.Get("Authorization")
+    if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+        return strings.TrimSpace(auth[7:])
+    }
+    return ""
+}
+
+// User token of a request: a bearer token wins over the token header, the
+// token query parameter is last (browsers can't set headers on websockets)
+func requestToken(r *http.Request) string {
+    if token := bearerToken(r); token != "" {
+        return token
+    }
+    if token := r.Header.Get("token"); token != "" {
+        return token
+    }
+    return strings.Join(r.URL.Query()["token"], "")
+}
+
+// Request URL for logs, with the token query parameter masked
+func logURL(u *url.URL) string {
+    query := u.Query()
+    if query.Get("token") == "" {
+        return u.String()
+    }
+    query.Set("token", "****")
+    masked := *u
+    masked.RawQuery = query.Encode()
+    return masked.String()
+}
+
+// Compares tokens in constant time so they can't be guessed from timings
+func tokensEqual(a string, b string) bool {
+    return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Held for writing while a user's token is changed, auth lookups hold it for
+// reading
+var tokenLock sync.RWMutex
+
+// Reloads user info in cache after an admin change. The entry for oldToken is
+// dropped so a replaced token stops working right away, and a running client
+// picks up the new token, webhook and events
+func (s *server) refreshUserInfo(userID string, oldToken string) {
+    var token, webhook, jid, events, payloadFormat, webhookHeaders string
+    var expiration sql.NullInt64
+    var storeMessages, contactNames, webhookTimeout, webhookGzip int
+    err := s.db.QueryRow("SELECT token,webhook,jid,events,expiration,store_messages,payload_format,contact_names,webhook_headers,webhook_timeout,webhook_gzip FROM users WHERE id=?", userID).Scan(&token, &webhook, &jid, &events, &expiration, &storeMessages, &payloadFormat, &contactNames, &webhookHeaders, &webhookTimeout, &webhookGzip)
+    if err != nil {
+        userinfocache.Delete(oldToken)
+        log.Error().Err(err).Str("userid", userID).Msg("Could not reload user info")
+        return
+    }
+    v := Values{map[string]string{
+        "Id":            userID,
+        "Jid":           jid,
+        "Webhook":       webhook,
+        "Token":         token,
+        "Events":        events,
+        "Expiration":    strconv.FormatInt(expiration.Int64, 10),
+        "StoreMessages": strconv.Itoa(storeMessages),
+        "PayloadFormat": payloadFormat,
+        "ContactNames":  strconv.Itoa(contactNames),
+        "WebhookHeaders": webhookHeaders,
+        "WebhookTimeout": strconv.Itoa(webhookTimeout),
+        "WebhookGzip":    strconv.Itoa(webhookGzip),
+    }}
+    // Set before the old entry goes, requests with an unchanged token keep
+    // finding it
+    userinfocache.Set(token, v, cache.NoExpiration)
+
+    id, _ := strconv.Atoi(userID)
+    if token != oldToken {
+        userinfocache.Delete(oldToken)
+        // Streams opened with the old token must not outlive it
+        streams.closeUser(id)
+    }
+    if mycli := sessions.myClient(id); mycli != nil {
+        var subscribedEvents []string
+        for _, arg := range strings.Split(events, ",") {
+            if Find(messageTypes, arg) && !Find(subscribedEvents, arg) {
+                subscribedEvents = append(subscribedEvents, arg)
+            }
+        }
+        if len(subscribedEvents) < 1 {
+            subscribedEvents = append(subscribedEvents, "All")
+        }
+        mycli.setUserInfo(token, subscribedEvents)
+    }
+}
+
+// Masks a token for display, keeping only a short prefix
+func maskToken(token string) string {
+    if len(token) <= 4 {
+        return strings.Repeat("*", len(token))
+    }
+    return token[:4] + strings.Repeat("*", 8)
+}
+
+// Last connection error per user, reported by the session status endpoint
+var connectErrors = make(map[int]string)
+var connectErrorsLock sync.Mutex
 
+func setConnectError(userID int, msg string) {
+    connectErrorsLock.Lock()
+    defer connectErrorsLock.Unlock()
+    if msg == "" {
+        delete(connectErrors, userID)
+        return
+    }
+    connectErrors[userID] = msg
+}
+
+func getConnectError(userID int) (string, bool) {
+    connectErrorsLock.Lock()
+    defer connectErrorsLock.Unlock()
+    msg, ok := connectErrors[userID]
+    return msg, ok
+}
+
+// Checks a proxy URL is one whatsmeow can use (http, https or socks5)
+func validateProxyURL(proxyURL string) error {
+    u, err := url.Parse(proxyURL)
+    if err != nil {
+        return err
+    }
+    if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" {
+        return fmt.Errorf("unsupported proxy scheme %q, use http, https or socks5", u.Scheme)
+    }
+    if u.Hostname() == "" {
+        return errors.New("missing proxy host")
+    }
     return nil
 }
+
+// Hides the password in URLs carrying credentials, for logging
+func redactURL(rawURL string) string {
+    u, err := url.Parse(rawURL)
+    if err != nil {
+        return "(invalid url)"
+    }
+    return u.Redacted()
+}
+
+// Disconnects the session of an expired user, it won't be reconnected on
+// startup either
+func (s *server) killExpired(userID int) {
+    if sessions.disconnect(userID) {
+        log.Warn().Int("userid", userID).Msg("User expired, disconnecting session")
+    }
+}
+
+// Periodically stops sessions of users whose expiration has passed, so they
+// don't keep running when no requests come in
+func (s *server) expirationChecker() {
+    for {
+        time.Sleep(time.Minute)
+        rows, err := s.db.Query("SELECT id FROM users WHERE expiration>0 AND expiration<=?", time.Now().Unix())
+        if err != nil {
+            log.Error().Err(err).Msg("Could not check expirations")
+            continue
+        }
+        var expired []int
+        for rows.Next() {
+            var id int
+            if err := rows.Scan(&id); err == nil {
+                expired = append(expired, id)
+            }
+        }
+        rows.Close()
+        for _, id := range expired {
+            s.killExpired(id)
+        }
+    }
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// How long an on demand history request waits for its answer, the phone
+// may be offline for a while
+const historyRequestTTL = time.Hour
+
+// Ids of the requests waiting for on demand history, by user and chat. A
+// newer request for the same chat takes the place of the older one.
+var historyRequests = cache.New(historyRequestTTL, 10*time.Minute)
+
+func historyRequestKey(userID int, chat types.JID) string {
+	return strconv.Itoa(userID) + "/" + chat.ToNonAD().String()
+}
+
+// Message the phone is asked for history before: the one given by id, or
+// the oldest stored for the chat. Without stored messages the last one seen
+// in the chat is used, so users not storing messages can ask too. False when
+// there is none.
+func historyAnchor(db *sql.DB, userID int, chat types.JID, before string) (types.MessageInfo, bool, error) {
+	info := types.MessageInfo{MessageSource: types.MessageSource{Chat: chat}}
+	var timestamp int64
+	var err error
+	if before != "" {
+		err = db.QueryRow("SELECT id, from_me, timestamp FROM messages WHERE user_id=? AND chat_jid=? AND id=?", userID, chat.String(), before).Scan(&info.ID, &info.IsFromMe, &timestamp)
+		if err == sql.ErrNoRows {
+			err = db.QueryRow("SELECT last_id, last_from_me, last_timestamp FROM chats WHERE user_id=? AND jid=? AND last_id=?", userID, chat.String(), before).Scan(&info.ID, &info.IsFromMe, &timestamp)
+		}
+	} else {
+		err = db.QueryRow("SELECT id, from_me, timestamp FROM messages WHERE user_id=? AND chat_jid=? ORDER BY timestamp ASC LIMIT 1", userID, chat.String()).Scan(&info.ID, &info.IsFromMe, &timestamp)
+		if err == sql.ErrNoRows {
+			err = db.QueryRow("SELECT last_id, last_from_me, last_timestamp FROM chats WHERE user_id=? AND jid=? AND last_id!=''", userID, chat.String()).Scan(&info.ID, &info.IsFromMe, &timestamp)
+		}
+	}
+	if err == sql.ErrNoRows {
+		return info, false, nil
+	}
+	if err != nil {
+		return info, false, err
+	}
+	info.Timestamp = time.Unix(timestamp, 0)
+	return info, true, nil
+}
+
+// Sets the ids of the requests an on demand history sync answers in its
+// webhook: request_ids by chat, and request_id when it answers a single one
+func (mycli *MyClient) addHistoryRequests(postmap map[string]interface{}, evt *events.HistorySync) {
+	if evt.Data.GetSyncType() != waProto.HistorySync_ON_DEMAND {
+		return
+	}
+	answered := map[string]string{}
+	for _, conv := range evt.Data.GetConversations() {
+		chat, err := types.ParseJID(conv.GetID())
+		if err != nil {
+			continue
+		}
+		key := historyRequestKey(mycli.userID, chat)
+		if id, found := historyRequests.Get(key); found {
+			answered[chat.ToNonAD().String()] = id.(string)
+			historyRequests.Delete(key)
+		}
+	}
+	if len(answered) == 0 {
+		return
+	}
+	postmap["request_ids"] = answered
+	if len(answered) == 1 {
+		for _, id := range answered {
+			postmap["request_id"] = id
+		}
+	}
+}
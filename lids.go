@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Phone number JIDs and LIDs (linked identifiers) of the same accounts.
+// The whatsmeow version in use neither keeps this mapping nor sends to LIDs,
+// so pairs are learned from group participant lists and kept in the
+// lid_mappings table. It is shared by all users, a LID names the same
+// account for everyone.
+type lidStore struct {
+	sync.RWMutex
+	db    *sql.DB
+	toPN  map[string]types.JID
+	toLID map[string]types.JID
+	// Groups already looked up for an unknown LID sender, by user and group
+	fetched sync.Map
+}
+
+var lids = &lidStore{toPN: make(map[string]types.JID), toLID: make(map[string]types.JID)}
+
+func (l *lidStore) load(db *sql.DB) error {
+	rows, err := db.Query("SELECT lid, pn FROM lid_mappings")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	l.Lock()
+	defer l.Unlock()
+	l.db = db
+	for rows.Next() {
+		var lidText, pnText string
+		if err := rows.Scan(&lidText, &pnText); err != nil {
+			return err
+		}
+		lid, err := types.ParseJID(lidText)
+		if err != nil {
+			continue
+		}
+		pn, err := types.ParseJID(pnText)
+		if err != nil {
+			continue
+		}
+		l.toPN[lid.User] = pn
+		l.toLID[pn.User] = lid
+	}
+	return rows.Err()
+}
+
+// Records that pn and lid are the same account
+func (l *lidStore) learn(pn types.JID, lid types.JID) {
+	if pn.Server != types.DefaultUserServer || lid.Server != types.HiddenUserServer {
+		return
+	}
+	pn, lid = pn.ToNonAD(), lid.ToNonAD()
+	l.Lock()
+	known, ok := l.toPN[lid.User]
+	if ok && known == pn {
+		l.Unlock()
+		return
+	}
+	l.toPN[lid.User] = pn
+	l.toLID[pn.User] = lid
+	db := l.db
+	l.Unlock()
+	if db == nil {
+		return
+	}
+	sqlStmt := `INSERT INTO lid_mappings (lid, pn) VALUES (?, ?) ON CONFLICT(lid) DO UPDATE SET pn=excluded.pn`
+	if _, err := execRetry(db, sqlStmt, lid.String(), pn.String()); err != nil {
+		log.Error().Err(err).Msg(sqlStmt)
+	}
+}
+
+// Learns the pairs of a group's participants listed with both forms
+func (l *lidStore) learnGroup(group *types.GroupInfo) {
+	if group == nil {
+		return
+	}
+	for _, participant := range group.Participants {
+		l.learn(participant.JID, participant.LID)
+	}
+}
+
+// Phone number JID of a LID
+func (l *lidStore) pn(lid types.JID) (types.JID, bool) {
+	l.RLock()
+	defer l.RUnlock()
+	pn, ok := l.toPN[lid.User]
+	return pn, ok
+}
+
+// LID of a phone number JID
+func (l *lidStore) lid(pn types.JID) (types.JID, bool) {
+	l.RLock()
+	defer l.RUnlock()
+	lid, ok := l.toLID[pn.User]
+	return lid, ok
+}
+
+// Both forms of jid, empty strings for the one not known
+func (l *lidStore) forms(jid types.JID) (pn string, lid string) {
+	jid = jid.ToNonAD()
+	switch jid.Server {
+	case types.DefaultUserServer:
+		pn = jid.String()
+		if other, ok := l.lid(jid); ok {
+			lid = other.String()
+		}
+	case types.HiddenUserServer:
+		lid = jid.String()
+		if other, ok := l.pn(jid); ok {
+			pn = other.String()
+		}
+	}
+	return pn, lid
+}
+
+// Participants of a group in both forms as far as they are known, LID
+// addressed groups list them by LID only
+func (l *lidStore) fillGroup(group *types.GroupInfo) {
+	if group == nil {
+		return
+	}
+	for i, participant := range group.Participants {
+		if participant.JID.Server == types.HiddenUserServer {
+			if pn, ok := l.pn(participant.JID); ok {
+				group.Participants[i].LID = participant.JID
+				group.Participants[i].JID = pn
+			}
+		} else if participant.LID.IsEmpty() {
+			if lid, ok := l.lid(participant.JID); ok {
+				group.Participants[i].LID = lid
+			}
+		}
+	}
+}
+
+// Sets the sender of an event in a webhook: sender as WhatsApp gave it, a
+// LID in LID addressed groups, senderPn its phone number JID, and pn and lid
+// with both forms. Forms not known are empty.
+func addSender(postmap map[string]interface{}, sender types.JID) (pn string) {
+	pn, lid := lids.forms(sender)
+	postmap["sender"] = sender.ToNonAD().String()
+	postmap["senderPn"] = pn
+	postmap["pn"] = pn
+	postmap["lid"] = lid
+	return pn
+}
+
+// Looks up the participants of group in the background the first time a
+// sender without known phone number writes there, so the next messages
+// carry both forms. Only tried once per group and user.
+func (l *lidStore) lookupGroup(client *whatsmeow.Client, userID int, group types.JID) {
+	key := struct {
+		userID int
+		group  types.JID
+	}{userID, group}
+	if _, done := l.fetched.LoadOrStore(key, true); done {
+		return
+	}
+	go func() {
+		info, err := client.GetGroupInfo(group)
+		if err != nil {
+			log.Warn().Err(err).Str("group", group.String()).Msg("Could not get group participants to map LIDs")
+			return
+		}
+		l.learnGroup(info)
+	}()
+}
+
+// Gets the phone number and LID forms of ?jid=, as learned from groups
+func (s *server) GetLID() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		param := r.URL.Query().Get("jid")
+		if param == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing jid parameter"))
+			return
+		}
+		jid, err := types.ParseJID(param)
+		if err != nil || jid.User == "" || (jid.Server != types.DefaultUserServer && jid.Server != types.HiddenUserServer) {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse jid, must be a phone number or LID JID"))
+			return
+		}
+
+		pn, lid := lids.forms(jid)
+		if pn == "" || lid == "" {
+			s.Respond(w, r, http.StatusNotFound, errors.New("No mapping known for jid"))
+			return
+		}
+		responseJson, err := json.Marshal(map[string]interface{}{"pn": pn, "lid": lid})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	testPN  = types.NewJID("5511999990000", types.DefaultUserServer)
+	testLID = types.NewJID("123456789012345", types.HiddenUserServer)
+	testGrp = types.NewJID("120363025246125486", types.GroupServer)
+)
+
+// Empty LID mapping in place of the shared one for the test
+func testLIDs(t *testing.T) *lidStore {
+	t.Helper()
+	saved := lids
+	lids = &lidStore{toPN: make(map[string]types.JID), toLID: make(map[string]types.JID)}
+	t.Cleanup(func() { lids = saved })
+	return lids
+}
+
+// Received message from a LID in a LID addressed group, as newer groups send
+func testLIDMessage(text string) *events.Message {
+	sender := testLID
+	sender.Device = 2
+	return &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{Chat: testGrp, Sender: sender, IsGroup: true},
+			ID:            "3EB0LID",
+			PushName:      "Ana",
+			Timestamp:     time.Unix(1700000000, 0),
+		},
+		Message: &waProto.Message{Conversation: proto.String(text)},
+	}
+}
+
+func TestLIDStoreLearnsFromGroups(t *testing.T) {
+	store := testLIDs(t)
+	other := types.NewJID("5511888880000", types.DefaultUserServer)
+	store.learnGroup(&types.GroupInfo{Participants: []types.GroupParticipant{
+		{JID: testPN, LID: testLID},
+		// Only the phone number, nothing to learn
+		{JID: other},
+	}})
+
+	if pn, ok := store.pn(testLID); !ok || pn != testPN {
+		t.Errorf("pn of LID: got %v %v", pn, ok)
+	}
+	if lid, ok := store.lid(testPN); !ok || lid != testLID {
+		t.Errorf("LID of pn: got %v %v", lid, ok)
+	}
+	if _, ok := store.lid(other); ok {
+		t.Error("LID known for a participant listed without one")
+	}
+
+	// Device JIDs are the same accounts
+	device := testLID
+	device.Device = 5
+	if pn, lid := store.forms(device); pn != testPN.String() || lid != testLID.String() {
+		t.Errorf("forms of LID device: got %q %q", pn, lid)
+	}
+	if pn, lid := store.forms(testPN); pn != testPN.String() || lid != testLID.String() {
+		t.Errorf("forms of pn: got %q %q", pn, lid)
+	}
+	unknown := types.NewJID("999999999999999", types.HiddenUserServer)
+	if pn, lid := store.forms(unknown); pn != "" || lid != unknown.String() {
+		t.Errorf("forms of unknown LID: got %q %q", pn, lid)
+	}
+	if pn, lid := store.forms(testGrp); pn != "" || lid != "" {
+		t.Errorf("forms of a group: got %q %q", pn, lid)
+	}
+
+	// Pairs in the wrong order are ignored
+	store.learn(testLID, testPN)
+	if _, ok := store.pn(testPN); ok {
+		t.Error("learned a phone number as LID")
+	}
+}
+
+func TestLIDStorePersists(t *testing.T) {
+	db := testUsersDB(t)
+	store := testLIDs(t)
+	if err := store.load(db); err != nil {
+		t.Fatal(err)
+	}
+	store.learn(testPN, testLID)
+
+	reloaded := &lidStore{toPN: make(map[string]types.JID), toLID: make(map[string]types.JID)}
+	if err := reloaded.load(db); err != nil {
+		t.Fatal(err)
+	}
+	if pn, ok := reloaded.pn(testLID); !ok || pn != testPN {
+		t.Errorf("pn after reload: got %v %v", pn, ok)
+	}
+
+	// A LID moving to another number replaces the row
+	moved := types.NewJID("5511777770000", types.DefaultUserServer)
+	store.learn(moved, testLID)
+	var count int
+	var pn string
+	if err := db.QueryRow("SELECT COUNT(*), MAX(pn) FROM lid_mappings").Scan(&count, &pn); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || pn != moved.String() {
+		t.Errorf("got %d rows with %s, want 1 with %s", count, pn, moved)
+	}
+}
+
+func TestFillGroupParticipants(t *testing.T) {
+	store := testLIDs(t)
+	store.learn(testPN, testLID)
+	other := types.NewJID("5511888880000", types.DefaultUserServer)
+	unknown := types.NewJID("999999999999999", types.HiddenUserServer)
+	group := &types.GroupInfo{Participants: []types.GroupParticipant{
+		{JID: testLID},
+		{JID: unknown},
+		{JID: other},
+	}}
+	store.learn(other, types.NewJID("888888888888888", types.HiddenUserServer))
+	store.fillGroup(group)
+
+	want := []types.GroupParticipant{
+		{JID: testPN, LID: testLID},
+		{JID: unknown},
+		{JID: other, LID: types.NewJID("888888888888888", types.HiddenUserServer)},
+	}
+	for i, participant := range group.Participants {
+		if participant.JID != want[i].JID || participant.LID != want[i].LID {
+			t.Errorf("participant %d: got %v/%v, want %v/%v", i, participant.JID, participant.LID, want[i].JID, want[i].LID)
+		}
+	}
+}
+
+func TestAddSenderLID(t *testing.T) {
+	store := testLIDs(t)
+	evt := testLIDMessage("hello")
+
+	postmap := map[string]interface{}{}
+	if pn := addSender(postmap, evt.Info.Sender); pn != "" {
+		t.Errorf("unknown LID gave phone number %q", pn)
+	}
+	if postmap["sender"] != testLID.String() || postmap["senderPn"] != "" || postmap["lid"] != testLID.String() {
+		t.Errorf("unknown LID: got %v", postmap)
+	}
+
+	store.learn(testPN, testLID)
+	postmap = map[string]interface{}{}
+	if pn := addSender(postmap, evt.Info.Sender); pn != testPN.String() {
+		t.Errorf("known LID gave phone number %q", pn)
+	}
+	want := map[string]interface{}{"sender": testLID.String(), "senderPn": testPN.String(), "pn": testPN.String(), "lid": testLID.String()}
+	for key, value := range want {
+		if postmap[key] != value {
+			t.Errorf("%s: got %v, want %v", key, postmap[key], value)
+		}
+	}
+
+	// Senders by phone number keep it as sender
+	postmap = map[string]interface{}{}
+	addSender(postmap, testPN)
+	if postmap["sender"] != testPN.String() || postmap["senderPn"] != testPN.String() || postmap["lid"] != testLID.String() {
+		t.Errorf("phone number sender: got %v", postmap)
+	}
+}
+
+func TestSimplifyLIDMessage(t *testing.T) {
+	store := testLIDs(t)
+	evt := testLIDMessage("hello")
+	if m := simplifyMessage(evt); m.Sender != testLID.String() || m.SenderPn != "" {
+		t.Errorf("unknown LID: got sender %q senderPn %q", m.Sender, m.SenderPn)
+	}
+	store.learn(testPN, testLID)
+	if m := simplifyMessage(evt); m.Sender != testLID.String() || m.SenderPn != testPN.String() || m.Chat != testGrp.String() {
+		t.Errorf("known LID: got %+v", m)
+	}
+}
+
+func TestSendToLID(t *testing.T) {
+	store := testLIDs(t)
+	if _, err := resolveRecipient(nil, "Phone", testLID.String()); err == nil {
+		t.Error("sent to a LID without known phone number")
+	}
+	store.learn(testPN, testLID)
+	jid, err := resolveRecipient(nil, "Phone", testLID.String())
+	if err != nil || jid != testPN {
+		t.Errorf("got %v %v, want %v", jid, err, testPN)
+	}
+}
+
+func TestGetLID(t *testing.T) {
+	store := testLIDs(t)
+	store.learn(testPN, testLID)
+	s := &server{}
+	tests := []struct {
+		jid    string
+		status int
+	}{
+		{testPN.String(), http.StatusOK},
+		{testLID.String(), http.StatusOK},
+		{"5511888880000@s.whatsapp.net", http.StatusNotFound},
+		{testGrp.String(), http.StatusBadRequest},
+		{"", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.GetLID()(w, httptest.NewRequest("GET", "/user/lid?jid="+tt.jid, nil))
+		if w.Code != tt.status {
+			t.Errorf("%q: status %d, want %d", tt.jid, w.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var body struct{ Data map[string]string }
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Data["pn"] != testPN.String() || body.Data["lid"] != testLID.String() {
+			t.Errorf("%q: got %s", tt.jid, w.Body)
+		}
+	}
+}
@@ -3,17 +3,21 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"go.mau.fi/whatsmeow/store/sqlstore"
 	waLog "go.mau.fi/whatsmeow/util/log"
+	"wuzapi/config"
 
 	"github.com/gorilla/mux"
 	"github.com/patrickmn/go-cache"
@@ -22,141 +26,452 @@ import (
 )
 
 type server struct {
-	db     *sql.DB
-	router *mux.Router
-	exPath string
+	db      *sql.DB
+	storeDb *sql.DB
+	router  *mux.Router
+	// adminRouter is the router of -admin-port, router itself without it
+	adminRouter *mux.Router
+	exPath      string
+	// exPath is the temporary fallback, see getWritableDbPath
+	exPathTemp bool
 }
 
 var (
-	address     = flag.String("address", "0.0.0.0", "Bind IP Address")
-	port        = flag.String("port", "8080", "Listen Port")
-	waDebug     = flag.String("wadebug", "", "Enable whatsmeow debug (INFO or DEBUG)")
-	logType     = flag.String("logtype", "console", "Type of log output (console or json)")
-	colorOutput = flag.Bool("color", false, "Enable colored output for console logs")
-	sslcert     = flag.String("sslcertificate", "", "SSL Certificate File")
-	sslprivkey  = flag.String("sslprivatekey", "", "SSL Certificate Private Key File")
-	adminToken  = flag.String("admintoken", "", "Security Token to authorize admin actions")
-	container   *sqlstore.Container
-
-	killchannel   = make(map[int](chan bool))
+	configFile         = flag.String("config", "", "YAML file with settings, by flag name, overridden by environment variables and flags")
+	address            = flag.String("address", "0.0.0.0", "Bind IP Address")
+	port               = flag.String("port", "8080", "Listen Port")
+	adminAddress       = flag.String("admin-address", "127.0.0.1", "Bind IP Address of the -admin-port listener")
+	adminPort          = flag.String("admin-port", "", "Serve the admin routes on this port only, on -admin-address, instead of on -port")
+	adminPrefix        = flag.String("admin-prefix", "/admin", "Path prefix of the admin routes, served under /v1")
+	waDebug            = flag.String("wadebug", "", "Enable whatsmeow debug (INFO or DEBUG)")
+	logType            = flag.String("logtype", "console", "Type of log output (console or json)")
+	colorOutput        = flag.Bool("color", false, "Enable colored output for console logs")
+	accessLogLevel     = flag.String("access-log", "info", "Requests logged: off, errors (4xx and 5xx only), info (all) or debug (with query, size, ip and user agent)")
+	sslcert            = flag.String("sslcertificate", "", "SSL Certificate File")
+	sslprivkey         = flag.String("sslprivatekey", "", "SSL Certificate Private Key File")
+	adminToken         = flag.String("admintoken", "", "Security Token to authorize admin actions")
+	buttons            = flag.Bool("buttons", false, "Enable sending buttons messages, WhatsApp may not deliver them")
+	rawProto           = flag.Bool("raw-proto", false, "Enable /chat/send/proto, sending any message given as a JSON waE2E.Message")
+	resolvePhones      = flag.Bool("resolve-phones", false, "Look up phone numbers sent to on WhatsApp first, sending to the JID they are registered with")
+	brazilNinthDigit   = flag.Bool("br-ninth-digit", true, "Look up Brazilian mobile numbers with and without the 9th digit before sending, disable when numbers come normalized")
+	maxMediaSize       = flag.Int64("maxmediasize", 64<<20, "Largest media accepted in an upload, images, audio and video are also capped at 16MB, stickers and pictures at 5MB")
+	maxBodyBytes       = flag.Int64("max-body-bytes", 1<<20, "Largest request body of the endpoints that take no media upload")
+	maxImportBytes     = flag.Int64("max-import-bytes", 64<<20, "Largest session export /admin/users/import takes")
+	gzipResponses      = flag.Bool("gzip", true, "Gzip responses for clients accepting it, except those under 1KB, media and event streams")
+	gzipLevel          = flag.Int("gzip-level", 6, "Compression level of gzipped responses and webhooks, 1 (fastest) to 9 (smallest)")
+	ffmpegPath         = flag.String("ffmpeg", "ffmpeg", "ffmpeg used to grab video thumbnails, empty disables it")
+	ffprobePath        = flag.String("ffprobe", "ffprobe", "ffprobe used to read video duration, size and codec, empty disables it")
+	insecureURLs       = flag.Bool("insecureurls", false, "Allow plain http URLs when fetching remote media")
+	startupConcurrency = flag.Int("startup-concurrency", 5, "Number of sessions connecting at the same time on startup")
+	startupDelay       = flag.Duration("startup-delay", 2*time.Second, "Wait between starting connections on startup")
+	reconnectMax       = flag.Duration("reconnectmax", 5*time.Minute, "Maximum wait between reconnection attempts after a connection drop")
+	replacedReconnect  = flag.Duration("replaced-reconnect", 0, "Wait before reconnecting once a session replaced by a connection from elsewhere, 0 leaves it disconnected")
+	messageRetention   = flag.Int("messageretention", 0, "Days to keep stored messages, 0 keeps them forever")
+	messageMaxRows     = flag.Int("messagemaxrows", 0, "Maximum stored messages per user, 0 for no limit")
+	dedupWindow        = flag.Duration("dedup-window", 10*time.Minute, "How long received message ids are remembered to drop messages WhatsApp delivers twice, 0 disables it")
+	receiptRetention   = flag.Duration("receiptretention", 7*24*time.Hour, "How long receipts of sent messages are kept, 0 disables tracking")
+	sendTimeout        = flag.Duration("send-timeout", 90*time.Second, "Longest a send may take, uploading media included, 0 for no limit")
+	broadcastDelay     = flag.Duration("broadcast-delay", 250*time.Millisecond, "Wait between the messages of a /chat/send/broadcast")
+	callRejectGrace    = flag.Duration("call-reject-grace", 5*time.Second, "Wait before automatically rejecting a call, calls answered on the phone meanwhile are left alone")
+	webhookTimeout     = flag.Duration("webhook-timeout", 5*time.Second, "Timeout for each webhook POST")
+	webhookWorkers     = flag.Int("webhook-workers", 4, "Concurrent webhook deliveries per user")
+	webhookQueueSize   = flag.Int("webhook-queue", 100, "Webhook events waiting for delivery per user")
+	webhookClientCert  = flag.String("webhook-client-cert", "", "Client certificate (PEM) presented to webhooks that require mTLS")
+	webhookClientKey   = flag.String("webhook-client-key", "", "Private key (PEM) of -webhook-client-cert")
+	webhookCA          = flag.String("webhook-ca", "", "PEM bundle of CAs trusted for webhook server certificates besides the system ones, for receivers on a private PKI")
+	replaySize         = flag.Int("replay-buffer", 1000, "Recent events kept per user for /events/replay, 0 disables it")
+	webhookNoPrivate   = flag.Bool("webhook-block-private", false, "Refuse webhook URLs resolving to loopback, private or link local addresses, and media downloads from them")
+	webhookLegacy      = flag.Bool("webhook-legacy", false, "Post webhook events in the shape used before the versioned envelope, while receivers migrate")
+	webhookOverflow    = flag.String("webhook-overflow", "queue", "What to do with events when the webhook queue is full: queue (wait for room) or drop")
+	globalWebhookURL   = flag.String("globalwebhook", "", "Webhook URL told when any user connects, disconnects, is logged out, fails webhook posts or hits an error, never of messages")
+	corsOriginList     = flag.String("cors-origins", "", "Comma separated origins allowed to call the API from browsers, * for any, empty disables CORS")
+	corsMethods        = flag.String("cors-methods", corsAllowMethods, "Comma separated methods allowed in CORS requests")
+	corsHeaders        = flag.String("cors-headers", corsAllowHeaders, "Comma separated request headers allowed in CORS requests")
+	corsCredentials    = flag.Bool("cors-credentials", false, "Allow credentialed CORS requests, needs explicit -cors-origins")
+	corsNoAdmin        = flag.Bool("cors-no-admin", false, "Leave the admin routes out of CORS so browsers can't call them")
+	dbWAL              = flag.Bool("db-wal", true, "Use SQLite WAL journal mode, better with many sessions reading and writing at once")
+	dbSynchronous      = flag.String("db-synchronous", "normal", "SQLite synchronous setting: off, normal, full or extra (SQLite default when empty)")
+	dbBusyTimeout      = flag.Duration("db-busy-timeout", 3*time.Second, "How long SQLite waits for a locked database before failing")
+	dbMaxOpenConns     = flag.Int("db-max-open-conns", 1, "Maximum open connections to the users database, 0 for no limit")
+	dbMaxIdleConns     = flag.Int("db-max-idle-conns", 1, "Maximum idle connections kept to the users database")
+	dbConnMaxLifetime  = flag.Duration("db-conn-max-lifetime", 0, "How long a users database connection is reused, 0 forever")
+	dataDir            = flag.String("datadir", "dbdata", "Directory of the databases and session stores")
+	storePerUser       = flag.Bool("store-per-user", false, "Keep each user's WhatsApp device in its own store file under the data directory's stores instead of the shared main.db")
+	dbMaintenance      = flag.Duration("db-maintenance", 24*time.Hour, "How often the databases are checkpointed and vacuumed, at a moment without sends, 0 disables it")
+	deviceSweep        = flag.Duration("device-sweep", time.Hour, "How often devices of the WhatsApp store and users are checked against each other, 0 disables it")
+	deviceName         = flag.String("device-name", "Mac OS 10", "Name the sessions are listed with in the phone's linked devices, users can override it with device_name")
+	shutdownTimeout    = flag.Duration("shutdown-timeout", 30*time.Second, "How long a shutdown waits for requests, session disconnects and webhook posts to finish")
+	migrateOnly        = flag.Bool("migrate-only", false, "Apply database migrations and exit, for init containers")
+	enableDebug        = flag.Bool("enable-debug-endpoints", false, "Serve pprof, a goroutine summary and a GC trigger under the admin routes /debug/, admin token required")
+	sentryDSN          = flag.String("sentry-dsn", "", "Sentry DSN panics and error logs are reported to, none by default")
+	otelEndpoint       = flag.String("otel-endpoint", "", "OTLP/HTTP collector URL traces of requests, sends, database calls and webhooks are exported to, none by default")
+	otelSampleRate     = flag.Float64("otel-sample-rate", 1, "Share of new traces recorded, 0 to 1, requests with a traceparent header follow the caller's choice")
+	legacyRoutes       = flag.Bool("legacy-routes", true, "Also serve the API on the unprefixed paths used before /v1, marked as deprecated")
+	container          *sqlstore.Container
+
 	userinfocache = cache.New(5*time.Minute, 10*time.Minute)
 	log           zerolog.Logger
+
+	startTime    = time.Now()
+	startupReady atomic.Bool
 )
 
 func init() {
-	flag.Parse()
+	// Name of -maxmediasize before it, still taken
+	flag.Int64Var(maxMediaSize, "max-upload-bytes", *maxMediaSize, "Deprecated, same as -maxmediasize")
+}
+
+// Flags whose values are never logged: credentials, URLs that may carry
+// them and paths of private keys
+var secretSettings = []string{"admintoken", "sentry-dsn", "globalwebhook", "otel-endpoint", "webhook-client-key", "sslprivatekey"}
+
+func newSettings() config.Config {
+	return config.Config{
+		EnvPrefix: "WUZAPI_",
+		// Names read before every flag had its own variable
+		EnvAliases: map[string]string{"admintoken": "WUZAPI_ADMIN_TOKEN"},
+		FileFlag:   "config",
+		Secrets:    secretSettings,
+	}
+}
+
+// Logs every flag with its value and where it came from, secrets redacted
+func logSettings(settings *config.Config) {
+	effective := log.Info()
+	for _, setting := range settings.Settings(flag.CommandLine) {
+		effective.Str(setting.Name, setting.Value+" ("+string(setting.Source)+")")
+	}
+	effective.Msg("Effective settings")
+}
+
+// Resolves the settings, sets up logging and checks the flags. Run first
+// by main, tests go without it and keep the defaults.
+func configure() {
+	settings := newSettings()
+	configErr := settings.Load(flag.CommandLine, os.Args[1:])
 
+	// The user subcommand prints its results on stdout
+	logOutput := os.Stdout
+	if flag.Arg(0) == "user" {
+		logOutput = os.Stderr
+	}
 	if *logType == "json" {
-		log = zerolog.New(os.Stdout).With().Timestamp().Str("role", filepath.Base(os.Args[0])).Logger()
+		log = zerolog.New(logOutput).With().Timestamp().Str("role", filepath.Base(os.Args[0])).Logger()
 	} else {
-		output := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339, NoColor: !*colorOutput}
+		output := zerolog.ConsoleWriter{Out: logOutput, TimeFormat: time.RFC3339, NoColor: !*colorOutput}
 		log = zerolog.New(output).With().Timestamp().Str("role", filepath.Base(os.Args[0])).Logger()
 	}
 
-	if *adminToken == "" {
-		if v := os.Getenv("WUZAPI_ADMIN_TOKEN"); v != "" {
-			*adminToken = v
-		}
+	if flag.Arg(0) == "user" {
+		log = log.Level(zerolog.WarnLevel)
+	}
+
+	if configErr != nil {
+		log.Fatal().Err(configErr).Msg("Invalid configuration")
+	}
+	// First, so invalid settings below are reported too
+	if err := setupErrorReports(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid -sentry-dsn")
+	}
+
+	if !Find(accessLogLevels, *accessLogLevel) {
+		log.Fatal().Str("access-log", *accessLogLevel).Msg("Invalid -access-log, must be off, errors, info or debug")
+	}
+	if *webhookOverflow != "queue" && *webhookOverflow != "drop" {
+		log.Fatal().Str("webhook-overflow", *webhookOverflow).Msg("Invalid -webhook-overflow, must be queue or drop")
+	}
+	if *webhookWorkers < 1 {
+		log.Fatal().Int("webhook-workers", *webhookWorkers).Msg("Invalid -webhook-workers, must be at least 1")
+	}
+	if *maxMediaSize <= 0 {
+		log.Fatal().Int64("maxmediasize", *maxMediaSize).Msg("Invalid -maxmediasize, must be positive")
+	}
+	if *maxBodyBytes <= 0 {
+		log.Fatal().Int64("max-body-bytes", *maxBodyBytes).Msg("Invalid -max-body-bytes, must be positive")
+	}
+	if *maxImportBytes <= 0 {
+		log.Fatal().Int64("max-import-bytes", *maxImportBytes).Msg("Invalid -max-import-bytes, must be positive")
+	}
+	if *gzipLevel < 1 || *gzipLevel > 9 {
+		log.Fatal().Int("gzip-level", *gzipLevel).Msg("Invalid -gzip-level, must be 1 to 9")
 	}
+	if *otelSampleRate < 0 || *otelSampleRate > 1 {
+		log.Fatal().Float64("otel-sample-rate", *otelSampleRate).Msg("Invalid -otel-sample-rate, must be 0 to 1")
+	}
+	if err := setupTracing(); err != nil {
+		log.Fatal().Err(err).Str("otel-endpoint", *otelEndpoint).Msg("Invalid -otel-endpoint")
+	}
+	if *webhookQueueSize < 0 {
+		log.Fatal().Int("webhook-queue", *webhookQueueSize).Msg("Invalid -webhook-queue, can't be negative")
+	}
+	if *replaySize < 0 {
+		log.Fatal().Int("replay-buffer", *replaySize).Msg("Invalid -replay-buffer, can't be negative")
+	}
+	if err := loadWebhookCertificate(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid webhook client certificate")
+	}
+	if err := loadWebhookCA(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid -webhook-ca")
+	}
+	if err := validateWebhookURL(*globalWebhookURL); err != nil {
+		log.Fatal().Err(err).Msg("Invalid -globalwebhook")
+	}
+	if err := validateCORS(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid CORS setting")
+	}
+	// Browsers refuse credentials with a wildcard origin, don't pretend to allow them
+	if *corsCredentials && Find(corsOrigins(), "*") {
+		log.Fatal().Msg("Invalid -cors-credentials, it can't be used with -cors-origins=*")
+	}
+
+	switch *dbSynchronous {
+	case "", "off", "normal", "full", "extra":
+	default:
+		log.Fatal().Str("db-synchronous", *dbSynchronous).Msg("Invalid -db-synchronous, must be off, normal, full or extra")
+	}
+	if *dbBusyTimeout < 0 {
+		log.Fatal().Dur("db-busy-timeout", *dbBusyTimeout).Msg("Invalid -db-busy-timeout, can't be negative")
+	}
+	if *dbMaxOpenConns < 0 || *dbMaxIdleConns < 0 || *dbConnMaxLifetime < 0 {
+		log.Fatal().Int("db-max-open-conns", *dbMaxOpenConns).Int("db-max-idle-conns", *dbMaxIdleConns).Dur("db-conn-max-lifetime", *dbConnMaxLifetime).Msg("Invalid database pool setting, can't be negative")
+	}
+	if *dbSynchronous == "off" {
+		log.Warn().Msg("-db-synchronous=off can corrupt the databases on a crash or power loss")
+	} else if *dbSynchronous == "normal" && !*dbWAL {
+		log.Warn().Msg("-db-synchronous=normal is only safe with -db-wal, a power loss can corrupt the databases")
+	}
+
+	if *deviceName == "" {
+		log.Fatal().Msg("Invalid -device-name, can't be empty")
+	}
+	if err := validateDeviceName(*deviceName); err != nil {
+		log.Fatal().Err(err).Str("device-name", *deviceName).Msg("Invalid -device-name")
+	}
+
+	if *dataDir == "" {
+		log.Fatal().Msg("Invalid -datadir, can't be empty")
+	}
+	if err := validateAdminPrefix(*adminPrefix); err != nil {
+		log.Fatal().Err(err).Str("admin-prefix", *adminPrefix).Msg("Invalid -admin-prefix")
+	}
+	if *adminPort != "" && *adminPort == *port {
+		log.Fatal().Str("admin-port", *adminPort).Msg("Invalid -admin-port, it can't be the same as -port")
+	}
+
+	logSettings(&settings)
 }
 
-func getWritableDbPath() string {
-	dbPath := "dbdata"
-	if err := os.MkdirAll(dbPath, 0755); err == nil {
-		return dbPath
+// Creates dir if needed and checks files can be written in it. MkdirAll
+// succeeds on an existing read-only directory, so a probe file is created
+// and removed again.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(dir, ".wuzapi-probe-*")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// Directory of the databases, -datadir or else a directory under the system
+// temp dir when that one is read-only. Whether the fallback was taken is
+// reported by the health check: sessions kept there are lost on reboot.
+func getWritableDbPath() (string, bool) {
+	err := checkWritable(*dataDir)
+	if err == nil {
+		return *dataDir, false
+	}
+	if !os.IsPermission(err) && !errors.Is(err, syscall.EROFS) {
+		log.Fatal().Err(err).Str("datadir", *dataDir).Msg("Could not use data directory")
 	}
 
-	// Fallback to /tmp if ./dbdata fails
 	tmpFallback := filepath.Join(os.TempDir(), "wuzapi-dbdata")
-	log.Warn().Msg("Using fallback path: " + tmpFallback)
-	if err := os.MkdirAll(tmpFallback, 0755); err != nil {
-		log.Fatal().Err(err).Msg("Could not create fallback dbdata directory")
-		os.Exit(1)
+	if err := checkWritable(tmpFallback); err != nil {
+		log.Fatal().Err(err).Str("datadir", tmpFallback).Msg("Could not create fallback data directory")
+	}
+	log.Warn().Err(err).Str("datadir", *dataDir).Str("fallback", tmpFallback).Msg("DATA DIRECTORY IS READ-ONLY, USING A TEMPORARY ONE: SESSIONS AND USERS WILL BE LOST ON REBOOT, set -datadir to a writable path")
+	return tmpFallback, true
+}
+
+// SQLite DSN for a database file with the pragmas set by the -db flags.
+// Pragmas run on every new connection of the pool.
+func sqliteDSN(path string) string {
+	pragmas := []string{"foreign_keys(1)", fmt.Sprintf("busy_timeout(%d)", dbBusyTimeout.Milliseconds())}
+	if *dbWAL {
+		pragmas = append(pragmas, "journal_mode(WAL)")
+	}
+	if *dbSynchronous != "" {
+		pragmas = append(pragmas, "synchronous("+strings.ToUpper(*dbSynchronous)+")")
+	}
+	return "file:" + path + "?_pragma=" + strings.Join(pragmas, "&_pragma=")
+}
+
+func (s *server) httpServer(addr string, router *mux.Router) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           s.cors(s.requestID(s.accessLog(s.trace(router, s.recoverPanic(router, s.compress(router)))))),
+		ReadHeaderTimeout: 20 * time.Second,
+		ReadTimeout:       60 * time.Second,
+		WriteTimeout:      120 * time.Second,
+		IdleTimeout:       180 * time.Second,
+	}
+}
+
+// Serves srv until it is shut down, with TLS when -sslcertificate is set
+func listen(srv *http.Server) {
+	if *sslcert != "" {
+		if err := srv.ListenAndServeTLS(*sslcert, *sslprivkey); err != nil && err != http.ErrServerClosed {
+			log.Fatal().Err(err).Str("addr", srv.Addr).Msg("Startup failed (TLS)")
+		}
+	} else {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal().Err(err).Str("addr", srv.Addr).Msg("Startup failed")
+		}
 	}
-	return tmpFallback
 }
 
 func main() {
-	dbDir := getWritableDbPath()
+	configure()
+	if flag.Arg(0) == "user" {
+		os.Exit(userCommand(flag.Args()[1:]))
+	}
+	if flag.NArg() > 0 {
+		log.Fatal().Strs("args", flag.Args()).Msg("Unknown command, only user is one")
+	}
 
-	usersDbPath := filepath.Join(dbDir, "users.db")
-	mainDbPath := "file:" + filepath.Join(dbDir, "main.db") + "?_pragma=foreign_keys(1)&_busy_timeout=3000"
+	dbDir, dbDirTemporary := getWritableDbPath()
+	log.Info().Str("datadir", dbDir).Bool("temporary", dbDirTemporary).Msg("Using data directory")
 
-	db, err := sql.Open("sqlite", usersDbPath+"?_pragma=foreign_keys(1)&_busy_timeout=3000")
+	usersDbPath := sqliteDSN(filepath.Join(dbDir, "users.db"))
+	mainDbPath := sqliteDSN(filepath.Join(dbDir, "main.db"))
+	log.Info().Str("users", redactURL(usersDbPath)).Str("store", redactURL(mainDbPath)).Msg("Opening databases")
+
+	db, err := sql.Open(sqlDriver(), usersDbPath)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Could not open/create users.db")
 		os.Exit(1)
 	}
 	defer db.Close()
+	// SQLite takes one writer at a time, with more connections concurrent
+	// writes wait on each other's locks and fail once the busy timeout runs
+	// out. A single connection queues them in the pool instead.
+	db.SetMaxOpenConns(*dbMaxOpenConns)
+	db.SetMaxIdleConns(*dbMaxIdleConns)
+	db.SetConnMaxLifetime(*dbConnMaxLifetime)
+
+	if err := migrate(db); err != nil {
+		log.Fatal().Err(err).Msg("Could not migrate users.db")
+	}
+	if err := stats.load(db); err != nil {
+		log.Fatal().Err(err).Msg("Could not load stats")
+	}
+	if err := lids.load(db); err != nil {
+		log.Fatal().Err(err).Msg("Could not load LID mappings")
+	}
 
-	sqlStmt := `CREATE TABLE IF NOT EXISTS users (
-		id INTEGER NOT NULL PRIMARY KEY,
-		name TEXT NOT NULL,
-		token TEXT NOT NULL,
-		webhook TEXT NOT NULL default "",
-		jid TEXT NOT NULL default "",
-		qrcode TEXT NOT NULL default "",
-		connected INTEGER,
-		expiration INTEGER,
-		events TEXT NOT NULL default "All"
-	);`
-	if _, err := db.Exec(sqlStmt); err != nil {
-		panic(fmt.Sprintf("%q: %s\n", err, sqlStmt))
+	// The store handle is kept around so admin actions (session export/import)
+	// can work with the whatsmeow tables directly
+	storeDb, err := sql.Open(sqlDriver(), mainDbPath)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not open/create main.db")
+		os.Exit(1)
 	}
+	defer storeDb.Close()
 
 	if *waDebug != "" {
 		dbLog := waLog.Stdout("Database", *waDebug, *colorOutput)
-		container, err = sqlstore.New("sqlite", mainDbPath, dbLog)
+		container = sqlstore.NewWithDB(storeDb, "sqlite", dbLog)
 	} else {
-		container, err = sqlstore.New("sqlite", mainDbPath, nil)
+		container = sqlstore.NewWithDB(storeDb, "sqlite", waLog.Noop)
 	}
+	err = container.Upgrade()
 	if err != nil {
 		panic(err)
 	}
+	if *migrateOnly {
+		log.Info().Msg("Migrations applied, exiting")
+		return
+	}
+	stores.dir = filepath.Join(dbDir, "stores")
+	defer stores.closeAll()
+	global := startGlobalWebhook(db)
 
 	s := &server{
-		router: mux.NewRouter(),
-		db:     db,
-		exPath: dbDir,
+		router:  mux.NewRouter(),
+		db:      db,
+		storeDb: storeDb,
+		exPath:  dbDir,
+
+		exPathTemp: dbDirTemporary,
+	}
+	s.adminRouter = s.router
+	if *adminPort != "" {
+		s.adminRouter = mux.NewRouter()
 	}
 	s.routes()
-	s.connectOnStartup()
+	go s.expirationChecker()
+	go s.messagePruner()
+	go s.receiptPruner()
+	go s.deviceSweeper()
+	go s.maintenanceScheduler()
+	go s.statsFlusher()
 
-	srv := &http.Server{
-		Addr:              *address + ":" + *port,
-		Handler:           s.router,
-		ReadHeaderTimeout: 20 * time.Second,
-		ReadTimeout:       60 * time.Second,
-		WriteTimeout:      120 * time.Second,
-		IdleTimeout:       180 * time.Second,
+	srv := s.httpServer(*address+":"+*port, s.router)
+	var adminSrv *http.Server
+	if *adminPort != "" {
+		adminSrv = s.httpServer(*adminAddress+":"+*adminPort, s.adminRouter)
 	}
 
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
+	go listen(srv)
+	log.Info().Str("address", *address).Str("port", *port).Msg("Server Started")
+	if adminSrv != nil {
+		go listen(adminSrv)
+		log.Info().Str("address", *adminAddress).Str("port", *adminPort).Msg("Admin Server Started")
+	}
+
+	// Sessions are brought up with the server already listening, /ready tells
+	// when the initial pass is over
 	go func() {
-		if *sslcert != "" {
-			if err := srv.ListenAndServeTLS(*sslcert, *sslprivkey); err != nil && err != http.ErrServerClosed {
-				log.Fatal().Err(err).Msg("Startup failed (TLS)")
-			}
-		} else {
-			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				log.Fatal().Err(err).Msg("Startup failed")
-			}
-		}
+		s.connectOnStartup()
+		startupReady.Store(true)
+		log.Info().Msg("Startup connections done")
 	}()
 
-	log.Info().Str("address", *address).Str("port", *port).Msg("Server Started")
 	<-done
-	log.Info().Msg("Server Stopped")
+	log.Info().Dur("timeout", *shutdownTimeout).Msg("Server Stopped")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// Everything below shares the timeout, the databases are closed once
+	// main returns
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
 	defer cancel()
 
+	stopped := sessions.closeAll()
+	pending := webhooksQueued.Load() + webhooksPending.Load()
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Error().Err(err).Msg("Server Shutdown Failed")
-		os.Exit(1)
 	}
+	if adminSrv != nil {
+		if err := adminSrv.Shutdown(ctx); err != nil {
+			log.Error().Err(err).Msg("Admin Server Shutdown Failed")
+		}
+	}
+	sessionsDone := sessions.wait(ctx)
+	global.queue.stop()
+	webhooksDone := sessionsDone && waitGroupContext(ctx, &webhookWorkersRunning)
+	undelivered := webhooksQueued.Load() + webhooksPending.Load()
+	stats.flush(db)
+	errorReports.flush(ctx)
+	tracing.shutdown(ctx)
 
-	log.Info().Msg("Server Exited Properly")
+	summary := log.Info()
+	if !sessionsDone || !webhooksDone {
+		summary = log.Warn()
+	}
+	summary.Int("sessions", stopped).Bool("sessions_disconnected", sessionsDone).Int64("webhooks_pending", pending).Int64("webhooks_undelivered", undelivered).Msg("Server Exited")
 }
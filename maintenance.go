@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pages freed per incremental_vacuum step, each one holds the write lock
+// briefly so sends and store writes only wait between steps
+const vacuumStepPages = 512
+
+// Scheduled maintenance waits until no message was sent for this long, and
+// runs anyway once it waited maintenanceMaxDelay
+const (
+	maintenanceQuiet    = time.Minute
+	maintenanceMaxDelay = time.Hour
+)
+
+// Unix time of the last send through the API, to find quiet moments
+var lastSend atomic.Int64
+
+var maintenanceLock sync.Mutex
+
+type vacuumResult struct {
+	Database   string `json:"database"`
+	Mode       string `json:"mode"`
+	FreedPages int64  `json:"freed_pages"`
+	SizeBefore int64  `json:"size_before"`
+	SizeAfter  int64  `json:"size_after"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+func pragmaInt(db *sql.DB, pragma string) (int64, error) {
+	var value int64
+	err := db.QueryRow("PRAGMA " + pragma).Scan(&value)
+	return value, err
+}
+
+func databaseSize(db *sql.DB) int64 {
+	pages, _ := pragmaInt(db, "page_count")
+	pageSize, _ := pragmaInt(db, "page_size")
+	return pages * pageSize
+}
+
+// Checkpoints the WAL into the database file and gives free pages back to
+// the filesystem. Databases not yet in incremental auto_vacuum mode are
+// switched to it with one full VACUUM, which locks them for its duration,
+// after that free pages are released a few at a time. full forces a VACUUM
+// anyway, it also defragments.
+func vacuumDatabase(name string, db *sql.DB, full bool) vacuumResult {
+	start := time.Now()
+	result := vacuumResult{Database: name, Mode: "incremental", SizeBefore: databaseSize(db)}
+	fail := func(err error) vacuumResult {
+		result.Error = err.Error()
+		result.DurationMs = time.Since(start).Milliseconds()
+		log.Error().Err(err).Str("database", name).Msg("Database maintenance failed")
+		return result
+	}
+
+	if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return fail(err)
+	}
+	freeBefore, err := pragmaInt(db, "freelist_count")
+	if err != nil {
+		return fail(err)
+	}
+	// 2 is INCREMENTAL
+	mode, err := pragmaInt(db, "auto_vacuum")
+	if err != nil {
+		return fail(err)
+	}
+
+	if full || mode != 2 {
+		result.Mode = "full"
+		// The new mode only sticks when VACUUM runs on the same connection
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			return fail(err)
+		}
+		_, err = conn.ExecContext(context.Background(), "PRAGMA auto_vacuum=INCREMENTAL")
+		if err == nil {
+			_, err = conn.ExecContext(context.Background(), "VACUUM")
+		}
+		conn.Close()
+		if err != nil {
+			return fail(err)
+		}
+	} else {
+		previous := int64(-1)
+		for {
+			free, err := pragmaInt(db, "freelist_count")
+			if err != nil {
+				return fail(err)
+			}
+			if free == 0 || free == previous {
+				break
+			}
+			previous = free
+			if _, err := db.Exec("PRAGMA incremental_vacuum(" + strconv.Itoa(vacuumStepPages) + ")"); err != nil {
+				return fail(err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return fail(err)
+	}
+
+	result.FreedPages = freeBefore
+	result.SizeAfter = databaseSize(db)
+	result.DurationMs = time.Since(start).Milliseconds()
+	log.Info().Str("database", name).Str("mode", result.Mode).Int64("freed_pages", result.FreedPages).Int64("size_before", result.SizeBefore).Int64("size_after", result.SizeAfter).Int64("duration_ms", result.DurationMs).Msg("Database maintenance done")
+	return result
+}
+
+// Vacuums users.db, the shared store and the per user stores currently open.
+// Returns false without doing anything if a run is already going on.
+func (s *server) maintainDatabases(full bool) ([]vacuumResult, bool) {
+	if !maintenanceLock.TryLock() {
+		return nil, false
+	}
+	defer maintenanceLock.Unlock()
+
+	results := []vacuumResult{
+		vacuumDatabase("users", s.db, full),
+		vacuumDatabase("store", s.storeDb, full),
+	}
+	for id, db := range stores.databases() {
+		results = append(results, vacuumDatabase("store/"+strconv.Itoa(id), db, full))
+	}
+	return results, true
+}
+
+// Runs the maintenance every -db-maintenance, at a moment without sends
+func (s *server) maintenanceScheduler() {
+	if *dbMaintenance <= 0 {
+		return
+	}
+	for {
+		time.Sleep(*dbMaintenance)
+		waited := time.Duration(0)
+		for time.Since(time.Unix(lastSend.Load(), 0)) < maintenanceQuiet && waited < maintenanceMaxDelay {
+			time.Sleep(maintenanceQuiet)
+			waited += maintenanceQuiet
+		}
+		s.maintainDatabases(false)
+	}
+}
+
+// Runs the database maintenance now, ?full=true forces a full VACUUM
+func (s *server) VacuumDatabases() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		full, _ := strconv.ParseBool(r.URL.Query().Get("full"))
+
+		// A full VACUUM of a big store outlasts the write timeout
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+		results, ran := s.maintainDatabases(full)
+		if !ran {
+			s.Respond(w, r, http.StatusConflict, errors.New("Maintenance already running"))
+			return
+		}
+		responseJson, err := json.Marshal(map[string]interface{}{"databases": results})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
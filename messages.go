@@ -0,0 +1,324 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+const messagePruneInterval = time.Hour
+
+// Message as kept in the messages table. Body is the JSON of the whatsmeow
+// events.Message, the same shape posted to the webhook as "event".
+type storedMessage struct {
+	Id        string
+	Chat      string
+	Sender    string
+	FromMe    bool
+	Type      string
+	Timestamp time.Time
+	Body      json.RawMessage
+	Media     string
+}
+
+// Tells whether the user behind the token opted in to message persistence
+func storeMessagesEnabled(token string) bool {
+	myuserinfo, found := userinfocache.Get(token)
+	if !found {
+		return false
+	}
+	return myuserinfo.(Values).Get("StoreMessages") == "1"
+}
+
+// Short name for the kind of content a message carries
+func messageKind(msg *waProto.Message) string {
+	if msg == nil {
+		return "unknown"
+	}
+	if inner := msg.GetViewOnceMessage().GetMessage(); inner != nil {
+		return messageKind(inner)
+	}
+	if inner := msg.GetEphemeralMessage().GetMessage(); inner != nil {
+		return messageKind(inner)
+	}
+	switch {
+	case msg.Conversation != nil, msg.ExtendedTextMessage != nil:
+		return "text"
+	case msg.ImageMessage != nil:
+		return "image"
+	case msg.AudioMessage != nil:
+		return "audio"
+	case msg.VideoMessage != nil:
+		return "video"
+	case msg.DocumentMessage != nil:
+		return "document"
+	case msg.StickerMessage != nil:
+		return "sticker"
+	case msg.ContactMessage != nil, msg.ContactsArrayMessage != nil:
+		return "contact"
+	case msg.LocationMessage != nil, msg.LiveLocationMessage != nil:
+		return "location"
+	case msg.ReactionMessage != nil:
+		return "reaction"
+	case msg.ButtonsMessage != nil:
+		return "buttons"
+	case msg.ButtonsResponseMessage != nil, msg.TemplateButtonReplyMessage != nil:
+		return "buttons_response"
+	case msg.ListMessage != nil:
+		return "list"
+	case msg.ListResponseMessage != nil:
+		return "list_response"
+	case msg.TemplateMessage != nil:
+		return "template"
+	case msg.ProtocolMessage != nil:
+		return "protocol"
+	}
+	return "unknown"
+}
+
+// Exec of either the database or a transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Writes a message to the messages table, a message arriving again with the
+// same id (edits, retries) replaces the stored one
+func saveMessage(db execer, userID int, evt *events.Message, mediaPath string) {
+	if _, err := insertMessage(db, "REPLACE", userID, evt, mediaPath); err != nil {
+		log.Error().Err(err).Str("id", evt.Info.ID).Msg("Could not store message")
+	}
+}
+
+// Inserts a message resolving id conflicts with REPLACE or IGNORE, reports
+// whether a row was written
+func insertMessage(db execer, onConflict string, userID int, evt *events.Message, mediaPath string) (bool, error) {
+	body, err := json.Marshal(evt)
+	if err != nil {
+		return false, err
+	}
+	fromMe := 0
+	if evt.Info.IsFromMe {
+		fromMe = 1
+	}
+	result, err := execRetry(db, "INSERT OR "+onConflict+" INTO messages (user_id, id, chat_jid, sender_jid, from_me, type, timestamp, body, media_path) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		userID, evt.Info.ID, evt.Info.Chat.ToNonAD().String(), evt.Info.Sender.ToNonAD().String(), fromMe, messageKind(evt.Message), evt.Info.Timestamp.Unix(), string(body), mediaPath)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// Stores the messages of a history sync chunk. Chunks keep arriving for a
+// while after pairing and may repeat messages, those already stored are
+// left alone.
+func (mycli *MyClient) saveHistory(evt *events.HistorySync) {
+	tx, err := mycli.db.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not store history sync")
+		return
+	}
+	stored := 0
+	for _, conv := range evt.Data.GetConversations() {
+		chatJID, err := types.ParseJID(conv.GetID())
+		if err != nil {
+			log.Warn().Err(err).Str("chat", conv.GetID()).Msg("Skipping history of invalid chat")
+			continue
+		}
+		for _, historyMsg := range conv.GetMessages() {
+			msg, err := mycli.WAClient.ParseWebMessage(chatJID, historyMsg.GetMessage())
+			if err != nil {
+				log.Debug().Err(err).Str("chat", conv.GetID()).Msg("Skipping history message")
+				continue
+			}
+			written, err := insertMessage(tx, "IGNORE", mycli.userID, msg, "")
+			if err != nil {
+				log.Error().Err(err).Msg("Could not store history sync")
+				tx.Rollback()
+				return
+			}
+			if written {
+				stored++
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error().Err(err).Msg("Could not store history sync")
+		return
+	}
+	log.Info().Str("userid", strconv.Itoa(mycli.userID)).Str("type", evt.Data.GetSyncType().String()).Int("conversations", len(evt.Data.GetConversations())).Int("stored", stored).Msg("Stored history sync")
+}
+
+// Bookkeeping for a message sent through the API: its receipts get tracked
+// and, when the user opted in, it is stored in the same shape as received
+// ones so both read back alike
+func (s *server) recordSent(r *http.Request, client *whatsmeow.Client, recipient types.JID, msgid string, msg *waProto.Message, timestamp time.Time) {
+	v := r.Context().Value("userinfo").(Values)
+	userid, _ := strconv.Atoi(v.Get("Id"))
+	countSent(s.db, userid)
+	stats.sent(userid)
+	replyBots.replied(userid, recipient)
+	trackSent(s.db, userid, msgid, recipient, timestamp, requestIDFrom(r))
+	var sender types.JID
+	if client.Store.ID != nil {
+		sender = client.Store.ID.ToNonAD()
+	}
+	recordChatMessage(s.db, userid, recipient, sender, msgid, true, msg, timestamp)
+	if v.Get("StoreMessages") != "1" {
+		return
+	}
+	evt := &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{
+				Chat:     recipient,
+				Sender:   sender,
+				IsFromMe: true,
+				IsGroup:  recipient.Server == types.GroupServer,
+			},
+			ID:        msgid,
+			Timestamp: timestamp,
+		},
+		Message: msg,
+	}
+	saveMessage(s.db, userid, evt, "")
+}
+
+// Periodically deletes stored messages older than -messageretention days and
+// trims users over -messagemaxrows, oldest first
+func (s *server) messagePruner() {
+	if *messageRetention <= 0 && *messageMaxRows <= 0 {
+		return
+	}
+	for {
+		if *messageRetention > 0 {
+			cutoff := time.Now().AddDate(0, 0, -*messageRetention).Unix()
+			result, err := execRetry(s.db, "DELETE FROM messages WHERE timestamp<?", cutoff)
+			if err != nil {
+				log.Error().Err(err).Msg("Could not prune stored messages")
+			} else if n, _ := result.RowsAffected(); n > 0 {
+				log.Info().Int64("deleted", n).Msg("Pruned stored messages past retention")
+			}
+		}
+		if *messageMaxRows > 0 {
+			s.trimMessages()
+		}
+		time.Sleep(messagePruneInterval)
+	}
+}
+
+func (s *server) trimMessages() {
+	rows, err := s.db.Query("SELECT user_id FROM messages GROUP BY user_id HAVING COUNT(*)>?", *messageMaxRows)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not trim stored messages")
+		return
+	}
+	var over []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			over = append(over, id)
+		}
+	}
+	rows.Close()
+	for _, id := range over {
+		result, err := execRetry(s.db, "DELETE FROM messages WHERE user_id=? AND rowid IN (SELECT rowid FROM messages WHERE user_id=? ORDER BY timestamp DESC LIMIT -1 OFFSET ?)", id, id, *messageMaxRows)
+		if err != nil {
+			log.Error().Err(err).Int("userid", id).Msg("Could not trim stored messages")
+			continue
+		}
+		n, _ := result.RowsAffected()
+		log.Info().Int("userid", id).Int64("deleted", n).Msg("Trimmed stored messages over the limit")
+	}
+}
+
+const storedMessageColumns = "id, chat_jid, sender_jid, from_me, type, timestamp, body, media_path"
+
+// Reads a messages row selected with storedMessageColumns
+func scanMessage(row interface{ Scan(...interface{}) error }) (storedMessage, error) {
+	var m storedMessage
+	var timestamp int64
+	var body string
+	err := row.Scan(&m.Id, &m.Chat, &m.Sender, &m.FromMe, &m.Type, &timestamp, &body, &m.Media)
+	if err != nil {
+		return m, err
+	}
+	m.Timestamp = time.Unix(timestamp, 0)
+	m.Body = json.RawMessage(body)
+	return m, nil
+}
+
+// Filters for listing stored messages, parsed from the phone, before and
+// limit query parameters
+type messageQuery struct {
+	chat   string
+	before int64
+	limit  int
+}
+
+func parseMessageQuery(r *http.Request) (messageQuery, error) {
+	q := messageQuery{limit: 50}
+	if phone := r.URL.Query().Get("phone"); phone != "" {
+		jid, err := parseRecipient(phone)
+		if err != nil {
+			return q, recipientError("phone", err)
+		}
+		q.chat = jid.ToNonAD().String()
+	}
+	if param := r.URL.Query().Get("before"); param != "" {
+		before, err := strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			return q, errors.New("Invalid before parameter, must be a unix timestamp")
+		}
+		q.before = before
+	}
+	if param := r.URL.Query().Get("limit"); param != "" {
+		value, err := strconv.Atoi(param)
+		if err != nil || value < 1 {
+			return q, errors.New("Invalid limit parameter")
+		}
+		q.limit = value
+	}
+	if q.limit > 500 {
+		q.limit = 500
+	}
+	return q, nil
+}
+
+// Stored messages of a user matching the query, newest first
+func queryMessages(db *sql.DB, userID int, q messageQuery) ([]storedMessage, error) {
+	query := "SELECT " + storedMessageColumns + " FROM messages WHERE user_id=?"
+	args := []interface{}{userID}
+	if q.chat != "" {
+		query += " AND chat_jid=?"
+		args = append(args, q.chat)
+	}
+	if q.before > 0 {
+		query += " AND timestamp<?"
+		args = append(args, q.before)
+	}
+	query += " ORDER BY timestamp DESC LIMIT ?"
+	args = append(args, q.limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := []storedMessage{}
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
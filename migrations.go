@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema changes of users.db, one numbered file each (NNN_description.sql)
+// under a directory per database engine. Applied in order at startup, each
+// inside a transaction along with its schema_version row, so a failing
+// migration leaves the database as it was before it.
+//
+//go:embed migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+const migrationsDir = "migrations/sqlite"
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// Columns added to existing tables before migrations were introduced.
+// Databases from those versions have no schema_version and may lack any of
+// them, they are added before migration 001 runs.
+var legacyColumns = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"users", "proxy_url", `TEXT NOT NULL default ""`},
+	{"users", "store_messages", `INTEGER NOT NULL default 0`},
+	{"users", "reject_calls", `INTEGER NOT NULL default 0`},
+	{"users", "reject_calls_message", `TEXT NOT NULL default ""`},
+	{"users", "max_messages_per_day", `INTEGER NOT NULL default 0`},
+	{"users", "messages_sent", `INTEGER NOT NULL default 0`},
+	{"users", "messages_day", `TEXT NOT NULL default ""`},
+	{"users", "device_name", `TEXT NOT NULL default ""`},
+	{"users", "payload_format", `TEXT NOT NULL default "raw"`},
+	{"users", "webhook_headers", `TEXT NOT NULL default ""`},
+	{"users", "webhook_timeout", `INTEGER NOT NULL default 0`},
+	{"users", "wa_debug", `TEXT NOT NULL default ""`},
+	{"sent_messages", "request_id", `TEXT NOT NULL default ""`},
+}
+
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationFiles.ReadDir(migrationsDir)
+	if err != nil {
+		return nil, err
+	}
+	var migrations []migration
+	for _, entry := range entries {
+		number, name, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		version, err := strconv.Atoi(number)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration file name %s, must be NNN_description.sql", entry.Name())
+		}
+		data, err := migrationFiles.ReadFile(path.Join(migrationsDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, name: name, sql: string(data)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i := range migrations {
+		if migrations[i].version != i+1 {
+			return nil, fmt.Errorf("migration %03d is missing", i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// Brings users.db to the latest schema version
+func migrate(db *sql.DB) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	sqlStmt := `CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER NOT NULL PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied INTEGER NOT NULL
+	);`
+	if _, err := db.Exec(sqlStmt); err != nil {
+		return err
+	}
+	var current int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&current); err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("database is at schema version %d, newer than this build knows (%d)", current, len(migrations))
+	}
+
+	for _, m := range migrations[current:] {
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("migration %03d_%s failed, database left at version %d: %w", m.version, m.name, m.version-1, err)
+		}
+		log.Info().Int("version", m.version).Str("name", m.name).Msg("Applied migration")
+	}
+	return nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if m.version == 1 {
+		for _, c := range legacyColumns {
+			if err := addColumnIfMissing(tx, c.table, c.column, c.definition); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.Exec(m.sql); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_version (version, name, applied) VALUES (?, ?, ?)", m.version, m.name, time.Now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Adds a column to an existing table when databases created by older
+// versions lack it, tables that don't exist yet are left to the migration
+func addColumnIfMissing(tx *sql.Tx, table string, column string, definition string) error {
+	rows, err := tx.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		columns = append(columns, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(columns) == 0 || Find(columns, column) {
+		return nil
+	}
+	log.Info().Str("table", table).Str("column", column).Msg("Adding missing column")
+	_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
@@ -0,0 +1,77 @@
+-- Schema as of the introduction of migrations. Written with IF NOT EXISTS
+-- so it also applies to databases created before, once their missing
+-- columns were added (see legacyColumns).
+
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER NOT NULL PRIMARY KEY,
+	name TEXT NOT NULL,
+	token TEXT NOT NULL,
+	webhook TEXT NOT NULL default "",
+	jid TEXT NOT NULL default "",
+	qrcode TEXT NOT NULL default "",
+	connected INTEGER,
+	expiration INTEGER,
+	events TEXT NOT NULL default "All",
+	proxy_url TEXT NOT NULL default "",
+	store_messages INTEGER NOT NULL default 0,
+	reject_calls INTEGER NOT NULL default 0,
+	reject_calls_message TEXT NOT NULL default "",
+	max_messages_per_day INTEGER NOT NULL default 0,
+	messages_sent INTEGER NOT NULL default 0,
+	messages_day TEXT NOT NULL default "",
+	device_name TEXT NOT NULL default "",
+	payload_format TEXT NOT NULL default "raw",
+	webhook_headers TEXT NOT NULL default "",
+	webhook_timeout INTEGER NOT NULL default 0,
+	wa_debug TEXT NOT NULL default ""
+);
+
+-- Messages persisted for users with store_messages enabled
+CREATE TABLE IF NOT EXISTS messages (
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	id TEXT NOT NULL,
+	chat_jid TEXT NOT NULL,
+	sender_jid TEXT NOT NULL default "",
+	from_me INTEGER NOT NULL default 0,
+	type TEXT NOT NULL default "",
+	timestamp INTEGER NOT NULL,
+	body TEXT NOT NULL default "{}",
+	media_path TEXT NOT NULL default "",
+	PRIMARY KEY (user_id, id)
+);
+CREATE INDEX IF NOT EXISTS messages_chat_timestamp ON messages (user_id, chat_jid, timestamp);
+CREATE INDEX IF NOT EXISTS messages_timestamp ON messages (user_id, timestamp);
+
+-- Messages sent through the API and the receipts they got, per recipient
+CREATE TABLE IF NOT EXISTS sent_messages (
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	id TEXT NOT NULL,
+	chat_jid TEXT NOT NULL,
+	timestamp INTEGER NOT NULL,
+	request_id TEXT NOT NULL default "",
+	PRIMARY KEY (user_id, id)
+);
+CREATE INDEX IF NOT EXISTS sent_messages_timestamp ON sent_messages (timestamp);
+CREATE TABLE IF NOT EXISTS message_receipts (
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	message_id TEXT NOT NULL,
+	recipient_jid TEXT NOT NULL,
+	state TEXT NOT NULL,
+	rank INTEGER NOT NULL,
+	timestamp INTEGER NOT NULL,
+	PRIMARY KEY (user_id, message_id, recipient_jid)
+);
+
+-- Named recipient lists for /chat/send/broadcast, recipients is a JSON array
+CREATE TABLE IF NOT EXISTS broadcast_lists (
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	recipients TEXT NOT NULL,
+	PRIMARY KEY (user_id, name)
+);
+
+-- Phone numbers of the LIDs seen in groups, not tied to a user
+CREATE TABLE IF NOT EXISTS lid_mappings (
+	lid TEXT NOT NULL PRIMARY KEY,
+	pn TEXT NOT NULL
+);
@@ -0,0 +1,15 @@
+-- Activity counters of each user by hour for /admin/stats, kept in memory
+-- and flushed here so restarts don't reset them
+CREATE TABLE stats (
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	hour INTEGER NOT NULL,
+	sent INTEGER NOT NULL default 0,
+	received INTEGER NOT NULL default 0,
+	webhooks_ok INTEGER NOT NULL default 0,
+	webhooks_failed INTEGER NOT NULL default 0,
+	PRIMARY KEY (user_id, hour)
+);
+CREATE INDEX stats_hour ON stats (hour);
+
+-- Unix time the session last connected to WhatsApp
+ALTER TABLE users ADD COLUMN last_connect INTEGER NOT NULL default 0;
@@ -0,0 +1,8 @@
+-- When each receipt of a recipient arrived, for /chat/messageinfo. Older
+-- rows only know the time of their current state.
+ALTER TABLE message_receipts ADD COLUMN delivered_at INTEGER NOT NULL default 0;
+ALTER TABLE message_receipts ADD COLUMN read_at INTEGER NOT NULL default 0;
+ALTER TABLE message_receipts ADD COLUMN played_at INTEGER NOT NULL default 0;
+UPDATE message_receipts SET delivered_at=timestamp WHERE state='delivered';
+UPDATE message_receipts SET read_at=timestamp WHERE state='read';
+UPDATE message_receipts SET played_at=timestamp WHERE state='played';
@@ -0,0 +1,3 @@
+-- Whether Message and Receipt webhooks carry the sender's names from the
+-- contact store, on unless the user wants minimal payloads.
+ALTER TABLE users ADD COLUMN contact_names INTEGER NOT NULL default 1;
@@ -0,0 +1,3 @@
+-- When the current device was paired, unix seconds, 0 when not paired or
+-- paired before this was recorded.
+ALTER TABLE users ADD COLUMN paired_at INTEGER NOT NULL default 0;
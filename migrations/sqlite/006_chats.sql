@@ -0,0 +1,18 @@
+-- Chats of each user's account for /chats, from history syncs and the
+-- messages seen since pairing. Archived, pinned and muted come from the
+-- app state in the whatsmeow store.
+CREATE TABLE chats (
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	jid TEXT NOT NULL,
+	name TEXT NOT NULL default "",
+	last_id TEXT NOT NULL default "",
+	last_sender TEXT NOT NULL default "",
+	last_from_me INTEGER NOT NULL default 0,
+	last_type TEXT NOT NULL default "",
+	last_preview TEXT NOT NULL default "",
+	last_timestamp INTEGER NOT NULL default 0,
+	unread_count INTEGER NOT NULL default 0,
+	marked_unread INTEGER NOT NULL default 0,
+	PRIMARY KEY (user_id, jid)
+);
+CREATE INDEX chats_last_timestamp ON chats (user_id, last_timestamp);
@@ -0,0 +1,2 @@
+-- Webhook posts of the user are sent gzipped, Content-Encoding: gzip
+ALTER TABLE users ADD COLUMN webhook_gzip INTEGER NOT NULL default 0;
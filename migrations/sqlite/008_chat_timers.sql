@@ -0,0 +1,10 @@
+-- Disappearing messages timer of each contact chat, in seconds, 0 when off.
+-- Updated is the unix time it was set at, older news don't replace it.
+-- Group timers are asked from WhatsApp instead.
+CREATE TABLE chat_timers (
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	jid TEXT NOT NULL,
+	timer INTEGER NOT NULL default 0,
+	updated INTEGER NOT NULL default 0,
+	PRIMARY KEY (user_id, jid)
+);
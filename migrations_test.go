@@ -0,0 +1,79 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// Databases of the versions before migrations only have the users table as
+// the first release created it, they must upgrade keeping their users
+func TestMigrateLegacyDatabase(t *testing.T) {
+	db, err := sql.Open(sqlDriver(), sqliteDSN(filepath.Join(t.TempDir(), "users.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	legacy := `CREATE TABLE IF NOT EXISTS users (
+		id INTEGER NOT NULL PRIMARY KEY,
+		name TEXT NOT NULL,
+		token TEXT NOT NULL,
+		webhook TEXT NOT NULL default "",
+		jid TEXT NOT NULL default "",
+		qrcode TEXT NOT NULL default "",
+		connected INTEGER,
+		expiration INTEGER,
+		events TEXT NOT NULL default "All"
+	);`
+	if _, err := db.Exec(legacy); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO users (name, token, webhook, jid, connected, expiration, events) VALUES ('old', 'old-token', 'https://example.com/hook', '5511999990000.0:3@s.whatsapp.net', 1, 0, 'Message')`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	// Running again on an up to date database changes nothing
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var version, applied int
+	if err := db.QueryRow("SELECT MAX(version), COUNT(*) FROM schema_version").Scan(&version, &applied); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) || applied != len(migrations) {
+		t.Errorf("schema at version %d with %d applied, want %d", version, applied, len(migrations))
+	}
+
+	var name, webhook, jid, events, payloadFormat, webhookHeaders string
+	var storeMessages, webhookTimeout, webhookGzip, contactNames int
+	err = db.QueryRow("SELECT name, webhook, jid, events, payload_format, webhook_headers, store_messages, webhook_timeout, webhook_gzip, contact_names FROM users WHERE token='old-token'").Scan(&name, &webhook, &jid, &events, &payloadFormat, &webhookHeaders, &storeMessages, &webhookTimeout, &webhookGzip, &contactNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "old" || webhook != "https://example.com/hook" || jid != "5511999990000.0:3@s.whatsapp.net" || events != "Message" {
+		t.Errorf("user changed by the upgrade: %s %s %s %s", name, webhook, jid, events)
+	}
+	if payloadFormat != "raw" || webhookHeaders != "" || storeMessages != 0 || webhookTimeout != 0 || webhookGzip != 0 {
+		t.Errorf("added columns without their defaults: %q %q %d %d %d", payloadFormat, webhookHeaders, storeMessages, webhookTimeout, webhookGzip)
+	}
+
+	// The tables of later releases are there and usable
+	if _, err := insertUser(db, newUser{Name: "new", Token: "new-token", PayloadFormat: "raw"}); err != nil {
+		t.Errorf("adding a user after the upgrade: %v", err)
+	}
+	for _, table := range []string{"sent_messages", "chats", "lid_mappings"} {
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+			t.Errorf("table %s after the upgrade: %v", table, err)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+	"github.com/vincent-petithory/dataurl"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// Newsletter (WhatsApp channel) as returned by the API
+type newsletterInfo struct {
+	JID         string
+	Name        string
+	Description string
+	InviteLink  string
+	Subscribers int
+	Verified    bool
+	State       string
+	Role        string `json:",omitempty"`
+	Muted       bool
+	Picture     string `json:",omitempty"`
+	Created     *time.Time
+}
+
+func newNewsletterInfo(meta *types.NewsletterMetadata) newsletterInfo {
+	info := newsletterInfo{
+		JID:         meta.ID.String(),
+		Name:        meta.ThreadMeta.Name.Text,
+		Description: meta.ThreadMeta.Description.Text,
+		Subscribers: meta.ThreadMeta.SubscriberCount,
+		Verified:    meta.ThreadMeta.VerificationState == types.NewsletterVerificationStateVerified,
+		State:       string(meta.State.Type),
+	}
+	if meta.ThreadMeta.InviteCode != "" {
+		info.InviteLink = whatsmeow.NewsletterLinkPrefix + meta.ThreadMeta.InviteCode
+	}
+	if meta.ViewerMeta != nil {
+		info.Role = string(meta.ViewerMeta.Role)
+		info.Muted = meta.ViewerMeta.Mute == types.NewsletterMuteOn
+	}
+	if meta.ThreadMeta.Picture != nil {
+		info.Picture = meta.ThreadMeta.Picture.URL
+	} else if meta.ThreadMeta.Preview.URL != "" {
+		info.Picture = meta.ThreadMeta.Preview.URL
+	}
+	if !meta.ThreadMeta.CreationTime.IsZero() {
+		info.Created = &meta.ThreadMeta.CreationTime.Time
+	}
+	return info
+}
+
+// Explains the errors WhatsApp gives for channels. Accounts without channels
+// (some regions, business accounts on old apps) get forbidden back.
+func newsletterError(err error, action string) error {
+	var gqlErr types.GraphQLError
+	code := 0
+	if errors.As(err, &gqlErr) {
+		code = gqlErr.Extensions.ErrorCode
+	}
+	switch {
+	case errors.Is(err, whatsmeow.ErrIQForbidden), errors.Is(err, whatsmeow.ErrIQNotAuthorized), code == 401, code == 403:
+		return newAPIError(ErrForbidden, "Channels are not available for this account", nil)
+	case errors.Is(err, whatsmeow.ErrIQNotFound), code == 404:
+		return newAPIError(ErrNotFound, "Newsletter not found", nil)
+	}
+	return newAPIError(ErrUpstreamFailed, fmt.Sprintf("Failed to %s: %v", action, err), nil)
+}
+
+// Newsletter given by JID or by invite link (or just its code), invites are
+// looked up to get the JID
+func newsletterTarget(client *whatsmeow.Client, jid string, invite string) (types.JID, error) {
+	if jid != "" {
+		target, err := types.ParseJID(jid)
+		if err != nil || target.Server != types.NewsletterServer {
+			return target, errors.New("Invalid JID, must be a newsletter JID ending in @newsletter")
+		}
+		return target, nil
+	}
+	if invite == "" {
+		return types.EmptyJID, errors.New("Missing JID or Invite")
+	}
+	meta, err := client.GetNewsletterInfoWithInvite(strings.TrimSpace(invite))
+	if err != nil {
+		return types.EmptyJID, newsletterError(err, "get newsletter info")
+	}
+	if meta == nil {
+		return types.EmptyJID, newAPIError(ErrNotFound, "Newsletter not found", nil)
+	}
+	return meta.ID, nil
+}
+
+// Fields of a newsletter post added to NewsletterMessage events
+func newsletterPost(evt *events.Message) map[string]interface{} {
+	post := map[string]interface{}{
+		"JID":      evt.Info.Chat.String(),
+		"ServerID": evt.Info.ServerID,
+	}
+	if evt.NewsletterMeta != nil && !evt.NewsletterMeta.EditTS.IsZero() {
+		post["Edited"] = evt.NewsletterMeta.EditTS.Unix()
+	}
+	return post
+}
+
+// Lists the newsletters the account follows or owns
+func (s *server) ListNewsletters() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		subscribed, err := client.GetSubscribedNewsletters()
+		if err != nil {
+			hlog.FromRequest(r).Warn().Err(err).Msg("Failed to get newsletters")
+			s.Respond(w, r, http.StatusInternalServerError, newsletterError(err, "get newsletters"))
+			return
+		}
+		newsletters := make([]newsletterInfo, 0, len(subscribed))
+		for _, meta := range subscribed {
+			if meta != nil {
+				newsletters = append(newsletters, newNewsletterInfo(meta))
+			}
+		}
+
+		responseJson, err := json.Marshal(map[string]interface{}{"Newsletters": newsletters})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets a newsletter by jid, or by invite for ones not followed yet
+func (s *server) GetNewsletterInfo() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		jid := r.URL.Query().Get("jid")
+		invite := r.URL.Query().Get("invite")
+		var meta *types.NewsletterMetadata
+		var err error
+		if jid != "" {
+			var target types.JID
+			target, err = newsletterTarget(client, jid, "")
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+			meta, err = client.GetNewsletterInfo(target)
+		} else if invite != "" {
+			meta, err = client.GetNewsletterInfoWithInvite(strings.TrimSpace(invite))
+		} else {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing jid or invite parameter"))
+			return
+		}
+		if err != nil {
+			hlog.FromRequest(r).Warn().Err(err).Msg("Failed to get newsletter info")
+			s.Respond(w, r, http.StatusInternalServerError, newsletterError(err, "get newsletter info"))
+			return
+		}
+		if meta == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Newsletter not found"))
+			return
+		}
+
+		responseJson, err := json.Marshal(newNewsletterInfo(meta))
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Follows or unfollows a newsletter given by JID or invite
+func (s *server) FollowNewsletter(follow bool) http.HandlerFunc {
+	type followStruct struct {
+		JID    string
+		Invite string
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		var t followStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+		target, err := newsletterTarget(client, t.JID, t.Invite)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		action, details := "follow newsletter", "Following newsletter"
+		if follow {
+			err = client.FollowNewsletter(target)
+		} else {
+			action, details = "unfollow newsletter", "Unfollowed newsletter"
+			err = client.UnfollowNewsletter(target)
+		}
+		if err != nil {
+			hlog.FromRequest(r).Warn().Err(err).Str("jid", target.String()).Msg("Failed to " + action)
+			s.Respond(w, r, http.StatusInternalServerError, newsletterError(err, action))
+			return
+		}
+		hlog.FromRequest(r).Info().Str("jid", target.String()).Bool("follow", follow).Msg("Newsletter subscription changed")
+
+		responseJson, err := json.Marshal(map[string]interface{}{"Details": details, "JID": target.String()})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Posts a text, image or video update to a newsletter the account owns or
+// administers. Newsletter media is uploaded unencrypted and sent with the
+// handle the upload returns.
+func (s *server) SendNewsletter() http.HandlerFunc {
+	type newsletterPostStruct struct {
+		JID     string
+		Body    string
+		Image   string
+		Video   string
+		Caption string
+		Id      string
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+
+		var t newsletterPostStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.decodeFailed(w, r, err, "video")
+			return
+		}
+		if t.JID == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing JID in Payload"))
+			return
+		}
+		target, err := newsletterTarget(client, t.JID, "")
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		given := 0
+		for _, field := range []string{t.Body, t.Image, t.Video} {
+			if field != "" {
+				given++
+			}
+		}
+		if given != 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Body, Image or Video in Payload, exactly one is needed"))
+			return
+		}
+
+		// Followers can't post, tell it before uploading anything
+		meta, err := client.GetNewsletterInfo(target)
+		if err != nil {
+			hlog.FromRequest(r).Warn().Err(err).Msg("Failed to get newsletter info")
+			s.Respond(w, r, http.StatusInternalServerError, newsletterError(err, "get newsletter info"))
+			return
+		}
+		if meta == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Newsletter not found"))
+			return
+		}
+		if meta.ViewerMeta == nil || (meta.ViewerMeta.Role != types.NewsletterRoleOwner && meta.ViewerMeta.Role != types.NewsletterRoleAdmin) {
+			s.Respond(w, r, http.StatusForbidden, newAPIError(ErrForbidden, "Only owners and admins of a newsletter can post to it", nil))
+			return
+		}
+
+		msgid := t.Id
+		if msgid == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		}
+		ctx, cancel := sendContext(r)
+		defer cancel()
+
+		var msg *waProto.Message
+		var handle string
+		switch {
+		case t.Body != "":
+			msg = &waProto.Message{ExtendedTextMessage: &waProto.ExtendedTextMessage{Text: proto.String(t.Body)}}
+		case t.Image != "":
+			if !strings.HasPrefix(t.Image, "data:image") {
+				s.Respond(w, r, http.StatusUnprocessableEntity, newAPIError(ErrInvalidMedia, "Image data should start with \"data:image/png;base64,\"", nil))
+				return
+			}
+			dataURL, err := dataurl.DecodeString(t.Image)
+			if err != nil {
+				s.Respond(w, r, http.StatusUnprocessableEntity, newAPIError(ErrInvalidMedia, "Could not decode base64 encoded data from payload", nil))
+				return
+			}
+			thumbnail, _, _, err := mediaThumbnail(dataURL.Data)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid Image: %v", err)))
+				return
+			}
+			uploaded, err := client.UploadNewsletter(ctx, dataURL.Data, whatsmeow.MediaImage)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "Failed to upload file", err))
+				return
+			}
+			handle = uploaded.Handle
+			msg = &waProto.Message{ImageMessage: &waProto.ImageMessage{
+				Caption:       proto.String(t.Caption),
+				URL:           proto.String(uploaded.URL),
+				DirectPath:    proto.String(uploaded.DirectPath),
+				Mimetype:      proto.String(http.DetectContentType(dataURL.Data)),
+				FileSHA256:    uploaded.FileSHA256,
+				FileLength:    proto.Uint64(uploaded.FileLength),
+				JPEGThumbnail: thumbnail,
+			}}
+		default:
+			if !strings.HasPrefix(t.Video, "data:video") {
+				s.Respond(w, r, http.StatusUnprocessableEntity, newAPIError(ErrInvalidMedia, "Video data should start with \"data:video/mp4;base64,\"", nil))
+				return
+			}
+			dataURL, err := dataurl.DecodeString(t.Video)
+			if err != nil {
+				s.Respond(w, r, http.StatusUnprocessableEntity, newAPIError(ErrInvalidMedia, "Could not decode base64 encoded data from payload", nil))
+				return
+			}
+			info, thumbnail, _, _, err := inspectVideo(dataURL.Data)
+			if err != nil {
+				hlog.FromRequest(r).Warn().Err(err).Msg("Could not inspect video")
+			}
+			uploaded, err := client.UploadNewsletter(ctx, dataURL.Data, whatsmeow.MediaVideo)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "Failed to upload file", err))
+				return
+			}
+			handle = uploaded.Handle
+			video := &waProto.VideoMessage{
+				Caption:       proto.String(t.Caption),
+				URL:           proto.String(uploaded.URL),
+				DirectPath:    proto.String(uploaded.DirectPath),
+				Mimetype:      proto.String(http.DetectContentType(dataURL.Data)),
+				FileSHA256:    uploaded.FileSHA256,
+				FileLength:    proto.Uint64(uploaded.FileLength),
+				JPEGThumbnail: thumbnail,
+			}
+			if info.Seconds > 0 {
+				video.Seconds = proto.Uint32(info.Seconds)
+			}
+			if info.Width > 0 && info.Height > 0 {
+				video.Width = proto.Uint32(info.Width)
+				video.Height = proto.Uint32(info.Height)
+			}
+			msg = &waProto.Message{VideoMessage: video}
+		}
+
+		resp, err := tracedSend(ctx, client, target, msg, whatsmeow.SendRequestExtra{ID: msgid, MediaHandle: handle})
+		if err != nil {
+			s.Respond(w, r, http.StatusBadGateway, sendError(ctx, "Error sending message", err))
+			return
+		}
+
+		s.recordSent(r, client, target, msgid, msg, resp.Timestamp)
+		hlog.FromRequest(r).Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Str("jid", target.String()).Msg("Newsletter post sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid, "ServerID": resp.ServerID}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+// Every registered route must be in apiDocs and every apiDocs entry must be
+// registered, with the admin routes on the main router and on their own
+func TestAPIDocsMatchRoutes(t *testing.T) {
+	defer func() { log = zerolog.Nop() }()
+	for _, ownAdminRouter := range []bool{false, true} {
+		s := &server{router: mux.NewRouter()}
+		s.adminRouter = s.router
+		if ownAdminRouter {
+			s.adminRouter = mux.NewRouter()
+		}
+		s.routes()
+		log = zerolog.Nop()
+
+		undocumented, unregistered := s.apiDocsDrift()
+		for _, route := range undocumented {
+			t.Errorf("route %s is missing from apiDocs", route)
+		}
+		for _, route := range unregistered {
+			t.Errorf("apiDocs has %s, no such route is registered", route)
+		}
+		if len(s.registeredRoutes()) == 0 {
+			t.Fatal("no routes registered")
+		}
+	}
+}
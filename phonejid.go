@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// How long /user/jid answers are reused. Numbers not on WhatsApp are
+// forgotten sooner, they may sign up.
+const (
+	phoneJIDTTL         = 24 * time.Hour
+	phoneJIDNotFoundTTL = time.Hour
+)
+
+// Canonical JIDs by normalized phone number, shared by all users as a number
+// has the same JID for everyone. Nil entries are numbers not on WhatsApp.
+var phoneJIDs = cache.New(phoneJIDTTL, time.Hour)
+
+type phoneJID struct {
+	JID          types.JID
+	VerifiedName string
+}
+
+// Digits of a phone number in international format. Spaces, dashes, dots,
+// parentheses and a leading + or 00 are dropped, anything else is refused.
+func normalizePhone(phone string) (string, error) {
+	phone = strings.TrimSpace(phone)
+	if strings.HasPrefix(phone, "00") {
+		phone = phone[2:]
+	}
+	phone = strings.TrimPrefix(phone, "+")
+	var digits strings.Builder
+	for _, c := range phone {
+		switch {
+		case c >= '0' && c <= '9':
+			digits.WriteRune(c)
+		case c == ' ' || c == '-' || c == '.' || c == '(' || c == ')':
+		default:
+			return "", errors.New("only digits and + - . ( ) are allowed in phone numbers")
+		}
+	}
+	// E.164 numbers are at most 15 digits, the shortest country code and
+	// subscriber number take 7
+	if digits.Len() < 7 || digits.Len() > 15 {
+		return "", errors.New("phone numbers must be 7 to 15 digits with the country code")
+	}
+	if digits.String()[0] == '0' {
+		return "", errors.New("phone numbers must start with the country code, not 0")
+	}
+	return digits.String(), nil
+}
+
+// Forms a phone number may be registered with. Brazilian mobiles got a 9
+// in front in 2012-2016 but accounts created before kept the 8 digit form,
+// so both are asked for unless -br-ninth-digit is off.
+func phoneVariants(digits string) []string {
+	variants := []string{digits}
+	if *brazilNinthDigit && strings.HasPrefix(digits, "55") {
+		switch subscriber := digits[4:]; {
+		case len(digits) == 13 && subscriber[0] == '9' && subscriber[1] >= '6':
+			variants = append(variants, digits[:4]+subscriber[1:])
+		case len(digits) == 12 && subscriber[0] >= '6':
+			variants = append(variants, digits[:4]+"9"+subscriber)
+		}
+	}
+	return variants
+}
+
+// JID a normalized phone number is registered with, nil when it isn't on
+// WhatsApp. Answers come from phoneJIDs when known.
+func lookupPhone(client *whatsmeow.Client, digits string) (*phoneJID, error) {
+	if cached, found := phoneJIDs.Get(digits); found {
+		return cached.(*phoneJID), nil
+	}
+	variants := phoneVariants(digits)
+	queries := make([]string, len(variants))
+	for i, variant := range variants {
+		queries[i] = "+" + variant
+	}
+	resp, err := client.IsOnWhatsApp(queries)
+	if err != nil {
+		return nil, err
+	}
+	var match *phoneJID
+	for _, item := range resp {
+		if !item.IsIn {
+			continue
+		}
+		match = &phoneJID{JID: item.JID.ToNonAD()}
+		if item.VerifiedName != nil {
+			match.VerifiedName = item.VerifiedName.Details.GetVerifiedName()
+		}
+		break
+	}
+	if match == nil {
+		phoneJIDs.Set(digits, match, phoneJIDNotFoundTTL)
+	} else {
+		phoneJIDs.Set(digits, match, cache.DefaultExpiration)
+	}
+	return match, nil
+}
+
+// Normalizes ?phone= and returns the WhatsApp JID it is registered with,
+// 404 when it isn't on WhatsApp
+func (s *server) GetJID() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		param := r.URL.Query().Get("phone")
+		if param == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing phone parameter"))
+			return
+		}
+		digits, err := normalizePhone(param)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, recipientError("phone", err))
+			return
+		}
+
+		client := sessions.client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+		match, err := lookupPhone(client, digits)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to check if users are on WhatsApp: %s", err)))
+			return
+		}
+		if match == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Phone is not on WhatsApp"))
+			return
+		}
+		_, lid := lids.forms(match.JID)
+		response := map[string]interface{}{"Phone": digits, "JID": match.JID.String(), "LID": lid, "VerifiedName": match.VerifiedName}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestPhoneVariants(t *testing.T) {
+	tests := []struct {
+		name   string
+		digits string
+		want   []string
+	}{
+		{"mobile with the 9th digit", "5511987654321", []string{"5511987654321", "551187654321"}},
+		{"mobile without the 9th digit", "551187654321", []string{"551187654321", "5511987654321"}},
+		{"mobile of another area", "5521998765432", []string{"5521998765432", "552198765432"}},
+		{"13 digits without a leading 9", "5521612345678", []string{"5521612345678"}},
+		{"old mobile starting with 6", "552161234567", []string{"552161234567", "5521961234567"}},
+		{"9 followed by a landline digit", "5511951234567", []string{"5511951234567"}},
+		{"landline", "551132345678", []string{"551132345678"}},
+		{"landline starting with 5", "551152345678", []string{"551152345678"}},
+		{"too short for a mobile", "55119876543", []string{"55119876543"}},
+		{"too long for a mobile", "55119876543210", []string{"55119876543210"}},
+		{"not Brazilian", "14155550100", []string{"14155550100"}},
+		{"not Brazilian, 13 digits", "4915123456789", []string{"4915123456789"}},
+	}
+	for _, tt := range tests {
+		if got := phoneVariants(tt.digits); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: phoneVariants(%s) = %v, want %v", tt.name, tt.digits, got, tt.want)
+		}
+	}
+}
+
+func TestPhoneVariantsDisabled(t *testing.T) {
+	defer func(enabled bool) { *brazilNinthDigit = enabled }(*brazilNinthDigit)
+	*brazilNinthDigit = false
+	for _, digits := range []string{"5511987654321", "551187654321"} {
+		if got := phoneVariants(digits); !reflect.DeepEqual(got, []string{digits}) {
+			t.Errorf("phoneVariants(%s) = %v with -br-ninth-digit off", digits, got)
+		}
+	}
+}
+
+func TestLookupPhoneCached(t *testing.T) {
+	registered := &phoneJID{JID: types.NewJID("551187654321", types.DefaultUserServer)}
+	phoneJIDs.Set("5511987654321", registered, phoneJIDTTL)
+	phoneJIDs.Set("5511987650000", (*phoneJID)(nil), phoneJIDNotFoundTTL)
+	defer phoneJIDs.Delete("5511987654321")
+	defer phoneJIDs.Delete("5511987650000")
+
+	// Answers known are reused, WhatsApp isn't asked again
+	match, err := lookupPhone(nil, "5511987654321")
+	if err != nil || match != registered {
+		t.Errorf("got %v %v, want the cached form", match, err)
+	}
+	match, err = lookupPhone(nil, "5511987650000")
+	if err != nil || match != nil {
+		t.Errorf("got %v %v, want not on WhatsApp", match, err)
+	}
+}
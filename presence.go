@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Event types not sent to subscribers of All, they have to be subscribed to
+// by name. Presence ones are too chatty and ReadReceipt was replaced by
+// Receipt.
+var explicitEventTypes = []string{"Presence", "ChatPresence", "ReadReceipt"}
+
+// Tells whether an event type is in a subscription list
+func subscribedTo(subscriptions []string, eventType string) bool {
+	if Find(subscriptions, eventType) {
+		return true
+	}
+	return Find(subscriptions, "All") && !Find(explicitEventTypes, eventType)
+}
+
+// Contacts whose presence each user asked for. WhatsApp forgets presence
+// subscriptions when the connection drops, they are sent again on connect.
+type presenceRegistry struct {
+	sync.Mutex
+	jids map[int]map[types.JID]bool
+}
+
+var presenceSubscriptions = &presenceRegistry{jids: make(map[int]map[types.JID]bool)}
+
+func (p *presenceRegistry) add(userID int, jid types.JID) {
+	p.Lock()
+	defer p.Unlock()
+	if p.jids[userID] == nil {
+		p.jids[userID] = make(map[types.JID]bool)
+	}
+	p.jids[userID][jid] = true
+}
+
+func (p *presenceRegistry) list(userID int) []types.JID {
+	p.Lock()
+	defer p.Unlock()
+	jids := make([]types.JID, 0, len(p.jids[userID]))
+	for jid := range p.jids[userID] {
+		jids = append(jids, jid)
+	}
+	return jids
+}
+
+// Subscribes again to the presence of the user's contacts after connecting
+func resubscribePresence(userID int, client *whatsmeow.Client) {
+	for _, jid := range presenceSubscriptions.list(userID) {
+		if err := client.SubscribePresence(jid); err != nil {
+			log.Warn().Err(err).Str("userid", strconv.Itoa(userID)).Str("jid", jid.String()).Msg("Could not subscribe to presence")
+		}
+	}
+}
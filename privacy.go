@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Privacy settings as named in the API, with the whatsmeow setting and the
+// values WhatsApp accepts for it
+var privacyOptions = []struct {
+	name    string
+	setting types.PrivacySettingType
+	allowed []types.PrivacySetting
+}{
+	{"LastSeen", types.PrivacySettingTypeLastSeen, []types.PrivacySetting{types.PrivacySettingAll, types.PrivacySettingContacts, types.PrivacySettingContactBlacklist, types.PrivacySettingNone}},
+	{"Online", types.PrivacySettingTypeOnline, []types.PrivacySetting{types.PrivacySettingAll, types.PrivacySettingMatchLastSeen}},
+	{"Profile", types.PrivacySettingTypeProfile, []types.PrivacySetting{types.PrivacySettingAll, types.PrivacySettingContacts, types.PrivacySettingContactBlacklist, types.PrivacySettingNone}},
+	{"About", types.PrivacySettingTypeStatus, []types.PrivacySetting{types.PrivacySettingAll, types.PrivacySettingContacts, types.PrivacySettingContactBlacklist, types.PrivacySettingNone}},
+	{"ReadReceipts", types.PrivacySettingTypeReadReceipts, []types.PrivacySetting{types.PrivacySettingAll, types.PrivacySettingNone}},
+	{"GroupAdd", types.PrivacySettingTypeGroupAdd, []types.PrivacySetting{types.PrivacySettingAll, types.PrivacySettingContacts, types.PrivacySettingContactBlacklist, types.PrivacySettingNone}},
+	{"CallAdd", types.PrivacySettingTypeCallAdd, []types.PrivacySetting{types.PrivacySettingAll, types.PrivacySettingKnown}},
+}
+
+// Friendlier names accepted for the WhatsApp values
+var privacyAliases = map[string]types.PrivacySetting{
+	"everyone": types.PrivacySettingAll,
+	"nobody":   types.PrivacySettingNone,
+}
+
+// Checks a value for the named setting, returning the whatsmeow value
+func privacyValue(name string, allowed []types.PrivacySetting, value string) (types.PrivacySetting, error) {
+	setting := types.PrivacySetting(strings.ToLower(value))
+	if alias, ok := privacyAliases[string(setting)]; ok {
+		setting = alias
+	}
+	for _, v := range allowed {
+		if v == setting {
+			return setting, nil
+		}
+	}
+	valid := make([]string, len(allowed))
+	for i, v := range allowed {
+		valid[i] = string(v)
+	}
+	return "", fmt.Errorf("Invalid %s value %q, must be one of %s", name, value, strings.Join(valid, ", "))
+}
+
+// Privacy settings keyed by their API names
+func privacyMap(settings types.PrivacySettings) map[string]string {
+	return map[string]string{
+		"LastSeen":     string(settings.LastSeen),
+		"Online":       string(settings.Online),
+		"Profile":      string(settings.Profile),
+		"About":        string(settings.Status),
+		"ReadReceipts": string(settings.ReadReceipts),
+		"GroupAdd":     string(settings.GroupAdd),
+		"CallAdd":      string(settings.CallAdd),
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"sync"
+
+	"github.com/nfnt/resize"
+	"go.mau.fi/whatsmeow"
+)
+
+// WhatsApp profile picture limits, bigger pictures are cropped square and
+// scaled down to profilePictureSize
+const (
+	profilePictureMin         = 192
+	profilePictureSize        = 640
+	profilePictureMaxDownload = 5 * 1024 * 1024
+)
+
+// Last known profile picture id per user, so /session/status doesn't ask
+// WhatsApp every time. "" means no picture is set.
+var profilePictures sync.Map
+
+// Checks a JPEG profile picture and makes it square and no bigger than
+// profilePictureSize
+func profilePicture(data []byte) ([]byte, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode picture: %w", err)
+	}
+	if format != "jpeg" {
+		return nil, fmt.Errorf("picture must be a JPEG, got %s", format)
+	}
+	if config.Width < profilePictureMin || config.Height < profilePictureMin {
+		return nil, fmt.Errorf("picture is %dx%d, it must be at least %dx%d", config.Width, config.Height, profilePictureMin, profilePictureMin)
+	}
+	if config.Width == config.Height && config.Width <= profilePictureSize {
+		return data, nil
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode picture: %w", err)
+	}
+	bounds := img.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	x := bounds.Min.X + (bounds.Dx()-side)/2
+	y := bounds.Min.Y + (bounds.Dy()-side)/2
+	square := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(square, square.Bounds(), img, image.Pt(x, y), draw.Src)
+	var out image.Image = square
+	if side > profilePictureSize {
+		out = resize.Resize(profilePictureSize, profilePictureSize, square, resize.Lanczos3)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, out, &jpeg.Options{Quality: 90}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Id of the user's own profile picture, asked to WhatsApp the first time
+func ownPictureID(userID int, client *whatsmeow.Client) string {
+	if id, ok := profilePictures.Load(userID); ok {
+		return id.(string)
+	}
+	info, err := client.GetProfilePictureInfo(client.Store.ID.ToNonAD(), &whatsmeow.GetProfilePictureParams{Preview: true})
+	if err != nil && !errors.Is(err, whatsmeow.ErrProfilePictureNotSet) {
+		log.Warn().Err(err).Int("userid", userID).Msg("Could not get own profile picture")
+		return ""
+	}
+	id := ""
+	if info != nil {
+		id = info.ID
+	}
+	profilePictures.Store(userID, id)
+	return id
+}
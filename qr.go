@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// Limits for the size of /session/qr.png, in pixels
+const (
+	qrDefaultSize = 256
+	qrMinSize     = 64
+	qrMaxSize     = 1024
+)
+
+// QR codes waiting to be scanned, by user. Only the raw string is kept so
+// the image can be rendered at any size, the users table has the default
+// one for /session/qr.
+var pendingQRs = struct {
+	sync.Mutex
+	codes map[int]string
+}{codes: make(map[int]string)}
+
+func setPendingQR(userID int, code string) {
+	pendingQRs.Lock()
+	defer pendingQRs.Unlock()
+	if code == "" {
+		delete(pendingQRs.codes, userID)
+		return
+	}
+	pendingQRs.codes[userID] = code
+}
+
+func pendingQR(userID int) string {
+	pendingQRs.Lock()
+	defer pendingQRs.Unlock()
+	return pendingQRs.codes[userID]
+}
+
+// How long POST /session/connect waits for the session to log in or show a
+// QR code, unless Immediate
+const connectWait = 10 * time.Second
+
+// QR code as the PNG data URL stored for /session/qr and sent in QR events
+func qrDataURL(code string) string {
+	image, _ := qrcode.Encode(code, qrcode.Medium, qrDefaultSize)
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(image)
+}
+
+// Waits for a session just started to get somewhere: connected once logged
+// in, qr with the code to scan when it needs pairing, or connecting when it
+// is still connected but neither happened in time. Fails when the connection
+// could not be made or the session stopped.
+func awaitConnect(sess *session, userID int, timeout time.Duration) (string, string, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	select {
+	case <-sess.ready:
+	case <-deadline.C:
+		return "", "", errors.New("Failed to Connect")
+	}
+	if sess.err != nil {
+		return "", "", errors.New("Failed to Connect")
+	}
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if !sessions.running(userID) {
+			return "", "", errors.New("Failed to Connect")
+		}
+		if client := sessions.client(userID); client != nil && client.IsLoggedIn() {
+			return "connected", "", nil
+		}
+		if code := pendingQR(userID); code != "" {
+			return "qr", code, nil
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			if client := sessions.client(userID); client != nil && client.IsConnected() {
+				return "connecting", "", nil
+			}
+			return "", "", errors.New("Failed to Connect")
+		}
+	}
+}
+
+// Gets the pending QR code as a PNG image, ?size= sets its width and height
+func (s *server) GetQRImage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		size := qrDefaultSize
+		if param := r.URL.Query().Get("size"); param != "" {
+			var err error
+			size, err = strconv.Atoi(param)
+			if err != nil || size < qrMinSize || size > qrMaxSize {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid size, must be between %d and %d", qrMinSize, qrMaxSize)))
+				return
+			}
+		}
+
+		if sessions.client(userid) == nil {
+			s.Respond(w, r, http.StatusConflict, errNoSession)
+			return
+		}
+		code := pendingQR(userid)
+		if code == "" {
+			s.Respond(w, r, http.StatusNotFound, errors.New("No QR code pending"))
+			return
+		}
+
+		image, err := qrcode.Encode(code, qrcode.Medium, size)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not render QR code: %v", err)))
+			return
+		}
+		// A new code replaces it every few seconds
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(image)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Daily message quotas are counted per UTC day, the counter lives in the
+// users row so it survives restarts
+func quotaDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// Next UTC midnight, when counters start again from 0
+func quotaReset(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+// Usage of a user for the current day. A limit of 0 means unlimited.
+type messageUsage struct {
+	Limit int
+	Sent  int
+	Reset time.Time
+}
+
+func (s *server) messageUsage(userID int) (messageUsage, error) {
+	now := time.Now()
+	usage := messageUsage{Reset: quotaReset(now)}
+	var day string
+	err := s.db.QueryRow("SELECT max_messages_per_day, messages_sent, messages_day FROM users WHERE id=?", userID).Scan(&usage.Limit, &usage.Sent, &day)
+	if err != nil {
+		return usage, err
+	}
+	if day != quotaDay(now) {
+		usage.Sent = 0
+	}
+	return usage, nil
+}
+
+// Counts a message sent today towards the user's quota
+func countSent(db execer, userID int) {
+	day := quotaDay(time.Now())
+	_, err := execRetry(db, "UPDATE users SET messages_sent=CASE WHEN messages_day=? THEN messages_sent+1 ELSE 1 END, messages_day=? WHERE id=?", day, day, userID)
+	if err != nil {
+		log.Error().Err(err).Int("userid", userID).Msg("Could not count sent message")
+	}
+}
+
+// Middleware: Refuses sends once the user reached max_messages_per_day.
+// Messages are counted once sent, so concurrent requests can go slightly
+// over the limit.
+func (s *server) sendQuota(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userid, _ := strconv.Atoi(r.Context().Value("userinfo").(Values).Get("Id"))
+		usage, err := s.messageUsage(userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
+		}
+		if usage.Limit > 0 && usage.Sent >= usage.Limit {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(usage.Reset).Seconds())+1))
+			s.Respond(w, r, http.StatusTooManyRequests, newAPIError(ErrRateLimited, "Daily message quota exceeded", map[string]interface{}{
+				"limit": usage.Limit,
+				"sent":  usage.Sent,
+				"reset": usage.Reset.Unix(),
+			}))
+			return
+		}
+		lastSend.Store(time.Now().Unix())
+		next.ServeHTTP(w, r)
+	})
+}
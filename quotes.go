@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// Quoted copy of a stored message: the text, or the media message as
+// received, thumbnail and keys included so nothing is downloaded again.
+// Nested quotes and mentions are left out.
+func quotedMessage(msg *waProto.Message) *waProto.Message {
+	if inner := msg.GetEphemeralMessage().GetMessage(); inner != nil {
+		return quotedMessage(inner)
+	}
+	if inner := msg.GetDocumentWithCaptionMessage().GetMessage(); inner != nil {
+		return quotedMessage(inner)
+	}
+	quoted := &waProto.Message{}
+	switch {
+	case msg.Conversation != nil:
+		quoted.Conversation = proto.String(msg.GetConversation())
+	case msg.ExtendedTextMessage != nil:
+		quoted.Conversation = proto.String(msg.GetExtendedTextMessage().GetText())
+	case msg.ImageMessage != nil:
+		quoted.ImageMessage = proto.Clone(msg.ImageMessage).(*waProto.ImageMessage)
+		quoted.ImageMessage.ContextInfo = nil
+	case msg.VideoMessage != nil:
+		quoted.VideoMessage = proto.Clone(msg.VideoMessage).(*waProto.VideoMessage)
+		quoted.VideoMessage.ContextInfo = nil
+	case msg.AudioMessage != nil:
+		quoted.AudioMessage = proto.Clone(msg.AudioMessage).(*waProto.AudioMessage)
+		quoted.AudioMessage.ContextInfo = nil
+	case msg.DocumentMessage != nil:
+		quoted.DocumentMessage = proto.Clone(msg.DocumentMessage).(*waProto.DocumentMessage)
+		quoted.DocumentMessage.ContextInfo = nil
+	case msg.StickerMessage != nil:
+		quoted.StickerMessage = proto.Clone(msg.StickerMessage).(*waProto.StickerMessage)
+		quoted.StickerMessage.ContextInfo = nil
+	case msg.LocationMessage != nil:
+		quoted.LocationMessage = proto.Clone(msg.LocationMessage).(*waProto.LocationMessage)
+		quoted.LocationMessage.ContextInfo = nil
+	case msg.ContactMessage != nil:
+		quoted.ContactMessage = proto.Clone(msg.ContactMessage).(*waProto.ContactMessage)
+		quoted.ContactMessage.ContextInfo = nil
+	default:
+		quoted.Conversation = proto.String("")
+	}
+	return quoted
+}
+
+// Stored message a reply quotes, its chat and sender too. False when it
+// isn't stored.
+func storedQuote(db *sql.DB, userID int, stanzaID string) (*waProto.Message, string, string, bool, error) {
+	var chat, sender, body string
+	err := db.QueryRow("SELECT chat_jid, sender_jid, body FROM messages WHERE user_id=? AND id=? LIMIT 1", userID, stanzaID).Scan(&chat, &sender, &body)
+	if err == sql.ErrNoRows {
+		return nil, "", "", false, nil
+	}
+	if err != nil {
+		return nil, "", "", false, err
+	}
+	// Only the message is needed, fields the proto types can't take back
+	// from JSON are skipped
+	var stored struct {
+		Message *waProto.Message
+	}
+	if err := json.Unmarshal([]byte(body), &stored); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if !errors.As(err, &typeErr) {
+			return nil, "", "", false, err
+		}
+	}
+	return stored.Message, chat, sender, true, nil
+}
+
+// ContextInfo of a reply to ci.StanzaID sent to chat. QuotedMessage is the
+// one given, or rebuilt from the stored messages when the user keeps them,
+// which also fills a missing Participant. Otherwise the quote goes out empty
+// as WhatsApp allows, and Participant can't be left out.
+func (s *server) quotedContext(r *http.Request, chat types.JID, ci *waProto.ContextInfo) (*waProto.ContextInfo, error) {
+	v := r.Context().Value("userinfo").(Values)
+	userid, _ := strconv.Atoi(v.Get("Id"))
+	stanzaID := ci.GetStanzaID()
+	quoted := &waProto.ContextInfo{
+		StanzaID:      proto.String(stanzaID),
+		Participant:   ci.Participant,
+		QuotedMessage: ci.QuotedMessage,
+	}
+	if quoted.QuotedMessage != nil && quoted.Participant != nil {
+		return quoted, nil
+	}
+	if v.Get("StoreMessages") != "1" {
+		if quoted.Participant == nil {
+			return nil, newAPIError(ErrMissingField, "Missing Participant in ContextInfo, quoting by StanzaID alone needs store_messages enabled", map[string]interface{}{"StanzaID": stanzaID})
+		}
+		quoted.QuotedMessage = &waProto.Message{Conversation: proto.String("")}
+		return quoted, nil
+	}
+
+	msg, storedChat, sender, found, err := storedQuote(s.db, userid, stanzaID)
+	if err != nil {
+		log.Error().Err(err).Str("id", stanzaID).Msg("Could not look up quoted message")
+		return nil, errors.New("Problem accessing DB")
+	}
+	if !found {
+		if quoted.Participant == nil {
+			return nil, newAPIError(ErrNotFound, "Quoted message not found in the stored messages, give Participant in ContextInfo", map[string]interface{}{"StanzaID": stanzaID})
+		}
+		if quoted.QuotedMessage == nil {
+			quoted.QuotedMessage = &waProto.Message{Conversation: proto.String("")}
+		}
+		return quoted, nil
+	}
+	if quoted.Participant == nil {
+		quoted.Participant = proto.String(sender)
+	}
+	if quoted.QuotedMessage == nil {
+		quoted.QuotedMessage = quotedMessage(msg)
+	}
+	// Quoting a message of another chat
+	if storedChat != chat.ToNonAD().String() {
+		quoted.RemoteJID = proto.String(storedChat)
+	}
+	return quoted, nil
+}
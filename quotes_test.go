@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestQuotedMessage(t *testing.T) {
+	reply := &waProto.ContextInfo{StanzaID: proto.String("3EB0OLDER"), Participant: proto.String("5511888880000@s.whatsapp.net")}
+	image := &waProto.ImageMessage{
+		Caption:       proto.String("look"),
+		Mimetype:      proto.String("image/jpeg"),
+		URL:           proto.String("https://mmg.whatsapp.net/o1/v/t62/image"),
+		DirectPath:    proto.String("/o1/v/t62/image"),
+		MediaKey:      []byte{1, 2, 3},
+		FileSHA256:    []byte{4, 5, 6},
+		FileEncSHA256: []byte{7, 8, 9},
+		FileLength:    proto.Uint64(123456),
+		JPEGThumbnail: []byte{0xff, 0xd8, 0xff, 0xe0},
+		ContextInfo:   reply,
+	}
+	document := &waProto.DocumentMessage{FileName: proto.String("invoice.pdf"), Caption: proto.String("invoice"), MediaKey: []byte{1}, JPEGThumbnail: []byte{0xff, 0xd8}, ContextInfo: reply}
+
+	tests := []struct {
+		name string
+		msg  *waProto.Message
+		want *waProto.Message
+	}{
+		{"text", &waProto.Message{Conversation: proto.String("hello")},
+			&waProto.Message{Conversation: proto.String("hello")}},
+		{"extended text", &waProto.Message{ExtendedTextMessage: &waProto.ExtendedTextMessage{Text: proto.String("hi back"), ContextInfo: reply}},
+			&waProto.Message{Conversation: proto.String("hi back")}},
+		{"image with thumbnail", &waProto.Message{ImageMessage: image},
+			&waProto.Message{ImageMessage: &waProto.ImageMessage{Caption: image.Caption, Mimetype: image.Mimetype, URL: image.URL, DirectPath: image.DirectPath, MediaKey: image.MediaKey, FileSHA256: image.FileSHA256, FileEncSHA256: image.FileEncSHA256, FileLength: image.FileLength, JPEGThumbnail: image.JPEGThumbnail}}},
+		{"ephemeral image", &waProto.Message{EphemeralMessage: &waProto.FutureProofMessage{Message: &waProto.Message{ImageMessage: image}}},
+			&waProto.Message{ImageMessage: &waProto.ImageMessage{Caption: image.Caption, Mimetype: image.Mimetype, URL: image.URL, DirectPath: image.DirectPath, MediaKey: image.MediaKey, FileSHA256: image.FileSHA256, FileEncSHA256: image.FileEncSHA256, FileLength: image.FileLength, JPEGThumbnail: image.JPEGThumbnail}}},
+		{"document with caption", &waProto.Message{DocumentWithCaptionMessage: &waProto.FutureProofMessage{Message: &waProto.Message{DocumentMessage: document}}},
+			&waProto.Message{DocumentMessage: &waProto.DocumentMessage{FileName: document.FileName, Caption: document.Caption, MediaKey: document.MediaKey, JPEGThumbnail: document.JPEGThumbnail}}},
+		{"location", &waProto.Message{LocationMessage: &waProto.LocationMessage{DegreesLatitude: proto.Float64(-23.5), DegreesLongitude: proto.Float64(-46.6), ContextInfo: reply}},
+			&waProto.Message{LocationMessage: &waProto.LocationMessage{DegreesLatitude: proto.Float64(-23.5), DegreesLongitude: proto.Float64(-46.6)}}},
+		{"not quotable", &waProto.Message{ReactionMessage: &waProto.ReactionMessage{Text: proto.String("👍")}},
+			&waProto.Message{Conversation: proto.String("")}},
+	}
+	for _, tt := range tests {
+		if got := quotedMessage(tt.msg); !proto.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	// The stored message is left as it was
+	if image.ContextInfo != reply {
+		t.Error("quoting changed the stored message")
+	}
+}
+
+// A user keeping messages or not, with its user info cached
+func testQuoteUser(t *testing.T, s *server, token string, store bool) int {
+	t.Helper()
+	id, err := insertUser(s.db, newUser{Name: token, Token: token, StoreMessages: store, PayloadFormat: "raw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.refreshUserInfo(strconv.FormatInt(id, 10), "")
+	return int(id)
+}
+
+func TestQuotedContext(t *testing.T) {
+	s := &server{db: testUsersDB(t)}
+	userID := testQuoteUser(t, s, "quotes-stored", true)
+	chat := types.NewJID("5511999990000", types.DefaultUserServer)
+
+	text := testMessage(&waProto.Message{Conversation: proto.String("hello")})
+	text.Info.ID = "3EB0TEXT"
+	saveMessage(s.db, userID, text, "")
+	image := testMessage(&waProto.Message{ImageMessage: &waProto.ImageMessage{Caption: proto.String("look"), Mimetype: proto.String("image/jpeg"), MediaKey: []byte{1, 2, 3}, DirectPath: proto.String("/o1/v/t62/image"), JPEGThumbnail: []byte{0xff, 0xd8, 0xff, 0xe0}}})
+	image.Info.ID = "3EB0IMAGE"
+	saveMessage(s.db, userID, image, "")
+	r := userRequest(t, "quotes-stored", "POST", "/chat/send/text", "")
+
+	t.Run("text", func(t *testing.T) {
+		quoted, err := s.quotedContext(r, chat, &waProto.ContextInfo{StanzaID: proto.String("3EB0TEXT")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if quoted.GetParticipant() != "5511999990000@s.whatsapp.net" || quoted.GetQuotedMessage().GetConversation() != "hello" || quoted.RemoteJID != nil {
+			t.Errorf("got %v", quoted)
+		}
+	})
+
+	t.Run("media", func(t *testing.T) {
+		quoted, err := s.quotedContext(r, chat, &waProto.ContextInfo{StanzaID: proto.String("3EB0IMAGE")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		img := quoted.GetQuotedMessage().GetImageMessage()
+		if img == nil || img.GetCaption() != "look" || string(img.GetJPEGThumbnail()) != "\xff\xd8\xff\xe0" || string(img.GetMediaKey()) != "\x01\x02\x03" || img.GetDirectPath() != "/o1/v/t62/image" {
+			t.Errorf("got %v, want the image with its thumbnail and keys", quoted.GetQuotedMessage())
+		}
+	})
+
+	t.Run("other chat", func(t *testing.T) {
+		group := types.NewJID("120363025246125486", types.GroupServer)
+		quoted, err := s.quotedContext(r, group, &waProto.ContextInfo{StanzaID: proto.String("3EB0TEXT")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if quoted.GetRemoteJID() != chat.String() {
+			t.Errorf("RemoteJID %q, want %s", quoted.GetRemoteJID(), chat)
+		}
+	})
+
+	t.Run("given quote is kept", func(t *testing.T) {
+		given := &waProto.Message{Conversation: proto.String("as sent")}
+		quoted, err := s.quotedContext(r, chat, &waProto.ContextInfo{StanzaID: proto.String("3EB0IMAGE"), Participant: proto.String("5511777770000@s.whatsapp.net"), QuotedMessage: given})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if quoted.GetParticipant() != "5511777770000@s.whatsapp.net" || quoted.GetQuotedMessage() != given {
+			t.Errorf("got %v", quoted)
+		}
+	})
+
+	t.Run("not stored", func(t *testing.T) {
+		_, err := s.quotedContext(r, chat, &waProto.ContextInfo{StanzaID: proto.String("3EB0UNKNOWN")})
+		var apiErr *apiError
+		if !errors.As(err, &apiErr) || apiErr.Code != ErrNotFound || apiErr.Details["StanzaID"] != "3EB0UNKNOWN" {
+			t.Errorf("got %v, want %s", err, ErrNotFound)
+		}
+		quoted, err := s.quotedContext(r, chat, &waProto.ContextInfo{StanzaID: proto.String("3EB0UNKNOWN"), Participant: proto.String("5511999990000@s.whatsapp.net")})
+		if err != nil || quoted.GetQuotedMessage().Conversation == nil {
+			t.Errorf("got %v %v, want an empty quote", quoted, err)
+		}
+	})
+}
+
+func TestQuotedContextWithoutStore(t *testing.T) {
+	s := &server{db: testUsersDB(t)}
+	userID := testQuoteUser(t, s, "quotes-not-stored", false)
+	chat := types.NewJID("5511999990000", types.DefaultUserServer)
+	// Kept from before store_messages was turned off, not to be used
+	saveMessage(s.db, userID, testMessage(&waProto.Message{Conversation: proto.String("hello")}), "")
+	r := userRequest(t, "quotes-not-stored", "POST", "/chat/send/text", "")
+
+	_, err := s.quotedContext(r, chat, &waProto.ContextInfo{StanzaID: proto.String("3EB0ABC")})
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) || apiErr.Code != ErrMissingField {
+		t.Fatalf("got %v, want %s", err, ErrMissingField)
+	}
+	if want := "Missing Participant in ContextInfo, quoting by StanzaID alone needs store_messages enabled"; apiErr.Message != want {
+		t.Errorf("message %q, want %q", apiErr.Message, want)
+	}
+
+	quoted, err := s.quotedContext(r, chat, &waProto.ContextInfo{StanzaID: proto.String("3EB0ABC"), Participant: proto.String("5511999990000@s.whatsapp.net")})
+	if err != nil || quoted.GetQuotedMessage().Conversation == nil || quoted.GetQuotedMessage().GetConversation() != "" {
+		t.Errorf("got %v %v, want an empty quote", quoted, err)
+	}
+}
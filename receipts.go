@@ -0,0 +1,147 @@
+package main
+
+import (
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+const receiptPruneInterval = time.Hour
+
+// Receipt states in increasing order, a recipient's state only moves up
+var receiptStates = map[types.ReceiptType]struct {
+	name string
+	rank int
+}{
+	types.ReceiptTypeDelivered: {"delivered", 1},
+	types.ReceiptTypeRead:      {"read", 2},
+	types.ReceiptTypePlayed:    {"played", 3},
+}
+
+// Delivery state of a sent message for one recipient, in groups there is
+// one per participant
+type receiptState struct {
+	Jid       string
+	State     string
+	Timestamp time.Time
+}
+
+// Receipts of one recipient for /chat/messageinfo, times are null until the
+// receipt arrives. Group participants who sent none yet are "sent".
+type recipientInfo struct {
+	Jid       string
+	State     string
+	Delivered *time.Time
+	Read      *time.Time
+	Played    *time.Time
+}
+
+func receiptTime(timestamp int64) *time.Time {
+	if timestamp == 0 {
+		return nil
+	}
+	t := time.Unix(timestamp, 0)
+	return &t
+}
+
+// Same key for the phone number and LID forms of a participant, receipts
+// may come with either
+func recipientKey(jid types.JID) string {
+	pn, lid := lids.forms(jid)
+	if pn != "" {
+		return pn
+	}
+	if lid != "" {
+		return lid
+	}
+	return jid.ToNonAD().String()
+}
+
+// Remembers a message sent through the API so its receipts get tracked,
+// along with the id of the request that sent it
+func trackSent(db execer, userID int, msgid string, chat types.JID, timestamp time.Time, requestID string) {
+	if *receiptRetention <= 0 {
+		return
+	}
+	_, err := execRetry(db, "INSERT OR REPLACE INTO sent_messages (user_id, id, chat_jid, timestamp, request_id) VALUES (?, ?, ?, ?, ?)",
+		userID, msgid, chat.ToNonAD().String(), timestamp.Unix(), requestID)
+	if err != nil {
+		log.Error().Err(err).Str("id", msgid).Msg("Could not track sent message")
+	}
+}
+
+// Records delivered, read and played receipts for messages we sent through
+// the API, others are ignored
+func (mycli *MyClient) recordReceipt(evt *events.Receipt) {
+	state, ok := receiptStates[evt.Type]
+	if !ok || evt.IsFromMe || *receiptRetention <= 0 {
+		return
+	}
+	recipient := evt.Sender.ToNonAD().String()
+	// The time of each state is kept in its own column, delivered_at and so
+	// on, the first receipt of a state wins
+	column := state.name + "_at"
+	for _, id := range evt.MessageIDs {
+		_, err := execRetry(mycli.db, `INSERT INTO message_receipts (user_id, message_id, recipient_jid, state, rank, timestamp, `+column+`)
+			SELECT ?, ?, ?, ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM sent_messages WHERE user_id=? AND id=?)
+			ON CONFLICT (user_id, message_id, recipient_jid) DO UPDATE SET
+				state=CASE WHEN excluded.rank>message_receipts.rank THEN excluded.state ELSE message_receipts.state END,
+				timestamp=CASE WHEN excluded.rank>message_receipts.rank THEN excluded.timestamp ELSE message_receipts.timestamp END,
+				rank=MAX(excluded.rank, message_receipts.rank),
+				`+column+`=CASE WHEN message_receipts.`+column+`=0 THEN excluded.`+column+` ELSE message_receipts.`+column+` END`,
+			mycli.userID, id, recipient, state.name, state.rank, evt.Timestamp.Unix(), evt.Timestamp.Unix(), mycli.userID, id)
+		if err != nil {
+			log.Error().Err(err).Str("id", id).Msg("Could not record receipt")
+		}
+	}
+}
+
+// Ids of the requests that sent the given messages, for those still tracked
+func (mycli *MyClient) sentRequestIDs(msgids []string) map[string]string {
+	ids := make(map[string]string)
+	for _, msgid := range msgids {
+		var requestID string
+		err := mycli.db.QueryRow("SELECT request_id FROM sent_messages WHERE user_id=? AND id=?", mycli.userID, msgid).Scan(&requestID)
+		if err == nil && requestID != "" {
+			ids[msgid] = requestID
+		}
+	}
+	return ids
+}
+
+// Periodically forgets sent messages and receipts older than -receiptretention
+func (s *server) receiptPruner() {
+	if *receiptRetention <= 0 {
+		return
+	}
+	for {
+		cutoff := time.Now().Add(-*receiptRetention).Unix()
+		if _, err := execRetry(s.db, "DELETE FROM sent_messages WHERE timestamp<?", cutoff); err != nil {
+			log.Error().Err(err).Msg("Could not prune tracked messages")
+		}
+		if _, err := execRetry(s.db, "DELETE FROM message_receipts WHERE timestamp<? OR NOT EXISTS (SELECT 1 FROM sent_messages WHERE sent_messages.user_id=message_receipts.user_id AND sent_messages.id=message_receipts.message_id)", cutoff); err != nil {
+			log.Error().Err(err).Msg("Could not prune receipts")
+		}
+		time.Sleep(receiptPruneInterval)
+	}
+}
+
+// Normalized payload of a delivered, read or played receipt for the Receipt
+// event, nil for other receipt types. One receipt can cover many messages.
+func receiptPayload(evt *events.Receipt) map[string]interface{} {
+	state, ok := receiptStates[evt.Type]
+	if !ok || evt.IsFromMe {
+		return nil
+	}
+	pn, _ := lids.forms(evt.Sender)
+	return map[string]interface{}{
+		"MessageIDs": evt.MessageIDs,
+		"Chat":       evt.Chat.ToNonAD().String(),
+		"Sender":     evt.Sender.ToNonAD().String(),
+		"SenderPn":   pn,
+		"IsGroup":    evt.IsGroup,
+		"Type":       state.name,
+		"Timestamp":  evt.Timestamp.Unix(),
+	}
+}
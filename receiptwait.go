@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// How long ?wait= holds a send by default and at most, well under the
+// server's write timeout
+const (
+	receiptWaitTimeout = 30 * time.Second
+	receiptWaitMax     = 60 * time.Second
+)
+
+// A request waiting on a receipt of at least rank, the channel takes one
+type receiptWaiter struct {
+	rank int
+	ch   chan receiptState
+}
+
+type receiptWaitRegistry struct {
+	sync.Mutex
+	waiters map[string][]*receiptWaiter
+}
+
+// Requests waiting on receipts, by user id and message id
+var receiptWaits = &receiptWaitRegistry{waiters: make(map[string][]*receiptWaiter)}
+
+// Best receipt lately seen of each message, so one arriving before its
+// request started waiting isn't missed
+var recentReceipts = cache.New(receiptWaitMax, receiptWaitMax)
+
+type recentReceipt struct {
+	rank  int
+	state receiptState
+}
+
+func receiptWaitKey(userID int, msgid string) string {
+	return strconv.Itoa(userID) + ":" + msgid
+}
+
+// Rank of the receipt ?wait= asks for
+func receiptWaitRank(name string) (int, bool) {
+	for _, state := range receiptStates {
+		if state.name == name {
+			return state.rank, true
+		}
+	}
+	return 0, false
+}
+
+// Reads ?wait= and ?timeout= of a send, zero rank when the request doesn't
+// wait
+func receiptWaitParams(r *http.Request) (int, time.Duration, error) {
+	query := r.URL.Query()
+	name := query.Get("wait")
+	if name == "" {
+		return 0, 0, nil
+	}
+	rank, ok := receiptWaitRank(name)
+	if !ok {
+		return 0, 0, errors.New("Invalid wait, must be delivered, read or played")
+	}
+	timeout := receiptWaitTimeout
+	if param := query.Get("timeout"); param != "" {
+		seconds, err := strconv.Atoi(param)
+		if err != nil || seconds < 1 || time.Duration(seconds)*time.Second > receiptWaitMax {
+			return 0, 0, errors.New("Invalid timeout, must be 1 to " + strconv.Itoa(int(receiptWaitMax.Seconds())) + " seconds")
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+	return rank, timeout, nil
+}
+
+// Wakes the requests waiting on the messages of a receipt
+func (reg *receiptWaitRegistry) received(userID int, evt *events.Receipt) {
+	state, ok := receiptStates[evt.Type]
+	if !ok || evt.IsFromMe {
+		return
+	}
+	receipt := receiptState{Jid: evt.Sender.ToNonAD().String(), State: state.name, Timestamp: evt.Timestamp}
+	reg.Lock()
+	defer reg.Unlock()
+	for _, msgid := range evt.MessageIDs {
+		key := receiptWaitKey(userID, msgid)
+		if prev, found := recentReceipts.Get(key); !found || prev.(recentReceipt).rank < state.rank {
+			recentReceipts.Set(key, recentReceipt{rank: state.rank, state: receipt}, cache.DefaultExpiration)
+		}
+		waiting := reg.waiters[key][:0]
+		for _, waiter := range reg.waiters[key] {
+			if waiter.rank <= state.rank {
+				waiter.ch <- receipt
+			} else {
+				waiting = append(waiting, waiter)
+			}
+		}
+		if len(waiting) == 0 {
+			delete(reg.waiters, key)
+		} else {
+			reg.waiters[key] = waiting
+		}
+	}
+}
+
+func (reg *receiptWaitRegistry) remove(key string, waiter *receiptWaiter) {
+	reg.Lock()
+	defer reg.Unlock()
+	waiting := reg.waiters[key][:0]
+	for _, other := range reg.waiters[key] {
+		if other != waiter {
+			waiting = append(waiting, other)
+		}
+	}
+	if len(waiting) == 0 {
+		delete(reg.waiters, key)
+	} else {
+		reg.waiters[key] = waiting
+	}
+}
+
+// Waits for a receipt of at least rank of a sent message, false on timeout or
+// when the request goes away first
+func (reg *receiptWaitRegistry) wait(r *http.Request, userID int, msgid string, rank int, timeout time.Duration) (receiptState, bool) {
+	key := receiptWaitKey(userID, msgid)
+	waiter := &receiptWaiter{rank: rank, ch: make(chan receiptState, 1)}
+	reg.Lock()
+	if prev, found := recentReceipts.Get(key); found && prev.(recentReceipt).rank >= rank {
+		reg.Unlock()
+		return prev.(recentReceipt).state, true
+	}
+	reg.waiters[key] = append(reg.waiters[key], waiter)
+	reg.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case receipt := <-waiter.ch:
+		return receipt, true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	reg.remove(key, waiter)
+	return receiptState{}, false
+}
+
+// Middleware: Refuses a bad ?wait= or ?timeout= before anything is sent
+func (s *server) checkReceiptWait(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, err := receiptWaitParams(r); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Holds a send response until the receipt ?wait= asks for arrives, adding
+// Status and Receipt to it. Status stays "sent" when none came in time, the
+// message went out all the same.
+func (s *server) waitReceipt(r *http.Request, msgid string, response map[string]interface{}) {
+	rank, timeout, _ := receiptWaitParams(r)
+	if rank == 0 {
+		return
+	}
+	userid, _ := strconv.Atoi(r.Context().Value("userinfo").(Values).Get("Id"))
+	receipt, ok := receiptWaits.wait(r, userid, msgid, rank, timeout)
+	if !ok {
+		response["Status"] = "sent"
+		response["Receipt"] = nil
+		return
+	}
+	response["Status"] = receipt.State
+	response["Receipt"] = receipt
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Parses a recipient given to the API: a bare phone number in any common
+// format or a full JID. Phone numbers, bare or as JIDs, are normalized with
+// normalizePhone, LIDs are mapped to their phone number as they can't be
+// sent to yet. Device JIDs are left as they are.
+func parseRecipient(value string) (types.JID, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return types.EmptyJID, errors.New("empty")
+	}
+	user, server, hasServer := strings.Cut(value, "@")
+	if !hasServer {
+		digits, err := normalizePhone(value)
+		if err != nil {
+			return types.EmptyJID, err
+		}
+		return types.NewJID(digits, types.DefaultUserServer), nil
+	}
+	switch server {
+	case types.DefaultUserServer, types.LegacyUserServer:
+		if strings.ContainsAny(user, ".:") {
+			jid, err := types.ParseJID(value)
+			if err != nil || jid.User == "" {
+				return types.EmptyJID, errors.New("malformed device JID")
+			}
+			return jid, nil
+		}
+		digits, err := normalizePhone(user)
+		if err != nil {
+			return types.EmptyJID, err
+		}
+		return types.NewJID(digits, types.DefaultUserServer), nil
+	case types.HiddenUserServer:
+		jid, err := types.ParseJID(value)
+		if err != nil || jid.User == "" {
+			return types.EmptyJID, errors.New("malformed LID")
+		}
+		pn, ok := lids.pn(jid)
+		if !ok {
+			return types.EmptyJID, errors.New("no phone number known for this LID")
+		}
+		return pn, nil
+	case types.GroupServer, types.NewsletterServer, types.BroadcastServer:
+		jid, err := types.ParseJID(value)
+		if err != nil || jid.User == "" {
+			return types.EmptyJID, errors.New("malformed JID")
+		}
+		return jid, nil
+	}
+	return types.EmptyJID, fmt.Errorf("unknown server %q", server)
+}
+
+// Error for a recipient field that couldn't be parsed, naming the field
+func recipientError(field string, err error) error {
+	return newAPIError(ErrInvalidJID, fmt.Sprintf("Invalid %s: %v", field, err), map[string]interface{}{"field": field})
+}
+
+// Parses the recipient in field and, with -resolve-phones, swaps phone
+// numbers for the JID WhatsApp has for them. Brazilian mobiles are looked up
+// without it too, they may be registered without the 9th digit. When
+// WhatsApp can't be asked the number is used as given.
+func resolveRecipient(client *whatsmeow.Client, field string, value string) (types.JID, error) {
+	jid, err := parseRecipient(value)
+	if err == nil {
+		jid, err = resolvePhone(client, jid)
+	}
+	if err != nil {
+		return jid, recipientError(field, err)
+	}
+	return jid, nil
+}
+
+// The lookup of resolveRecipient for a parsed recipient, other JIDs than
+// phone numbers are returned as they are
+func resolvePhone(client *whatsmeow.Client, jid types.JID) (types.JID, error) {
+	if client == nil || jid.Server != types.DefaultUserServer || jid.Device != 0 {
+		return jid, nil
+	}
+	if !*resolvePhones && len(phoneVariants(jid.User)) == 1 {
+		return jid, nil
+	}
+	match, err := lookupPhone(client, jid.User)
+	if err != nil {
+		log.Warn().Err(err).Str("phone", jid.User).Msg("Could not look up phone number, using it as given")
+		return jid, nil
+	}
+	if match == nil {
+		if !*resolvePhones {
+			return jid, nil
+		}
+		return jid, errors.New("not on WhatsApp")
+	}
+	return match.JID, nil
+}
+
+// Parses a group JID in field, bare group ids are not accepted as they look
+// like phone numbers
+func parseGroupJID(field string, value string) (types.JID, error) {
+	jid, err := parseRecipient(value)
+	if err == nil && jid.Server != types.GroupServer {
+		err = errors.New("must be a group JID ending in @g.us")
+	}
+	if err != nil {
+		return jid, recipientError(field, err)
+	}
+	return jid, nil
+}
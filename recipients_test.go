@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestParseRecipient(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		err   string
+	}{
+		{"5511999990000", "5511999990000@s.whatsapp.net", ""},
+		{"+55 (11) 99999-0000", "5511999990000@s.whatsapp.net", ""},
+		{"0055 11 99999 0000", "5511999990000@s.whatsapp.net", ""},
+		{"+1.415.555.0100", "14155550100@s.whatsapp.net", ""},
+		{"  49-30-1234567 \n", "49301234567@s.whatsapp.net", ""},
+		{"5511999990000@s.whatsapp.net", "5511999990000@s.whatsapp.net", ""},
+		{"+55 11 99999-0000@s.whatsapp.net", "5511999990000@s.whatsapp.net", ""},
+		{"5511999990000@c.us", "5511999990000@s.whatsapp.net", ""},
+		{"5511999990000:12@s.whatsapp.net", "5511999990000:12@s.whatsapp.net", ""},
+		{"120363025246125486@g.us", "120363025246125486@g.us", ""},
+		{"120363144038483540@newsletter", "120363144038483540@newsletter", ""},
+		{"status@broadcast", "status@broadcast", ""},
+		{"", "", "empty"},
+		{"   ", "", "empty"},
+		{"+55 11 9999O-0000", "", "only digits"},
+		{"5511#999990000", "", "only digits"},
+		{"+1 234", "", "7 to 15 digits"},
+		{"1234567890123456", "", "7 to 15 digits"},
+		{"011 5555 1234", "", "country code"},
+		{"+0 555 1234 567", "", "country code"},
+		{"@s.whatsapp.net", "", "7 to 15 digits"},
+		{":1@s.whatsapp.net", "", "malformed device JID"},
+		{"@g.us", "", "malformed JID"},
+		{"@lid", "", "malformed LID"},
+		{"98765432101234@lid", "", "no phone number known"},
+		{"5511999990000@example.com", "", `unknown server "example.com"`},
+	}
+	for _, tt := range tests {
+		jid, err := parseRecipient(tt.value)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: got %v %v, want error with %q", tt.value, jid, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || jid.String() != tt.want {
+			t.Errorf("%q: got %v %v, want %s", tt.value, jid, err, tt.want)
+		}
+	}
+}
+
+func TestResolveRecipientError(t *testing.T) {
+	// Without a session the parsed JID is used as is
+	jid, err := resolveRecipient(nil, "Phone", "+55 (11) 99999-0000")
+	if err != nil || jid != types.NewJID("5511999990000", types.DefaultUserServer) {
+		t.Errorf("got %v %v", jid, err)
+	}
+
+	_, err = resolveRecipient(nil, "Phone", "12ab")
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("got %v, want an apiError", err)
+	}
+	if apiErr.Code != ErrInvalidJID || apiErr.Details["field"] != "Phone" || !strings.HasPrefix(apiErr.Message, "Invalid Phone: ") {
+		t.Errorf("unexpected error %+v", apiErr)
+	}
+}
+
+func TestParseGroupJID(t *testing.T) {
+	if jid, err := parseGroupJID("GroupJID", "120363025246125486@g.us"); err != nil || jid.Server != types.GroupServer {
+		t.Errorf("got %v %v", jid, err)
+	}
+	for _, value := range []string{"120363025246125486", "5511999990000@s.whatsapp.net", "status@broadcast"} {
+		_, err := parseGroupJID("GroupJID", value)
+		var apiErr *apiError
+		if !errors.As(err, &apiErr) || apiErr.Code != ErrInvalidJID || apiErr.Details["field"] != "GroupJID" {
+			t.Errorf("%q: got %v, want an INVALID_JID error", value, err)
+		}
+	}
+}
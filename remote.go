@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const remoteFetchTimeout = 15 * time.Second
+
+var remoteHTTPClient = &http.Client{Timeout: remoteFetchTimeout, Transport: newRemoteTransport()}
+
+// Transport of media downloads. With -webhook-block-private connections to
+// private addresses are refused as for webhooks, users could otherwise have
+// the server fetch internal hosts. The flag is read on each dial, it isn't
+// parsed yet when the client is made.
+func newRemoteTransport() *http.Transport {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	guarded := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: refusePrivateAddress}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if *webhookNoPrivate {
+			return guarded.DialContext(ctx, network, address)
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+	return transport
+}
+
+// Downloads media given by URL instead of inline, only https unless started
+// with -insecureurls, and no bigger than limit bytes. what names the media
+// in error messages.
+func fetchRemote(rawURL string, what string, limit int64) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid %s URL", what)
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && *insecureURLs) {
+		return nil, fmt.Errorf("%s URL must be https", what)
+	}
+	resp, err := remoteHTTPClient.Get(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("could not download %s: %w", what, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not download %s: %s", what, resp.Status)
+	}
+	if resp.ContentLength > limit {
+		return nil, newAPIError(ErrPayloadTooLarge, fmt.Sprintf("%s download too large, the limit is %d KB", what, limit/1024), map[string]interface{}{"limit": limit})
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not download %s: %w", what, err)
+	}
+	if int64(len(data)) > limit {
+		return nil, newAPIError(ErrPayloadTooLarge, fmt.Sprintf("%s download too large, the limit is %d KB", what, limit/1024), map[string]interface{}{"limit": limit})
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty " + what + " download")
+	}
+	return data, nil
+}
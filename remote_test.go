@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchRemoteBlocksPrivate(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("instance credentials"))
+	}))
+	defer internal.Close()
+	defer func(insecure, block bool) { *insecureURLs, *webhookNoPrivate = insecure, block }(*insecureURLs, *webhookNoPrivate)
+	*insecureURLs = true
+
+	*webhookNoPrivate = false
+	if data, err := fetchRemote(internal.URL+"/latest/meta-data", "image", 1024); err != nil || string(data) != "instance credentials" {
+		t.Fatalf("fetch without -webhook-block-private: got %q %v", data, err)
+	}
+
+	*webhookNoPrivate = true
+	// A fresh connection each time, the one above may still be kept alive
+	remoteHTTPClient.CloseIdleConnections()
+	data, err := fetchRemote(internal.URL+"/latest/meta-data", "image", 1024)
+	if err == nil || !strings.Contains(err.Error(), "is private") {
+		t.Errorf("loopback fetched with -webhook-block-private: got %q %v", data, err)
+	}
+}
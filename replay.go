@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Most events /events/replay answers with at once
+const replayMaxLimit = 1000
+
+// Event kept for /events/replay, the JSON streams get
+type replayEvent struct {
+	Seq   uint64
+	Type  string
+	Time  time.Time
+	Event json.RawMessage
+}
+
+// Recent events of a user, the oldest overwritten once full. seq counts all
+// events dispatched since the server started, so gaps show.
+type replayRing struct {
+	seq    uint64
+	events []replayEvent
+	next   int
+}
+
+// Ring buffers of -replay-buffer events per user, in memory only: they
+// bridge a webhook receiver being down, not a server restart
+type replayBuffer struct {
+	sync.Mutex
+	users map[int]*replayRing
+}
+
+var replay = &replayBuffer{users: make(map[int]*replayRing)}
+
+// Numbers an event and keeps it, setting its seq in postmap so webhooks and
+// streams carry it too
+func (b *replayBuffer) record(userID int, postmap map[string]interface{}) {
+	b.Lock()
+	defer b.Unlock()
+	ring := b.users[userID]
+	if ring == nil {
+		ring = &replayRing{}
+		b.users[userID] = ring
+	}
+	ring.seq++
+	postmap["seq"] = ring.seq
+	if *replaySize <= 0 {
+		return
+	}
+	payload, err := json.Marshal(postmap)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not marshal event for replay")
+		return
+	}
+	eventType, _ := postmap["type"].(string)
+	event := replayEvent{Seq: ring.seq, Type: eventType, Time: time.Now(), Event: payload}
+	if len(ring.events) < *replaySize {
+		ring.events = append(ring.events, event)
+		return
+	}
+	ring.events[ring.next] = event
+	ring.next = (ring.next + 1) % len(ring.events)
+}
+
+// Kept events after seq or, with a zero seq, from since on, oldest first,
+// along with the oldest seq kept and the last one given
+func (b *replayBuffer) since(userID int, seq uint64, since time.Time) ([]replayEvent, uint64, uint64) {
+	b.Lock()
+	defer b.Unlock()
+	ring := b.users[userID]
+	if ring == nil {
+		return nil, 0, 0
+	}
+	var found []replayEvent
+	var oldest uint64
+	for i := range ring.events {
+		event := ring.events[(ring.next+i)%len(ring.events)]
+		if oldest == 0 {
+			oldest = event.Seq
+		}
+		if (seq > 0 && event.Seq > seq) || (seq == 0 && !event.Time.Before(since)) {
+			found = append(found, event)
+		}
+	}
+	return found, oldest, ring.seq
+}
+
+// Drops the events of a deleted user
+func (b *replayBuffer) forget(userID int) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.users, userID)
+}
+
+// Events kept after ?since=, a seq already received or an RFC 3339 time. Gap
+// tells events in between were lost: overwritten in the buffer, or the
+// server restarted and numbers began again.
+func (s *server) ReplayEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		if *replaySize <= 0 {
+			s.Respond(w, r, http.StatusForbidden, errors.New("Event replay is disabled, start the server with -replay-buffer to enable it"))
+			return
+		}
+
+		param := r.URL.Query().Get("since")
+		if param == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing since parameter"))
+			return
+		}
+		var seq uint64
+		var since time.Time
+		if strings.Contains(param, "T") {
+			t, err := time.Parse(time.RFC3339, param)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid since parameter, must be a seq or an RFC 3339 time"))
+				return
+			}
+			since = t
+		} else {
+			n, err := strconv.ParseUint(param, 10, 64)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid since parameter, must be a seq or an RFC 3339 time"))
+				return
+			}
+			seq = n
+		}
+
+		limit := 100
+		if param := r.URL.Query().Get("limit"); param != "" {
+			value, err := strconv.Atoi(param)
+			if err != nil || value < 1 || value > replayMaxLimit {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid limit parameter, must be 1 to "+strconv.Itoa(replayMaxLimit)))
+				return
+			}
+			limit = value
+		}
+		var types []string
+		if param := r.URL.Query().Get("types"); param != "" {
+			types = strings.Split(param, ",")
+		}
+
+		found, oldest, latest := replay.since(userid, seq, since)
+		gap := seq > 0 && oldest > seq+1
+		if seq > latest {
+			// Numbers began again since, all kept events are new
+			gap = true
+			found, oldest, latest = replay.since(userid, 0, time.Time{})
+		}
+		events := []replayEvent{}
+		more := false
+		for _, event := range found {
+			if len(types) > 0 && !Find(types, event.Type) {
+				continue
+			}
+			if len(events) == limit {
+				more = true
+				break
+			}
+			events = append(events, event)
+		}
+		// Where the next call picks up, events filtered out are skipped
+		next := latest
+		if more {
+			next = events[len(events)-1].Seq
+		}
+
+		response := map[string]interface{}{"Events": events, "Oldest": oldest, "Latest": latest, "Next": next, "More": more, "Gap": gap}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// WhatsApp clears the typing indicator by itself after a while, it is sent
+// again this often while the bot is "typing"
+const replyBotRefresh = 10 * time.Second
+
+// Limits for the Duration of /chat/replybot/online, in seconds
+const (
+	replyBotDefaultDuration = 10
+	replyBotMaxDuration     = 120
+)
+
+// Presence the session goes back to once no chat is being replied to, ""
+// leaves it as it is
+var replyBotReverts = map[string]types.Presence{
+	"unavailable": types.PresenceUnavailable,
+	"available":   types.PresenceAvailable,
+	"none":        "",
+}
+
+type replyTimer struct {
+	stop       chan struct{}
+	revert     types.Presence
+	superseded bool
+}
+
+// Chats each user is shown typing in. Every chat has its own timer, the
+// presence is only reverted when the last of them ends.
+type replyBotRegistry struct {
+	sync.Mutex
+	chats map[int]map[types.JID]*replyTimer
+}
+
+var replyBots = &replyBotRegistry{chats: make(map[int]map[types.JID]*replyTimer)}
+
+// Shows the session online and typing in chat for duration. A call for a
+// chat already typing restarts its timer.
+func (b *replyBotRegistry) start(userID int, client *whatsmeow.Client, chat types.JID, duration time.Duration, revert types.Presence) error {
+	if err := client.SendPresence(types.PresenceAvailable); err != nil {
+		return err
+	}
+	if err := client.SendChatPresence(chat, types.ChatPresenceComposing, ""); err != nil {
+		return err
+	}
+
+	t := &replyTimer{stop: make(chan struct{}), revert: revert}
+	b.Lock()
+	if b.chats[userID] == nil {
+		b.chats[userID] = make(map[types.JID]*replyTimer)
+	}
+	if old := b.chats[userID][chat]; old != nil {
+		old.superseded = true
+		close(old.stop)
+	}
+	b.chats[userID][chat] = t
+	b.Unlock()
+
+	go b.run(userID, client, chat, t, duration)
+	return nil
+}
+
+// Stops typing in a chat once a message was sent to it, the message already
+// cleared the indicator
+func (b *replyBotRegistry) replied(userID int, chat types.JID) {
+	b.Lock()
+	defer b.Unlock()
+	if t := b.chats[userID][chat]; t != nil {
+		delete(b.chats[userID], chat)
+		close(t.stop)
+	}
+}
+
+func (b *replyBotRegistry) run(userID int, client *whatsmeow.Client, chat types.JID, t *replyTimer, duration time.Duration) {
+	refresh := time.NewTicker(replyBotRefresh)
+	defer refresh.Stop()
+	deadline := time.NewTimer(duration)
+	defer deadline.Stop()
+
+	timedOut := false
+	for !timedOut {
+		select {
+		case <-refresh.C:
+			if err := client.SendChatPresence(chat, types.ChatPresenceComposing, ""); err != nil {
+				log.Warn().Err(err).Str("userid", strconv.Itoa(userID)).Str("chat", chat.String()).Msg("Could not refresh typing indicator")
+			}
+		case <-deadline.C:
+			timedOut = true
+		case <-t.stop:
+			b.finish(userID, client, chat, t, false)
+			return
+		}
+	}
+	b.finish(userID, client, chat, t, true)
+}
+
+func (b *replyBotRegistry) finish(userID int, client *whatsmeow.Client, chat types.JID, t *replyTimer, timedOut bool) {
+	b.Lock()
+	if b.chats[userID][chat] == t {
+		delete(b.chats[userID], chat)
+	}
+	remaining := len(b.chats[userID])
+	if remaining == 0 {
+		delete(b.chats, userID)
+	}
+	superseded := t.superseded
+	b.Unlock()
+
+	if superseded {
+		return
+	}
+	if timedOut {
+		if err := client.SendChatPresence(chat, types.ChatPresencePaused, ""); err != nil {
+			log.Warn().Err(err).Str("userid", strconv.Itoa(userID)).Str("chat", chat.String()).Msg("Could not clear typing indicator")
+		}
+	}
+	if remaining == 0 && t.revert != "" {
+		if err := client.SendPresence(t.revert); err != nil {
+			log.Warn().Err(err).Str("userid", strconv.Itoa(userID)).Msg("Could not revert presence")
+		}
+	}
+}
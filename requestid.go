@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/rs/xid"
+)
+
+type requestIDKey struct{}
+
+// Longest X-Request-ID taken from callers, longer ones are replaced
+const maxRequestIDLength = 128
+
+// Tells whether a caller supplied request id is safe to log and echo back
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Middleware: Gives every request an id, the caller's X-Request-ID when valid
+// or a new one. It is returned in the response headers and carried by the
+// request logger (hlog.FromRequest), error responses and the events the
+// request causes.
+func (s *server) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = xid.New().String()
+		}
+		w.Header().Set("X-Request-ID", id)
+		// Name used before X-Request-ID, kept for existing clients
+		w.Header().Set("Request-Id", id)
+
+		logger := log.With().Str("req_id", id).Logger()
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		next.ServeHTTP(w, r.WithContext(logger.WithContext(ctx)))
+	})
+}
+
+// Id given to the request by the requestID middleware
+func requestIDFrom(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
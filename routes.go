@@ -1,13 +1,12 @@
 package main
 
 import (
+	"github.com/gorilla/mux"
 	"github.com/justinas/alice"
-	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
 	"net/http"
 	"os"
 	"path/filepath"
-	"time"
 )
 
 type Middleware = alice.Constructor
@@ -20,78 +19,181 @@ func (s *server) routes() {
     }
     exPath := filepath.Dir(ex)
 
-	if *logType == "json" {
-		log = zerolog.New(os.Stdout).With().Timestamp().Str("role", filepath.Base(os.Args[0])).Str("host", *address).Logger()
-	} else {
-		output := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339, NoColor: !*colorOutput}
-		log = zerolog.New(output).With().Timestamp().Str("role", filepath.Base(os.Args[0])).Str("host", *address).Logger()
+	// The logger configure built, with its level and error report hook
+	log = log.With().Str("host", *address).Logger()
+
+    // Unauthenticated probes for orchestrators, they only report counts
+    s.router.Handle("/health", s.Health()).Methods("GET")
+    s.router.Handle("/ready", s.Ready()).Methods("GET")
+    s.router.Handle("/openapi.json", s.OpenAPI()).Methods("GET")
+    s.router.Handle("/version", s.Version()).Methods("GET")
+
+	// API routes are served under /v1. With -legacy-routes the same handlers
+	// also answer on the old unprefixed paths, marked as deprecated.
+	handleOn := func(router *mux.Router, path string, handler http.Handler, method string) {
+		router.Handle("/"+apiVersion+path, handler).Methods(method)
+		if *legacyRoutes {
+			router.Handle(path, deprecated(handler)).Methods(method)
+		}
+	}
+	handle := func(path string, handler http.Handler, method string) {
+		handleOn(s.router, path, handler, method)
 	}
 
-    adminRoutes := s.router.PathPrefix("/admin").Subrouter()
-    adminRoutes.Use(s.authadmin)
-    adminRoutes.Handle("/users", s.ListUsers()).Methods("GET")
-    adminRoutes.Handle("/users", s.AddUser()).Methods("POST")
-    adminRoutes.Handle("/users/{id}", s.DeleteUser()).Methods("DELETE")
+	// Admin routes go under -admin-prefix, on their own listener with
+	// -admin-port. The admin token is still required there.
+	handleAdmin := func(path string, handler http.Handler, method string) {
+		handleOn(s.adminRouter, *adminPrefix+path, handler, method)
+	}
+
+	a := alice.New(s.limitBody, s.authadmin)
+	handleAdmin("/users", a.Then(s.ListUsers()), "GET")
+	handleAdmin("/users", a.Then(s.AddUser()), "POST")
+	handleAdmin("/users/{id}", a.Then(s.UpdateUser()), "PUT")
+	handleAdmin("/users/{id}", a.Then(s.DeleteUser()), "DELETE")
+	handleAdmin("/users/{id}/rotatetoken", a.Then(s.RotateToken()), "POST")
+	handleAdmin("/users/{id}/rotate-token", a.Then(s.RotateToken()), "POST")
+	handleAdmin("/users/{id}/expiration", a.Then(s.SetExpiration()), "PUT")
+	handleAdmin("/users/{id}/usage", a.Then(s.GetUsage()), "GET")
+	handleAdmin("/users/{id}/reconnect", a.Then(s.ReconnectUser()), "POST")
+	handleAdmin("/users/{id}/export", a.Then(s.ExportUser()), "GET")
+	// Session exports carry the whole device store, they get -max-import-bytes
+	handleAdmin("/users/import", alice.New(s.limitBodyTo(maxImportBytes), s.authadmin).Then(s.ImportUser()), "POST")
+	handleAdmin("/devices/sweep", a.Then(s.SweepDevices()), "POST")
+	handleAdmin("/maintenance/vacuum", a.Then(s.VacuumDatabases()), "POST")
+	handleAdmin("/store/stats", a.Then(s.GetStoreStats()), "GET")
+	handleAdmin("/users/{id}/loglevel", a.Then(s.SetUserLogLevel()), "POST")
+	handleAdmin("/users/{id}/loglevel", a.Then(s.SetUserLogLevel()), "PUT")
+	handleAdmin("/loglevels", a.Then(s.ListLogLevels()), "GET")
+	handleAdmin("/stats", a.Then(s.GetStats()), "GET")
+	handleAdmin("/globalwebhook", a.Then(s.GetGlobalWebhook()), "GET")
+	handleAdmin("/globalwebhook", a.Then(s.SetGlobalWebhook()), "PUT")
+	// Profiling and runtime state, never served unless asked for
+	if *enableDebug {
+		for route, doc := range debugAPIDocs {
+			apiDocs[route] = doc
+		}
+		handleAdmin("/debug/pprof/", a.Then(s.PprofIndex()), "GET")
+		handleAdmin("/debug/pprof/{profile}", a.Then(s.PprofProfile()), "GET")
+		handleAdmin("/debug/pprof/symbol", a.Then(s.PprofProfile()), "POST")
+		handleAdmin("/debug/goroutines", a.Then(s.DebugGoroutines()), "GET")
+		handleAdmin("/debug/gc", a.Then(s.DebugGC()), "POST")
+	}
 
 	c := alice.New()
+	c = c.Append(s.limitBody)
 	c = c.Append(s.authalice)
-	c = c.Append(hlog.NewHandler(log))
-
-	c = c.Append(hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
-		hlog.FromRequest(r).Info().
-			Str("method", r.Method).
-			Stringer("url", r.URL).
-			Int("status", status).
-			Int("size", size).
-			Dur("duration", duration).
-			Str("userid", r.Context().Value("userinfo").(Values).Get("Id")).
-			Msg("Got API Request")
-	}))
+
 	c = c.Append(hlog.RemoteAddrHandler("ip"))
 	c = c.Append(hlog.UserAgentHandler("user_agent"))
 	c = c.Append(hlog.RefererHandler("referer"))
-	c = c.Append(hlog.RequestIDHandler("req_id", "Request-Id"))
-
-	s.router.Handle("/session/connect", c.Then(s.Connect())).Methods("POST")
-	s.router.Handle("/session/disconnect", c.Then(s.Disconnect())).Methods("POST")
-	s.router.Handle("/session/logout", c.Then(s.Logout())).Methods("POST")
-	s.router.Handle("/session/status", c.Then(s.GetStatus())).Methods("GET")
-	s.router.Handle("/session/qr", c.Then(s.GetQR())).Methods("GET")
-	s.router.Handle("/session/pairphone", c.Then(s.PairPhone())).Methods("POST")
-
-	s.router.Handle("/webhook", c.Then(s.SetWebhook())).Methods("POST")
-	s.router.Handle("/webhook", c.Then(s.GetWebhook())).Methods("GET")
-
-	s.router.Handle("/chat/send/text", c.Then(s.SendMessage())).Methods("POST")
-	s.router.Handle("/chat/send/image", c.Then(s.SendImage())).Methods("POST")
-	s.router.Handle("/chat/send/audio", c.Then(s.SendAudio())).Methods("POST")
-	s.router.Handle("/chat/send/document", c.Then(s.SendDocument())).Methods("POST")
-//	s.router.Handle("/chat/send/template", c.Then(s.SendTemplate())).Methods("POST")
-	s.router.Handle("/chat/send/video", c.Then(s.SendVideo())).Methods("POST")
-	s.router.Handle("/chat/send/sticker", c.Then(s.SendSticker())).Methods("POST")
-	s.router.Handle("/chat/send/location", c.Then(s.SendLocation())).Methods("POST")
-	s.router.Handle("/chat/send/contact", c.Then(s.SendContact())).Methods("POST")
-	s.router.Handle("/chat/react", c.Then(s.React())).Methods("POST")
-	s.router.Handle("/chat/send/buttons",     c.Then(s.SendButtons())).Methods("POST")
-	s.router.Handle("/chat/send/list",     c.Then(s.SendList())).Methods("POST")
-
-	s.router.Handle("/user/info", c.Then(s.GetUser())).Methods("POST")
-	s.router.Handle("/user/check", c.Then(s.CheckUser())).Methods("POST")
-	s.router.Handle("/user/avatar", c.Then(s.GetAvatar())).Methods("POST")
-	s.router.Handle("/user/contacts", c.Then(s.GetContacts())).Methods("GET")
-
-	s.router.Handle("/chat/presence", c.Then(s.ChatPresence())).Methods("POST")
-	s.router.Handle("/chat/markread", c.Then(s.MarkRead())).Methods("POST")
-	s.router.Handle("/chat/downloadimage", c.Then(s.DownloadImage())).Methods("POST")
-	s.router.Handle("/chat/downloadvideo", c.Then(s.DownloadVideo())).Methods("POST")
-	s.router.Handle("/chat/downloadaudio", c.Then(s.DownloadAudio())).Methods("POST")
-	s.router.Handle("/chat/downloaddocument", c.Then(s.DownloadDocument())).Methods("POST")
-
-	s.router.Handle("/group/list", c.Then(s.ListGroups())).Methods("GET")
-	s.router.Handle("/group/info", c.Then(s.GetGroupInfo())).Methods("GET")
-	s.router.Handle("/group/invitelink", c.Then(s.GetGroupInviteLink())).Methods("GET")
-	s.router.Handle("/group/photo", c.Then(s.SetGroupPhoto())).Methods("POST")
-	s.router.Handle("/group/name", c.Then(s.SetGroupName())).Methods("POST")
+
+	// Sending counts towards the user's daily quota
+	q := c.Append(s.sendQuota)
+	// Message sends can hold the response until a receipt, ?wait=
+	m := q.Append(s.checkReceiptWait)
+
+	handle("/session/connect", c.Then(s.Connect()), "POST")
+	handle("/session/disconnect", c.Then(s.Disconnect()), "POST")
+	handle("/session/logout", c.Then(s.Logout()), "POST")
+	handle("/session/status", c.Then(s.GetStatus()), "GET")
+	handle("/session/qr", c.Then(s.GetQR()), "GET")
+	handle("/session/qr.png", c.Then(s.GetQRImage()), "GET")
+	handle("/session/pairphone", c.Then(s.PairPhone()), "POST")
+	handle("/session/proxy", c.Then(s.SetProxy()), "POST")
+	handle("/session/loglevel", c.Then(s.SetLogLevel()), "POST")
+	handle("/session/events", c.Then(s.SessionEvents()), "GET")
+	handle("/session/profile/name", c.Then(s.SetProfileName()), "PUT")
+	handle("/session/profile/picture", c.Append(s.limitUpload("picture")).Then(s.SetProfilePicture()), "PUT")
+	handle("/session/profile/picture", c.Then(s.DeleteProfilePicture()), "DELETE")
+	handle("/session/privacy", c.Then(s.GetPrivacy()), "GET")
+	handle("/session/devices", c.Then(s.GetDevices()), "GET")
+	handle("/session/deviceinfo", c.Then(s.GetDeviceInfo()), "GET")
+	handle("/session/privacy", c.Then(s.SetPrivacy()), "PUT")
+
+	handle("/ws", c.Then(s.EventStream()), "GET")
+	handle("/events/replay", c.Then(s.ReplayEvents()), "GET")
+
+	handle("/webhook", c.Then(s.SetWebhook()), "POST")
+	handle("/webhook", c.Then(s.GetWebhook()), "GET")
+	handle("/webhook/test", c.Then(s.TestWebhook()), "POST")
+
+	handle("/chat/send/text", m.Then(s.SendMessage()), "POST")
+	handle("/chat/send/image", m.Append(s.limitUpload("image")).Then(s.SendImage()), "POST")
+	handle("/chat/send/audio", m.Append(s.limitUpload("audio")).Then(s.SendAudio()), "POST")
+	handle("/chat/send/document", m.Append(s.limitUpload("document")).Then(s.SendDocument()), "POST")
+//	handle("/chat/send/template", c.Then(s.SendTemplate()), "POST")
+	handle("/chat/send/video", m.Append(s.limitUpload("video")).Then(s.SendVideo()), "POST")
+	handle("/chat/send/sticker", m.Append(s.limitUpload("sticker")).Then(s.SendSticker()), "POST")
+	handle("/chat/send/location", m.Then(s.SendLocation()), "POST")
+	handle("/chat/send/contact", m.Then(s.SendContact()), "POST")
+	handle("/chat/react", q.Then(s.React()), "POST")
+	handle("/chat/send/buttons", m.Then(s.SendButtons()), "POST")
+	handle("/chat/send/list", m.Then(s.SendList()), "POST")
+	handle("/chat/send/proto", m.Then(s.SendProto()), "POST")
+	handle("/chat/send/broadcast", q.Then(s.SendBroadcast()), "POST")
+
+	handle("/broadcast/list", c.Then(s.CreateBroadcastList()), "POST")
+	handle("/broadcast/list", c.Then(s.ListBroadcastLists()), "GET")
+	handle("/broadcast/list/{name}", c.Then(s.GetBroadcastList()), "GET")
+	handle("/broadcast/list/{name}", c.Then(s.UpdateBroadcastList()), "PUT")
+	handle("/broadcast/list/{name}", c.Then(s.DeleteBroadcastList()), "DELETE")
+
+	handle("/user/info", c.Then(s.GetUser()), "POST")
+	handle("/user/check", c.Then(s.CheckUser()), "POST")
+	handle("/user/avatar", c.Then(s.GetAvatar()), "POST")
+	handle("/user/contacts", c.Then(s.GetContacts()), "GET")
+	handle("/user/lid", c.Then(s.GetLID()), "GET")
+	handle("/user/jid", c.Then(s.GetJID()), "GET")
+	handle("/user/businessprofile", c.Then(s.GetBusinessProfile()), "GET")
+	handle("/user/businessprofile", c.Then(s.GetBusinessProfiles()), "POST")
+	handle("/user/presence/subscribe", c.Then(s.SubscribePresence()), "POST")
+
+	handle("/chat/presence", c.Then(s.ChatPresence()), "POST")
+	handle("/chat/replybot/online", c.Then(s.ReplyBotOnline()), "POST")
+	handle("/chat/markread", c.Then(s.MarkRead()), "POST")
+	handle("/chat/ephemeral", c.Then(s.SetChatEphemeral()), "PUT")
+	handle("/chat/archive", c.Then(s.ArchiveChat()), "POST")
+	handle("/chat/pin", c.Then(s.PinChat()), "POST")
+	handle("/chat/mute", c.Then(s.MuteChat()), "POST")
+	handle("/chat/downloadimage", c.Then(s.DownloadImage()), "POST")
+	handle("/chat/downloadvideo", c.Then(s.DownloadVideo()), "POST")
+	handle("/chat/downloadaudio", c.Then(s.DownloadAudio()), "POST")
+	handle("/chat/downloaddocument", c.Then(s.DownloadDocument()), "POST")
+	handle("/chat/messages", c.Then(s.ListMessages()), "GET")
+	handle("/chat/messages/{id}", c.Then(s.GetMessage()), "GET")
+	handle("/chat/status/{id}", c.Then(s.GetMessageStatus()), "GET")
+	handle("/chat/messageinfo", c.Then(s.GetMessageInfo()), "GET")
+	handle("/chat/history", c.Then(s.GetHistory()), "GET")
+	handle("/chat/history", c.Then(s.RequestHistory()), "POST")
+	handle("/chat/history/sync", c.Then(s.RequestHistory()), "POST")
+	handle("/chats", c.Then(s.ListChats()), "GET")
+
+	handle("/call/reject", c.Then(s.RejectCall()), "POST")
+	handle("/call/autoreject", c.Then(s.SetCallAutoReject()), "POST")
+
+	handle("/group/list", c.Then(s.ListGroups()), "GET")
+	handle("/group/info", c.Then(s.GetGroupInfo()), "GET")
+	handle("/group/invitelink", c.Then(s.GetGroupInviteLink()), "GET")
+	handle("/group/photo", c.Append(s.limitUpload("picture")).Then(s.SetGroupPhoto()), "POST")
+	handle("/group/name", c.Then(s.SetGroupName()), "POST")
+	handle("/group/settings", c.Then(s.SetGroupSettings()), "POST")
+	handle("/group/requests", c.Then(s.GetGroupRequests()), "GET")
+	handle("/group/requests", c.Then(s.UpdateGroupRequests()), "POST")
+
+	handle("/newsletter/list", c.Then(s.ListNewsletters()), "GET")
+	handle("/newsletter/info", c.Then(s.GetNewsletterInfo()), "GET")
+	handle("/newsletter/follow", c.Then(s.FollowNewsletter(true)), "POST")
+	handle("/newsletter/unfollow", c.Then(s.FollowNewsletter(false)), "POST")
+	handle("/newsletter/send", q.Append(s.limitUpload("video")).Then(s.SendNewsletter()), "POST")
+
+	// Onboarding page, it goes through the API like any client
+	s.router.Handle("/dashboard", s.Dashboard(true, s.adminRouter == s.router)).Methods("GET")
+	if s.adminRouter != s.router {
+		s.adminRouter.Handle("/dashboard", s.Dashboard(false, true)).Methods("GET")
+	}
 
 	s.router.PathPrefix("/").Handler(http.FileServer(http.Dir(exPath+"/static/")))
+
+	s.checkAPIDocs()
 }
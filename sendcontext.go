@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Status nginx answers requests the caller gave up on with, net/http has no
+// name for it
+const statusClientClosedRequest = 499
+
+// Context for the uploads and sends of a request: canceled when the caller
+// goes away and bounded by -send-timeout, so abandoned requests don't keep
+// whatsmeow working
+func sendContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if *sendTimeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), *sendTimeout)
+}
+
+// Error for a failed upload or send, answered with 502, or what ended ctx
+// when it did so callers get 499 or 504 instead of whatsmeow's error
+func sendError(ctx context.Context, message string, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return newAPIError(ErrSendTimeout, fmt.Sprintf("%s: timed out after %s", message, *sendTimeout), nil)
+	case context.Canceled:
+		return newAPIError(ErrRequestCanceled, message+": request canceled", nil)
+	}
+	return newAPIError(ErrUpstreamFailed, fmt.Sprintf("%s: %v", message, err), nil)
+}
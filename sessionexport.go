@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// whatsmeow tables holding device data, along with the column that ties
+// each row to the device JID. The device table must come first as the
+// others reference it.
+var storeTables = []struct {
+	Name   string
+	JIDCol string
+}{
+	{"whatsmeow_device", "jid"},
+	{"whatsmeow_identity_keys", "our_jid"},
+	{"whatsmeow_pre_keys", "jid"},
+	{"whatsmeow_sessions", "our_jid"},
+	{"whatsmeow_sender_keys", "our_jid"},
+	{"whatsmeow_app_state_sync_keys", "jid"},
+	{"whatsmeow_app_state_version", "jid"},
+	{"whatsmeow_app_state_mutation_macs", "jid"},
+	{"whatsmeow_contacts", "our_jid"},
+	{"whatsmeow_chat_settings", "our_jid"},
+	{"whatsmeow_message_secrets", "our_jid"},
+	{"whatsmeow_privacy_tokens", "our_jid"},
+}
+
+const sessionExportVersion = 1
+
+// Column value keeping its SQLite storage class, so blobs are not
+// restored as text
+type exportValue struct {
+	Blob []byte   `json:"b,omitempty"`
+	Text *string  `json:"t,omitempty"`
+	Int  *int64   `json:"i,omitempty"`
+	Real *float64 `json:"r,omitempty"`
+}
+
+// Users row of an export. Fields after Events were added later, exports
+// made before them just leave them at their defaults.
+type exportUser struct {
+	Name               string
+	Token              string
+	Webhook            string
+	Jid                string
+	Expiration         int64
+	Events             string
+	ProxyURL           string
+	StoreMessages      bool
+	RejectCalls        bool
+	RejectCallsMessage string
+	MaxMessagesPerDay  int
+	DeviceName         string
+	PayloadFormat      string
+	WebhookHeaders     string
+	WebhookTimeout     int
+	WebhookGzip        bool
+	// Nil in exports made before contact_names, which defaults to on
+	ContactNames *bool
+	PairedAt     int64
+}
+
+type sessionExport struct {
+	Version  int
+	Exported int64
+	User     exportUser
+	Tables   map[string][]map[string]exportValue
+}
+
+// Envelope of the encrypted export blob
+type sealedExport struct {
+	Version int
+	Salt    []byte
+	Nonce   []byte
+	Data    []byte
+}
+
+func toExportValue(v interface{}) exportValue {
+	switch t := v.(type) {
+	case nil:
+		return exportValue{}
+	case []byte:
+		b := make([]byte, len(t))
+		copy(b, t)
+		return exportValue{Blob: b}
+	case string:
+		return exportValue{Text: &t}
+	case int64:
+		return exportValue{Int: &t}
+	case float64:
+		return exportValue{Real: &t}
+	case bool:
+		i := int64(0)
+		if t {
+			i = 1
+		}
+		return exportValue{Int: &i}
+	case time.Time:
+		s := t.Format(time.RFC3339Nano)
+		return exportValue{Text: &s}
+	default:
+		s := fmt.Sprintf("%v", t)
+		return exportValue{Text: &s}
+	}
+}
+
+func (e exportValue) value() interface{} {
+	switch {
+	case e.Blob != nil:
+		return e.Blob
+	case e.Text != nil:
+		return *e.Text
+	case e.Int != nil:
+		return *e.Int
+	case e.Real != nil:
+		return *e.Real
+	}
+	return nil
+}
+
+// Reads all store rows belonging to the given device JID
+func exportStoreRows(db *sql.DB, jid string) (map[string][]map[string]exportValue, error) {
+	tables := make(map[string][]map[string]exportValue)
+	for _, table := range storeTables {
+		rows, err := db.Query("SELECT * FROM "+table.Name+" WHERE "+table.JIDCol+"=?", jid)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", table.Name, err)
+		}
+		columns, err := rows.Columns()
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		for rows.Next() {
+			values := make([]interface{}, len(columns))
+			pointers := make([]interface{}, len(columns))
+			for i := range values {
+				pointers[i] = &values[i]
+			}
+			if err := rows.Scan(pointers...); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("could not read %s: %w", table.Name, err)
+			}
+			row := make(map[string]exportValue, len(columns))
+			for i, column := range columns {
+				row[column] = toExportValue(values[i])
+			}
+			tables[table.Name] = append(tables[table.Name], row)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", table.Name, err)
+		}
+	}
+	if len(tables["whatsmeow_device"]) == 0 {
+		return nil, errors.New("no device found in store for " + jid)
+	}
+	return tables, nil
+}
+
+type rowsQueryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Columns of a store table as SQLite has them
+func storeColumns(db rowsQueryer, table string) (map[string]bool, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+// Checks the columns of exported rows against the store tables. Their names
+// go into the INSERT statements, one the table doesn't have is refused.
+func checkStoreColumns(db rowsQueryer, tables map[string][]map[string]exportValue) error {
+	for _, table := range storeTables {
+		if len(tables[table.Name]) == 0 {
+			continue
+		}
+		columns, err := storeColumns(db, table.Name)
+		if err != nil {
+			return fmt.Errorf("could not read columns of %s: %w", table.Name, err)
+		}
+		for _, row := range tables[table.Name] {
+			for column := range row {
+				if !columns[column] {
+					return fmt.Errorf("unknown column %q in %s", column, table.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Writes exported store rows inside the given transaction
+func importStoreRows(tx *sql.Tx, tables map[string][]map[string]exportValue) error {
+	if err := checkStoreColumns(tx, tables); err != nil {
+		return err
+	}
+	for _, table := range storeTables {
+		for _, row := range tables[table.Name] {
+			names := make([]string, 0, len(row))
+			for column := range row {
+				names = append(names, column)
+			}
+			sort.Strings(names)
+			columns := ""
+			placeholders := ""
+			args := make([]interface{}, 0, len(row))
+			for _, column := range names {
+				if columns != "" {
+					columns += ","
+					placeholders += ","
+				}
+				columns += `"` + column + `"`
+				placeholders += "?"
+				args = append(args, row[column].value())
+			}
+			_, err := tx.Exec("INSERT OR REPLACE INTO "+table.Name+" ("+columns+") VALUES ("+placeholders+")", args...)
+			if err != nil {
+				return fmt.Errorf("could not restore %s: %w", table.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Replaces the store rows of jid with exported ones in a single transaction
+func restoreStoreRows(db *sql.DB, jid string, tables map[string][]map[string]exportValue) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM whatsmeow_device WHERE jid=?", jid); err == nil {
+		err = importStoreRows(tx, tables)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func exportKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+// Encrypts the export with a key derived from passphrase (scrypt + AES-GCM)
+func sealExport(export *sessionExport, passphrase string) ([]byte, error) {
+	plaintext, err := json.Marshal(export)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	key, err := exportKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := sealedExport{
+		Version: sessionExportVersion,
+		Salt:    salt,
+		Nonce:   nonce,
+		Data:    gcm.Seal(nil, nonce, plaintext, nil),
+	}
+	return json.Marshal(sealed)
+}
+
+// Decrypts an export produced by sealExport
+func openExport(blob []byte, passphrase string) (*sessionExport, error) {
+	var sealed sealedExport
+	if err := json.Unmarshal(blob, &sealed); err != nil {
+		return nil, errors.New("Malformed export data")
+	}
+	if sealed.Version != sessionExportVersion {
+		return nil, fmt.Errorf("Unsupported export version %d", sealed.Version)
+	}
+	key, err := exportKey(passphrase, sealed.Salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("Malformed export data")
+	}
+	plaintext, err := gcm.Open(nil, sealed.Nonce, sealed.Data, nil)
+	if err != nil {
+		return nil, errors.New("Could not decrypt export, wrong passphrase?")
+	}
+	var export sessionExport
+	if err := json.Unmarshal(plaintext, &export); err != nil {
+		return nil, errors.New("Malformed export data")
+	}
+	return &export, nil
+}
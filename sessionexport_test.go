@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestImportStoreRowsRefusesUnknownColumns(t *testing.T) {
+	db := testStoreDB(t)
+	jid := "5491155553934.0:53@s.whatsapp.net"
+	text := func(s string) exportValue { return exportValue{Text: &s} }
+
+	for _, column := range []string{
+		`jid") VALUES ('x'); DROP TABLE whatsmeow_sessions; --`,
+		"no_such_column",
+	} {
+		tables := map[string][]map[string]exportValue{
+			"whatsmeow_device": {{"jid": text(jid), column: text("x")}},
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = importStoreRows(tx, tables)
+		tx.Rollback()
+		if err == nil || !strings.Contains(err.Error(), "unknown column") {
+			t.Errorf("column %q: got %v, want an unknown column error", column, err)
+		}
+		if err := checkStoreColumns(db, tables); err == nil {
+			t.Errorf("column %q: checkStoreColumns accepted it", column)
+		}
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM whatsmeow_sessions").Scan(&count); err != nil {
+		t.Fatalf("whatsmeow_sessions is gone: %v", err)
+	}
+}
+
+func TestCheckStoreColumnsAcceptsStoreSchema(t *testing.T) {
+	db := testStoreDB(t)
+	jid := "5491155553934.0:53@s.whatsapp.net"
+	tables := map[string][]map[string]exportValue{
+		"whatsmeow_device":   {{"jid": {Text: &jid}}},
+		"whatsmeow_contacts": {{"our_jid": {Text: &jid}, "their_jid": {Text: &jid}}},
+	}
+	if err := checkStoreColumns(db, tables); err != nil {
+		t.Fatal(err)
+	}
+}
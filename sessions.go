@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Running (or starting) whatsmeow session of a user. client and mycli are
+// only set once the client is created, read them through the manager.
+type session struct {
+	client       *whatsmeow.Client
+	mycli        *MyClient
+	kill         chan struct{}
+	once         sync.Once
+	reconnecting atomic.Bool
+	replaced     atomic.Bool
+	ready        chan struct{}
+	readyOnce    sync.Once
+	err          error
+}
+
+// Records the outcome of the first connection attempt, err is only safe to
+// read once ready is closed
+func (sess *session) connected(err error) {
+	sess.readyOnce.Do(func() {
+		sess.err = err
+		close(sess.ready)
+	})
+}
+
+// Asks the session goroutine to disconnect, safe to call more than once
+func (sess *session) stop() {
+	sess.once.Do(func() { close(sess.kill) })
+}
+
+// Registry of running sessions, handlers and event code go through it
+// instead of touching the maps directly
+type sessionManager struct {
+	sync.RWMutex
+	sessions map[int]*session
+	closed   bool
+	// Session goroutines that haven't returned yet
+	goroutines sync.WaitGroup
+}
+
+var sessions = &sessionManager{sessions: make(map[int]*session)}
+
+// Registers a new session for the user, returns false when one is already
+// running or starting so double connects are rejected
+func (m *sessionManager) reserve(userID int) (*session, bool) {
+	m.Lock()
+	defer m.Unlock()
+	if m.closed || m.sessions[userID] != nil {
+		return nil, false
+	}
+	sess := &session{kill: make(chan struct{}), ready: make(chan struct{})}
+	m.sessions[userID] = sess
+	m.goroutines.Add(1)
+	return sess, true
+}
+
+// Marks a session goroutine started by reserve as returned
+func (m *sessionManager) finished() {
+	m.goroutines.Done()
+}
+
+// Tells whether the server is shutting down, no sessions start then
+func (m *sessionManager) closing() bool {
+	m.RLock()
+	defer m.RUnlock()
+	return m.closed
+}
+
+// Refuses new sessions and stops the running ones, returns how many there were
+func (m *sessionManager) closeAll() int {
+	m.Lock()
+	m.closed = true
+	running := make([]*session, 0, len(m.sessions))
+	for _, sess := range m.sessions {
+		running = append(running, sess)
+	}
+	m.Unlock()
+	for _, sess := range running {
+		sess.stop()
+	}
+	return len(running)
+}
+
+// Waits for the stopped sessions to disconnect, false if ctx ended first
+func (m *sessionManager) wait(ctx context.Context) bool {
+	return waitGroupContext(ctx, &m.goroutines)
+}
+
+// Sets the client of a reserved session, false if it was stopped meanwhile
+func (m *sessionManager) attach(userID int, sess *session, client *whatsmeow.Client, mycli *MyClient) bool {
+	m.Lock()
+	defer m.Unlock()
+	if m.sessions[userID] != sess {
+		return false
+	}
+	sess.client = client
+	sess.mycli = mycli
+	return true
+}
+
+// Forgets the session, unless it was already replaced by a newer one
+func (m *sessionManager) remove(userID int, sess *session) {
+	m.Lock()
+	defer m.Unlock()
+	if m.sessions[userID] == sess {
+		delete(m.sessions, userID)
+	}
+}
+
+// Signals the user's session to disconnect, false if none is running
+func (m *sessionManager) disconnect(userID int) bool {
+	m.RLock()
+	sess := m.sessions[userID]
+	m.RUnlock()
+	if sess == nil {
+		return false
+	}
+	sess.stop()
+	return true
+}
+
+// Returns the running session the client belongs to, nil if it was stopped
+// or replaced
+func (m *sessionManager) sessionOf(mycli *MyClient) *session {
+	m.RLock()
+	defer m.RUnlock()
+	if sess := m.sessions[mycli.userID]; sess != nil && sess.mycli == mycli {
+		return sess
+	}
+	return nil
+}
+
+func (m *sessionManager) running(userID int) bool {
+	m.RLock()
+	defer m.RUnlock()
+	return m.sessions[userID] != nil
+}
+
+// Returns the user's whatsmeow client, nil if not running or still starting
+func (m *sessionManager) client(userID int) *whatsmeow.Client {
+	m.RLock()
+	defer m.RUnlock()
+	if sess := m.sessions[userID]; sess != nil {
+		return sess.client
+	}
+	return nil
+}
+
+func (m *sessionManager) myClient(userID int) *MyClient {
+	m.RLock()
+	defer m.RUnlock()
+	if sess := m.sessions[userID]; sess != nil {
+		return sess.mycli
+	}
+	return nil
+}
+
+// Reports whether the user's client is connected and logged in
+func (m *sessionManager) status(userID int) (connected bool, loggedIn bool) {
+	client := m.client(userID)
+	if client == nil {
+		return false, false
+	}
+	return client.IsConnected(), client.IsLoggedIn()
+}
+
+// Live state of the user's client: connected, pairing (connected but not
+// logged in) or disconnected
+func (m *sessionManager) state(userID int) string {
+	connected, loggedIn := m.status(userID)
+	switch {
+	case connected && loggedIn:
+		return "connected"
+	case connected:
+		return "pairing"
+	}
+	return "disconnected"
+}
+
+// Snapshot of the clients currently running
+func (m *sessionManager) clients() map[int]*whatsmeow.Client {
+	m.RLock()
+	defer m.RUnlock()
+	clients := make(map[int]*whatsmeow.Client, len(m.sessions))
+	for userID, sess := range m.sessions {
+		if sess.client != nil {
+			clients[userID] = sess.client
+		}
+	}
+	return clients
+}
+
+// Users whose client is connected and logged in
+func (m *sessionManager) connectedIDs() []int {
+	var ids []int
+	for userID, client := range m.clients() {
+		if client.IsConnected() && client.IsLoggedIn() {
+			ids = append(ids, userID)
+		}
+	}
+	return ids
+}
+
+// Waits for wg, false if ctx ended first
+func waitGroupContext(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
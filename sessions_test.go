@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// A user with a webhook receiver and cached user info, as after a request
+// authenticated with token
+func testUser(t *testing.T, s *server, token string) int {
+	t.Helper()
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(receiver.Close)
+	id, err := insertUser(s.db, newUser{Name: token, Token: token, Webhook: receiver.URL, Events: "All", PayloadFormat: "raw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.refreshUserInfo(strconv.FormatInt(id, 10), "")
+	return int(id)
+}
+
+// A request to a user route, with the user info the auth middleware sets
+func userRequest(t *testing.T, token string, method string, path string, body string) *http.Request {
+	t.Helper()
+	v, found := userinfocache.Get(token)
+	if !found {
+		t.Fatalf("no user info cached for %s", token)
+	}
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	return r.WithContext(context.WithValue(r.Context(), "userinfo", v))
+}
+
+// Admin edits, webhook changes and events of the running session touch the
+// same user info, go test -race catches unguarded access
+func TestUserInfoUpdatesWhileRunning(t *testing.T) {
+	s := &server{db: testUsersDB(t)}
+	userID := testUser(t, s, "race-info")
+
+	sess, ok := sessions.reserve(userID)
+	if !ok {
+		t.Fatal("could not reserve session")
+	}
+	mycli := &MyClient{userID: userID, db: s.db, webhooks: newWebhookQueue(userID, newWebhookClient()), token: "race-info", subscriptions: []string{"All"}}
+	defer sessions.finished()
+	defer sessions.remove(userID, sess)
+	defer mycli.webhooks.stop()
+	if !sessions.attach(userID, sess, nil, mycli) {
+		t.Fatal("could not attach session")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			s.refreshUserInfo(strconv.Itoa(userID), "race-info")
+		}()
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			s.SetWebhook()(w, userRequest(t, "race-info", "POST", "/webhook", `{"Timeout":`+strconv.Itoa(i)+`,"Headers":{"X-Test":"1"}}`))
+			if w.Code != http.StatusOK {
+				t.Errorf("SetWebhook answered %d: %s", w.Code, w.Body)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			mycli.sendWebhook(map[string]interface{}{"type": "Presence", "event": map[string]string{}}, "")
+		}()
+	}
+	wg.Wait()
+
+	if got := mycli.getToken(); got != "race-info" {
+		t.Errorf("token %q after updates", got)
+	}
+}
+
+// Connects, disconnects and webhook changes of one user racing each other.
+// The proxy refuses connections, so sessions start and fail without leaving
+// the machine.
+func TestConcurrentConnectDisconnect(t *testing.T) {
+	s := &server{db: testUsersDB(t), storeDb: testStoreDB(t)}
+	saved := container
+	container = sqlstore.NewWithDB(s.storeDb, "sqlite", waLog.Noop)
+	defer func() { container = saved }()
+	userID := testUser(t, s, "race-connect")
+	if _, err := s.db.Exec("UPDATE users SET proxy_url=? WHERE id=?", "http://127.0.0.1:1", userID); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(5)
+		go func() {
+			defer wg.Done()
+			s.connectAndWait(userID, "", "race-connect", []string{"All"})
+		}()
+		go func() {
+			defer wg.Done()
+			sessions.disconnect(userID)
+		}()
+		go func() {
+			defer wg.Done()
+			sessions.state(userID)
+			if mycli := sessions.myClient(userID); mycli != nil {
+				mycli.getSubscriptions()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			s.SetWebhook()(w, userRequest(t, "race-connect", "POST", "/webhook", `{"Gzip":true}`))
+		}()
+		go func() {
+			defer wg.Done()
+			s.refreshUserInfo(strconv.Itoa(userID), "race-connect")
+		}()
+	}
+	wg.Wait()
+
+	sessions.disconnect(userID)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if !sessions.wait(ctx) {
+		t.Fatal("sessions did not stop")
+	}
+	if sessions.running(userID) {
+		t.Error("session still registered after all stopped")
+	}
+	// Nothing is left behind that would keep the user from connecting again
+	if err := s.connectAndWait(userID, "", "race-connect", []string{"All"}); err == nil {
+		t.Error("connect through the refusing proxy succeeded")
+	}
+	if _, ok := getConnectError(userID); !ok {
+		t.Error("refused connection not reported")
+	}
+}
+
+// A store that can't be read fails that user's connect, the process goes on
+func TestConnectWithUnreadableStore(t *testing.T) {
+	s := &server{db: testUsersDB(t)}
+	// No whatsmeow tables, reading the device fails
+	s.storeDb = testUsersDB(t)
+	saved := container
+	container = sqlstore.NewWithDB(s.storeDb, "sqlite", waLog.Noop)
+	defer func() { container = saved }()
+	userID := testUser(t, s, "broken-store")
+
+	if err := s.connectAndWait(userID, "5511999990000.0:3@s.whatsapp.net", "broken-store", []string{"All"}); err == nil {
+		t.Fatal("connect with an unreadable store succeeded")
+	}
+	msg, ok := getConnectError(userID)
+	if !ok || !strings.Contains(msg, "Could not read device from store") {
+		t.Errorf("connect error %q, want the store failure", msg)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if !sessions.wait(ctx) || sessions.running(userID) {
+		t.Error("failed session still registered")
+	}
+}
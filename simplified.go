@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/hex"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Webhook payload formats of the payload_format user setting. raw posts the
+// whatsmeow event as is, simplified maps messages to simplifiedMessage.
+var payloadFormats = []string{"raw", "simplified"}
+
+// Message of a simplified Message webhook. Its shape doesn't depend on the
+// whatsmeow protos, fields that don't apply to the type are left empty.
+type simplifiedMessage struct {
+	ID         string           `json:"id"`
+	Chat       string           `json:"chat"`
+	Sender     string           `json:"sender"`
+	SenderPn   string           `json:"senderPn"`
+	SenderName string           `json:"senderName"`
+	Type       string           `json:"type"`
+	Text       string           `json:"text"`
+	Caption    string           `json:"caption"`
+	Media      *simplifiedMedia `json:"media"`
+	Quoted     *simplifiedQuote `json:"quoted"`
+	Timestamp  int64            `json:"timestamp"`
+	FromMe     bool             `json:"fromMe"`
+	ViewOnce   bool             `json:"viewOnce,omitempty"`
+
+	Location *simplifiedLocation `json:"location,omitempty"`
+	Contacts []simplifiedContact `json:"contacts,omitempty"`
+	// Message reacted to (reaction) or deleted (revoke)
+	Target string `json:"target,omitempty"`
+	// Whole message, only for the unknown type
+	Raw *waProto.Message `json:"raw,omitempty"`
+}
+
+type simplifiedMedia struct {
+	Mimetype string `json:"mimetype"`
+	Size     uint64 `json:"size"`
+	SHA256   string `json:"sha256"`
+	FileName string `json:"fileName,omitempty"`
+}
+
+type simplifiedQuote struct {
+	ID     string `json:"id"`
+	Sender string `json:"sender"`
+}
+
+type simplifiedLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Name      string  `json:"name,omitempty"`
+	Address   string  `json:"address,omitempty"`
+}
+
+type simplifiedContact struct {
+	DisplayName string `json:"displayName"`
+	Vcard       string `json:"vcard"`
+}
+
+// Attachment fields shared by all media messages
+type mediaMessage interface {
+	GetMimetype() string
+	GetFileLength() uint64
+	GetFileSHA256() []byte
+}
+
+func newSimplifiedMedia(media mediaMessage) *simplifiedMedia {
+	return &simplifiedMedia{
+		Mimetype: media.GetMimetype(),
+		Size:     media.GetFileLength(),
+		SHA256:   hex.EncodeToString(media.GetFileSHA256()),
+	}
+}
+
+func newSimplifiedQuote(ctx *waProto.ContextInfo) *simplifiedQuote {
+	if ctx.GetStanzaID() == "" {
+		return nil
+	}
+	return &simplifiedQuote{ID: ctx.GetStanzaID(), Sender: ctx.GetParticipant()}
+}
+
+// Maps a received message to its simplified form
+func simplifyMessage(evt *events.Message) simplifiedMessage {
+	pn, _ := lids.forms(evt.Info.Sender)
+	m := simplifiedMessage{
+		ID:         evt.Info.ID,
+		Chat:       evt.Info.Chat.String(),
+		Sender:     evt.Info.Sender.ToNonAD().String(),
+		SenderPn:   pn,
+		SenderName: evt.Info.PushName,
+		Timestamp:  evt.Info.Timestamp.Unix(),
+		FromMe:     evt.Info.IsFromMe,
+		ViewOnce:   evt.IsViewOnce,
+	}
+
+	msg := evt.Message
+	switch {
+	case msg.GetConversation() != "":
+		m.Type = "text"
+		m.Text = msg.GetConversation()
+	case msg.ExtendedTextMessage != nil:
+		m.Type = "text"
+		m.Text = msg.GetExtendedTextMessage().GetText()
+		m.Quoted = newSimplifiedQuote(msg.GetExtendedTextMessage().GetContextInfo())
+	case msg.ImageMessage != nil:
+		img := msg.GetImageMessage()
+		m.Type = "image"
+		m.Caption = img.GetCaption()
+		m.Media = newSimplifiedMedia(img)
+		m.Quoted = newSimplifiedQuote(img.GetContextInfo())
+	case msg.VideoMessage != nil:
+		video := msg.GetVideoMessage()
+		m.Type = "video"
+		m.Caption = video.GetCaption()
+		m.Media = newSimplifiedMedia(video)
+		m.Quoted = newSimplifiedQuote(video.GetContextInfo())
+	case msg.AudioMessage != nil:
+		audio := msg.GetAudioMessage()
+		m.Type = "audio"
+		m.Media = newSimplifiedMedia(audio)
+		m.Quoted = newSimplifiedQuote(audio.GetContextInfo())
+	case msg.DocumentMessage != nil:
+		document := msg.GetDocumentMessage()
+		m.Type = "document"
+		m.Caption = document.GetCaption()
+		m.Media = newSimplifiedMedia(document)
+		m.Media.FileName = document.GetFileName()
+		m.Quoted = newSimplifiedQuote(document.GetContextInfo())
+	case msg.StickerMessage != nil:
+		sticker := msg.GetStickerMessage()
+		m.Type = "sticker"
+		m.Media = newSimplifiedMedia(sticker)
+		m.Quoted = newSimplifiedQuote(sticker.GetContextInfo())
+	case msg.LocationMessage != nil:
+		location := msg.GetLocationMessage()
+		m.Type = "location"
+		m.Location = &simplifiedLocation{
+			Latitude:  location.GetDegreesLatitude(),
+			Longitude: location.GetDegreesLongitude(),
+			Name:      location.GetName(),
+			Address:   location.GetAddress(),
+		}
+		m.Quoted = newSimplifiedQuote(location.GetContextInfo())
+	case msg.LiveLocationMessage != nil:
+		location := msg.GetLiveLocationMessage()
+		m.Type = "location"
+		m.Caption = location.GetCaption()
+		m.Location = &simplifiedLocation{
+			Latitude:  location.GetDegreesLatitude(),
+			Longitude: location.GetDegreesLongitude(),
+		}
+		m.Quoted = newSimplifiedQuote(location.GetContextInfo())
+	case msg.ContactMessage != nil:
+		contact := msg.GetContactMessage()
+		m.Type = "contact"
+		m.Contacts = []simplifiedContact{{DisplayName: contact.GetDisplayName(), Vcard: contact.GetVcard()}}
+		m.Quoted = newSimplifiedQuote(contact.GetContextInfo())
+	case msg.ContactsArrayMessage != nil:
+		m.Type = "contact"
+		for _, contact := range msg.GetContactsArrayMessage().GetContacts() {
+			m.Contacts = append(m.Contacts, simplifiedContact{DisplayName: contact.GetDisplayName(), Vcard: contact.GetVcard()})
+		}
+	case msg.ReactionMessage != nil:
+		// An empty text removes the reaction
+		m.Type = "reaction"
+		m.Text = msg.GetReactionMessage().GetText()
+		m.Target = msg.GetReactionMessage().GetKey().GetID()
+	case msg.ProtocolMessage != nil && msg.GetProtocolMessage().GetType() == waProto.ProtocolMessage_REVOKE:
+		m.Type = "revoke"
+		m.Target = msg.GetProtocolMessage().GetKey().GetID()
+	default:
+		m.Type = "unknown"
+		m.Raw = msg
+	}
+	return m
+}
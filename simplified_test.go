@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// Received message in a one to one chat, with what is shared by all types
+func testMessage(msg *waProto.Message) *events.Message {
+	sender := types.NewJID("5511999990000", types.DefaultUserServer)
+	sender.Device = 3
+	return &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{Chat: sender.ToNonAD(), Sender: sender},
+			ID:            "3EB0ABC",
+			PushName:      "Ana",
+			Timestamp:     time.Unix(1700000000, 0),
+		},
+		Message: msg,
+	}
+}
+
+// The simplified payload is part of the API, these pin its shape per type
+func TestSimplifyMessage(t *testing.T) {
+	const common = `"id":"3EB0ABC","chat":"5511999990000@s.whatsapp.net","sender":"5511999990000@s.whatsapp.net","senderPn":"5511999990000@s.whatsapp.net","senderName":"Ana",`
+	const end = `"timestamp":1700000000,"fromMe":false`
+	quote := &waProto.ContextInfo{StanzaID: proto.String("3EB0QUOTED"), Participant: proto.String("5511888880000@s.whatsapp.net")}
+	media := func(mimetype string) (*string, *uint64, []byte) {
+		return proto.String(mimetype), proto.Uint64(1234), []byte{0xab, 0xcd}
+	}
+	imageType, imageSize, imageHash := media("image/jpeg")
+	videoType, videoSize, videoHash := media("video/mp4")
+	audioType, audioSize, audioHash := media("audio/ogg; codecs=opus")
+	documentType, documentSize, documentHash := media("application/pdf")
+	stickerType, stickerSize, stickerHash := media("image/webp")
+
+	tests := []struct {
+		name string
+		msg  *waProto.Message
+		want string
+	}{
+		{"text", &waProto.Message{Conversation: proto.String("hello")},
+			`{` + common + `"type":"text","text":"hello","caption":"","media":null,"quoted":null,` + end + `}`},
+		{"extended text with quote", &waProto.Message{ExtendedTextMessage: &waProto.ExtendedTextMessage{Text: proto.String("hi back"), ContextInfo: quote}},
+			`{` + common + `"type":"text","text":"hi back","caption":"","media":null,"quoted":{"id":"3EB0QUOTED","sender":"5511888880000@s.whatsapp.net"},` + end + `}`},
+		{"image", &waProto.Message{ImageMessage: &waProto.ImageMessage{Caption: proto.String("look"), Mimetype: imageType, FileLength: imageSize, FileSHA256: imageHash}},
+			`{` + common + `"type":"image","text":"","caption":"look","media":{"mimetype":"image/jpeg","size":1234,"sha256":"abcd"},"quoted":null,` + end + `}`},
+		{"video", &waProto.Message{VideoMessage: &waProto.VideoMessage{Caption: proto.String("clip"), Mimetype: videoType, FileLength: videoSize, FileSHA256: videoHash}},
+			`{` + common + `"type":"video","text":"","caption":"clip","media":{"mimetype":"video/mp4","size":1234,"sha256":"abcd"},"quoted":null,` + end + `}`},
+		{"audio", &waProto.Message{AudioMessage: &waProto.AudioMessage{Mimetype: audioType, FileLength: audioSize, FileSHA256: audioHash, ContextInfo: quote}},
+			`{` + common + `"type":"audio","text":"","caption":"","media":{"mimetype":"audio/ogg; codecs=opus","size":1234,"sha256":"abcd"},"quoted":{"id":"3EB0QUOTED","sender":"5511888880000@s.whatsapp.net"},` + end + `}`},
+		{"document", &waProto.Message{DocumentMessage: &waProto.DocumentMessage{Caption: proto.String("invoice"), FileName: proto.String("invoice.pdf"), Mimetype: documentType, FileLength: documentSize, FileSHA256: documentHash}},
+			`{` + common + `"type":"document","text":"","caption":"invoice","media":{"mimetype":"application/pdf","size":1234,"sha256":"abcd","fileName":"invoice.pdf"},"quoted":null,` + end + `}`},
+		{"sticker", &waProto.Message{StickerMessage: &waProto.StickerMessage{Mimetype: stickerType, FileLength: stickerSize, FileSHA256: stickerHash}},
+			`{` + common + `"type":"sticker","text":"","caption":"","media":{"mimetype":"image/webp","size":1234,"sha256":"abcd"},"quoted":null,` + end + `}`},
+		{"location", &waProto.Message{LocationMessage: &waProto.LocationMessage{DegreesLatitude: proto.Float64(-23.5), DegreesLongitude: proto.Float64(-46.6), Name: proto.String("Office"), Address: proto.String("Av. Paulista")}},
+			`{` + common + `"type":"location","text":"","caption":"","media":null,"quoted":null,` + end + `,"location":{"latitude":-23.5,"longitude":-46.6,"name":"Office","address":"Av. Paulista"}}`},
+		{"live location", &waProto.Message{LiveLocationMessage: &waProto.LiveLocationMessage{DegreesLatitude: proto.Float64(1.5), DegreesLongitude: proto.Float64(2.5), Caption: proto.String("on my way")}},
+			`{` + common + `"type":"location","text":"","caption":"on my way","media":null,"quoted":null,` + end + `,"location":{"latitude":1.5,"longitude":2.5}}`},
+		{"contact", &waProto.Message{ContactMessage: &waProto.ContactMessage{DisplayName: proto.String("Bob"), Vcard: proto.String("BEGIN:VCARD")}},
+			`{` + common + `"type":"contact","text":"","caption":"","media":null,"quoted":null,` + end + `,"contacts":[{"displayName":"Bob","vcard":"BEGIN:VCARD"}]}`},
+		{"contacts array", &waProto.Message{ContactsArrayMessage: &waProto.ContactsArrayMessage{Contacts: []*waProto.ContactMessage{{DisplayName: proto.String("Bob"), Vcard: proto.String("B")}, {DisplayName: proto.String("Eve"), Vcard: proto.String("E")}}}},
+			`{` + common + `"type":"contact","text":"","caption":"","media":null,"quoted":null,` + end + `,"contacts":[{"displayName":"Bob","vcard":"B"},{"displayName":"Eve","vcard":"E"}]}`},
+		{"reaction", &waProto.Message{ReactionMessage: &waProto.ReactionMessage{Text: proto.String("👍"), Key: &waProto.MessageKey{ID: proto.String("3EB0TARGET")}}},
+			`{` + common + `"type":"reaction","text":"👍","caption":"","media":null,"quoted":null,` + end + `,"target":"3EB0TARGET"}`},
+		{"reaction removed", &waProto.Message{ReactionMessage: &waProto.ReactionMessage{Text: proto.String(""), Key: &waProto.MessageKey{ID: proto.String("3EB0TARGET")}}},
+			`{` + common + `"type":"reaction","text":"","caption":"","media":null,"quoted":null,` + end + `,"target":"3EB0TARGET"}`},
+		{"revoke", &waProto.Message{ProtocolMessage: &waProto.ProtocolMessage{Type: waProto.ProtocolMessage_REVOKE.Enum(), Key: &waProto.MessageKey{ID: proto.String("3EB0GONE")}}},
+			`{` + common + `"type":"revoke","text":"","caption":"","media":null,"quoted":null,` + end + `,"target":"3EB0GONE"}`},
+		{"unknown", &waProto.Message{PollCreationMessage: &waProto.PollCreationMessage{Name: proto.String("Lunch?")}},
+			`{` + common + `"type":"unknown","text":"","caption":"","media":null,"quoted":null,` + end + `,"raw":{"pollCreationMessage":{"name":"Lunch?"}}}`},
+	}
+	for _, tt := range tests {
+		got, err := json.Marshal(simplifyMessage(testMessage(tt.msg)))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSimplifyMessageFlags(t *testing.T) {
+	evt := testMessage(&waProto.Message{Conversation: proto.String("secret")})
+	evt.Info.IsFromMe = true
+	evt.IsViewOnce = true
+	m := simplifyMessage(evt)
+	if !m.FromMe || !m.ViewOnce {
+		t.Errorf("fromMe %v, viewOnce %v, want both", m.FromMe, m.ViewOnce)
+	}
+}
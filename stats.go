@@ -0,0 +1,284 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Hourly counters are kept for the longest window /admin/stats reports
+const statsHours = 7 * 24
+
+// How often counters changed since the last flush are written to the stats
+// table, at most this much activity is lost on a crash
+const statsFlushInterval = time.Minute
+
+type statsCounts struct {
+	Sent           int64
+	Received       int64
+	WebhooksOK     int64
+	WebhooksFailed int64
+}
+
+func (c *statsCounts) add(counts statsCounts) {
+	c.Sent += counts.Sent
+	c.Received += counts.Received
+	c.WebhooksOK += counts.WebhooksOK
+	c.WebhooksFailed += counts.WebhooksFailed
+}
+
+type statsKey struct {
+	userID int
+	hour   int64
+}
+
+// Activity counters of every user by hour, updated as messages and webhook
+// posts happen so reading them never touches the database
+type statsRecorder struct {
+	sync.Mutex
+	counts map[statsKey]*statsCounts
+	dirty  map[statsKey]bool
+}
+
+var stats = &statsRecorder{counts: make(map[statsKey]*statsCounts), dirty: make(map[statsKey]bool)}
+
+func statsHour(t time.Time) int64 {
+	return t.Unix() / 3600
+}
+
+func (st *statsRecorder) add(userID int, count func(*statsCounts)) {
+	key := statsKey{userID, statsHour(time.Now())}
+	st.Lock()
+	defer st.Unlock()
+	counts := st.counts[key]
+	if counts == nil {
+		counts = &statsCounts{}
+		st.counts[key] = counts
+	}
+	count(counts)
+	st.dirty[key] = true
+}
+
+func (st *statsRecorder) sent(userID int) {
+	st.add(userID, func(c *statsCounts) { c.Sent++ })
+}
+
+func (st *statsRecorder) received(userID int) {
+	st.add(userID, func(c *statsCounts) { c.Received++ })
+}
+
+func (st *statsRecorder) webhook(userID int, ok bool) {
+	st.add(userID, func(c *statsCounts) {
+		if ok {
+			c.WebhooksOK++
+		} else {
+			c.WebhooksFailed++
+		}
+	})
+}
+
+// Drops the counters of a deleted user, the rows go with the user
+func (st *statsRecorder) forget(userID int) {
+	st.Lock()
+	defer st.Unlock()
+	for key := range st.counts {
+		if key.userID == userID {
+			delete(st.counts, key)
+			delete(st.dirty, key)
+		}
+	}
+}
+
+// Totals of each user over the last hours, the current one included
+func (st *statsRecorder) window(hours int64) map[int]statsCounts {
+	from := statsHour(time.Now()) - hours + 1
+	st.Lock()
+	defer st.Unlock()
+	totals := make(map[int]statsCounts)
+	for key, counts := range st.counts {
+		if key.hour < from {
+			continue
+		}
+		total := totals[key.userID]
+		total.add(*counts)
+		totals[key.userID] = total
+	}
+	return totals
+}
+
+// Reads back the counters flushed before the last restart
+func (st *statsRecorder) load(db *sql.DB) error {
+	rows, err := db.Query("SELECT user_id, hour, sent, received, webhooks_ok, webhooks_failed FROM stats WHERE hour>?", statsHour(time.Now())-statsHours)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	st.Lock()
+	defer st.Unlock()
+	for rows.Next() {
+		var key statsKey
+		counts := &statsCounts{}
+		if err := rows.Scan(&key.userID, &key.hour, &counts.Sent, &counts.Received, &counts.WebhooksOK, &counts.WebhooksFailed); err != nil {
+			return err
+		}
+		st.counts[key] = counts
+	}
+	return rows.Err()
+}
+
+// Writes the counters changed since the last flush and forgets the hours
+// past the longest window, in memory and in the table
+func (st *statsRecorder) flush(db *sql.DB) {
+	oldest := statsHour(time.Now()) - statsHours
+	st.Lock()
+	changed := make(map[statsKey]statsCounts, len(st.dirty))
+	for key := range st.dirty {
+		changed[key] = *st.counts[key]
+	}
+	st.dirty = make(map[statsKey]bool)
+	for key := range st.counts {
+		if key.hour <= oldest {
+			delete(st.counts, key)
+		}
+	}
+	st.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not flush stats")
+		st.redo(changed)
+		return
+	}
+	defer tx.Rollback()
+	for key, counts := range changed {
+		// Users deleted since are skipped, their rows are gone
+		_, err := tx.Exec(`INSERT INTO stats (user_id, hour, sent, received, webhooks_ok, webhooks_failed) SELECT ?, ?, ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM users WHERE id=?)
+			ON CONFLICT (user_id, hour) DO UPDATE SET sent=excluded.sent, received=excluded.received, webhooks_ok=excluded.webhooks_ok, webhooks_failed=excluded.webhooks_failed`,
+			key.userID, key.hour, counts.Sent, counts.Received, counts.WebhooksOK, counts.WebhooksFailed, key.userID)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not flush stats")
+			st.redo(changed)
+			return
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM stats WHERE hour<=?", oldest); err != nil {
+		log.Error().Err(err).Msg("Could not prune stats")
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error().Err(err).Msg("Could not flush stats")
+		st.redo(changed)
+	}
+}
+
+// Marks counters dirty again after a failed flush, so the next one retries
+func (st *statsRecorder) redo(changed map[statsKey]statsCounts) {
+	st.Lock()
+	defer st.Unlock()
+	for key := range changed {
+		if st.counts[key] != nil {
+			st.dirty[key] = true
+		}
+	}
+}
+
+func (s *server) statsFlusher() {
+	for {
+		time.Sleep(statsFlushInterval)
+		stats.flush(s.db)
+	}
+}
+
+// Activity over a window, the success rate is null without webhook posts
+type statsWindow struct {
+	Sent               int64    `json:"sent"`
+	Received           int64    `json:"received"`
+	WebhooksOK         int64    `json:"webhooks_ok"`
+	WebhooksFailed     int64    `json:"webhooks_failed"`
+	WebhookSuccessRate *float64 `json:"webhook_success_rate"`
+}
+
+func newStatsWindow(counts statsCounts) statsWindow {
+	window := statsWindow{Sent: counts.Sent, Received: counts.Received, WebhooksOK: counts.WebhooksOK, WebhooksFailed: counts.WebhooksFailed}
+	if posts := counts.WebhooksOK + counts.WebhooksFailed; posts > 0 {
+		rate := float64(counts.WebhooksOK) / float64(posts)
+		window.WebhookSuccessRate = &rate
+	}
+	return window
+}
+
+type userStats struct {
+	ID             int         `json:"id"`
+	Name           string      `json:"name"`
+	State          string      `json:"state"`
+	LastConnect    int64       `json:"last_connect"`
+	Last24h        statsWindow `json:"last_24h"`
+	Last7d         statsWindow `json:"last_7d"`
+	WebhooksQueued int         `json:"webhooks_queued"`
+}
+
+// Usage of every user and of the whole instance, from the in memory
+// counters and a single users query, cheap enough to poll
+func (s *server) GetStats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		day, week := stats.window(24), stats.window(statsHours)
+
+		rows, err := s.db.Query("SELECT id, name, last_connect FROM users ORDER BY id")
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
+		}
+		defer rows.Close()
+
+		users := []userStats{}
+		var totalDay, totalWeek statsCounts
+		connected := 0
+		for rows.Next() {
+			var user userStats
+			if err := rows.Scan(&user.ID, &user.Name, &user.LastConnect); err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+				return
+			}
+			user.State = sessions.state(user.ID)
+			if user.State == "connected" {
+				connected++
+			}
+			user.Last24h = newStatsWindow(day[user.ID])
+			user.Last7d = newStatsWindow(week[user.ID])
+			if mycli := sessions.myClient(user.ID); mycli != nil && mycli.webhooks != nil {
+				user.WebhooksQueued = mycli.webhooks.depth()
+			}
+			totalDay.add(day[user.ID])
+			totalWeek.add(week[user.ID])
+			users = append(users, user)
+		}
+		if err := rows.Err(); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
+		}
+
+		responseJson, err := json.Marshal(map[string]interface{}{
+			"version": version,
+			"commit":  commit,
+			"uptime":  int64(time.Since(startTime).Seconds()),
+			"totals": map[string]interface{}{
+				"users":            len(users),
+				"connected":        connected,
+				"last_24h":         newStatsWindow(totalDay),
+				"last_7d":          newStatsWindow(totalWeek),
+				"webhooks_queued":  webhooksQueued.Load(),
+				"webhooks_pending": webhooksPending.Load(),
+				"webhooks_dropped": webhooksDropped.Load(),
+			},
+			"users": users,
+		})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/nfnt/resize"
+)
+
+// WhatsApp sticker limits
+const (
+	stickerSize            = 512
+	stickerMaxStatic       = 100 * 1024
+	stickerMaxAnimated     = 500 * 1024
+	stickerQualityFallback = 40
+	stickerMaxDownload     = 5 * 1024 * 1024
+)
+
+// Reads dimensions and animation flag from a WebP header
+func webpInfo(data []byte) (width int, height int, animated bool, err error) {
+	if len(data) < 30 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return 0, 0, false, errors.New("not a WebP image")
+	}
+	chunk := data[20:]
+	switch string(data[12:16]) {
+	case "VP8X":
+		animated = chunk[0]&0x02 != 0
+		width = int(uint32(chunk[4])|uint32(chunk[5])<<8|uint32(chunk[6])<<16) + 1
+		height = int(uint32(chunk[7])|uint32(chunk[8])<<8|uint32(chunk[9])<<16) + 1
+	case "VP8 ":
+		if chunk[3] != 0x9d || chunk[4] != 0x01 || chunk[5] != 0x2a {
+			return 0, 0, false, errors.New("invalid VP8 frame")
+		}
+		width = int(binary.LittleEndian.Uint16(chunk[6:8]) & 0x3fff)
+		height = int(binary.LittleEndian.Uint16(chunk[8:10]) & 0x3fff)
+	case "VP8L":
+		if chunk[0] != 0x2f {
+			return 0, 0, false, errors.New("invalid VP8L signature")
+		}
+		bits := binary.LittleEndian.Uint32(chunk[1:5])
+		width = int(bits&0x3fff) + 1
+		height = int((bits>>14)&0x3fff) + 1
+	default:
+		return 0, 0, false, errors.New("unknown WebP format")
+	}
+	return width, height, animated, nil
+}
+
+// Checks a WebP sticker against WhatsApp size limits
+func validateSticker(data []byte) (width int, height int, animated bool, err error) {
+	width, height, animated, err = webpInfo(data)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if width > stickerSize || height > stickerSize {
+		return 0, 0, false, fmt.Errorf("sticker is %dx%d, it must fit in %dx%d", width, height, stickerSize, stickerSize)
+	}
+	limit := stickerMaxStatic
+	if animated {
+		limit = stickerMaxAnimated
+	}
+	if len(data) > limit {
+		return 0, 0, false, fmt.Errorf("sticker is %d KB, the limit is %d KB", len(data)/1024, limit/1024)
+	}
+	return width, height, animated, nil
+}
+
+// Converts a PNG or JPEG into a 512x512 WebP sticker, the image is scaled to
+// fit and padded with transparency. Go has no WebP encoder, so this needs the
+// cwebp tool from libwebp installed.
+func convertToSticker(data []byte) ([]byte, error) {
+	cwebp, err := exec.LookPath("cwebp")
+	if err != nil {
+		return nil, errors.New("converting to WebP needs cwebp installed, send a WebP sticker instead")
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode image: %w", err)
+	}
+	bounds := img.Bounds()
+	var scaled image.Image
+	if bounds.Dx() >= bounds.Dy() {
+		scaled = resize.Resize(stickerSize, 0, img, resize.Lanczos3)
+	} else {
+		scaled = resize.Resize(0, stickerSize, img, resize.Lanczos3)
+	}
+	canvas := image.NewNRGBA(image.Rect(0, 0, stickerSize, stickerSize))
+	offset := image.Pt((stickerSize-scaled.Bounds().Dx())/2, (stickerSize-scaled.Bounds().Dy())/2)
+	draw.Draw(canvas, scaled.Bounds().Add(offset), scaled, scaled.Bounds().Min, draw.Over)
+
+	dir, err := os.MkdirTemp("", "wuzapi-sticker")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "in.png")
+	output := filepath.Join(dir, "out.webp")
+	file, err := os.Create(input)
+	if err != nil {
+		return nil, err
+	}
+	err = png.Encode(file, canvas)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// Lower the quality until it fits the static sticker limit
+	for quality := 80; ; quality -= 20 {
+		out, err := exec.Command(cwebp, "-quiet", "-q", fmt.Sprint(quality), input, "-o", output).CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("cwebp failed: %v %s", err, out)
+		}
+		webp, err := os.ReadFile(output)
+		if err != nil {
+			return nil, err
+		}
+		if len(webp) <= stickerMaxStatic || quality <= stickerQualityFallback {
+			return webp, nil
+		}
+	}
+}
+
+// Downloads a sticker image from a remote URL, only https unless started
+// with -insecureurls, and no bigger than stickerMaxDownload
+func fetchSticker(rawURL string) ([]byte, error) {
+	return fetchRemote(rawURL, "sticker", stickerMaxDownload)
+}
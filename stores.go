@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// whatsmeow store of one user under -store-per-user
+type userStore struct {
+	db        *sql.DB
+	container *sqlstore.Container
+}
+
+// With -store-per-user every user's device lives in its own SQLite file,
+// dbdata/stores/{id}.db, so a corrupted store only takes down one session.
+// Stores are opened on first use and closed once their session ends without
+// a paired device (logout, unpaired QR timeout).
+type storeManager struct {
+	sync.Mutex
+	dir    string
+	stores map[int]*userStore
+}
+
+var stores = &storeManager{stores: make(map[int]*userStore)}
+
+func (m *storeManager) path(userID int) string {
+	return filepath.Join(m.dir, strconv.Itoa(userID)+".db")
+}
+
+// Store container and database of a user: their own file with
+// -store-per-user, the shared main.db otherwise
+func (s *server) userContainer(userID int) (*sqlstore.Container, *sql.DB, error) {
+	if !*storePerUser {
+		return container, s.storeDb, nil
+	}
+	return stores.open(userID)
+}
+
+// Store container of a user, for callers that don't need the database
+func deviceContainer(userID int) (*sqlstore.Container, error) {
+	if !*storePerUser {
+		return container, nil
+	}
+	userContainer, _, err := stores.open(userID)
+	return userContainer, err
+}
+
+func (m *storeManager) open(userID int) (*sqlstore.Container, *sql.DB, error) {
+	m.Lock()
+	defer m.Unlock()
+	if store := m.stores[userID]; store != nil {
+		return store.container, store.db, nil
+	}
+	if err := os.MkdirAll(m.dir, 0751); err != nil {
+		return nil, nil, fmt.Errorf("could not create stores directory: %w", err)
+	}
+	db, err := sql.Open(sqlDriver(), sqliteDSN(m.path(userID)))
+	if err != nil {
+		return nil, nil, err
+	}
+	dbLog := waLog.Noop
+	if *waDebug != "" {
+		dbLog = waLog.Stdout("Database/"+strconv.Itoa(userID), *waDebug, *colorOutput)
+	}
+	userContainer := sqlstore.NewWithDB(db, "sqlite", dbLog)
+	if err := userContainer.Upgrade(); err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("could not upgrade store of user %d: %w", userID, err)
+	}
+	m.stores[userID] = &userStore{db: db, container: userContainer}
+	log.Info().Int("userid", userID).Str("path", m.path(userID)).Msg("Opened user store")
+	return userContainer, db, nil
+}
+
+// Closes a user's store, it is opened again on next use
+func (m *storeManager) close(userID int) {
+	m.Lock()
+	store := m.stores[userID]
+	delete(m.stores, userID)
+	m.Unlock()
+	if store == nil {
+		return
+	}
+	if err := store.db.Close(); err != nil {
+		log.Error().Err(err).Int("userid", userID).Msg("Could not close user store")
+		return
+	}
+	log.Info().Int("userid", userID).Msg("Closed user store")
+}
+
+// Closes and deletes the store file of a deleted user
+func (m *storeManager) remove(userID int) {
+	m.close(userID)
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Remove(m.path(userID) + suffix); err != nil && !os.IsNotExist(err) {
+			log.Error().Err(err).Int("userid", userID).Msg("Could not delete user store")
+		}
+	}
+}
+
+// Closes every open store on shutdown
+func (m *storeManager) closeAll() {
+	m.Lock()
+	ids := make([]int, 0, len(m.stores))
+	for id := range m.stores {
+		ids = append(ids, id)
+	}
+	m.Unlock()
+	for _, id := range ids {
+		m.close(id)
+	}
+}
+
+// Databases of the stores currently open, by user id
+func (m *storeManager) databases() map[int]*sql.DB {
+	m.Lock()
+	defer m.Unlock()
+	databases := make(map[int]*sql.DB, len(m.stores))
+	for id, store := range m.stores {
+		databases[id] = store.db
+	}
+	return databases
+}
+
+// User ids that have a store file, whether open or not
+func (m *storeManager) files() ([]int, error) {
+	entries, err := os.ReadDir(m.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".db")
+		if !ok {
+			continue
+		}
+		if id, err := strconv.Atoi(name); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// Copies a device still kept in the shared main.db to the user's own store,
+// for sessions paired before -store-per-user was turned on. The rows are
+// left in main.db so going back without the flag still works.
+func (s *server) migrateStore(userID int, jid string, userDb *sql.DB) bool {
+	tables, err := exportStoreRows(s.storeDb, jid)
+	if err != nil {
+		return false
+	}
+	if err := restoreStoreRows(userDb, jid, tables); err != nil {
+		log.Error().Err(err).Int("userid", userID).Str("jid", jid).Msg("Could not move device to user store")
+		return false
+	}
+	log.Info().Int("userid", userID).Str("jid", jid).Msg("Moved device from main.db to user store")
+	return true
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// Row counts of the whatsmeow store tables that grow with use: one device
+// per paired session, a signal session per contact device talked to, a
+// sender key per group member device and the app state keys of each device
+type storeStats struct {
+	Database         string `json:"database"`
+	Open             bool   `json:"open"`
+	Devices          int64  `json:"devices"`
+	Sessions         int64  `json:"sessions"`
+	SenderKeys       int64  `json:"sender_keys"`
+	AppStateSyncKeys int64  `json:"app_state_sync_keys"`
+	FileSize         int64  `json:"file_size"`
+	WALSize          int64  `json:"wal_size"`
+	Error            string `json:"error,omitempty"`
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// Counts a store's rows with COUNT(*) queries, nothing is loaded. db is nil
+// for per user stores not open now, only their file sizes are given.
+func readStoreStats(name string, db *sql.DB, path string) storeStats {
+	stats := storeStats{Database: name, Open: db != nil, FileSize: fileSize(path), WALSize: fileSize(path + "-wal")}
+	if db == nil {
+		return stats
+	}
+	counts := []struct {
+		table string
+		count *int64
+	}{
+		{"whatsmeow_device", &stats.Devices},
+		{"whatsmeow_sessions", &stats.Sessions},
+		{"whatsmeow_sender_keys", &stats.SenderKeys},
+		{"whatsmeow_app_state_sync_keys", &stats.AppStateSyncKeys},
+	}
+	for _, t := range counts {
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + t.table).Scan(t.count); err != nil {
+			stats.Error = err.Error()
+			log.Error().Err(err).Str("database", name).Str("table", t.table).Msg("Could not count store rows")
+			break
+		}
+	}
+	return stats
+}
+
+// Admin: Row counts and file sizes of the shared store and, with
+// -store-per-user, of each user's store, with their sum in total. Read only.
+func (s *server) GetStoreStats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		databases := []storeStats{readStoreStats("store", s.storeDb, filepath.Join(s.exPath, "main.db"))}
+		if *storePerUser {
+			open := stores.databases()
+			ids, err := stores.files()
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			sort.Ints(ids)
+			for _, id := range ids {
+				databases = append(databases, readStoreStats("store/"+strconv.Itoa(id), open[id], stores.path(id)))
+			}
+		}
+
+		total := storeStats{Database: "total", Open: true}
+		for _, stats := range databases {
+			total.Devices += stats.Devices
+			total.Sessions += stats.Sessions
+			total.SenderKeys += stats.SenderKeys
+			total.AppStateSyncKeys += stats.AppStateSyncKeys
+			total.FileSize += stats.FileSize
+			total.WALSize += stats.WALSize
+		}
+
+		responseJson, err := json.Marshal(map[string]interface{}{"databases": databases, "total": total})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+)
+
+// Live event subscriber (a websocket client), it gets the same JSON
+// payloads posted to the webhook
+type streamSubscriber struct {
+	events []string
+	send   chan []byte
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (sub *streamSubscriber) close() {
+	sub.once.Do(func() { close(sub.done) })
+}
+
+func (sub *streamSubscriber) wants(eventType string) bool {
+	return subscribedTo(sub.events, eventType)
+}
+
+// Registry of live event subscribers per user
+type streamHub struct {
+	sync.Mutex
+	subscribers map[int]map[*streamSubscriber]bool
+}
+
+var streams = &streamHub{subscribers: make(map[int]map[*streamSubscriber]bool)}
+
+func (h *streamHub) subscribe(userID int, events []string) *streamSubscriber {
+	sub := &streamSubscriber{
+		events: events,
+		send:   make(chan []byte, 64),
+		done:   make(chan struct{}),
+	}
+	h.Lock()
+	defer h.Unlock()
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = make(map[*streamSubscriber]bool)
+	}
+	h.subscribers[userID][sub] = true
+	return sub
+}
+
+func (h *streamHub) unsubscribe(userID int, sub *streamSubscriber) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.subscribers[userID], sub)
+	if len(h.subscribers[userID]) == 0 {
+		delete(h.subscribers, userID)
+	}
+	sub.close()
+}
+
+// Sends an event to the user's subscribers without blocking, slow clients
+// miss events instead of holding up the event handler
+func (h *streamHub) publish(userID int, postmap map[string]interface{}) {
+	eventType, _ := postmap["type"].(string)
+	h.Lock()
+	defer h.Unlock()
+	if len(h.subscribers[userID]) == 0 {
+		return
+	}
+	payload, err := json.Marshal(postmap)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not marshal event for streams")
+		return
+	}
+	for sub := range h.subscribers[userID] {
+		if !sub.wants(eventType) {
+			continue
+		}
+		select {
+		case sub.send <- payload:
+		default:
+			log.Warn().Str("userid", strconv.Itoa(userID)).Str("type", eventType).Msg("Stream client too slow, dropping event")
+		}
+	}
+}
+
+// Ends all streams of a user, when its session stops or its token changes
+func (h *streamHub) closeUser(userID int) {
+	h.Lock()
+	defer h.Unlock()
+	for sub := range h.subscribers[userID] {
+		sub.close()
+	}
+	delete(h.subscribers, userID)
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/gorilla/mux"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	sqlite "modernc.org/sqlite"
+)
+
+const (
+	// Finished spans waiting to be exported, more are dropped
+	traceQueueSize      = 2048
+	traceBatchSize      = 512
+	traceExportInterval = 5 * time.Second
+	traceExportTimeout  = 10 * time.Second
+)
+
+// OTLP span kinds
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+	spanConsumer = 5
+)
+
+// Name the databases are opened with when tracing, the sqlite driver
+// wrapped to trace the calls made with a context
+const tracedSQLDriver = "sqlite-traced"
+
+type spanAttr struct {
+	key   string
+	value string
+	isInt bool
+}
+
+// A timed operation of a trace. Methods do nothing on a nil span, which is
+// what every start function returns when tracing is off or the trace isn't
+// sampled, so callers never check.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []spanAttr
+	err      string
+}
+
+type spanKey struct{}
+
+// Exports spans to -otel-endpoint with OTLP over HTTP in JSON, in batches
+// sent by a single goroutine so requests never wait on the collector
+type tracer struct {
+	endpoint string
+	resource []otlpAttr
+	client   *http.Client
+	spans    chan *span
+	stopped  chan struct{}
+	finished chan struct{}
+	once     sync.Once
+}
+
+// Set when -otel-endpoint is, nil otherwise
+var tracing *tracer
+
+// database/sql takes a driver name once
+var registerTracedDriver sync.Once
+
+// Starts tracing to -otel-endpoint, the OTLP/HTTP base URL of a collector
+// (http://collector:4318) or its full traces URL
+func setupTracing() error {
+	if *otelEndpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(*otelEndpoint)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("must be an http or https URL")
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	hostname, _ := os.Hostname()
+	tracing = &tracer{
+		endpoint: u.String(),
+		resource: []otlpAttr{stringAttr("service.name", "wuzapi"), stringAttr("service.version", version), stringAttr("host.name", hostname)},
+		client:   &http.Client{Timeout: traceExportTimeout},
+		spans:    make(chan *span, traceQueueSize),
+		stopped:  make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	registerTracedDriver.Do(func() { sql.Register(tracedSQLDriver, tracedDriver{&sqlite.Driver{}}) })
+	go tracing.exporter()
+	return nil
+}
+
+// Driver name the databases are opened with
+func sqlDriver() string {
+	if tracing != nil {
+		return tracedSQLDriver
+	}
+	return "sqlite"
+}
+
+func newSpan(name string, kind int, traceID [16]byte, parentID [8]byte) *span {
+	sp := &span{traceID: traceID, parentID: parentID, name: name, kind: kind, start: time.Now()}
+	randomID(sp.spanID[:])
+	return sp
+}
+
+// Random non zero id, as OTLP requires
+func randomID(id []byte) {
+	for {
+		for i := 0; i < len(id); i += 8 {
+			n := rand.Uint64()
+			for j := i; j < len(id) && j < i+8; j++ {
+				id[j] = byte(n >> (8 * (j - i)))
+			}
+		}
+		for _, b := range id {
+			if b != 0 {
+				return
+			}
+		}
+	}
+}
+
+// Child span of the one in ctx, nil when there is none
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if tracing == nil {
+		return ctx, nil
+	}
+	parent, _ := ctx.Value(spanKey{}).(*span)
+	if parent == nil {
+		return ctx, nil
+	}
+	sp := newSpan(name, kind, parent.traceID, parent.spanID)
+	if v, ok := ctx.Value("userinfo").(Values); ok {
+		sp.setString("wuzapi.user_id", v.Get("Id"))
+	}
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+// Span starting a trace, or continuing the one of a traceparent header. The
+// caller's sampling decision is kept, new traces are sampled at
+// -otel-sample-rate. Nil when not sampled.
+func startRootSpan(ctx context.Context, name string, kind int, traceparent string) (context.Context, *span) {
+	if tracing == nil {
+		return ctx, nil
+	}
+	var traceID [16]byte
+	var parentID [8]byte
+	if tid, pid, sampled, ok := parseTraceparent(traceparent); ok {
+		if !sampled {
+			return ctx, nil
+		}
+		traceID, parentID = tid, pid
+	} else {
+		if rand.Float64() >= *otelSampleRate {
+			return ctx, nil
+		}
+		randomID(traceID[:])
+	}
+	sp := newSpan(name, kind, traceID, parentID)
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+// W3C trace context header, version 00 only
+func parseTraceparent(header string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	if len(header) != 55 || header[:3] != "00-" || header[35] != '-' || header[52] != '-' {
+		return
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(traceID[:], []byte(header[3:35])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(parentID[:], []byte(header[36:52])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(flags[:], []byte(header[53:])); err != nil {
+		return
+	}
+	if traceID == [16]byte{} || parentID == [8]byte{} {
+		return
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+// traceparent header continuing the trace in the span
+func (sp *span) traceparent() string {
+	return "00-" + hex.EncodeToString(sp.traceID[:]) + "-" + hex.EncodeToString(sp.spanID[:]) + "-01"
+}
+
+func (sp *span) setString(key string, value string) {
+	if sp == nil {
+		return
+	}
+	sp.attrs = append(sp.attrs, spanAttr{key: key, value: value})
+}
+
+func (sp *span) setInt(key string, value int64) {
+	if sp == nil {
+		return
+	}
+	sp.attrs = append(sp.attrs, spanAttr{key: key, value: strconv.FormatInt(value, 10), isInt: true})
+}
+
+// Ends the span, failed when err is set, and queues it for export
+func (sp *span) finish(err error) {
+	if sp == nil {
+		return
+	}
+	sp.end = time.Now()
+	if err != nil {
+		sp.err = err.Error()
+	}
+	select {
+	case tracing.spans <- sp:
+	default:
+	}
+}
+
+func (t *tracer) exporter() {
+	defer close(t.finished)
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+	batch := make([]*span, 0, traceBatchSize)
+	for {
+		select {
+		case sp := <-t.spans:
+			batch = append(batch, sp)
+			if len(batch) >= traceBatchSize {
+				t.export(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				t.export(batch)
+				batch = batch[:0]
+			}
+		case <-t.stopped:
+			for {
+				select {
+				case sp := <-t.spans:
+					batch = append(batch, sp)
+				default:
+					if len(batch) > 0 {
+						t.export(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// Exports the spans ended so far, up to ctx
+func (t *tracer) shutdown(ctx context.Context) bool {
+	if t == nil {
+		return true
+	}
+	t.once.Do(func() { close(t.stopped) })
+	select {
+	case <-t.finished:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+func stringAttr(key string, value string) otlpAttr {
+	return otlpAttr{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func (t *tracer) export(batch []*span) {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, sp := range batch {
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(sp.traceID[:]),
+			SpanID:            hex.EncodeToString(sp.spanID[:]),
+			Name:              sp.name,
+			Kind:              sp.kind,
+			StartTimeUnixNano: strconv.FormatInt(sp.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(sp.end.UnixNano(), 10),
+		}
+		if sp.parentID != [8]byte{} {
+			out.ParentSpanID = hex.EncodeToString(sp.parentID[:])
+		}
+		for _, attr := range sp.attrs {
+			value := attr.value
+			if attr.isInt {
+				out.Attributes = append(out.Attributes, otlpAttr{Key: attr.key, Value: otlpValue{IntValue: &value}})
+			} else {
+				out.Attributes = append(out.Attributes, otlpAttr{Key: attr.key, Value: otlpValue{StringValue: &value}})
+			}
+		}
+		if sp.err != "" {
+			out.Status = otlpStatus{Code: 2, Message: sp.err}
+		}
+		spans = append(spans, out)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": t.resource},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "wuzapi", "version": version},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Warn().Err(err).Int("spans", len(spans)).Msg("Could not export traces")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Warn().Str("status", resp.Status).Int("spans", len(spans)).Msg("Collector refused traces")
+	}
+}
+
+// Middleware: Traces each request in a span named after its route, child of
+// the caller's when it sends a traceparent header
+func (s *server) trace(router *mux.Router, next http.Handler) http.Handler {
+	if tracing == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, sp := startRootSpan(r.Context(), "", spanServer, r.Header.Get("traceparent"))
+		if sp == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Before the handler, some rewrite the path
+		route := routeTemplate(router, r)
+		user, ok := ctx.Value(accessUserKey{}).(*accessUser)
+		if !ok {
+			user = &accessUser{}
+			ctx = context.WithValue(ctx, accessUserKey{}, user)
+		}
+		aw := &accessWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r.WithContext(ctx))
+
+		status := aw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		sp.name = r.Method + " " + route
+		sp.setString("http.request.method", r.Method)
+		sp.setString("http.route", route)
+		sp.setInt("http.response.status_code", int64(status))
+		sp.setString("wuzapi.request_id", requestIDFrom(r))
+		if user.id != "" {
+			sp.setString("wuzapi.user_id", user.id)
+		}
+		var err error
+		if status >= 500 {
+			err = errors.New(http.StatusText(status))
+		}
+		sp.finish(err)
+	})
+}
+
+// Sets the traceparent header of a webhook post so the receiver can continue
+// the trace, and what the span records of it. Never the payload.
+func (sp *span) webhook(req *resty.Request, webhookURL string, userID int, event string) {
+	if sp == nil {
+		return
+	}
+	req.SetHeader("traceparent", sp.traceparent())
+	sp.setString("http.request.method", http.MethodPost)
+	if u, err := url.Parse(webhookURL); err == nil {
+		sp.setString("server.address", u.Host)
+	}
+	sp.setString("wuzapi.user_id", strconv.Itoa(userID))
+	if event != "" {
+		sp.setString("wuzapi.event_type", event)
+	}
+}
+
+// client.SendMessage in a span of the WhatsApp round trip
+func tracedSend(ctx context.Context, client *whatsmeow.Client, to types.JID, msg *waProto.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error) {
+	ctx, sp := startSpan(ctx, "whatsmeow.send", spanClient)
+	resp, err := client.SendMessage(ctx, to, msg, extra...)
+	if sp != nil {
+		sp.setString("wuzapi.message_type", messageKind(msg))
+		sp.setString("wuzapi.recipient_server", to.Server)
+		sp.finish(err)
+	}
+	return resp, err
+}
+
+// client.Upload in a span
+func tracedUpload(ctx context.Context, client *whatsmeow.Client, data []byte, mediaType whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+	ctx, sp := startSpan(ctx, "whatsmeow.upload", spanClient)
+	resp, err := client.Upload(ctx, data, mediaType)
+	if sp != nil {
+		sp.setString("wuzapi.media_type", string(mediaType))
+		sp.setInt("wuzapi.media_size", int64(len(data)))
+		sp.finish(err)
+	}
+	return resp, err
+}
+
+// client.Download in a span. It can't be canceled, whatsmeow doesn't take a
+// context for it.
+func tracedDownload(ctx context.Context, client *whatsmeow.Client, msg whatsmeow.DownloadableMessage) ([]byte, error) {
+	_, sp := startSpan(ctx, "whatsmeow.download", spanClient)
+	data, err := client.Download(msg)
+	if sp != nil {
+		sp.setInt("wuzapi.media_size", int64(len(data)))
+		sp.finish(err)
+	}
+	return data, err
+}
+
+// The sqlite driver with the calls made with a context traced as children
+// of its span, database/sql uses background ones for the others
+type tracedDriver struct {
+	driver.Driver
+}
+
+// What the sqlite driver's connections implement, database/sql checks for
+// these interfaces and would otherwise fall back to slower paths
+type sqliteConn interface {
+	driver.Conn
+	driver.Pinger
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+}
+
+type tracedConn struct {
+	sqliteConn
+}
+
+func (d tracedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := conn.(sqliteConn); ok {
+		return tracedConn{c}, nil
+	}
+	return conn, nil
+}
+
+// Statements have placeholders, the values bound aren't recorded
+func dbSpan(ctx context.Context, name string, query string) *span {
+	_, sp := startSpan(ctx, name, spanClient)
+	sp.setString("db.system", "sqlite")
+	sp.setString("db.statement", query)
+	return sp
+}
+
+func (c tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	sp := dbSpan(ctx, "db.exec", query)
+	res, err := c.sqliteConn.ExecContext(ctx, query, args)
+	sp.finish(err)
+	return res, err
+}
+
+func (c tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	sp := dbSpan(ctx, "db.query", query)
+	rows, err := c.sqliteConn.QueryContext(ctx, query, args)
+	sp.finish(err)
+	return rows, err
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// With -otel-endpoint unset spans are never made, the calls on the request
+// path cost nothing
+func TestTracingDisabledAllocs(t *testing.T) {
+	if tracing != nil {
+		t.Fatal("tracing set up")
+	}
+	ctx := context.Background()
+	allocs := testing.AllocsPerRun(100, func() {
+		ctx, root := startRootSpan(ctx, "GET /chat/send/text", spanServer, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+		ctx, send := startSpan(ctx, "whatsmeow.send", spanClient)
+		send.setString("wuzapi.message_type", "text")
+		send.setInt("wuzapi.media_size", 1024)
+		send.finish(nil)
+		dbSpan(ctx, "db.query", "SELECT 1").finish(nil)
+		root.finish(nil)
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per request with tracing off, want 0", allocs)
+	}
+
+	next := http.NewServeMux()
+	if handler := (&server{}).trace(mux.NewRouter(), next); handler != next || sqlDriver() != "sqlite" {
+		t.Error("middleware or driver wrapped with tracing off")
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header  string
+		sampled bool
+		ok      bool
+	}{
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", true, true},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", false, true},
+		{"01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", false, false},
+		{"00-00000000000000000000000000000000-b7ad6b7169203331-01", false, false},
+		{"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01", false, false},
+		{"00-0af7651916cd43dd8448eb211c80319x-b7ad6b7169203331-01", false, false},
+		{"", false, false},
+	}
+	for _, tt := range tests {
+		traceID, parentID, sampled, ok := parseTraceparent(tt.header)
+		if ok != tt.ok || sampled != tt.sampled {
+			t.Errorf("%q: got sampled %v ok %v", tt.header, sampled, ok)
+			continue
+		}
+		if ok && "00-"+hex.EncodeToString(traceID[:])+"-"+hex.EncodeToString(parentID[:])+tt.header[52:] != tt.header {
+			t.Errorf("%q: got %x %x", tt.header, traceID, parentID)
+		}
+	}
+}
+
+// A request through the middleware, with the database calls its handler
+// makes, reaches the collector as one trace: the request's span continues
+// the caller's and the database spans are its children
+func TestTracingExportsSpans(t *testing.T) {
+	var mu sync.Mutex
+	var payloads [][]byte
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("export to %s as %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		mu.Lock()
+		payloads = append(payloads, body)
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	saved := *otelEndpoint
+	*otelEndpoint = collector.URL
+	defer func() {
+		*otelEndpoint = saved
+		tracing = nil
+	}()
+	if err := setupTracing(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open(sqlDriver(), sqliteDSN(filepath.Join(t.TempDir(), "users.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/notes/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := db.ExecContext(r.Context(), "INSERT INTO notes (id, body) VALUES (?, ?)", mux.Vars(r)["id"], "secret"); err != nil {
+			t.Error(err)
+		}
+		var body string
+		if err := db.QueryRowContext(r.Context(), "SELECT body FROM notes WHERE id = ?", mux.Vars(r)["id"]).Scan(&body); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	handler := (&server{}).trace(router, router)
+	r := httptest.NewRequest("POST", "/notes/7", nil)
+	r.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status %d", w.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !tracing.shutdown(ctx) {
+		t.Fatal("spans not exported")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(payloads) != 1 {
+		t.Fatalf("%d exports, want 1", len(payloads))
+	}
+	var export struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpAttr
+			}
+			ScopeSpans []struct {
+				Scope struct{ Name string }
+				Spans []otlpSpan
+			}
+		}
+	}
+	if err := json.Unmarshal(payloads[0], &export); err != nil {
+		t.Fatalf("%v: %s", err, payloads[0])
+	}
+	if len(export.ResourceSpans) != 1 || len(export.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("got %s", payloads[0])
+	}
+	if attrs := export.ResourceSpans[0].Resource.Attributes; len(attrs) == 0 || attrs[0].Key != "service.name" || *attrs[0].Value.StringValue != "wuzapi" {
+		t.Errorf("resource: got %+v", attrs)
+	}
+	spans := export.ResourceSpans[0].ScopeSpans[0].Spans
+
+	byName := map[string]otlpSpan{}
+	for _, sp := range spans {
+		byName[sp.Name] = sp
+		if sp.TraceID != "0af7651916cd43dd8448eb211c80319c" {
+			t.Errorf("%s: trace %s, want the caller's", sp.Name, sp.TraceID)
+		}
+		if len(sp.SpanID) != 16 {
+			t.Errorf("%s: span id %q", sp.Name, sp.SpanID)
+		}
+		start, err1 := strconv.ParseInt(sp.StartTimeUnixNano, 10, 64)
+		end, err2 := strconv.ParseInt(sp.EndTimeUnixNano, 10, 64)
+		if err1 != nil || err2 != nil || start == 0 || end < start {
+			t.Errorf("%s: times %s to %s", sp.Name, sp.StartTimeUnixNano, sp.EndTimeUnixNano)
+		}
+	}
+	request, ok := byName["POST /notes/{id}"]
+	if len(spans) != 3 || !ok {
+		t.Fatalf("got spans %+v", spans)
+	}
+	if request.ParentSpanID != "b7ad6b7169203331" || request.Kind != spanServer {
+		t.Errorf("request span: parent %s kind %d", request.ParentSpanID, request.Kind)
+	}
+	for _, name := range []string{"db.exec", "db.query"} {
+		sp := byName[name]
+		if sp.ParentSpanID != request.SpanID || sp.Kind != spanClient {
+			t.Errorf("%s: parent %s kind %d, want child of %s", name, sp.ParentSpanID, sp.Kind, request.SpanID)
+		}
+		for _, attr := range sp.Attributes {
+			if attr.Value.StringValue != nil && *attr.Value.StringValue == "secret" {
+				t.Errorf("%s records a bound value", name)
+			}
+		}
+	}
+	attrs := map[string]string{}
+	for _, attr := range request.Attributes {
+		if attr.Value.StringValue != nil {
+			attrs[attr.Key] = *attr.Value.StringValue
+		} else if attr.Value.IntValue != nil {
+			attrs[attr.Key] = *attr.Value.IntValue
+		}
+	}
+	if attrs["http.route"] != "/notes/{id}" || attrs["http.response.status_code"] != "201" {
+		t.Errorf("request span attributes: got %v", attrs)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Largest media accepted by kind, WhatsApp's practical caps. Stickers and
+// pictures are converted or resized after upload, they get the same 5 MB as
+// when fetched by URL. -maxmediasize lowers all of them.
+var uploadLimits = map[string]int64{
+	"image":    16 << 20,
+	"audio":    16 << 20,
+	"video":    16 << 20,
+	"document": 100 << 20,
+	"sticker":  stickerMaxDownload,
+	"picture":  profilePictureMaxDownload,
+}
+
+// Room in upload bodies for the fields other than the media
+const uploadBodySlack = 16 * 1024
+
+func uploadLimit(kind string) int64 {
+	limit := uploadLimits[kind]
+	if *maxMediaSize < limit {
+		limit = *maxMediaSize
+	}
+	return limit
+}
+
+// A size in the largest unit it is a whole number of, about
+func byteSize(size int64) string {
+	if size < 1<<10 {
+		return fmt.Sprintf("%d bytes", size)
+	}
+	if size < 1<<20 {
+		return fmt.Sprintf("%d KB", size>>10)
+	}
+	return fmt.Sprintf("%d MB", size>>20)
+}
+
+func uploadTooLarge(kind string) error {
+	limit := uploadLimit(kind)
+	return newAPIError(ErrPayloadTooLarge, fmt.Sprintf("Payload too large, %s uploads are limited to %s", kind, byteSize(limit)), map[string]interface{}{"limit": limit})
+}
+
+func bodyTooLarge(limit int64) error {
+	return newAPIError(ErrPayloadTooLarge, fmt.Sprintf("Payload too large, request bodies are limited to %s", byteSize(limit)), map[string]interface{}{"limit": limit})
+}
+
+// Request body capped by limitBody, remembering whether the cap was hit.
+// original is the body as received, for limitUpload to cap on its own.
+type limitedBody struct {
+	io.ReadCloser
+	original io.ReadCloser
+	limit    int64
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// Middleware: Caps request bodies at -max-body-bytes, media uploads get
+// their own limit from limitUpload so the Content-Length isn't checked here.
+// Bodies are cut off while being read and the connection closed after
+// answering.
+func (s *server) limitBody(next http.Handler) http.Handler {
+	return s.limitBodyTo(maxBodyBytes)(next)
+}
+
+// Middleware: Caps request bodies at limit as limitBody does, for endpoints
+// taking more than -max-body-bytes
+func (s *server) limitBodyTo(limit *int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, *limit), original: r.Body, limit: *limit}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Limit of a body limitBody cut off, handlers only see it fail to decode
+func bodyLimitExceeded(r *http.Request) (int64, bool) {
+	if body, ok := r.Body.(*limitedBody); ok && body.exceeded {
+		return body.limit, true
+	}
+	return 0, false
+}
+
+// Middleware: Caps the body of media uploads at the base64 size of the
+// kind's limit. Bodies are cut off while being read so an oversized upload
+// never sits whole in memory.
+func (s *server) limitUpload(kind string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit := int64(base64.StdEncoding.EncodedLen(int(uploadLimit(kind)))) + uploadBodySlack
+			if r.ContentLength > limit {
+				s.Respond(w, r, http.StatusRequestEntityTooLarge, uploadTooLarge(kind))
+				return
+			}
+			if body, ok := r.Body.(*limitedBody); ok {
+				r.Body = body.original
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Answers an upload body that couldn't be decoded, 413 when it was cut off
+// by limitUpload
+func (s *server) decodeFailed(w http.ResponseWriter, r *http.Request, err error, kind string) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		s.Respond(w, r, http.StatusRequestEntityTooLarge, uploadTooLarge(kind))
+		return
+	}
+	s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+}
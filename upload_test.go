@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Body that never ends, a JSON prefix followed by as many A as are read.
+// read counts what was taken from it.
+type endlessBody struct {
+	prefix string
+	read   int64
+}
+
+func (b *endlessBody) Read(p []byte) (int, error) {
+	n := copy(p, b.prefix)
+	b.prefix = b.prefix[n:]
+	for i := n; i < len(p); i++ {
+		p[i] = 'A'
+	}
+	b.read += int64(len(p))
+	return len(p), nil
+}
+
+func (b *endlessBody) Close() error { return nil }
+
+// Sets a size flag for the test
+func setLimit(t *testing.T, flag *int64, limit int64) {
+	t.Helper()
+	saved := *flag
+	*flag = limit
+	t.Cleanup(func() { *flag = saved })
+}
+
+// A user with a session whose client never connects, enough for handlers
+// to get past the session check
+func testSession(t *testing.T, s *server, token string) int {
+	t.Helper()
+	userID := testUser(t, s, token)
+	device := sqlstore.NewWithDB(testStoreDB(t), "sqlite", waLog.Noop).NewDevice()
+	sess, ok := sessions.reserve(userID)
+	if !ok {
+		t.Fatal("could not reserve session")
+	}
+	t.Cleanup(sessions.finished)
+	t.Cleanup(func() { sessions.remove(userID, sess) })
+	if !sessions.attach(userID, sess, whatsmeow.NewClient(device, waLog.Noop), nil) {
+		t.Fatal("could not attach session")
+	}
+	return userID
+}
+
+// Checks a 413 answer carries the limit
+func assertTooLarge(t *testing.T, w *httptest.ResponseRecorder, limit int64) {
+	t.Helper()
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, want 413: %s", w.Code, w.Body)
+	}
+	var body struct {
+		Code    string
+		Details map[string]interface{}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Code != ErrPayloadTooLarge || body.Details["limit"] != float64(limit) {
+		t.Errorf("got %s, want %s with limit %d", w.Body, ErrPayloadTooLarge, limit)
+	}
+}
+
+func TestUploadLimit(t *testing.T) {
+	tests := []struct {
+		maxMedia int64
+		limits   map[string]int64
+	}{
+		{64 << 20, map[string]int64{"image": 16 << 20, "audio": 16 << 20, "video": 16 << 20, "document": 64 << 20, "sticker": 5 << 20, "picture": 5 << 20}},
+		{200 << 20, map[string]int64{"image": 16 << 20, "video": 16 << 20, "document": 100 << 20, "sticker": 5 << 20}},
+		{1 << 20, map[string]int64{"image": 1 << 20, "video": 1 << 20, "document": 1 << 20, "sticker": 1 << 20, "picture": 1 << 20}},
+	}
+	for _, tt := range tests {
+		setLimit(t, maxMediaSize, tt.maxMedia)
+		for kind, want := range tt.limits {
+			if got := uploadLimit(kind); got != want {
+				t.Errorf("%s with -maxmediasize %d: limit %d, want %d", kind, tt.maxMedia, got, want)
+			}
+		}
+	}
+}
+
+func TestMaxUploadBytesAlias(t *testing.T) {
+	setLimit(t, maxMediaSize, *maxMediaSize)
+	if err := flag.Set("max-upload-bytes", "2097152"); err != nil {
+		t.Fatal(err)
+	}
+	if *maxMediaSize != 2<<20 || uploadLimit("video") != 2<<20 {
+		t.Errorf("-max-upload-bytes 2MB gave -maxmediasize %d", *maxMediaSize)
+	}
+}
+
+func TestOversizedJSONBody(t *testing.T) {
+	s := &server{db: testUsersDB(t)}
+	body := &endlessBody{prefix: `{"name":"`}
+	r := httptest.NewRequest("POST", "/admin/users", nil)
+	r.Body, r.ContentLength = body, -1
+	w := httptest.NewRecorder()
+	s.limitBody(s.AddUser()).ServeHTTP(w, r)
+
+	assertTooLarge(t, w, *maxBodyBytes)
+	// Reading stops at the limit, the rest is never taken
+	if body.read > *maxBodyBytes+1 {
+		t.Errorf("read %d bytes of a body limited to %d", body.read, *maxBodyBytes)
+	}
+}
+
+func TestImportBodyLimit(t *testing.T) {
+	s := &server{db: testUsersDB(t)}
+	setLimit(t, maxImportBytes, 4<<20)
+
+	// Over -max-body-bytes but not -max-import-bytes, the export is read
+	export := `{"Passphrase":"secret","Export":"` + strings.Repeat("A", 2<<20) + `"}`
+	w := httptest.NewRecorder()
+	s.limitBodyTo(maxImportBytes)(s.ImportUser()).ServeHTTP(w, httptest.NewRequest("POST", "/admin/users/import", strings.NewReader(export)))
+	if w.Code == http.StatusRequestEntityTooLarge {
+		t.Fatalf("export under -max-import-bytes refused: %s", w.Body)
+	}
+
+	body := &endlessBody{prefix: `{"Passphrase":"secret","Export":"`}
+	r := httptest.NewRequest("POST", "/admin/users/import", nil)
+	r.Body, r.ContentLength = body, -1
+	w = httptest.NewRecorder()
+	s.limitBodyTo(maxImportBytes)(s.ImportUser()).ServeHTTP(w, r)
+	assertTooLarge(t, w, *maxImportBytes)
+	if body.read > *maxImportBytes+1 {
+		t.Errorf("read %d bytes of a body limited to %d", body.read, *maxImportBytes)
+	}
+}
+
+func TestOversizedMediaUpload(t *testing.T) {
+	s := &server{db: testUsersDB(t)}
+	testSession(t, s, "upload-limit")
+	setLimit(t, maxMediaSize, 64<<10)
+	bodyLimit := int64(base64.StdEncoding.EncodedLen(64<<10)) + uploadBodySlack
+	// As routed, the JSON body limit first and the upload's own after it
+	handler := s.limitBody(s.limitUpload("image")(s.SendImage()))
+
+	t.Run("declared length", func(t *testing.T) {
+		body := &endlessBody{}
+		r := userRequest(t, "upload-limit", "POST", "/chat/send/image", "")
+		r.Body, r.ContentLength = body, 700<<20
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assertTooLarge(t, w, 64<<10)
+		if body.read != 0 {
+			t.Errorf("read %d bytes of a body refused by its length", body.read)
+		}
+	})
+
+	t.Run("chunked", func(t *testing.T) {
+		body := &endlessBody{prefix: `{"Phone":"5511999990000","Image":"data:image/jpeg;base64,`}
+		r := userRequest(t, "upload-limit", "POST", "/chat/send/image", "")
+		r.Body, r.ContentLength = body, -1
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assertTooLarge(t, w, 64<<10)
+		if body.read > bodyLimit+1 {
+			t.Errorf("read %d bytes of a body limited to %d", body.read, bodyLimit)
+		}
+	})
+
+	t.Run("over the JSON limit", func(t *testing.T) {
+		// Media bodies may be bigger than -max-body-bytes
+		setLimit(t, maxBodyBytes, 1<<10)
+		image := strings.Repeat("A", 8<<10)
+		r := userRequest(t, "upload-limit", "POST", "/chat/send/image", `{"Phone":"5511999990000","Image":"data:image/jpeg;base64,`+image+`"}`)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code == http.StatusRequestEntityTooLarge {
+			t.Errorf("upload under -maxmediasize refused: %s", w.Body)
+		}
+	})
+}
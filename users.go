@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A new user as given to POST /admin/users or wuzapi user add
+type newUser struct {
+	Name              string `json:"name"`
+	Token             string `json:"token"`
+	Webhook           string `json:"webhook"`
+	Expiration        int    `json:"expiration"`
+	Events            string `json:"events"`
+	ProxyURL          string `json:"proxy_url"`
+	StoreMessages     bool   `json:"store_messages"`
+	MaxMessagesPerDay int    `json:"max_messages_per_day"`
+	DeviceName        string `json:"device_name"`
+	PayloadFormat     string `json:"payload_format"`
+	ContactNames      *bool  `json:"contact_names"`
+}
+
+// Another user already has the token
+var errTokenTaken = errors.New("User with the same token already exists")
+
+type queryExecer interface {
+	execer
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Checks a comma separated list of events, returned without the spaces
+// around them. Empty is All, as sessions take no events.
+func parseEvents(list string) (string, error) {
+	if strings.TrimSpace(list) == "" {
+		return "All", nil
+	}
+	events := strings.Split(list, ",")
+	for i, event := range events {
+		event = strings.TrimSpace(event)
+		if !contains(messageTypes, event) {
+			return "", errors.New("Invalid event: " + event)
+		}
+		events[i] = event
+	}
+	return strings.Join(events, ","), nil
+}
+
+// Checks a new user, the payload format defaults to raw
+func (user *newUser) validate() error {
+	events, err := parseEvents(user.Events)
+	if err != nil {
+		return err
+	}
+	user.Events = events
+	if err := validateWebhookURL(user.Webhook); err != nil {
+		return fmt.Errorf("Invalid webhook: %v", err)
+	}
+	if user.ProxyURL != "" {
+		if err := validateProxyURL(user.ProxyURL); err != nil {
+			return fmt.Errorf("Invalid proxy_url: %v", err)
+		}
+	}
+	if user.MaxMessagesPerDay < 0 {
+		return errors.New("Invalid max_messages_per_day")
+	}
+	if err := validateDeviceName(user.DeviceName); err != nil {
+		return fmt.Errorf("Invalid device_name: %v", err)
+	}
+	if user.PayloadFormat == "" {
+		user.PayloadFormat = "raw"
+	} else if !Find(payloadFormats, user.PayloadFormat) {
+		return errors.New("Invalid payload_format, must be raw or simplified")
+	}
+	return nil
+}
+
+// Inserts a validated user and returns its id, errTokenTaken when the token
+// is in use
+func insertUser(db queryExecer, user newUser) (int64, error) {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE token = ?", user.Token).Scan(&count); err != nil {
+		return 0, err
+	}
+	if count > 0 {
+		return 0, errTokenTaken
+	}
+
+	storeMessages := 0
+	if user.StoreMessages {
+		storeMessages = 1
+	}
+	// Names are added unless turned off
+	contactNames := 1
+	if user.ContactNames != nil && !*user.ContactNames {
+		contactNames = 0
+	}
+	result, err := execRetry(db, "INSERT INTO users (name, token, webhook, expiration, events, jid, qrcode, proxy_url, store_messages, max_messages_per_day, device_name, payload_format, contact_names) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		user.Name, user.Token, user.Webhook, user.Expiration, user.Events, "", "", user.ProxyURL, storeMessages, user.MaxMessagesPerDay, user.DeviceName, user.PayloadFormat, contactNames)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestListUsersPages(t *testing.T) {
+	db := testUsersDB(t)
+	for i := 1; i <= 5; i++ {
+		if _, err := insertUser(db, newUser{Name: fmt.Sprintf("u%d", i), Token: fmt.Sprintf("tok%d", i), PayloadFormat: "raw"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &server{db: db}
+
+	tests := []struct {
+		query string
+		ids   []int
+		total string
+	}{
+		{"", []int{1, 2, 3, 4, 5}, "5"},
+		{"?limit=2", []int{1, 2}, "5"},
+		{"?limit=2&offset=3", []int{4, 5}, "5"},
+		{"?offset=10", []int{}, "5"},
+		{"?connected=false&limit=1&offset=1", []int{2}, "5"},
+		{"?connected=true", []int{}, "0"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.ListUsers()(w, httptest.NewRequest("GET", "/admin/users"+tt.query, nil))
+		if w.Code != 200 {
+			t.Fatalf("%q: status %d: %s", tt.query, w.Code, w.Body)
+		}
+		if got := w.Header().Get("X-Total-Count"); got != tt.total {
+			t.Errorf("%q: X-Total-Count %s, want %s", tt.query, got, tt.total)
+		}
+		var users []struct {
+			Id int `json:"id"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &users); err != nil {
+			t.Fatalf("%q: %v: %s", tt.query, err, w.Body)
+		}
+		ids := []int{}
+		for _, user := range users {
+			ids = append(ids, user.Id)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(tt.ids) {
+			t.Errorf("%q: ids %v, want %v", tt.query, ids, tt.ids)
+		}
+	}
+}
+
+func TestParseEvents(t *testing.T) {
+	tests := []struct {
+		list string
+		want string
+		err  bool
+	}{
+		{"Message", "Message", false},
+		{"Message, ReadReceipt", "Message,ReadReceipt", false},
+		{" Message ,Presence , All", "Message,Presence,All", false},
+		{"", "All", false},
+		{"  ", "All", false},
+		{"Message,", "", true},
+		{"Message,Unknown", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseEvents(tt.list)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("%q: got %q %v, want %q", tt.list, got, err, tt.want)
+		}
+	}
+}
+
+func TestUpdateUserEvents(t *testing.T) {
+	s := &server{db: testUsersDB(t)}
+	id, err := insertUser(s.db, newUser{Name: "events", Token: "events-token", Events: "Message", PayloadFormat: "raw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		events string
+		want   string
+	}{
+		{"Message, ReadReceipt", "Message,ReadReceipt"},
+		{"", "All"},
+	} {
+		r := httptest.NewRequest("PUT", "/admin/users/"+strconv.FormatInt(id, 10), strings.NewReader(`{"events":"`+tt.events+`"}`))
+		r = mux.SetURLVars(r, map[string]string{"id": strconv.FormatInt(id, 10)})
+		w := httptest.NewRecorder()
+		s.UpdateUser()(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: status %d: %s", tt.events, w.Code, w.Body)
+		}
+		var stored string
+		if err := s.db.QueryRow("SELECT events FROM users WHERE id=?", id).Scan(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if stored != tt.want {
+			t.Errorf("%q: stored %q, want %q", tt.events, stored, tt.want)
+		}
+	}
+}
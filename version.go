@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"runtime"
+	"strings"
+)
+
+// Version of wuzapi and of the API served under /v1. commit and buildDate
+// are set when building:
+//
+//	go build -ldflags "-X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "1.0.0"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+const apiVersion = "v1"
+
+// Marks responses of the unprefixed paths kept by -legacy-routes as
+// deprecated, pointing to the /v1 path replacing them
+func deprecated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "</"+apiVersion+r.URL.Path+">; rel=\"successor-version\"")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Tells whether path is an admin route, versioned or legacy
+func isAdminPath(path string) bool {
+	return hasPathPrefix(path, "/"+apiVersion+*adminPrefix) || hasPathPrefix(path, *adminPrefix)
+}
+
+// Whether path is prefix or below it, /adminx is not under /admin
+func hasPathPrefix(path string, prefix string) bool {
+	rest, ok := strings.CutPrefix(path, prefix)
+	return ok && (rest == "" || rest[0] == '/')
+}
+
+// First path segments served besides the admin routes
+var userRoutePrefixes = []string{"/" + apiVersion, "/session", "/ws", "/events", "/webhook", "/chat", "/chats", "/broadcast", "/user", "/call", "/group",
+	"/newsletter", "/health", "/ready", "/openapi.json", "/version"}
+
+// Admin routes go under -admin-prefix, a path of its own: it can't take over the
+// user routes, the probes or the static files
+func validateAdminPrefix(prefix string) error {
+	if !strings.HasPrefix(prefix, "/") || strings.HasSuffix(prefix, "/") || path.Clean(prefix) != prefix {
+		return errors.New("must be a clean path starting with / and not ending with /")
+	}
+	for _, taken := range userRoutePrefixes {
+		if hasPathPrefix(prefix, taken) || hasPathPrefix(taken, prefix) {
+			return fmt.Errorf("overlaps the %s routes", taken)
+		}
+	}
+	return nil
+}
+
+// Build information, no token needed
+func (s *server) Version() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"version":       version,
+			"api":           apiVersion,
+			"commit":        commit,
+			"build_date":    buildDate,
+			"go":            runtime.Version(),
+			"legacy_routes": *legacyRoutes,
+		})
+	}
+}
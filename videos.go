@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Probing and grabbing a frame of a long video can take a while, don't
+// hold the send
+const videoInspectTimeout = 20 * time.Second
+
+// Video codecs every WhatsApp client plays, iOS can't play the others
+var playableVideoCodecs = []string{"h264"}
+
+// What ffprobe tells of a video, zero values when unknown
+type videoInfo struct {
+	Seconds uint32
+	Width   uint32
+	Height  uint32
+	Codec   string
+}
+
+// Probes duration, size and codec of a video and grabs a frame as its
+// thumbnail, with the -ffprobe and -ffmpeg tools. Either part is skipped when
+// its tool isn't installed, a nil thumbnail means none could be made.
+func inspectVideo(data []byte) (videoInfo, []byte, uint32, uint32, error) {
+	var info videoInfo
+	ffprobe, probeErr := lookupTool(*ffprobePath)
+	ffmpeg, ffmpegErr := lookupTool(*ffmpegPath)
+	if probeErr != nil && ffmpegErr != nil {
+		// Without the tools videos go as before, callers can set the fields
+		return info, nil, 0, 0, nil
+	}
+
+	dir, err := os.MkdirTemp("", "wuzapi-video")
+	if err != nil {
+		return info, nil, 0, 0, err
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "in")
+	if err := os.WriteFile(input, data, 0600); err != nil {
+		return info, nil, 0, 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), videoInspectTimeout)
+	defer cancel()
+
+	var errs []error
+	if probeErr == nil {
+		info, err = probeVideo(ctx, ffprobe, input)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	var thumbnail []byte
+	var width, height uint32
+	if ffmpegErr == nil {
+		// A frame a bit in, the very first one is often black
+		at := "0"
+		if info.Seconds >= 2 {
+			at = "1"
+		}
+		output := filepath.Join(dir, "frame.jpg")
+		out, err := exec.CommandContext(ctx, ffmpeg, "-v", "error", "-ss", at, "-i", input, "-frames:v", "1", "-f", "image2", output).CombinedOutput()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("ffmpeg failed: %v %s", err, out))
+		} else if frame, err := os.ReadFile(output); err != nil {
+			errs = append(errs, err)
+		} else if thumbnail, width, height, err = mediaThumbnail(frame); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return info, thumbnail, width, height, errors.Join(errs...)
+}
+
+// Full path of a tool given by -ffmpeg or -ffprobe, an empty flag disables it
+func lookupTool(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("disabled")
+	}
+	return exec.LookPath(name)
+}
+
+func probeVideo(ctx context.Context, ffprobe string, input string) (videoInfo, error) {
+	var info videoInfo
+	out, err := exec.CommandContext(ctx, ffprobe, "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=codec_name,width,height:format=duration", "-of", "json", input).Output()
+	if err != nil {
+		return info, fmt.Errorf("ffprobe failed: %w", err)
+	}
+	var probe struct {
+		Streams []struct {
+			CodecName string `json:"codec_name"`
+			Width     uint32 `json:"width"`
+			Height    uint32 `json:"height"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return info, fmt.Errorf("could not read ffprobe output: %w", err)
+	}
+	if len(probe.Streams) == 0 {
+		return info, errors.New("no video stream found")
+	}
+	info.Codec = probe.Streams[0].CodecName
+	info.Width = probe.Streams[0].Width
+	info.Height = probe.Streams[0].Height
+	if duration, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil && duration > 0 {
+		info.Seconds = uint32(math.Ceil(duration))
+	}
+	return info, nil
+}
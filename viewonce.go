@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/vincent-petithory/dataurl"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+)
+
+// Wraps a media message in the view once envelope, the media itself has to
+// be marked ViewOnce as well
+func viewOnceMessage(msg *waProto.Message) *waProto.Message {
+	return &waProto.Message{ViewOnceMessage: &waProto.FutureProofMessage{Message: msg}}
+}
+
+var savedMediaID = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+
+// Copy of the media of a received message, saved in the user's files
+// directory as it arrived. View once media is deleted from the CDN once
+// opened on the phone, this copy is what is left of it.
+func savedMedia(userDirectory string, msgid string) ([]byte, bool) {
+	if !savedMediaID.MatchString(msgid) {
+		return nil, false
+	}
+	matches, _ := filepath.Glob(filepath.Join(userDirectory, msgid+".*"))
+	if len(matches) == 0 {
+		return nil, false
+	}
+	data, err := os.ReadFile(matches[0])
+	if err != nil {
+		log.Warn().Err(err).Str("path", matches[0]).Msg("Could not read saved media")
+		return nil, false
+	}
+	return data, true
+}
+
+// Tells apart media that is gone from the CDN (expired, or a view once one
+// that was opened) from media whose keys or hashes don't match
+func downloadFailed(err error, kind string) error {
+	message := fmt.Sprintf("Failed to download %s %v", kind, err)
+	switch {
+	case errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith404), errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith410):
+		return newAPIError(ErrMediaExpired, message, map[string]interface{}{"reason": "expired"})
+	case errors.Is(err, whatsmeow.ErrInvalidMediaHMAC), errors.Is(err, whatsmeow.ErrInvalidMediaEncSHA256), errors.Is(err, whatsmeow.ErrInvalidMediaSHA256):
+		return newAPIError(ErrMediaDecryption, message, map[string]interface{}{"reason": "decryption"})
+	}
+	return errors.New(message)
+}
+
+// Answers a download from the saved copy, as a data URL or raw when Stream
+// was asked
+func (s *server) respondSaved(w http.ResponseWriter, r *http.Request, data []byte, mimetype string, stream bool) {
+	if mimetype == "" {
+		mimetype = http.DetectContentType(data)
+	}
+	if stream {
+		w.Header().Set("Content-Type", mimetype)
+		w.Write(data)
+		return
+	}
+	responseJson, err := json.Marshal(map[string]interface{}{"Mimetype": mimetype, "Data": dataurl.New(data, mimetype).String()})
+	if err != nil {
+		s.Respond(w, r, http.StatusInternalServerError, err)
+	} else {
+		s.Respond(w, r, http.StatusOK, string(responseJson))
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/hlog"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// whatsmeow log levels, a client logs at its level and above. OFF is the
+// default when neither the user nor -wadebug sets one.
+var waLogLevels = map[string]int32{
+	"DEBUG": 0,
+	"INFO":  1,
+	"WARN":  2,
+	"ERROR": 3,
+	"OFF":   4,
+}
+
+var errInvalidWALevel = errors.New("Invalid level, use DEBUG, INFO, WARN, ERROR, OFF or empty for the server default")
+
+// Current level of each user's client loggers, by user id. Kept while the
+// server runs so a reconnect picks up a level changed in between.
+var waLevels sync.Map
+
+func waLevel(userID int) *atomic.Int32 {
+	level, _ := waLevels.LoadOrStore(userID, new(atomic.Int32))
+	return level.(*atomic.Int32)
+}
+
+// Level a client logs at, the user's wa_debug or else -wadebug
+func effectiveWALevel(userLevel string) string {
+	if userLevel == "" {
+		userLevel = strings.ToUpper(*waDebug)
+	}
+	if _, ok := waLogLevels[userLevel]; !ok {
+		return "OFF"
+	}
+	return userLevel
+}
+
+// whatsmeow logger of one user's client. Lines go through the server log
+// tagged with the user so output of many sessions can be told apart, and the
+// level can be changed while the client runs.
+type clientLogger struct {
+	module string
+	userID int
+	name   string
+	level  *atomic.Int32
+}
+
+func newClientLogger(userID int, name string, userLevel string) *clientLogger {
+	level := waLevel(userID)
+	level.Store(waLogLevels[effectiveWALevel(userLevel)])
+	return &clientLogger{module: "Client", userID: userID, name: name, level: level}
+}
+
+func (l *clientLogger) output(level string, msg string, args ...interface{}) {
+	if waLogLevels[level] < l.level.Load() {
+		return
+	}
+	var event = log.Debug()
+	switch level {
+	case "INFO":
+		event = log.Info()
+	case "WARN":
+		event = log.Warn()
+	case "ERROR":
+		event = log.Error()
+	}
+	event.Str("userid", strconv.Itoa(l.userID)).Str("user", l.name).Str("module", l.module).Msg(fmt.Sprintf(msg, args...))
+}
+
+func (l *clientLogger) Errorf(msg string, args ...interface{}) { l.output("ERROR", msg, args...) }
+func (l *clientLogger) Warnf(msg string, args ...interface{})  { l.output("WARN", msg, args...) }
+func (l *clientLogger) Infof(msg string, args ...interface{})  { l.output("INFO", msg, args...) }
+func (l *clientLogger) Debugf(msg string, args ...interface{}) { l.output("DEBUG", msg, args...) }
+func (l *clientLogger) Sub(module string) waLog.Logger {
+	return &clientLogger{module: l.module + "/" + module, userID: l.userID, name: l.name, level: l.level}
+}
+
+// Saves a user's whatsmeow log level and applies it to the running client,
+// empty goes back to -wadebug. Returns the level now in effect.
+func (s *server) setWALevel(userID int, level string) (string, error) {
+	level = strings.ToUpper(strings.TrimSpace(level))
+	if _, ok := waLogLevels[level]; !ok && level != "" {
+		return "", errInvalidWALevel
+	}
+	result, err := execRetry(s.db, "UPDATE users SET wa_debug=? WHERE id=?", level, userID)
+	if err != nil {
+		return "", err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return "", sql.ErrNoRows
+	}
+	effective := effectiveWALevel(level)
+	waLevel(userID).Store(waLogLevels[effective])
+	return effective, nil
+}
+
+type waLevelStruct struct {
+	Level string
+}
+
+func (s *server) respondWALevel(w http.ResponseWriter, r *http.Request, userID int) {
+	var t waLevelStruct
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+		return
+	}
+
+	effective, err := s.setWALevel(userID, t.Level)
+	if err == sql.ErrNoRows {
+		s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
+		return
+	}
+	if err == errInvalidWALevel {
+		s.Respond(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		hlog.FromRequest(r).Error().Err(err).Msg("Could not set whatsmeow log level")
+		s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+		return
+	}
+
+	hlog.FromRequest(r).Info().Int("userid", userID).Str("level", effective).Msg("whatsmeow log level updated")
+	response := map[string]interface{}{"Details": "Log level updated", "Level": strings.ToUpper(strings.TrimSpace(t.Level)), "Effective": effective}
+	responseJson, err := json.Marshal(response)
+	if err != nil {
+		s.Respond(w, r, http.StatusInternalServerError, err)
+	} else {
+		s.Respond(w, r, http.StatusOK, string(responseJson))
+	}
+}
+
+// Sets the whatsmeow log level of the user's own client
+func (s *server) SetLogLevel() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		s.respondWALevel(w, r, userid)
+	}
+}
+
+// Sets the whatsmeow log level of any user's client
+func (s *server) SetUserLogLevel() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userid, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid user id"))
+			return
+		}
+		s.respondWALevel(w, r, userid)
+	}
+}
+
+// Lists the users with a whatsmeow log level of their own, so verbose
+// logging turned on for a session isn't forgotten
+func (s *server) ListLogLevels() http.HandlerFunc {
+
+	type userLevel struct {
+		Id        int
+		Name      string
+		Level     string
+		Connected bool
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		rows, err := s.db.Query("SELECT id, name, wa_debug FROM users WHERE wa_debug!='' ORDER BY id")
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
+		}
+		defer rows.Close()
+		users := []userLevel{}
+		for rows.Next() {
+			var u userLevel
+			if err := rows.Scan(&u.Id, &u.Name, &u.Level); err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+				return
+			}
+			u.Connected = sessions.client(u.Id) != nil
+			users = append(users, u)
+		}
+
+		response := map[string]interface{}{"Default": effectiveWALevel(""), "Users": users}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
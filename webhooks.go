@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// Webhook posts waiting for a worker and those given up on because the queue
+// was full, reported by the health check
+var (
+	webhooksQueued  atomic.Int64
+	webhooksDropped atomic.Int64
+)
+
+// Webhook workers of all users, the shutdown waits for them to post what
+// was queued
+var webhookWorkersRunning sync.WaitGroup
+
+type webhookJob struct {
+	url     string
+	data    map[string]string
+	path    string
+	headers map[string]string
+	timeout time.Duration
+	gzip    bool
+	// Event type, for tracing
+	event string
+}
+
+// Longest webhook timeout a user can set, in seconds
+const maxWebhookTimeout = 300
+
+// Largest part of the receiver's answer returned by /webhook/test
+const webhookTestBodyLimit = 1024
+
+// Checks a webhook URL before it is saved, empty clears the webhook. With
+// -webhook-block-private hosts resolving to loopback, private or link local
+// addresses are refused so users of a shared server can't reach its network.
+func validateWebhookURL(rawURL string) error {
+	if rawURL == "" {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return errors.New("could not parse URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q, use http or https", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return errors.New("missing host")
+	}
+	if !*webhookNoPrivate {
+		return nil
+	}
+	ips, err := net.LookupIP(u.Hostname())
+	if err != nil {
+		return fmt.Errorf("could not resolve %s", u.Hostname())
+	}
+	for _, ip := range ips {
+		if privateAddress(ip) {
+			return fmt.Errorf("%s resolves to a private address", u.Hostname())
+		}
+	}
+	return nil
+}
+
+func privateAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// Dialer Control of webhook and media download connections with
+// -webhook-block-private. It sees the resolved address, so a host changing
+// its DNS after being saved or a redirect to a private address doesn't get
+// through either.
+func refusePrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil && privateAddress(ip) {
+		return errors.New("address " + host + " is private")
+	}
+	return nil
+}
+
+// HTTP client posting webhooks. Timeouts are set on each post, users can
+// have their own.
+func newWebhookClient() *resty.Client {
+	//httpClient := resty.New().EnableTrace()
+	httpClient := resty.New()
+	httpClient.SetRedirectPolicy(resty.FlexibleRedirectPolicy(15))
+	if *waDebug == "DEBUG" {
+		httpClient.SetDebug(true)
+		httpClient.OnRequestLog(redactRequestLog)
+	}
+	// Receivers are verified against the system CAs, or those of -webhook-ca
+	httpClient.SetTLSClientConfig(&tls.Config{RootCAs: webhookRootCAs, Certificates: webhookCertificates})
+	if *webhookNoPrivate {
+		if transport, ok := httpClient.GetClient().Transport.(*http.Transport); ok {
+			dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: refusePrivateAddress}
+			transport.DialContext = dialer.DialContext
+		}
+	}
+	httpClient.OnError(func(req *resty.Request, err error) {
+		if v, ok := err.(*resty.ResponseError); ok {
+			// v.Response contains the last response from the server
+			// v.Err contains the original error
+			log.Debug().Str("response", v.Response.String()).Msg("resty error")
+			log.Error().Err(v.Err).Msg("resty error")
+		}
+	})
+	return httpClient
+}
+
+// Raised when the envelope or a payload changes in a way receivers would
+// notice, fields being added doesn't count
+const webhookEnvelopeVersion = 1
+
+// What every webhook post carries in jsonData, unless -webhook-legacy.
+// payload is the event in the shape posted before the envelope existed.
+type webhookEnvelope struct {
+	Event     string                 `json:"event"`
+	Version   int                    `json:"version"`
+	Token     string                 `json:"token"`
+	Timestamp int64                  `json:"timestamp"`
+	Seq       uint64                 `json:"seq,omitempty"`
+	Payload   map[string]interface{} `json:"payload"`
+}
+
+// jsonData of a webhook post for an event
+func webhookJSON(postmap map[string]interface{}, token string) ([]byte, error) {
+	if *webhookLegacy {
+		return json.Marshal(postmap)
+	}
+	eventType, _ := postmap["type"].(string)
+	seq, _ := postmap["seq"].(uint64)
+	return json.Marshal(webhookEnvelope{
+		Event:     eventType,
+		Version:   webhookEnvelopeVersion,
+		Token:     token,
+		Timestamp: time.Now().Unix(),
+		Seq:       seq,
+		Payload:   postmap,
+	})
+}
+
+// Outcome of a /webhook/test post
+type webhookTestResult struct {
+	URL       string `json:"url"`
+	Status    int    `json:"status"`
+	LatencyMs int64  `json:"latency_ms"`
+	Body      string `json:"body"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Posts a test event to webhookURL the way events are posted, with the
+// user's headers, timeout and compression. The post is traced as a child of
+// parent's span, it isn't canceled with it.
+func testWebhook(parent context.Context, webhookURL string, token string, headers map[string]string, timeout time.Duration, compress bool) (result webhookTestResult) {
+	result = webhookTestResult{URL: webhookURL}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, sp := startSpan(parent, "webhook.test", spanClient)
+	defer func() {
+		if sp != nil {
+			sp.setInt("http.response.status_code", int64(result.Status))
+			var err error
+			if result.Error != "" {
+				err = errors.New(result.Error)
+			}
+			sp.finish(err)
+		}
+	}()
+	httpClient := newWebhookClient()
+	defer httpClient.GetClient().CloseIdleConnections()
+
+	jsonData := []byte(`{"event":"test"}`)
+	if !*webhookLegacy {
+		jsonData, _ = json.Marshal(webhookEnvelope{Event: "test", Version: webhookEnvelopeVersion, Token: token, Timestamp: time.Now().Unix(), Payload: map[string]interface{}{}})
+	}
+	data := map[string]string{"jsonData": string(jsonData), "token": token}
+	req := httpClient.R().SetContext(ctx).SetHeaders(headers).SetDoNotParseResponse(true)
+	sp.webhook(req, webhookURL, 0, "test")
+	if err := setWebhookForm(req, data, compress); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	start := time.Now()
+	resp, err := req.Post(webhookURL)
+	result.LatencyMs = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.RawBody().Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.RawBody(), webhookTestBodyLimit))
+	result.Status = resp.StatusCode()
+	result.Body = string(body)
+	if resp.IsError() {
+		result.Error = "webhook answered " + resp.Status()
+	}
+	return result
+}
+
+// Headers set by wuzapi itself, users can't replace them
+var reservedWebhookHeaders = []string{"Content-Type", "Content-Length", "Host", "Transfer-Encoding", "Connection"}
+
+// Checks the static headers a user attaches to webhook posts. Values are
+// secrets (API keys), errors only name the header.
+func validateWebhookHeaders(headers map[string]string) error {
+	for name, value := range headers {
+		if !validHeaderName(name) {
+			return errors.New("invalid header name " + strconv.Quote(name))
+		}
+		if Find(reservedWebhookHeaders, http.CanonicalHeaderKey(name)) {
+			return errors.New("header " + name + " can't be set")
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return errors.New("invalid value for header " + name)
+		}
+	}
+	return nil
+}
+
+// Header names are RFC 7230 tokens
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Static headers stored as JSON in users.webhook_headers, nil when none
+func parseWebhookHeaders(stored string) map[string]string {
+	if stored == "" {
+		return nil
+	}
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(stored), &headers); err != nil {
+		log.Error().Err(err).Msg("Invalid webhook headers")
+		return nil
+	}
+	return headers
+}
+
+// Names of the headers, for responses that must not show the values
+func webhookHeaderNames(headers map[string]string) []string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Timeout of a user's webhook posts, webhook_timeout seconds or
+// -webhook-timeout when 0
+func webhookTimeoutFor(seconds string) time.Duration {
+	if n, err := strconv.Atoi(seconds); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return *webhookTimeout
+}
+
+// Client certificate presented to webhooks, from -webhook-client-cert and
+// -webhook-client-key
+var webhookCertificates []tls.Certificate
+
+// System CAs plus those of -webhook-ca, nil for the system ones alone
+var webhookRootCAs *x509.CertPool
+
+func loadWebhookCA() error {
+	if *webhookCA == "" {
+		webhookRootCAs = nil
+		return nil
+	}
+	bundle, err := os.ReadFile(*webhookCA)
+	if err != nil {
+		return err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(bundle) {
+		return errors.New("no PEM certificate found in " + *webhookCA)
+	}
+	webhookRootCAs = pool
+	return nil
+}
+
+func loadWebhookCertificate() error {
+	if *webhookClientCert == "" && *webhookClientKey == "" {
+		return nil
+	}
+	if *webhookClientCert == "" || *webhookClientKey == "" {
+		return errors.New("both -webhook-client-cert and -webhook-client-key are needed")
+	}
+	cert, err := tls.LoadX509KeyPair(*webhookClientCert, *webhookClientKey)
+	if err != nil {
+		return err
+	}
+	webhookCertificates = []tls.Certificate{cert}
+	return nil
+}
+
+// Hides header values in resty debug output (-wadebug DEBUG), users'
+// headers carry credentials
+func redactRequestLog(rl *resty.RequestLog) error {
+	for name := range rl.Header {
+		switch strings.ToLower(name) {
+		case "content-type", "content-length", "user-agent", "accept":
+		default:
+			rl.Header.Set(name, "[redacted]")
+		}
+	}
+	return nil
+}
+
+// Per user webhook delivery. A fixed number of workers post the queued
+// events so a slow receiver never holds up the whatsmeow event goroutine.
+// User 0 is the global webhook.
+type webhookQueue struct {
+	userID     int
+	httpClient *resty.Client
+	jobs       chan webhookJob
+	done       chan struct{}
+	once       sync.Once
+	// Posts failed in a row
+	failures atomic.Int32
+}
+
+func newWebhookQueue(userID int, httpClient *resty.Client) *webhookQueue {
+	q := &webhookQueue{
+		userID:     userID,
+		httpClient: httpClient,
+		jobs:       make(chan webhookJob, *webhookQueueSize),
+		done:       make(chan struct{}),
+	}
+	for i := 0; i < *webhookWorkers; i++ {
+		webhookWorkersRunning.Add(1)
+		go q.worker()
+	}
+	return q
+}
+
+func (q *webhookQueue) worker() {
+	defer webhookWorkersRunning.Done()
+	for {
+		select {
+		case job := <-q.jobs:
+			q.deliver(job)
+		case <-q.done:
+			// Post what was already queued before going away
+			for {
+				select {
+				case job := <-q.jobs:
+					q.deliver(job)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (q *webhookQueue) deliver(job webhookJob) {
+	webhooksQueued.Add(-1)
+	timeout := job.timeout
+	if timeout <= 0 {
+		timeout = *webhookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// Own trace, the event's handling is over by now
+	ctx, sp := startRootSpan(ctx, "webhook.post", spanClient, "")
+	req := q.httpClient.R().SetContext(ctx).SetHeaders(job.headers)
+	sp.webhook(req, job.url, q.userID, job.event)
+	var err error
+	if job.path == "" {
+		err = callHook(req, job.url, job.data, q.userID, job.gzip)
+	} else {
+		err = callHookFile(req, job.url, job.data, q.userID, job.path)
+		if err != nil {
+			log.Error().Err(err).Msg("Error calling hook file")
+		}
+	}
+	if q.userID != 0 {
+		stats.webhook(q.userID, err == nil)
+		q.trackFailures(err)
+	}
+	sp.finish(err)
+}
+
+// Events waiting for a free worker
+func (q *webhookQueue) depth() int {
+	return len(q.jobs)
+}
+
+// Queues a webhook post. When all workers are busy and the queue is full it
+// waits for room, or drops the event with -webhook-overflow=drop
+func (q *webhookQueue) enqueue(job webhookJob) {
+	webhooksQueued.Add(1)
+	select {
+	case q.jobs <- job:
+		return
+	case <-q.done:
+		webhooksQueued.Add(-1)
+		return
+	default:
+	}
+	if *webhookOverflow == "queue" {
+		select {
+		case q.jobs <- job:
+			return
+		case <-q.done:
+			webhooksQueued.Add(-1)
+			return
+		}
+	}
+	webhooksQueued.Add(-1)
+	webhooksDropped.Add(1)
+	log.Warn().Str("userid", strconv.Itoa(q.userID)).Str("url", redactURL(job.url)).Msg("Webhook queue full, dropping event")
+}
+
+// Stops the workers once the queued posts are sent, safe to call more than once
+func (q *webhookQueue) stop() {
+	q.once.Do(func() { close(q.done) })
+}
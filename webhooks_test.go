@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Receivers with a certificate of an unknown CA get no posts, unless the CA
+// is given with -webhook-ca
+func TestWebhookVerifiesCertificates(t *testing.T) {
+	receiver := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+	saved := *webhookCA
+	defer func() {
+		*webhookCA = saved
+		loadWebhookCA()
+	}()
+
+	*webhookCA = ""
+	if err := loadWebhookCA(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newWebhookClient().R().Post(receiver.URL); err == nil {
+		t.Error("post to a receiver with an unknown CA succeeded")
+	}
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: receiver.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	*webhookCA = bundle
+	if err := loadWebhookCA(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newWebhookClient().R().Post(receiver.URL); err != nil {
+		t.Errorf("post with the receiver's CA trusted: %v", err)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(empty, []byte("not a certificate"), 0600)
+	*webhookCA = empty
+	if err := loadWebhookCA(); err == nil {
+		t.Error("bundle without certificates accepted")
+	}
+}
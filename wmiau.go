@@ -3,24 +3,23 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
 	"mime"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
-	"crypto/tls"
 
 	"github.com/go-resty/resty/v2"
 	_ "modernc.org/sqlite"
 	"github.com/mdp/qrterminal/v3"
 	"github.com/patrickmn/go-cache"
-	"github.com/skip2/go-qrcode"
 	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/appstate"
 	waProto "go.mau.fi/whatsmeow/binary/proto"
@@ -28,50 +27,97 @@ import (
 //	"go.mau.fi/whatsmeow/store/sqlstore"
 	"go.mau.fi/whatsmeow/types"
 	"go.mau.fi/whatsmeow/types/events"
-	waLog "go.mau.fi/whatsmeow/util/log"
 	//"google.golang.org/protobuf/proto"
 )
 
 //var wlog waLog.Logger
-var clientPointer = make(map[int]*whatsmeow.Client)
-var clientHttp = make(map[int]*resty.Client)
 var historySyncID int32
 
 type MyClient struct {
 	WAClient       *whatsmeow.Client
 	eventHandlerID uint32
 	userID         int
-	token          string
-	subscriptions  []string
 	db             *sql.DB
+	httpClient     *resty.Client
+	webhooks       *webhookQueue
+	// token and subscriptions change when an admin edits the user, the
+	// event goroutine reads them through getToken and getSubscriptions
+	userInfoLock  sync.RWMutex
+	token         string
+	subscriptions []string
+}
+
+func (mycli *MyClient) getToken() string {
+	mycli.userInfoLock.RLock()
+	defer mycli.userInfoLock.RUnlock()
+	return mycli.token
+}
+
+func (mycli *MyClient) getSubscriptions() []string {
+	mycli.userInfoLock.RLock()
+	defer mycli.userInfoLock.RUnlock()
+	return mycli.subscriptions
+}
+
+// Switches the client to a changed token and events
+func (mycli *MyClient) setUserInfo(token string, subscriptions []string) {
+	mycli.userInfoLock.Lock()
+	defer mycli.userInfoLock.Unlock()
+	mycli.token = token
+	mycli.subscriptions = subscriptions
 }
 
 // Connects to Whatsapp Websocket on server startup if last state was connected
 func (s *server) connectOnStartup() {
-	rows, err := s.db.Query("SELECT id,token,jid,webhook,events FROM users WHERE connected=1")
+	type startupUser struct {
+		userid        int
+		jid           string
+		token         string
+		subscriptions []string
+	}
+	var users []startupUser
+
+	rows, err := s.db.Query("SELECT id,token,jid,webhook,events,expiration,store_messages,payload_format,contact_names,webhook_headers,webhook_timeout,webhook_gzip FROM users WHERE connected=1")
 	if err != nil {
 		log.Error().Err(err).Msg("DB Problem")
 		return
 	}
-	defer rows.Close()
 	for rows.Next() {
 		txtid := ""
 		token := ""
 		jid := ""
 		webhook := ""
 		events := ""
-		err = rows.Scan(&txtid, &token, &jid, &webhook, &events)
+		var expiration sql.NullInt64
+		storeMessages := 0
+		payloadFormat := ""
+		contactNames := 0
+		webhookHeaders := ""
+		webhookTimeout := 0
+		webhookGzip := 0
+		err = rows.Scan(&txtid, &token, &jid, &webhook, &events, &expiration, &storeMessages, &payloadFormat, &contactNames, &webhookHeaders, &webhookTimeout, &webhookGzip)
 		if err != nil {
 			log.Error().Err(err).Msg("DB Problem")
+			rows.Close()
 			return
+		} else if expiration.Int64 > 0 && time.Now().Unix() >= expiration.Int64 {
+			log.Warn().Str("userid", txtid).Msg("User expired, not connecting on startup")
+			continue
 		} else {
-			log.Info().Str("token", token).Msg("Connect to Whatsapp on startup")
+			log.Info().Str("userid", txtid).Msg("Connect to Whatsapp on startup")
 			v := Values{map[string]string{
-				"Id":      txtid,
-				"Jid":     jid,
-				"Webhook": webhook,
-				"Token":   token,
-				"Events":  events,
+				"Id":            txtid,
+				"Jid":           jid,
+				"Webhook":       webhook,
+				"Token":         token,
+				"Events":        events,
+				"Expiration":    strconv.FormatInt(expiration.Int64, 10),
+				"StoreMessages": strconv.Itoa(storeMessages),
+				"PayloadFormat": payloadFormat,
+				"ContactNames":  strconv.Itoa(contactNames),
+				"WebhookHeaders": webhookHeaders,
+				"WebhookTimeout": strconv.Itoa(webhookTimeout),
+				"WebhookGzip":    strconv.Itoa(webhookGzip),
 			}}
 			userinfocache.Set(token, v, cache.NoExpiration)
 			userid, _ := strconv.Atoi(txtid)
@@ -94,103 +140,222 @@ func (s *server) connectOnStartup() {
 					}
 				}
 			}
-			eventstring := strings.Join(subscribedEvents, ",")
-			log.Info().Str("events", eventstring).Str("jid",jid).Msg("Attempt to connect")
-			killchannel[userid] = make(chan bool)
-			go s.startClient(userid, jid, token, subscribedEvents)
+			users = append(users, startupUser{userid, jid, token, subscribedEvents})
 		}
 	}
 	err = rows.Err()
+	rows.Close()
 	if err != nil {
 		log.Error().Err(err).Msg("DB Problem")
 	}
+
+	// Connect through a limited pool, so many sessions don't all handshake
+	// with WhatsApp at the same time
+	concurrency := *startupConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var done atomic.Int32
+	for i, u := range users {
+		if i > 0 {
+			time.Sleep(*startupDelay)
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(u startupUser) {
+			defer wg.Done()
+			log.Info().Str("events", strings.Join(u.subscriptions, ",")).Str("jid", u.jid).Msg("Attempt to connect")
+			err := s.connectAndWait(u.userid, u.jid, u.token, u.subscriptions)
+			<-slots
+			log.Info().Int("done", int(done.Add(1))).Int("total", len(users)).Msg("Startup connections progress")
+			if err != nil {
+				go s.retryStartup(u.userid, u.jid, u.token, u.subscriptions, slots)
+			}
+		}(u)
+	}
+	wg.Wait()
 }
 
-func parseJID(arg string) (types.JID, bool) {
-	if arg[0] == '+' {
-		arg = arg[1:]
+// Starts a session and waits until its first connection attempt is over
+func (s *server) connectAndWait(userID int, textjid string, token string, subscriptions []string) error {
+	sess := s.startSession(userID, textjid, token, subscriptions)
+	if sess == nil {
+		// Already running, connected by hand meanwhile
+		return nil
 	}
-	if !strings.ContainsRune(arg, '@') {
-		return types.NewJID(arg, types.DefaultUserServer), true
-	} else {
-		recipient, err := types.ParseJID(arg)
-		if err != nil {
-		    log.Error().Err(err).Msg("Invalid JID")
-			return recipient, false
-		} else if recipient.User == "" {
-		    log.Error().Err(err).Msg("Invalid JID no server specified")
-			return recipient, false
+	select {
+	case <-sess.ready:
+		return sess.err
+	case <-time.After(time.Minute):
+		return nil
+	}
+}
+
+// Keeps trying to connect a session that failed on startup, backing off up
+// to reconnectMax, until it connects or is no longer meant to be connected
+func (s *server) retryStartup(userID int, textjid string, token string, subscriptions []string, slots chan struct{}) {
+	delay := 2 * time.Second
+	for attempt := 1; ; attempt++ {
+		log.Warn().Int("userid", userID).Int("attempt", attempt).Dur("wait", delay).Msg("Startup connection failed, retrying")
+		time.Sleep(delay)
+
+		connected := 0
+		err := s.db.QueryRow("SELECT connected FROM users WHERE id=?", userID).Scan(&connected)
+		if err != nil || connected != 1 {
+			log.Info().Int("userid", userID).Msg("User no longer set to connect, giving up")
+			return
+		}
+
+		slots <- struct{}{}
+		err = s.connectAndWait(userID, textjid, token, subscriptions)
+		<-slots
+		if err == nil {
+			log.Info().Int("userid", userID).Int("attempts", attempt).Msg("Startup connection retry succeeded")
+			return
+		}
+
+		delay *= 2
+		if delay > *reconnectMax {
+			delay = *reconnectMax
 		}
-		return recipient, true
 	}
 }
 
-func (s *server) startClient(userID int, textjid string, token string, subscriptions []string) {
+func parseJID(arg string) (types.JID, bool) {
+	recipient, err := parseRecipient(arg)
+	if err != nil {
+		log.Error().Err(err).Str("jid", arg).Msg("Invalid JID")
+		return recipient, false
+	}
+	return recipient, true
+}
+
+// Starts the user's session in the background, nil if one is already
+// running or starting
+func (s *server) startSession(userID int, textjid string, token string, subscriptions []string) *session {
+	if sessions.closing() {
+		log.Info().Str("userid", strconv.Itoa(userID)).Msg("Shutting down, not starting session")
+		return nil
+	}
+	sess, ok := sessions.reserve(userID)
+	if !ok {
+		log.Warn().Str("userid", strconv.Itoa(userID)).Msg("Session already running, not starting again")
+		return nil
+	}
+	go s.startClient(sess, userID, textjid, token, subscriptions)
+	return sess
+}
+
+func (s *server) startClient(sess *session, userID int, textjid string, token string, subscriptions []string) {
 
 	log.Info().Str("userid", strconv.Itoa(userID)).Str("jid",textjid).Msg("Starting websocket connection to Whatsapp")
 
+	// Whatever way this ends (failure, kill) the user can connect again
+	defer sessions.finished()
+	defer sessions.remove(userID, sess)
+	defer sess.connected(errors.New("session stopped"))
+	defer setPendingQR(userID, "")
+
 	var deviceStore *store.Device
 	var err error
 
-	if clientPointer[userID] != nil {
-		isConnected := clientPointer[userID].IsConnected()
-		if isConnected == true {
-			return
-		}
+	userContainer, userDb, err := s.userContainer(userID)
+	if err != nil {
+		setConnectError(userID, "Could not open device store: "+err.Error())
+		log.Error().Err(err).Str("userid", strconv.Itoa(userID)).Msg("Could not open device store, not connecting")
+		return
 	}
 
 	if textjid != "" {
 		jid, _ := parseJID(textjid)
 		// If you want multiple sessions, remember their JIDs and use .GetDevice(jid) or .GetAllDevices() instead.
 		//deviceStore, err := container.GetFirstDevice()
-		deviceStore, err = container.GetDevice(jid)
+		deviceStore, err = userContainer.GetDevice(jid)
+		if err == nil && deviceStore == nil && *storePerUser && s.migrateStore(userID, textjid, userDb) {
+			deviceStore, err = userContainer.GetDevice(jid)
+		}
 		if err != nil {
-			panic(err)
+			setConnectError(userID, "Could not read device from store: "+err.Error())
+			log.Error().Err(err).Str("userid", strconv.Itoa(userID)).Msg("Could not read device from store, not connecting")
+			return
 		}
 	} else {
 		log.Warn().Msg("No jid found. Creating new device")
-		deviceStore = container.NewDevice()
+		deviceStore = userContainer.NewDevice()
 	}
 
 	if deviceStore == nil {
 		log.Warn().Msg("No store found. Creating new one")
-		deviceStore = container.NewDevice()
+		deviceStore = userContainer.NewDevice()
+	}
+
+	// A store left without paired device (logout, QR never scanned) is
+	// closed until the next connect
+	if *storePerUser {
+		defer func() {
+			if deviceStore.ID == nil {
+				stores.close(userID)
+			}
+		}()
 	}
 
 	//store.CompanionProps.PlatformType = waProto.CompanionProps_CHROME.Enum()
 	//store.CompanionProps.Os = proto.String("Mac OS")
 
-	osName := "Mac OS 10"
+	osName := *deviceName
 	store.DeviceProps.PlatformType = waProto.DeviceProps_UNKNOWN.Enum()
 	store.DeviceProps.Os = &osName
 
-	clientLog := waLog.Stdout("Client", *waDebug, *colorOutput)
-	var client *whatsmeow.Client
-	if(*waDebug!="") {
-		client = whatsmeow.NewClient(deviceStore, clientLog)
-	} else {
-		client = whatsmeow.NewClient(deviceStore, nil)
+	// whatsmeow lines are tagged with the user, at the user's own level if
+	// set (see /session/loglevel)
+	var userName, userLevel string
+	err = s.db.QueryRow("SELECT name, wa_debug FROM users WHERE id=?", userID).Scan(&userName, &userLevel)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not get log level for user")
 	}
-	clientPointer[userID] = client
-	mycli := MyClient{client, 1, userID, token, subscriptions, s.db}
-	mycli.eventHandlerID = mycli.WAClient.AddEventHandler(mycli.myEventHandler)
+	client := whatsmeow.NewClient(deviceStore, newClientLogger(userID, userName, userLevel))
+
+	// Shown in the phone's linked devices once paired
+	setDeviceName(client, s.deviceName(userID))
+
+	// Route websocket and media traffic through the user's proxy, if any
+	proxyURL := ""
+	err = s.db.QueryRow("SELECT proxy_url FROM users WHERE id=?", userID).Scan(&proxyURL)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not get proxy for user")
+	}
+	if proxyURL != "" {
+		if err := validateProxyURL(proxyURL); err != nil {
+			setConnectError(userID, "Invalid proxy: "+err.Error())
+			log.Error().Err(err).Str("userid", strconv.Itoa(userID)).Msg("Invalid proxy, not connecting")
+			return
+		}
+		if err := client.SetProxyAddress(proxyURL); err != nil {
+			setConnectError(userID, "Invalid proxy: "+err.Error())
+			log.Error().Err(err).Str("userid", strconv.Itoa(userID)).Msg("Could not set proxy, not connecting")
+			return
+		}
+		log.Info().Str("userid", strconv.Itoa(userID)).Str("proxy", redactURL(proxyURL)).Msg("Using proxy")
+	}
+	setConnectError(userID, "")
+
+	httpClient := newWebhookClient()
+
+	// Reconnection is handled by us so it can back off and be cancelled
+	client.EnableAutoReconnect = false
 
-	//clientHttp[userID] = resty.New().EnableTrace()
-	clientHttp[userID] = resty.New()
-	clientHttp[userID].SetRedirectPolicy(resty.FlexibleRedirectPolicy(15))
-	if *waDebug == "DEBUG" {
-		clientHttp[userID].SetDebug(true)
-	}
-	clientHttp[userID].SetTimeout(5 * time.Second)
-	clientHttp[userID].SetTLSClientConfig(&tls.Config{ InsecureSkipVerify: true })
-	clientHttp[userID].OnError(func(req *resty.Request, err error) {
-		if v, ok := err.(*resty.ResponseError); ok {
-			// v.Response contains the last response from the server
-			// v.Err contains the original error
-			log.Debug().Str("response",v.Response.String()).Msg("resty error")
-			log.Error().Err(v.Err).Msg("resty error")
-	  }
-	})
+	webhooks := newWebhookQueue(userID, httpClient)
+	defer webhooks.stop()
+
+	mycli := MyClient{WAClient: client, eventHandlerID: 1, userID: userID, db: s.db, httpClient: httpClient, webhooks: webhooks, token: token, subscriptions: subscriptions}
+	mycli.eventHandlerID = mycli.WAClient.AddEventHandler(mycli.myEventHandler)
+	if !sessions.attach(userID, sess, client, &mycli) {
+		log.Info().Str("userid", strconv.Itoa(userID)).Msg("Session stopped while starting")
+		client.RemoveEventHandler(mycli.eventHandlerID)
+		return
+	}
 
 	if client.Store.ID == nil {
 		// No ID stored, new login
@@ -204,8 +369,10 @@ func (s *server) startClient(userID int, textjid string, token string, subscript
 		} else {
 			err = client.Connect() // Si no conectamos no se puede generar QR
 			if err != nil {
-				panic(err)
+				s.connectFailed(userID, &mycli, proxyURL, err)
+				return
 			}
+			sess.connected(nil)
 			for evt := range qrChan {
 				if evt.Event == "code" {
 					// Display QR code in terminal (useful for testing/developing)
@@ -214,28 +381,34 @@ func (s *server) startClient(userID int, textjid string, token string, subscript
 						fmt.Println("QR code:\n", evt.Code)
 					}
 					// Store encoded/embeded base64 QR on database for retrieval with the /qr endpoint
-					image, _ := qrcode.Encode(evt.Code, qrcode.Medium, 256)
-					base64qrcode := "data:image/png;base64," + base64.StdEncoding.EncodeToString(image)
+					setPendingQR(userID, evt.Code)
+					base64qrcode := qrDataURL(evt.Code)
 					sqlStmt := `UPDATE users SET qrcode=? WHERE id=?`
-					_, err := s.db.Exec(sqlStmt, base64qrcode, userID)
+					_, err := execRetry(s.db, sqlStmt, base64qrcode, userID)
 					if err != nil {
 						log.Error().Err(err).Msg(sqlStmt)
 					}
+					postmap := map[string]interface{}{
+						"type":  "QR",
+						"event": map[string]string{"Code": evt.Code, "QRCode": base64qrcode},
+					}
+					mycli.dispatchEvent(postmap, "")
 				} else if evt.Event == "timeout" {
 					// Clear QR code from DB on timeout
+					setPendingQR(userID, "")
 					sqlStmt := `UPDATE users SET qrcode=? WHERE id=?`
-					_, err := s.db.Exec(sqlStmt, "", userID)
+					_, err := execRetry(s.db, sqlStmt, "", userID)
 					if err != nil {
 						log.Error().Err(err).Msg(sqlStmt)
 					}
 					log.Warn().Msg("QR timeout killing channel")
-					delete(clientPointer, userID)
-					killchannel[userID] <- true
+					sess.stop()
 				} else if evt.Event == "success" {
 					log.Info().Msg("QR pairing ok!")
 					// Clear QR code after pairing
+					setPendingQR(userID, "")
 					sqlStmt := `UPDATE users SET qrcode=? WHERE id=?`
-					_, err := s.db.Exec(sqlStmt, "", userID)
+					_, err := execRetry(s.db, sqlStmt, "", userID)
 					if err != nil {
 						log.Error().Err(err).Msg(sqlStmt)
 					}
@@ -250,31 +423,122 @@ func (s *server) startClient(userID int, textjid string, token string, subscript
 		log.Info().Msg("Already logged in, just connect")
 		err = client.Connect()
 		if err != nil {
-			panic(err)
+			s.connectFailed(userID, &mycli, proxyURL, err)
+			return
 		}
+		sess.connected(nil)
 	}
 
 	// Keep connected client live until disconnected/killed
-	for {
+	<-sess.kill
+	log.Info().Str("userid",strconv.Itoa(userID)).Msg("Received kill signal")
+	client.Disconnect()
+	sessions.remove(userID, sess)
+	streams.closeUser(userID)
+	// Sessions stopped by a shutdown connect again on the next start
+	if sessions.closing() {
+		return
+	}
+	sqlStmt := `UPDATE users SET connected=0 WHERE id=?`
+	_, err = execRetry(s.db, sqlStmt, userID)
+	if err != nil {
+		log.Error().Err(err).Msg(sqlStmt)
+	}
+}
+
+// Connects once more after the session was replaced, with -replaced-reconnect.
+// A single attempt per session: if the other client reconnects too they would
+// keep taking the number from each other.
+func (mycli *MyClient) recoverReplaced(sess *session) {
+	txtid := strconv.Itoa(mycli.userID)
+	select {
+	case <-sess.kill:
+		return
+	case <-time.After(*replacedReconnect):
+	}
+	if mycli.WAClient.IsConnected() {
+		return
+	}
+	if err := mycli.WAClient.Connect(); err != nil {
+		log.Error().Err(err).Str("userid", txtid).Msg("Could not reconnect replaced session, stopping it")
+		sess.stop()
+		return
+	}
+	log.Info().Str("userid", txtid).Msg("Reconnected replaced session")
+	sqlStmt := `UPDATE users SET connected=1 WHERE id=?`
+	if _, err := execRetry(mycli.db, sqlStmt, mycli.userID); err != nil {
+		log.Error().Err(err).Msg(sqlStmt)
+	}
+}
+
+// Retries the connection after it dropped, with exponential backoff and
+// jitter up to reconnectMax, until it succeeds or the session is stopped
+func (mycli *MyClient) reconnect(sess *session) {
+	if !sess.reconnecting.CompareAndSwap(false, true) {
+		return
+	}
+	defer sess.reconnecting.Store(false)
+
+	txtid := strconv.Itoa(mycli.userID)
+	delay := 2 * time.Second
+	for attempt := 1; ; attempt++ {
+		// Half fixed, half random so sessions dropped together don't retry in lockstep
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		log.Info().Str("userid", txtid).Int("attempt", attempt).Dur("wait", wait).Msg("Reconnecting")
+		mycli.dispatchEvent(map[string]interface{}{
+			"type":  "Reconnecting",
+			"event": map[string]interface{}{"Attempt": attempt, "Wait": wait.Seconds()},
+		}, "")
+
 		select {
-		case <-killchannel[userID]:
-			log.Info().Str("userid",strconv.Itoa(userID)).Msg("Received kill signal")
-			client.Disconnect()
-			delete(clientPointer, userID)
-			sqlStmt := `UPDATE users SET connected=0 WHERE id=?`
-			_, err := s.db.Exec(sqlStmt, userID)
-			if err != nil {
-				log.Error().Err(err).Msg(sqlStmt)
+		case <-sess.kill:
+			log.Info().Str("userid", txtid).Msg("Session stopped, giving up reconnection")
+			return
+		case <-time.After(wait):
+		}
+		if mycli.WAClient.IsConnected() {
+			return
+		}
+
+		err := mycli.WAClient.Connect()
+		if err == nil {
+			select {
+			case <-sess.kill:
+				// Stopped while connecting, don't leave it running
+				mycli.WAClient.Disconnect()
+				return
+			default:
 			}
+			log.Info().Str("userid", txtid).Int("attempts", attempt).Msg("Reconnected")
+			mycli.dispatchEvent(map[string]interface{}{
+				"type":  "Reconnected",
+				"event": map[string]interface{}{"Attempts": attempt},
+			}, "")
 			return
-		default:
-			time.Sleep(1000 * time.Millisecond)
-			//log.Info().Str("jid",textjid).Msg("Loop the loop")
 		}
+		log.Warn().Err(err).Str("userid", txtid).Int("attempt", attempt).Msg("Reconnection failed")
+
+		delay *= 2
+		if delay > *reconnectMax {
+			delay = *reconnectMax
+		}
+	}
+}
+
+// Cleans up after the websocket connection could not be established
+func (s *server) connectFailed(userID int, mycli *MyClient, proxyURL string, err error) {
+	msg := "Failed to connect: " + err.Error()
+	if proxyURL != "" {
+		msg = "Failed to connect through proxy " + redactURL(proxyURL) + ": " + err.Error()
 	}
+	setConnectError(userID, msg)
+	log.Error().Err(err).Str("userid", strconv.Itoa(userID)).Str("proxy", redactURL(proxyURL)).Msg("Failed to connect")
+	globalHooks.send("UserConnectFailed", userID, msg)
+	mycli.WAClient.RemoveEventHandler(mycli.eventHandlerID)
 }
 
 func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
+	defer mycli.recoverEvent(rawEvt)
 	txtid := strconv.Itoa(mycli.userID)
 	postmap := make(map[string]interface{})
 	postmap["event"] = rawEvt
@@ -298,6 +562,15 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 			}
 		}
 	case *events.Connected, *events.PushNameSetting:
+		if _, ok := evt.(*events.Connected); ok {
+			mycli.dispatchEvent(map[string]interface{}{"type": "Connected", "event": evt}, "")
+			globalHooks.send("UserConnected", mycli.userID, "")
+			go resubscribePresence(mycli.userID, mycli.WAClient)
+			go mycli.refreshDeviceInfo()
+			if _, err := execRetry(mycli.db, "UPDATE users SET last_connect=? WHERE id=?", time.Now().Unix(), mycli.userID); err != nil {
+				log.Error().Err(err).Msg("Could not record connection time")
+			}
+		}
 		if len(mycli.WAClient.Store.PushName) == 0 {
 			return
 		}
@@ -310,22 +583,25 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 			log.Info().Msg("Marked self as available")
 		}
 		sqlStmt := `UPDATE users SET connected=1 WHERE id=?`
-		_, err = mycli.db.Exec(sqlStmt, mycli.userID)
+		_, err = execRetry(mycli.db, sqlStmt, mycli.userID)
 		if err != nil {
 			log.Error().Err(err).Msg(sqlStmt)
 			return
 		}
 	case *events.PairSuccess:
-		log.Info().Str("userid",strconv.Itoa(mycli.userID)).Str("token",mycli.token).Str("ID",evt.ID.String()).Str("BusinessName",evt.BusinessName).Str("Platform",evt.Platform).Msg("QR Pair Success")
+		postmap["type"] = "PairSuccess"
+		dowebhook = 1
+		log.Info().Str("userid",strconv.Itoa(mycli.userID)).Str("ID",evt.ID.String()).Str("BusinessName",evt.BusinessName).Str("Platform",evt.Platform).Msg("QR Pair Success")
 		jid := evt.ID
-		sqlStmt := `UPDATE users SET jid=? WHERE id=?`
-		_, err := mycli.db.Exec(sqlStmt, jid, mycli.userID)
+		sqlStmt := `UPDATE users SET jid=?, paired_at=? WHERE id=?`
+		_, err := execRetry(mycli.db, sqlStmt, jid, time.Now().Unix(), mycli.userID)
 		if err != nil {
 			log.Error().Err(err).Msg(sqlStmt)
 			return
 		}
+		globalHooks.send("UserPaired", mycli.userID, "")
 
-		myuserinfo, found := userinfocache.Get(mycli.token)
+		myuserinfo, found := userinfocache.Get(mycli.getToken())
 		if !found {
 			log.Warn().Msg("No user info cached on pairing?")
 		} else {
@@ -333,14 +609,61 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 			token := myuserinfo.(Values).Get("Token")
 			v := updateUserInfo(myuserinfo, "Jid", fmt.Sprintf("%s", jid))
 			userinfocache.Set(token, v, cache.NoExpiration)
-			log.Info().Str("jid",jid.String()).Str("userid",txtid).Str("token",token).Msg("User information set")
+			log.Info().Str("jid",jid.String()).Str("userid",txtid).Msg("User information set")
+		}
+	case *events.Disconnected:
+		log.Info().Str("userid", txtid).Msg("Disconnected from WhatsApp")
+		postmap["type"] = "Disconnected"
+		dowebhook = 1
+		globalHooks.send("UserDisconnected", mycli.userID, "connection lost")
+		if sess := sessions.sessionOf(mycli); sess != nil {
+			go mycli.reconnect(sess)
 		}
 	case *events.StreamReplaced:
-		log.Info().Msg("Received StreamReplaced event")
-		return
+		// The number was connected from another client with the same device
+		// keys, whatsmeow has closed the stream and won't reconnect by itself
+		retry := *replacedReconnect > 0
+		log.Warn().Str("userid", txtid).Bool("reconnect", retry).Msg("Session replaced by a connection from elsewhere")
+		postmap["type"] = "SessionReplaced"
+		dowebhook = 1
+		globalHooks.send("UserSessionReplaced", mycli.userID, "connected from elsewhere")
+		sqlStmt := `UPDATE users SET connected=0 WHERE id=?`
+		if _, err := execRetry(mycli.db, sqlStmt, mycli.userID); err != nil {
+			log.Error().Err(err).Msg(sqlStmt)
+		}
+		if sess := sessions.sessionOf(mycli); sess != nil {
+			if retry && sess.replaced.CompareAndSwap(false, true) {
+				postmap["reconnect"] = replacedReconnect.Seconds()
+				go mycli.recoverReplaced(sess)
+			} else {
+				postmap["reconnect"] = 0
+				sess.stop()
+			}
+		}
 	case *events.Message:
+		if duplicateMessage(mycli.userID, evt) {
+			log.Info().Str("userid", txtid).Str("id", evt.Info.ID).Str("chat", evt.Info.Chat.String()).Msg("Dropping message received again")
+			return
+		}
+		// Traced on its own, with the media downloads, until dispatched
+		msgctx, sp := startRootSpan(context.Background(), "whatsapp.message", spanConsumer, "")
+		sp.setString("wuzapi.user_id", txtid)
+		sp.setString("wuzapi.message_type", messageKind(evt.Message))
+		defer sp.finish(nil)
+		if evt.Info.Chat.Server == types.NewsletterServer {
+			// Channel posts are their own event type, their media isn't
+			// downloaded: it's public and referenced by the event
+			postmap["type"] = "NewsletterMessage"
+			dowebhook = 1
+			postmap["newsletter"] = newsletterPost(evt)
+			log.Info().Str("id", evt.Info.ID).Str("newsletter", evt.Info.Chat.String()).Msg("Newsletter message received")
+			break
+		}
 		postmap["type"] = "Message"
 		dowebhook = 1
+		if !evt.Info.IsFromMe {
+			stats.received(mycli.userID)
+		}
 		metaParts := []string{fmt.Sprintf("pushname: %s", evt.Info.PushName), fmt.Sprintf("timestamp: %s", evt.Info.Timestamp)}
 		if evt.Info.Type != "" {
 			metaParts = append(metaParts, fmt.Sprintf("type: %s", evt.Info.Type))
@@ -351,11 +674,47 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		if evt.IsViewOnce {
 			metaParts = append(metaParts, "view once")
 		}
-		if evt.IsViewOnce {
+		if evt.IsEphemeral {
 			metaParts = append(metaParts, "ephemeral")
 		}
+		if evt.IsViewOnce {
+			postmap["viewOnce"] = true
+		}
 
 		log.Info().Str("id",evt.Info.ID).Str("source",evt.Info.SourceString()).Str("parts",strings.Join(metaParts,", ")).Msg("Message Received")
+		recordChatMessage(mycli.db, mycli.userID, evt.Info.Chat, evt.Info.Sender, evt.Info.ID, evt.Info.IsFromMe, evt.Message, evt.Info.Timestamp)
+		mycli.learnChatTimer(evt)
+
+		// Sender as phone number and LID, as far as they are known
+		if pn := addSender(postmap, evt.Info.Sender); pn == "" && evt.Info.IsGroup {
+			lids.lookupGroup(mycli.WAClient, mycli.userID, evt.Info.Chat)
+		}
+		mycli.addContact(postmap, evt.Info.Sender, evt.Info.PushName)
+
+		// Quick reply pressed on a buttons (or template) message
+		if reply := evt.Message.GetButtonsResponseMessage(); reply != nil {
+			postmap["buttonResponse"] = map[string]string{
+				"ButtonId": reply.GetSelectedButtonID(),
+				"Title":    reply.GetSelectedDisplayText(),
+				"StanzaId": reply.GetContextInfo().GetStanzaID(),
+			}
+		} else if reply := evt.Message.GetTemplateButtonReplyMessage(); reply != nil {
+			postmap["buttonResponse"] = map[string]string{
+				"ButtonId": reply.GetSelectedID(),
+				"Title":    reply.GetSelectedDisplayText(),
+				"StanzaId": reply.GetContextInfo().GetStanzaID(),
+			}
+		}
+
+		// Row picked from a list message
+		if reply := evt.Message.GetListResponseMessage(); reply != nil {
+			postmap["listResponse"] = map[string]string{
+				"RowId":       reply.GetSingleSelectReply().GetSelectedRowID(),
+				"Title":       reply.GetTitle(),
+				"Description": reply.GetDescription(),
+				"StanzaId":    reply.GetContextInfo().GetStanzaID(),
+			}
+		}
 
 		// try to get Image if any
 		img := evt.Message.GetImageMessage()
@@ -372,7 +731,7 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 				}
 			}
 
-			data, err := mycli.WAClient.Download(img)
+			data, err := tracedDownload(msgctx, mycli.WAClient, img)
 			if err != nil {
 				log.Error().Err(err).Msg("Failed to download image")
 				return
@@ -402,7 +761,7 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 				}
 			}
 
-			data, err := mycli.WAClient.Download(audio)
+			data, err := tracedDownload(msgctx, mycli.WAClient, audio)
 			if err != nil {
 				log.Error().Err(err).Msg("Failed to download audio")
 				return
@@ -438,7 +797,7 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 				}
 			}
 
-			data, err := mycli.WAClient.Download(document)
+			data, err := tracedDownload(msgctx, mycli.WAClient, document)
 			if err != nil {
 				log.Error().Err(err).Msg("Failed to download document")
 				return
@@ -459,11 +818,75 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 			}
 			log.Info().Str("path",path).Msg("Document saved")
 		}
+
+		// Videos are only saved when view once, the CDN copy is deleted as
+		// soon as the recipient opens them on the phone
+		video := evt.Message.GetVideoMessage()
+		if video != nil && evt.IsViewOnce {
+
+			// check/creates user directory for files
+			userDirectory := filepath.Join(exPath, "files", "user_"+txtid)
+			_, err := os.Stat(userDirectory)
+			if os.IsNotExist(err) {
+				errDir := os.MkdirAll(userDirectory, 0751)
+				if errDir != nil {
+					log.Error().Err(errDir).Msg("Could not create user directory")
+					return
+				}
+			}
+
+			data, err := tracedDownload(msgctx, mycli.WAClient, video)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to download view once video")
+				return
+			}
+			ext := ".mp4"
+			if exts, _ := mime.ExtensionsByType(video.GetMimetype()); len(exts) > 0 {
+				ext = exts[0]
+			}
+			path = filepath.Join(userDirectory, evt.Info.ID+ext)
+			err = os.WriteFile(path, data, 0600)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to save video")
+				return
+			}
+			log.Info().Str("path",path).Msg("View once video saved")
+		}
+
+		if storeMessagesEnabled(mycli.getToken()) {
+			saveMessage(mycli.db, mycli.userID, evt, path)
+		}
 	case *events.Receipt:
+		mycli.recordReceipt(evt)
+		receiptWaits.received(mycli.userID, evt)
+		if receipt := receiptPayload(evt); receipt != nil {
+			receiptmap := map[string]interface{}{"type": "Receipt", "event": evt, "receipt": receipt}
+			mycli.addContact(receiptmap, evt.Sender, "")
+			// Ties the receipt to the requests that sent the messages,
+			// request_id is only set when a single request sent them all
+			if requestIDs := mycli.sentRequestIDs(evt.MessageIDs); len(requestIDs) > 0 {
+				receipt["RequestIDs"] = requestIDs
+				single := ""
+				for _, id := range requestIDs {
+					if single != "" && id != single {
+						single = ""
+						break
+					}
+					single = id
+				}
+				if single != "" && len(requestIDs) == len(evt.MessageIDs) {
+					receiptmap["request_id"] = single
+				}
+			}
+			mycli.dispatchEvent(receiptmap, "")
+		}
+		// Kept for integrations written before Receipt
 		postmap["type"] = "ReadReceipt"
+		addSender(postmap, evt.Sender)
+		mycli.addContact(postmap, evt.Sender, "")
 		dowebhook = 1
 		if evt.Type == events.ReceiptTypeRead || evt.Type == events.ReceiptTypeReadSelf {
-			log.Info().Strs("id",evt.MessageIDs).Str("source",evt.SourceString()).Str("timestamp",fmt.Sprintf("%d",evt.Timestamp)).Msg("Message was read")
+			log.Info().Strs("id",evt.MessageIDs).Str("source",evt.SourceString()).Str("timestamp",fmt.Sprintf("%d",evt.Timestamp.Unix())).Msg("Message was read")
 			if evt.Type == events.ReceiptTypeRead {
 				postmap["state"] = "Read"
 			} else {
@@ -471,7 +894,7 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 			}
 		} else if evt.Type == events.ReceiptTypeDelivered {
 			postmap["state"] = "Delivered"
-			log.Info().Str("id",evt.MessageIDs[0]).Str("source",evt.SourceString()).Str("timestamp",fmt.Sprintf("%d",evt.Timestamp)).Msg("Message delivered")
+			log.Info().Str("id",evt.MessageIDs[0]).Str("source",evt.SourceString()).Str("timestamp",fmt.Sprintf("%d",evt.Timestamp.Unix())).Msg("Message delivered")
 		} else {
 			// Discard webhooks for inactive or other delivery types
 			return
@@ -479,12 +902,24 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 	case *events.Presence:
 		postmap["type"] = "Presence"
 		dowebhook = 1
+		// A zero LastSeen while offline means the contact hides it, not
+		// that it was never online
+		presence := map[string]interface{}{
+			"Jid":            evt.From.ToNonAD().String(),
+			"Available":      !evt.Unavailable,
+			"LastSeen":       nil,
+			"LastSeenHidden": evt.Unavailable && evt.LastSeen.IsZero(),
+		}
+		if !evt.LastSeen.IsZero() {
+			presence["LastSeen"] = evt.LastSeen.Unix()
+		}
+		postmap["presence"] = presence
 		if evt.Unavailable {
 			postmap["state"] = "offline"
 			if evt.LastSeen.IsZero() {
 				log.Info().Str("from",evt.From.String()).Msg("User is now offline")
 			} else {
-				log.Info().Str("from",evt.From.String()).Str("lastSeen",fmt.Sprintf("%d",evt.LastSeen)).Msg("User is now offline")
+				log.Info().Str("from",evt.From.String()).Str("lastSeen",fmt.Sprintf("%d",evt.LastSeen.Unix())).Msg("User is now offline")
 			}
 		} else {
 			postmap["state"] = "online"
@@ -493,6 +928,12 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 	case *events.HistorySync:
 		postmap["type"] = "HistorySync"
 		dowebhook = 1
+		mycli.addHistoryRequests(postmap, evt)
+
+		if storeMessagesEnabled(mycli.getToken()) {
+			mycli.saveHistory(evt)
+		}
+		mycli.saveHistoryChats(evt)
 
 		// check/creates user directory for files
 		userDirectory := filepath.Join(exPath, "files", "user_"+txtid)
@@ -521,74 +962,200 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		}
 		log.Info().Str("filename",fileName).Msg("Wrote history sync")
 		_ = file.Close()
+	case *events.Contact:
+		mycli.forgetContactName(evt.JID)
+		mycli.dispatchAppStateChange(evt)
+	case *events.Archive, *events.Pin, *events.Mute, *events.Star:
+		mycli.dispatchAppStateChange(evt)
+	case *events.PushName:
+		mycli.forgetContactName(evt.JID)
+	case *events.BusinessName:
+		mycli.forgetContactName(evt.JID)
+	case *events.MarkChatAsRead:
+		mycli.recordChatRead(evt)
+	case *events.DeleteChat:
+		mycli.forgetChat(evt.JID)
 	case *events.AppState:
 		log.Info().Str("index",fmt.Sprintf("%+v",evt.Index)).Str("actionValue",fmt.Sprintf("%+v",evt.SyncActionValue)).Msg("App state event received")
 	case *events.LoggedOut:
-		log.Info().Str("reason",evt.Reason.String()).Msg("Logged out")
-		killchannel[mycli.userID] <- true
-		sqlStmt := `UPDATE users SET connected=0 WHERE id=?`
-		_, err := mycli.db.Exec(sqlStmt, mycli.userID)
-		if err != nil {
-			log.Error().Err(err).Msg(sqlStmt)
-			return
-		}
+		log.Info().Str("reason",evt.Reason.String()).Str("userid", txtid).Msg("Logged out")
+		postmap["type"] = "LoggedOut"
+		postmap["reason"] = evt.Reason.String()
+		dowebhook = 1
+		globalHooks.send("UserLoggedOut", mycli.userID, evt.Reason.String())
+		sessions.disconnect(mycli.userID)
+		forgetDevice(mycli.db, mycli.userID, mycli.getToken())
 	case *events.ChatPresence:
 		postmap["type"] = "ChatPresence"
+		addSender(postmap, evt.Sender)
 		dowebhook = 1
+		presence := map[string]interface{}{
+			"Jid":   evt.Sender.ToNonAD().String(),
+			"Chat":  evt.Chat.ToNonAD().String(),
+			"State": string(evt.State),
+		}
+		if evt.Media != "" {
+			presence["Media"] = string(evt.Media)
+		}
+		postmap["presence"] = presence
 		log.Info().Str("state",fmt.Sprintf("%s",evt.State)).Str("media",fmt.Sprintf("%s",evt.Media)).Str("chat",evt.MessageSource.Chat.String()).Str("sender",evt.MessageSource.Sender.String()).Msg("Chat Presence received")
 	case *events.CallOffer:
-		log.Info().Str("event",fmt.Sprintf("%+v",evt)).Msg("Got call offer")
+		postmap["type"] = "CallOffer"
+		dowebhook = 1
+		isVideo := evt.Data != nil && evt.Data.GetChildByTag("video").Tag == "video"
+		postmap["call"] = map[string]interface{}{
+			"From":    evt.From.ToNonAD().String(),
+			"CallID":  evt.CallID,
+			"IsVideo": isVideo,
+			"IsGroup": false,
+		}
+		log.Info().Str("from",evt.From.String()).Str("callid",evt.CallID).Bool("video",isVideo).Msg("Got call offer")
+		calls.offer(mycli.userID, evt.CallID, evt.From)
+		mycli.checkAutoReject(evt.CallID)
 	case *events.CallAccept:
-		log.Info().Str("event",fmt.Sprintf("%+v",evt)).Msg("Got call accept")
+		postmap["type"] = "CallAccept"
+		dowebhook = 1
+		postmap["call"] = map[string]interface{}{
+			"From":   evt.From.ToNonAD().String(),
+			"CallID": evt.CallID,
+		}
+		log.Info().Str("from",evt.From.String()).Str("callid",evt.CallID).Msg("Got call accept")
+		calls.accept(mycli.userID, evt.CallID)
 	case *events.CallTerminate:
-		log.Info().Str("event",fmt.Sprintf("%+v",evt)).Msg("Got call terminate")
+		postmap["type"] = "CallTerminate"
+		dowebhook = 1
+		postmap["call"] = map[string]interface{}{
+			"From":   evt.From.ToNonAD().String(),
+			"CallID": evt.CallID,
+			"Reason": evt.Reason,
+		}
+		log.Info().Str("from",evt.From.String()).Str("callid",evt.CallID).Str("reason",evt.Reason).Msg("Got call terminate")
+		calls.end(mycli.userID, evt.CallID)
 	case *events.CallOfferNotice:
-		log.Info().Str("event",fmt.Sprintf("%+v",evt)).Msg("Got call offer notice")
+		// Group calls only come as a notice
+		postmap["type"] = "CallOffer"
+		dowebhook = 1
+		postmap["call"] = map[string]interface{}{
+			"From":    evt.From.ToNonAD().String(),
+			"CallID":  evt.CallID,
+			"IsVideo": evt.Media == "video",
+			"IsGroup": evt.Type == "group",
+		}
+		log.Info().Str("from",evt.From.String()).Str("callid",evt.CallID).Str("media",evt.Media).Msg("Got call offer notice")
+	case *events.GroupInfo:
+		if evt.Name != nil {
+			mycli.recordChatName(evt.JID, evt.Name.Name)
+		}
+		mycli.dispatchGroupSettings(evt)
+		mycli.dispatchJoinRequests(evt)
 	case *events.CallRelayLatency:
 		log.Info().Str("event",fmt.Sprintf("%+v",evt)).Msg("Got call relay latency")
+	case *events.ConnectFailure, *events.TemporaryBan, *events.ClientOutdated, *events.StreamError:
+		reason := fmt.Sprintf("%T: %+v", evt, evt)
+		switch evt := evt.(type) {
+		case *events.ConnectFailure:
+			reason = "connect failure: " + evt.Reason.String()
+		case *events.TemporaryBan:
+			reason = evt.String()
+		case *events.ClientOutdated:
+			reason = "client outdated"
+		case *events.StreamError:
+			reason = "stream error " + evt.Code
+		}
+		log.Error().Str("userid", txtid).Str("reason", reason).Msg("WhatsApp connection error")
+		globalHooks.send("UserError", mycli.userID, reason)
 	default:
 		log.Warn().Str("event",fmt.Sprintf("%+v",evt)).Msg("Unhandled event")
 	}
 
 	if dowebhook == 1 {
-		// call webhook
-		webhookurl := ""
-		myuserinfo, found := userinfocache.Get(mycli.token)
-		if !found {
-			log.Warn().Str("token",mycli.token).Msg("Could not call webhook as there is no user for this token")
-		} else {
-			webhookurl = myuserinfo.(Values).Get("Webhook")
+		mycli.dispatchEvent(postmap, path)
+	}
+}
+
+// Hands an event to the user's live streams and webhook
+func (mycli *MyClient) dispatchEvent(postmap map[string]interface{}, path string) {
+	replay.record(mycli.userID, postmap)
+	streams.publish(mycli.userID, postmap)
+	mycli.sendWebhook(postmap, path)
+}
+
+// Sends a GroupAnnounceChanged, GroupLockedChanged or GroupEphemeralChanged
+// event for each group setting changed, whoever changed it. sender is the
+// admin who did when WhatsApp tells.
+func (mycli *MyClient) dispatchGroupSettings(evt *events.GroupInfo) {
+	changed := func(eventType string, field string, value interface{}) {
+		postmap := map[string]interface{}{"type": eventType, "event": evt, "group": evt.JID.String(), field: value}
+		if evt.Sender != nil {
+			addSender(postmap, *evt.Sender)
+		}
+		log.Info().Str("group", evt.JID.String()).Str("type", eventType).Interface(field, value).Msg("Group settings changed")
+		mycli.dispatchEvent(postmap, "")
+	}
+	if evt.Announce != nil {
+		changed("GroupAnnounceChanged", "announce", evt.Announce.IsAnnounce)
+	}
+	if evt.Locked != nil {
+		changed("GroupLockedChanged", "locked", evt.Locked.IsLocked)
+	}
+	if evt.Ephemeral != nil {
+		timer := uint32(0)
+		if evt.Ephemeral.IsEphemeral {
+			timer = evt.Ephemeral.DisappearingTimer
 		}
+		changed("GroupEphemeralChanged", "disappearingTimer", timer)
+	}
+}
 
-		if !Find(mycli.subscriptions, postmap["type"].(string)) && !Find(mycli.subscriptions, "All") {
-			log.Warn().Str("type",postmap["type"].(string)).Msg("Skipping webhook. Not subscribed for this type")
-			return
+// Posts an event to the user's webhook if subscribed to its type, attaching
+// the file at path when given
+func (mycli *MyClient) sendWebhook(postmap map[string]interface{}, path string) {
+	// call webhook
+	webhookurl := ""
+	payloadFormat := ""
+	var webhookHeaders map[string]string
+	timeout := *webhookTimeout
+	compress := false
+	token := mycli.getToken()
+	myuserinfo, found := userinfocache.Get(token)
+	if !found {
+		log.Warn().Str("userid",strconv.Itoa(mycli.userID)).Msg("Could not call webhook as there is no user for this token")
+	} else {
+		webhookurl = myuserinfo.(Values).Get("Webhook")
+		payloadFormat = myuserinfo.(Values).Get("PayloadFormat")
+		webhookHeaders = parseWebhookHeaders(myuserinfo.(Values).Get("WebhookHeaders"))
+		timeout = webhookTimeoutFor(myuserinfo.(Values).Get("WebhookTimeout"))
+		compress = myuserinfo.(Values).Get("WebhookGzip") == "1"
+	}
+
+	if !subscribedTo(mycli.getSubscriptions(), postmap["type"].(string)) {
+		log.Warn().Str("type",postmap["type"].(string)).Msg("Skipping webhook. Not subscribed for this type")
+		return
+	}
+
+	// Streams keep the raw event, only this webhook gets the simplified one
+	if evt, ok := postmap["event"].(*events.Message); ok && payloadFormat == "simplified" {
+		simplified := make(map[string]interface{}, len(postmap))
+		for k, v := range postmap {
+			simplified[k] = v
 		}
+		simplified["event"] = simplifyMessage(evt)
+		postmap = simplified
+	}
 
-		if webhookurl != "" {
-			log.Info().Str("url",webhookurl).Msg("Calling webhook")
-			values, _ := json.Marshal(postmap)
-			data := map[string]string{
-				"jsonData":  string(values),
-				"token": mycli.token,
-			}
-			if path == "" {
-				go callHook(webhookurl, data, mycli.userID)
-			} else {
-				// Create a channel to capture error from the goroutine
-				errChan := make(chan error, 1)
-				go func() {
-					err := callHookFile(webhookurl, data, mycli.userID, path)
-					errChan <- err
-				}()
-
-				// Optionally handle the error from the channel
-				if err := <-errChan; err != nil {
-					log.Error().Err(err).Msg("Error calling hook file")
-				}
-			}
-		} else {
-			log.Warn().Str("userid",strconv.Itoa(mycli.userID)).Msg("No webhook set for user")
+	if webhookurl != "" {
+		log.Info().Str("url",redactURL(webhookurl)).Msg("Calling webhook")
+		values, err := webhookJSON(postmap, token)
+		if err != nil {
+			log.Error().Err(err).Str("type",postmap["type"].(string)).Msg("Could not marshal webhook event")
+			return
+		}
+		data := map[string]string{
+			"jsonData":  string(values),
+			"token": token,
 		}
+		mycli.webhooks.enqueue(webhookJob{url: webhookurl, data: data, path: path, headers: webhookHeaders, timeout: timeout, gzip: compress, event: postmap["type"].(string)})
+	} else {
+		log.Warn().Str("userid",strconv.Itoa(mycli.userID)).Msg("No webhook set for user")
 	}
 }